@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =============================================================================
+// USER ACCOUNTS
+// =============================================================================
+
+// usersFile lists the user accounts added with the user command. Only salted
+// hashes of the passwords are kept. The leading dot keeps it out of page listings.
+const usersFile = ".users.json"
+
+// sessionCookie is the cookie holding a logged-in browser's session ID
+const sessionCookie = "wiki_session"
+
+// sessionTTL is how long a login lasts
+const sessionTTL = 30 * 24 * time.Hour
+
+// passwordIterations is the PBKDF2 work factor of password hashes
+const passwordIterations = 600000
+
+// User is an account people log in to with a password. Its name is shared
+// with tokens: it is recorded as the author of the user's edits and is the
+// name others mention them by.
+type User struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"` // Hex PBKDF2-SHA256 of the password
+	Salt    string    `json:"salt"` // Hex salt of the hash
+	Scopes  []string  `json:"scopes"`
+	Email   string    `json:"email,omitempty"` // Address mentions of the user are mailed to
+	Created time.Time `json:"created"`
+}
+
+// hasScope reports whether the account grants a scope
+func (u *User) hasScope(scope string) bool {
+	return slices.Contains(u.Scopes, scope)
+}
+
+// checkPassword reports whether password is the account's password
+func (u *User) checkPassword(password string) bool {
+	salt, err := hex.DecodeString(u.Salt)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashPassword(password, salt)), []byte(u.Hash)) == 1
+}
+
+// setPassword gives the account a new password with a fresh salt
+func (u *User) setPassword(password string) error {
+	if len(password) < 8 {
+		return errors.New("passwords must be at least 8 characters long")
+	}
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	u.Salt, u.Hash = hex.EncodeToString(salt), hashPassword(password, salt)
+	return nil
+}
+
+// hashPassword returns the hash a password is stored as
+func hashPassword(password string, salt []byte) string {
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, sha256.Size)
+	if err != nil {
+		panic(err) // Only for key lengths PBKDF2 can't produce
+	}
+	return hex.EncodeToString(key)
+}
+
+// readUsers returns the user accounts of a data directory
+func readUsers(dataDir string) ([]User, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, usersFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", usersFile, err)
+	}
+	return users, nil
+}
+
+// writeUsers replaces the user accounts of a data directory
+func writeUsers(dataDir string, users []User) error {
+	data, err := json.MarshalIndent(users, "", "\t")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, usersFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// addUser adds an account to a data directory
+func addUser(dataDir, name, password string, scopes []string, email string) error {
+	if !validUser.MatchString(name) {
+		return fmt.Errorf("invalid name %q: use letters, digits, - and _", name)
+	}
+	if err := reservedName(name); err != nil {
+		return err
+	}
+	if email != "" && !validEmail(email) {
+		return fmt.Errorf("invalid email address %q", email)
+	}
+	users, err := readUsers(dataDir)
+	if err != nil {
+		return err
+	}
+	if slices.ContainsFunc(users, func(u User) bool { return u.Name == name }) {
+		return fmt.Errorf("a user named %q already exists", name)
+	}
+	u := User{Name: name, Scopes: scopes, Email: email, Created: time.Now().UTC()}
+	if err := u.setPassword(password); err != nil {
+		return err
+	}
+	return writeUsers(dataDir, append(users, u))
+}
+
+// changePassword replaces the password of an account
+func changePassword(dataDir, name, password string) error {
+	users, err := readUsers(dataDir)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(users, func(u User) bool { return u.Name == name })
+	if i < 0 {
+		return fmt.Errorf("no user named %q", name)
+	}
+	if err := users[i].setPassword(password); err != nil {
+		return err
+	}
+	return writeUsers(dataDir, users)
+}
+
+// removeUser deletes an account from a data directory, ending its sessions
+func removeUser(dataDir, name string) error {
+	users, err := readUsers(dataDir)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(users, func(u User) bool { return u.Name == name })
+	if i < 0 {
+		return fmt.Errorf("no user named %q", name)
+	}
+	return writeUsers(dataDir, slices.Delete(users, i, i+1))
+}
+
+// userRegistry holds the user accounts, rereading the users file when the
+// user command changes it, and the sessions of logged-in browsers. Sessions
+// are kept in memory, so restarting the server logs everyone out.
+type userRegistry struct {
+	mu       sync.Mutex
+	modTime  time.Time
+	users    []User
+	sessions map[string]session // By session ID
+}
+
+// session is a login of a browser
+type session struct {
+	user    string
+	expires time.Time
+}
+
+// newUserRegistry returns a registry that loads accounts on first use
+func newUserRegistry() *userRegistry {
+	return &userRegistry{sessions: make(map[string]session)}
+}
+
+// named returns the account with a name, reporting false when there is none
+func (ur *userRegistry) named(dataDir, name string) (User, bool) {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	ur.refresh(dataDir)
+	for _, u := range ur.users {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+// any reports whether user accounts have been added
+func (ur *userRegistry) any(dataDir string) bool {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	ur.refresh(dataDir)
+	return len(ur.users) > 0
+}
+
+// count returns the number of accounts
+func (ur *userRegistry) count(dataDir string) int {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	ur.refresh(dataDir)
+	return len(ur.users)
+}
+
+// refresh rereads the users file if it changed. Callers hold mu.
+func (ur *userRegistry) refresh(dataDir string) {
+	info, err := os.Stat(filepath.Join(dataDir, usersFile))
+	if err != nil {
+		ur.users, ur.modTime = nil, time.Time{}
+		return
+	}
+	if info.ModTime().Equal(ur.modTime) {
+		return
+	}
+	users, err := readUsers(dataDir)
+	if err != nil {
+		return // Keep the accounts read before rather than locking everyone out
+	}
+	ur.users, ur.modTime = users, info.ModTime()
+}
+
+// login starts a session for a user and returns its ID, forgetting the
+// sessions that have expired
+func (ur *userRegistry) login(name string, now time.Time) string {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	for id, sess := range ur.sessions {
+		if now.After(sess.expires) {
+			delete(ur.sessions, id)
+		}
+	}
+	id := make([]byte, 32)
+	rand.Read(id)
+	sid := hex.EncodeToString(id)
+	ur.sessions[sid] = session{user: name, expires: now.Add(sessionTTL)}
+	return sid
+}
+
+// logout ends a session
+func (ur *userRegistry) logout(id string) {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	delete(ur.sessions, id)
+}
+
+// sessionUser returns the name of the user logged in with a session,
+// reporting false when the session doesn't exist or has expired
+func (ur *userRegistry) sessionUser(id string, now time.Time) (string, bool) {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	sess, ok := ur.sessions[id]
+	if !ok || now.After(sess.expires) {
+		return "", false
+	}
+	return sess.user, true
+}
+
+// sessionUser returns the account a request is logged in to through its
+// session cookie, reporting false when it isn't logged in. Sessions of
+// removed accounts no longer count.
+func (s *Server) sessionUser(r *http.Request) (User, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return User{}, false
+	}
+	name, ok := s.users.sessionUser(c.Value, time.Now())
+	if !ok {
+		return User{}, false
+	}
+	return s.users.named(s.cfg().DataDir, name)
+}
+
+// editAllowed checks that a request may change pages, answering and
+// reporting false when it may not. Anyone may until user accounts are
+// added; after that editors must log in, or send a token, and hold the write
+// scope, or have their edits reviewed.
+func (s *Server) editAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if !s.users.any(s.cfg().DataDir) {
+		return true
+	}
+	if s.tokenName(r) == "" {
+		s.loginChallenge(w, r)
+		return false
+	}
+	if !s.hasScope(r, scopeWrite) && !s.cfg().ReviewEdits {
+		http.Error(w, "Your account may not edit pages", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requireEditor wraps the pages that change pages for those editAllowed allows
+func (s *Server) requireEditor(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.editAllowed(w, r) {
+			fn(w, r)
+		}
+	}
+}
+
+// loginChallenge answers a request that needs credentials: browsers getting
+// a page are sent to the login form once user accounts exist, and anything
+// else is asked for a token as the password of HTTP basic auth
+func (s *Server) loginChallenge(w http.ResponseWriter, r *http.Request) {
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.Header.Get("Authorization") == "" && s.users.any(s.cfg().DataDir) {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="wiki"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// setReader fills in who is reading a page, for its login and edit links
+func (s *Server) setReader(r *http.Request, p *Page) {
+	u, _ := s.sessionUser(r)
+	cfg := s.cfg()
+	p.User, p.Login, p.ReadOnly = u.Name, s.users.any(cfg.DataDir), cfg.ReadOnly
+}
+
+// LoginPage contains data for rendering the login form
+type LoginPage struct {
+	Name  string
+	Next  string // Local URL to return to after logging in
+	Error string
+
+	csrfForm
+	themedPage
+}
+
+// loginHandler shows the login form and logs users in when it is posted,
+// sending them back to the page that asked them to log in
+func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
+	data := &LoginPage{Next: localURL(r.FormValue("next"))}
+	if r.Method != http.MethodPost {
+		s.renderTemplate(w, r, "login", data)
+		return
+	}
+
+	data.Name = strings.TrimSpace(r.PostFormValue("name"))
+	password := r.PostFormValue("password")
+	u, ok := s.users.named(s.cfg().DataDir, data.Name)
+	if !ok {
+		// Take as long as checking a password, so names can't be probed
+		(&User{Salt: "00"}).checkPassword(password)
+	}
+	if !ok || !u.checkPassword(password) {
+		slog.Warn("Failed login", "user", data.Name, "remote", r.RemoteAddr)
+		data.Error = "Unknown user name or wrong password."
+		w.WriteHeader(http.StatusUnauthorized)
+		s.renderTemplate(w, r, "login", data)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.users.login(u.Name, time.Now()),
+		Path:     "/",
+		MaxAge:   int(sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(s.cfg().PublicURL, "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, data.Next, http.StatusSeeOther)
+}
+
+// logoutHandler ends the reader's session
+func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		s.users.logout(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// localURL returns next when it is a path on this wiki, and the front page
+// otherwise, so logging in can't send users to another site
+func localURL(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, `/\`) {
+		return "/"
+	}
+	return next
+}
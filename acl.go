@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =============================================================================
+// PAGE PERMISSIONS
+// =============================================================================
+
+// permissionsFile lists the permission rules set on the permissions admin
+// page. The leading dot keeps it out of page listings.
+const permissionsFile = ".permissions.json"
+
+// anyUser in a permission list stands for every logged-in user and token holder
+const anyUser = "*"
+
+// accessLevel is what a request does with a page. Each level a rule grants
+// includes those below it.
+type accessLevel int
+
+const (
+	accessRead  accessLevel = iota + 1 // Viewing the page, its history and attachments
+	accessEdit                         // Changing the page and uploading to it
+	accessAdmin                        // Renaming and deleting the page
+)
+
+// String returns the verb the level is shown as
+func (l accessLevel) String() string {
+	switch l {
+	case accessRead:
+		return "read"
+	case accessEdit:
+		return "edit"
+	}
+	return "administer"
+}
+
+// Permission restricts access to a page, or to every page of a namespace.
+// Each list names the users and tokens allowed a level of access; an empty
+// list leaves that level to the wiki's usual rules. Admins of the wiki are
+// never restricted.
+type Permission struct {
+	Target string   `json:"target"`          // Page title, or namespace ending in "/"
+	Read   []string `json:"read,omitempty"`  // Who may read, besides those who may edit
+	Edit   []string `json:"edit,omitempty"`  // Who may edit, besides those who may administer
+	Admin  []string `json:"admin,omitempty"` // Who may rename and delete
+}
+
+// allows reports whether the user or token holder name, "" for anonymous
+// readers, has a level of access under the rule
+func (p *Permission) allows(level accessLevel, name string) bool {
+	lists := [][]string{p.Read, p.Edit, p.Admin}[level-1:]
+	if len(lists[0]) == 0 {
+		return true
+	}
+	if name == "" {
+		return false
+	}
+	for _, list := range lists {
+		if slices.Contains(list, name) || slices.Contains(list, anyUser) {
+			return true
+		}
+	}
+	return false
+}
+
+// Namespace reports whether the rule covers a namespace rather than a single page
+func (p *Permission) Namespace() bool {
+	return strings.HasSuffix(p.Target, "/")
+}
+
+// covers reports whether the rule applies to a page
+func (p *Permission) covers(title string) bool {
+	if p.Namespace() {
+		return strings.HasPrefix(title, p.Target)
+	}
+	return p.Target == title
+}
+
+// parsePermissionList reads a comma-separated list of user names
+func parsePermissionList(list string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || slices.Contains(names, name) {
+			continue
+		}
+		if name != anyUser && !validUser.MatchString(name) {
+			return nil, fmt.Errorf("invalid user name %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// readPermissions returns the permission rules of a data directory
+func readPermissions(dataDir string) ([]Permission, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, permissionsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rules []Permission
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", permissionsFile, err)
+	}
+	return rules, nil
+}
+
+// permissionRegistry holds the permission rules, rereading the permissions
+// file when it changes on disk
+type permissionRegistry struct {
+	mu      sync.Mutex
+	modTime time.Time
+	rules   []Permission
+}
+
+// newPermissionRegistry returns a registry that loads rules on first use
+func newPermissionRegistry() *permissionRegistry {
+	return &permissionRegistry{}
+}
+
+// list returns a copy of the rules, sorted by target
+func (pr *permissionRegistry) list(dataDir string) []Permission {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.refresh(dataDir)
+	rules := slices.Clone(pr.rules)
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Target < rules[j].Target })
+	return rules
+}
+
+// rule returns the rule governing a page: the page's own, or else that of
+// the innermost namespace holding it. It reports false when none applies.
+func (pr *permissionRegistry) rule(dataDir, title string) (Permission, bool) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.refresh(dataDir)
+	var best Permission
+	found := false
+	for _, p := range pr.rules {
+		if p.Target == title {
+			return p, true
+		}
+		if p.covers(title) && len(p.Target) > len(best.Target) {
+			best, found = p, true
+		}
+	}
+	return best, found
+}
+
+// set replaces the rule for a target, or removes it when it restricts nothing
+func (pr *permissionRegistry) set(dataDir string, p Permission) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.refresh(dataDir)
+	rules := slices.DeleteFunc(slices.Clone(pr.rules), func(old Permission) bool { return old.Target == p.Target })
+	if len(p.Read)+len(p.Edit)+len(p.Admin) > 0 {
+		rules = append(rules, p)
+	}
+	data, err := json.MarshalIndent(rules, "", "\t")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, permissionsFile)
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return err
+	}
+	pr.rules = rules
+	if info, err := os.Stat(path); err == nil {
+		pr.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// refresh rereads the permissions file if it changed. Callers hold mu.
+func (pr *permissionRegistry) refresh(dataDir string) {
+	info, err := os.Stat(filepath.Join(dataDir, permissionsFile))
+	if err != nil {
+		pr.rules, pr.modTime = nil, time.Time{}
+		return
+	}
+	if info.ModTime().Equal(pr.modTime) {
+		return
+	}
+	rules, err := readPermissions(dataDir)
+	if err != nil {
+		slog.Error("Reading page permissions failed", "err", err)
+		return // Keep the rules read before rather than opening protected pages
+	}
+	pr.rules, pr.modTime = rules, info.ModTime()
+}
+
+// pageActionLevels is the access each action of the page routes needs
+var pageActionLevels = map[string]accessLevel{
+	"view":      accessRead,
+	"diff":      accessRead,
+	"history":   accessRead,
+	"backlinks": accessRead,
+	"book":      accessRead,
+	"pdf":       accessRead,
+	"raw":       accessRead,
+	"edit":      accessEdit,
+	"save":      accessEdit,
+	"preview":   accessEdit,
+	"draft":     accessEdit,
+	"upload":    accessEdit,
+	"comment":   accessEdit,
+	"rename":    accessAdmin,
+	"delete":    accessAdmin,
+}
+
+// permissionTarget returns the page a request acts on and the access it
+// needs, reporting false for requests not about a single page
+func permissionTarget(r *http.Request) (string, accessLevel, bool) {
+	level := accessRead
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		level = accessEdit // Such as restoring a revision from the history page
+	}
+	if m := validPath.FindStringSubmatch(r.URL.Path); m != nil {
+		return m[2], max(level, pageActionLevels[m[1]]), true
+	}
+	if m := validFeedPath.FindStringSubmatch(r.URL.Path); m != nil {
+		return m[1], accessRead, true
+	}
+	if path, ok := strings.CutPrefix(r.URL.Path, "/attachments/"); ok {
+		if i := strings.LastIndexByte(path, '/'); i > 0 {
+			return path[:i], level, true
+		}
+		return "", 0, false
+	}
+
+	// API paths are matched escaped, as the mux does, since titles with
+	// namespaces have their slashes escaped there
+	segments := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	if segments[0] != "api" {
+		return "", 0, false
+	}
+	segments = segments[1:]
+	if len(segments) > 0 && segments[0] == "v1" {
+		segments = segments[1:]
+	}
+	if len(segments) < 2 || segments[0] != "pages" {
+		return "", 0, false
+	}
+	title, err := url.PathUnescape(segments[1])
+	if err != nil || !validTitle.MatchString(title) {
+		return "", 0, false
+	}
+	if r.Method == http.MethodDelete && len(segments) == 2 {
+		level = pageActionLevels["delete"] // As deleting it from the page's form
+	}
+	return title, level, true
+}
+
+// permitted reports whether a request has a level of access to a page
+func (s *Server) permitted(r *http.Request, title string, level accessLevel) bool {
+	p, ok := s.permissions.rule(s.cfg().DataDir, title)
+	return !ok || p.allows(level, s.tokenName(r)) || s.hasScope(r, scopeAdmin)
+}
+
+// canRead reports whether a request may read a page, for leaving the pages
+// it may not out of searches and listings of page content
+func (s *Server) canRead(r *http.Request, title string) bool {
+	return s.permitted(r, title, accessRead)
+}
+
+// readChecker returns canRead for a request, working out who the reader is
+// once for the many pages a listing or rendering checks
+func (s *Server) readChecker(r *http.Request) func(title string) bool {
+	name, admin := s.tokenName(r), s.hasScope(r, scopeAdmin)
+	return func(title string) bool {
+		p, ok := s.permissions.rule(s.cfg().DataDir, title)
+		return !ok || p.allows(accessRead, name) || admin
+	}
+}
+
+// errUnreadable is returned by a readableStore for the pages its reader may not read
+var errUnreadable = errors.New("permission denied")
+
+// readableStore is the page store as one reader sees it, failing to load the
+// pages they may not read, for expanding transclusions and compiling books
+// on their behalf
+type readableStore struct {
+	PageStore
+	canRead func(title string) bool
+}
+
+// readableBy returns the page store as a request may read it
+func (s *Server) readableBy(r *http.Request) PageStore {
+	return readableStore{PageStore: s.store, canRead: s.readChecker(r)}
+}
+
+// Load returns the current version of a page the reader may read
+func (rs readableStore) Load(ctx context.Context, title string) (*Page, error) {
+	if !rs.canRead(title) {
+		return nil, fmt.Errorf("%s: %w", title, errUnreadable)
+	}
+	return rs.PageStore.Load(ctx, title)
+}
+
+// Revisions returns the revisions of a page the reader may read
+func (rs readableStore) Revisions(ctx context.Context, title string) ([]Revision, error) {
+	if !rs.canRead(title) {
+		return nil, fmt.Errorf("%s: %w", title, errUnreadable)
+	}
+	return rs.PageStore.Revisions(ctx, title)
+}
+
+// Revision returns a revision of a page the reader may read
+func (rs readableStore) Revision(ctx context.Context, title string, n int) ([]byte, error) {
+	if !rs.canRead(title) {
+		return nil, fmt.Errorf("%s: %w", title, errUnreadable)
+	}
+	return rs.PageStore.Revision(ctx, title, n)
+}
+
+// checkPermissions answers requests for pages their permission rules don't
+// allow the requester, reporting false when it did. Anonymous readers are
+// asked to log in. Titles still appear in the index and change listings,
+// while pages included in others show there only to those who may read them.
+func (s *Server) checkPermissions(w http.ResponseWriter, r *http.Request) bool {
+	title, level, ok := permissionTarget(r)
+	if !ok || s.permitted(r, title, level) {
+		return true
+	}
+	api := strings.HasPrefix(r.URL.Path, "/api/")
+	switch {
+	case s.tokenName(r) == "" && api:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="wiki api"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "log in or send a token to " + level.String() + " " + title})
+	case s.tokenName(r) == "":
+		s.loginChallenge(w, r)
+	case api:
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "you may not " + level.String() + " " + title})
+	default:
+		http.Error(w, "You may not "+level.String()+" "+title, http.StatusForbidden)
+	}
+	return false
+}
+
+// PermissionsPage contains data for the permissions admin page
+type PermissionsPage struct {
+	Rules []Permission
+	Error string
+
+	csrfForm
+	themedPage
+}
+
+// permissionsHandler lists the permission rules and changes them when a
+// rule's form is posted: saving its lists, or removing it
+func (s *Server) permissionsHandler(w http.ResponseWriter, r *http.Request) {
+	data := &PermissionsPage{}
+	if r.Method == http.MethodPost {
+		p := Permission{Target: strings.TrimSpace(r.PostFormValue("target"))}
+		if !validTitle.MatchString(strings.TrimSuffix(p.Target, "/")) {
+			data.Error = fmt.Sprintf("%q is not a page title, or a namespace ending in /.", p.Target)
+		} else if r.PostFormValue("action") != "remove" {
+			var errs [3]error
+			p.Read, errs[0] = parsePermissionList(r.PostFormValue("read"))
+			p.Edit, errs[1] = parsePermissionList(r.PostFormValue("edit"))
+			p.Admin, errs[2] = parsePermissionList(r.PostFormValue("admin"))
+			if err := errors.Join(errs[:]...); err != nil {
+				data.Error = err.Error()
+			}
+		}
+		if data.Error == "" {
+			if err := s.permissions.set(s.cfg().DataDir, p); err != nil {
+				serverError(w, r, err)
+				return
+			}
+			slog.Info("Permissions set", "target", p.Target, "by", s.tokenName(r), "read", p.Read, "edit", p.Edit, "admin", p.Admin)
+			http.Redirect(w, r, "/admin/permissions", http.StatusSeeOther)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	data.Rules = s.permissions.list(s.cfg().DataDir)
+	s.renderTemplate(w, r, "permissions", data)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPermissionTarget(t *testing.T) {
+	for _, tc := range []struct {
+		method, path string
+		title        string
+		level        accessLevel
+		ok           bool
+	}{
+		{http.MethodGet, "/view/Guide", "Guide", accessRead, true},
+		{http.MethodHead, "/raw/Guide", "Guide", accessRead, true},
+		{http.MethodGet, "/history/Team/Plan", "Team/Plan", accessRead, true},
+		{http.MethodPost, "/history/Guide", "Guide", accessEdit, true},
+		{http.MethodGet, "/edit/Guide", "Guide", accessEdit, true},
+		{http.MethodPost, "/save/Guide", "Guide", accessEdit, true},
+		{http.MethodPost, "/comment/Guide", "Guide", accessEdit, true},
+		{http.MethodGet, "/rename/Guide", "Guide", accessAdmin, true},
+		{http.MethodPost, "/delete/Guide", "Guide", accessAdmin, true},
+		{http.MethodGet, "/feed/Guide.atom", "Guide", accessRead, true},
+		{http.MethodGet, "/attachments/Guide/logo.png", "Guide", accessRead, true},
+		{http.MethodPost, "/attachments/Guide/logo.png", "Guide", accessEdit, true},
+		{http.MethodGet, "/api/v1/pages/Team%2FPlan", "Team/Plan", accessRead, true},
+		{http.MethodGet, "/api/pages/Guide/exists", "Guide", accessRead, true},
+		{http.MethodPut, "/api/v1/pages/Guide", "Guide", accessEdit, true},
+		{http.MethodPatch, "/api/pages/Guide", "Guide", accessEdit, true},
+		{http.MethodPost, "/api/v1/pages/Guide/tasks/0", "Guide", accessEdit, true},
+		{http.MethodDelete, "/api/v1/pages/Guide", "Guide", accessAdmin, true},
+		{http.MethodDelete, "/api/pages/Guide", "Guide", accessAdmin, true},
+		{http.MethodGet, "/api/v1/pages", "", 0, false},
+		{http.MethodGet, "/api/v1/search", "", 0, false},
+		{http.MethodGet, "/index", "", 0, false},
+		{http.MethodGet, "/view/bad..title", "", 0, false},
+	} {
+		title, level, ok := permissionTarget(httptest.NewRequest(tc.method, tc.path, nil))
+		if title != tc.title || level != tc.level || ok != tc.ok {
+			t.Errorf("%s %s: got %q, %v, %v, want %q, %v, %v", tc.method, tc.path, title, level, ok, tc.title, tc.level, tc.ok)
+		}
+	}
+}
+
+// TestPermissionInheritance checks that pages follow their own rule, else
+// the rule of the innermost namespace holding them
+func TestPermissionInheritance(t *testing.T) {
+	s := newTestServer(t, nil)
+	dir := s.cfg().DataDir
+	for _, p := range []Permission{
+		{Target: "Team/", Read: []string{"alice"}},
+		{Target: "Team/Private/", Read: []string{"bob"}},
+		{Target: "Team/Lobby", Read: []string{anyUser}},
+	} {
+		if err := s.permissions.set(dir, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		title  string
+		target string // "" for none
+	}{
+		{"Guide", ""},
+		{"Team", ""},
+		{"Team/Plan", "Team/"},
+		{"Team/Private/Salaries", "Team/Private/"},
+		{"Team/Lobby", "Team/Lobby"},
+		{"Team/Lobby/Chairs", "Team/"},
+		{"Teams/Plan", ""},
+	} {
+		p, ok := s.permissions.rule(dir, tc.title)
+		if ok != (tc.target != "") || p.Target != tc.target {
+			t.Errorf("rule(%q) = %q, %v, want %q", tc.title, p.Target, ok, tc.target)
+		}
+	}
+}
+
+// TestDeniedTransclusion checks that a page transcluding one its reader may
+// not read leaves it out for them, however the rendering was cached
+func TestDeniedTransclusion(t *testing.T) {
+	s, reqs := newCredentialServer(t, nil)
+	savePages(t, s, map[string]string{
+		"Home":        "Welcome.\n\n{{include:Team/Secret}}\n",
+		"Team/Secret": "The launch is on Friday.\n",
+	})
+	if err := s.permissions.set(s.cfg().DataDir, Permission{Target: "Team/", Read: []string{"alice"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, reader := range []string{"anonymous", "user session", "anonymous", "writer", "admin token", "writer"} {
+		r := httptest.NewRequest(http.MethodGet, "/view/Home", nil)
+		r.Header = reqs[reader].Header.Clone()
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		shown := strings.Contains(w.Body.String(), "The launch is on Friday.")
+		if want := reader == "user session" || reader == "admin token"; shown != want {
+			t.Errorf("%s: included page shown = %v, want %v", reader, shown, want)
+		}
+		if !shown && !strings.Contains(w.Body.String(), "You may not read the included page Team/Secret") {
+			t.Errorf("%s: the left out page isn't noted", reader)
+		}
+	}
+}
+
+// TestDeleteNeedsAdminAccess deletes a page through the API and through the
+// page's form, which the page's permission rule must treat alike
+func TestDeleteNeedsAdminAccess(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		rule    Permission
+		allowed bool
+	}{
+		{"editor", Permission{Target: "Policy", Edit: []string{"writer"}, Admin: []string{"bob"}}, false},
+		{"administrator", Permission{Target: "Policy", Admin: []string{"writer"}}, true},
+	} {
+		for _, route := range []struct{ method, path string }{
+			{http.MethodDelete, "/api/v1/pages/Policy"},
+			{http.MethodDelete, "/api/pages/Policy"},
+			{http.MethodPost, "/delete/Policy"},
+		} {
+			s, reqs := newCredentialServer(t, nil)
+			savePages(t, s, map[string]string{"Policy": "Be kind.\n"})
+			if err := s.permissions.set(s.cfg().DataDir, tc.rule); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(route.method, route.path, strings.NewReader(""))
+			r.Header.Set("Authorization", reqs["writer"].Header.Get("Authorization"))
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if denied := w.Code == http.StatusForbidden; denied == tc.allowed {
+				t.Errorf("%s: %s %s: status %d", tc.name, route.method, route.path, w.Code)
+			}
+			if exists := s.store.Exists(r.Context(), "Policy"); exists == tc.allowed {
+				t.Errorf("%s: %s %s: page exists = %v", tc.name, route.method, route.path, exists)
+			}
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// ADMIN AUTHENTICATION
+// =============================================================================
+
+// requestToken extracts the token a client authenticated with, accepting both
+// "Authorization: Bearer <token>" for scripts and the password of HTTP basic
+// auth so browsers can reach admin pages through their login prompt
+func requestToken(r *http.Request) string {
+	if token := bearerToken(r); token != "" {
+		return token
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	return ""
+}
+
+// bearerToken returns the token sent as "Authorization: Bearer <token>",
+// which unlike basic auth credentials browsers never send by themselves
+func bearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return ""
+}
+
+// requireAdmin wraps a handler so it only runs for requests carrying the
+// admin token or an API token with the admin scope, or logged in to an
+// account with it
+func (s *Server) requireAdmin(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg()
+		if cfg.AdminToken == "" && !s.tokens.any(cfg.DataDir) && !s.users.any(cfg.DataDir) {
+			http.Error(w, "admin endpoints are disabled; start the server with -admin-token, or add a token or user with the admin scope", http.StatusForbidden)
+			return
+		}
+		s.requireLogin(scopeAdmin, fn)(w, r)
+	}
+}
+
+// =============================================================================
+// STATISTICS
+// =============================================================================
+
+// statsDays is the number of days covered by the edits-per-day series
+const statsDays = 30
+
+// WikiStats is a snapshot of wiki size and activity for monitoring
+type WikiStats struct {
+	Pages        int            `json:"pages"`
+	Revisions    int            `json:"revisions"`
+	Users        int            `json:"users"`  // Accounts people log in to
+	Tokens       int            `json:"tokens"` // API tokens issued, besides the admin and API tokens of the configuration
+	StorageBytes int64          `json:"storage_bytes"`
+	EditsPerDay  map[string]int `json:"edits_per_day"`  // Keyed by UTC date (YYYY-MM-DD)
+	CacheHitRate float64        `json:"cache_hit_rate"` // Fraction of page renders served from the render cache
+}
+
+// CacheHitPercent returns the render cache hit rate as a percentage for display
+func (s *WikiStats) CacheHitPercent() float64 {
+	return s.CacheHitRate * 100
+}
+
+// collectStats gathers page, revision, account, storage and activity statistics
+func (s *Server) collectStats(ctx context.Context) (*WikiStats, error) {
+	pages, err := s.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dataDir := s.cfg().DataDir
+	stats := &WikiStats{
+		Pages:        len(pages),
+		Users:        s.users.count(dataDir),
+		Tokens:       s.tokens.count(dataDir),
+		EditsPerDay:  make(map[string]int),
+		CacheHitRate: s.renders.hitRate(),
+	}
+
+	for _, title := range pages {
+		revs, err := s.store.Revisions(ctx, title)
+		if err != nil {
+			return nil, err
+		}
+		stats.Revisions += len(revs)
+	}
+
+	stats.StorageBytes, err = dirSize(ctx, dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Report every day of the window, including quiet ones, so graphs have no gaps
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for i := 0; i < statsDays; i++ {
+		stats.EditsPerDay[today.AddDate(0, 0, -i).Format(time.DateOnly)] = 0
+	}
+	events, err := s.audit.events()
+	if err != nil {
+		return nil, err
+	}
+	for _, ev := range events {
+		if ev.Type != eventEdit && ev.Type != eventCreate {
+			continue
+		}
+		day := ev.Time.UTC().Format(time.DateOnly)
+		if _, ok := stats.EditsPerDay[day]; ok {
+			stats.EditsPerDay[day]++
+		}
+	}
+	return stats, nil
+}
+
+// dirSize returns the total size of the regular files below dir
+func dirSize(ctx context.Context, dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// statsHandler serves wiki statistics as JSON for external monitoring
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.collectStats(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// =============================================================================
+// DISK USAGE
+// =============================================================================
+
+// Directories below the data directory holding wiki data other than the pages themselves
+const (
+	attachmentsDir = ".attachments" // Files uploaded to pages
+	trashDir       = ".trash"       // Deleted pages awaiting purge
+	indexDir       = ".index"       // Search and link indexes that can be rebuilt
+	pendingDir     = ".pending"     // Edits awaiting review
+	draftsDir      = ".drafts"      // Unsaved text autosaved from edit forms
+	commentsDir    = ".comments"    // Discussions below pages
+)
+
+// diskCheckInterval is how often the background job compares usage against the alert threshold
+const diskCheckInterval = 10 * time.Minute
+
+// DiskUsage breaks down the bytes used by each component of the data directory
+type DiskUsage struct {
+	Pages       int64 `json:"pages"`
+	Revisions   int64 `json:"revisions"`
+	Attachments int64 `json:"attachments"`
+	Trash       int64 `json:"trash"`
+	Index       int64 `json:"index"`
+	Other       int64 `json:"other"` // Audit log and other bookkeeping files
+	Total       int64 `json:"total"`
+}
+
+// measureDiskUsage walks the data directory once, attributing every file to the component owning it
+func (s *Server) measureDiskUsage(ctx context.Context) (*DiskUsage, error) {
+	usage := &DiskUsage{}
+	components := map[string]*int64{
+		historyDir:     &usage.Revisions,
+		attachmentsDir: &usage.Attachments,
+		trashDir:       &usage.Trash,
+		indexDir:       &usage.Index,
+	}
+
+	err := filepath.WalkDir(s.cfg().DataDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(s.cfg().DataDir, path)
+		top, _, nested := strings.Cut(filepath.ToSlash(rel), "/")
+		switch counter, ok := components[top]; {
+		case ok && nested:
+			*counter += info.Size()
+		case strings.HasPrefix(top, ".") || !strings.HasSuffix(rel, ".txt"):
+			usage.Other += info.Size()
+		default:
+			usage.Pages += info.Size()
+		}
+		usage.Total += info.Size()
+		return nil
+	})
+	return usage, err
+}
+
+// diskAlert is the JSON payload posted to the disk alert webhook. The text
+// field lets Slack-compatible webhooks display it without further mapping.
+type diskAlert struct {
+	Text      string     `json:"text"`
+	Threshold int64      `json:"threshold_bytes"`
+	Usage     *DiskUsage `json:"usage"`
+}
+
+// monitorDiskUsage periodically checks data directory usage and posts an alert
+// to the configured webhook when it first exceeds the threshold. Another alert
+// is sent only after usage has dropped back below the threshold.
+func (s *Server) monitorDiskUsage(ctx context.Context) {
+	alerted := false
+	for {
+		if threshold := s.cfg().DiskAlertBytes; threshold <= 0 {
+			alerted = false
+		} else if usage, err := s.measureDiskUsage(ctx); err != nil {
+			slog.Error("Measuring disk usage failed", "err", err)
+		} else if usage.Total < threshold {
+			alerted = false
+		} else if !alerted {
+			alerted = true
+			slog.Warn("Disk usage exceeds alert threshold", "bytes", usage.Total, "threshold", threshold)
+			if s.cfg().DiskAlertWebhook != "" {
+				s.sendDiskAlert(ctx, usage)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(diskCheckInterval):
+		}
+	}
+}
+
+// sendDiskAlert posts the disk usage alert to the configured webhook
+func (s *Server) sendDiskAlert(ctx context.Context, usage *DiskUsage) {
+	cfg := s.cfg()
+	payload, err := json.Marshal(diskAlert{
+		Text:      fmt.Sprintf("Wiki data directory uses %d bytes, above the alert threshold of %d bytes", usage.Total, cfg.DiskAlertBytes),
+		Threshold: cfg.DiskAlertBytes,
+		Usage:     usage,
+	})
+	if err != nil {
+		slog.Error("Encoding disk alert failed", "err", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.DiskAlertWebhook, bytes.NewReader(payload))
+	if err != nil {
+		slog.Error("Creating disk alert request failed", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Error("Sending disk alert failed", "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("Disk alert webhook failed", "status", resp.Status)
+	}
+}
+
+// =============================================================================
+// ADMIN DASHBOARD
+// =============================================================================
+
+// AdminPage contains data for rendering the admin dashboard
+type AdminPage struct {
+	Stats          *WikiStats
+	Usage          *DiskUsage
+	AlertThreshold int64 // Zero when disk alerts are disabled
+
+	themedPage
+}
+
+// adminHandler displays the admin dashboard with wiki statistics and disk usage
+func (s *Server) adminHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.collectStats(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	usage, err := s.measureDiskUsage(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	data := &AdminPage{Stats: stats, Usage: usage, AlertThreshold: s.cfg().DiskAlertBytes}
+	s.renderTemplate(w, r, "admin", data)
+}
+
+// diskUsageHandler serves the per-component disk usage as JSON
+func (s *Server) diskUsageHandler(w http.ResponseWriter, r *http.Request) {
+	usage, err := s.measureDiskUsage(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
+// formatBytes renders a byte count with a binary unit suffix for display
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// PAGE API
+// =============================================================================
+
+// maxAPIBodyBytes limits the size of JSON request bodies accepted by the API
+const maxAPIBodyBytes = 1 << 20
+
+// Operations supported by PATCH /api/v1/pages/{title}
+const (
+	patchAppend         = "append"
+	patchPrepend        = "prepend"
+	patchReplaceSection = "replace-section"
+)
+
+// pagePatch is the JSON body of a PATCH request
+type pagePatch struct {
+	Op      string `json:"op"`
+	Content string `json:"content"`
+	Section string `json:"section,omitempty"` // Heading anchor, for replace-section
+	Summary string `json:"summary,omitempty"`
+}
+
+// pageWrite is the JSON body of a PUT request
+type pageWrite struct {
+	Body    string `json:"body"`
+	Summary string `json:"summary,omitempty"`
+}
+
+// apiPageInfo is a page in the JSON page list
+type apiPageInfo struct {
+	Title    string    `json:"title"`
+	Modified time.Time `json:"modified"`
+}
+
+// apiSearchResult is a match in the JSON search results
+type apiSearchResult struct {
+	Title   string `json:"title"`
+	Lang    string `json:"lang"`
+	Snippet string `json:"snippet,omitempty"`
+}
+
+// bodyETag returns the entity tag identifying a page body, used for optimistic concurrency
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// applyPatch returns body with the patch applied
+func applyPatch(body string, patch pagePatch) (string, error) {
+	content := patch.Content
+	switch patch.Op {
+	case patchAppend:
+		if body != "" && !strings.HasSuffix(body, "\n") {
+			body += "\n"
+		}
+		return body + content, nil
+	case patchPrepend:
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		return content + body, nil
+	case patchReplaceSection:
+		start, end, ok := findSection(body, patch.Section)
+		if !ok {
+			return "", errSectionNotFound
+		}
+		if content != "" && !strings.HasSuffix(content, "\n") && end < len(body) {
+			content += "\n"
+		}
+		return body[:start] + content + body[end:], nil
+	}
+	return "", errUnknownPatchOp
+}
+
+var (
+	errSectionNotFound = errors.New("section not found")
+	errUnknownPatchOp  = errors.New(`op must be "append", "prepend" or "replace-section"`)
+)
+
+// patchPageHandler applies a partial update to a page without the client having
+// to send the whole body. Appending and prepending create missing pages.
+// Sending the page's ETag in If-Match makes the update fail with 412 if
+// someone else changed the page in the meantime.
+func (s *Server) patchPageHandler(w http.ResponseWriter, r *http.Request) {
+	title := r.PathValue("title")
+	if !validTitle.MatchString(title) {
+		http.NotFound(w, r)
+		return
+	}
+
+	var patch pagePatch
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodyBytes)).Decode(&patch); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+
+	unlock := s.store.Lock(title)
+	defer unlock()
+
+	var body []byte
+	p, err := s.store.Load(r.Context(), title)
+	exists := err == nil
+	if exists {
+		body = p.Body
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if !exists && patch.Op == patchReplaceSection {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "page not found"})
+		return
+	}
+
+	if match := r.Header.Get("If-Match"); match != "" {
+		if !exists || (match != "*" && match != bodyETag(body)) {
+			writeJSON(w, http.StatusPreconditionFailed, map[string]string{"error": "page has changed since it was read"})
+			return
+		}
+	}
+
+	updated, err := applyPatch(string(body), patch)
+	switch {
+	case errors.Is(err, errSectionNotFound):
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	p = &Page{Title: title, Body: []byte(updated), Summary: patch.Summary, Author: s.tokenName(r)}
+	if s.needsReview(r) {
+		s.holdAPIEdit(w, r, p)
+		return
+	}
+	if err := s.savePage(r.Context(), p); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	status := http.StatusOK
+	if !exists {
+		status = http.StatusCreated
+	}
+	w.Header().Set("ETag", bodyETag(p.Body))
+	writeJSON(w, status, apiPage{Title: title, Body: updated})
+}
+
+// Limits on the number of pages returned by one list request
+const (
+	defaultPageListLimit = 100
+	maxPageListLimit     = 1000
+)
+
+// Orders of the page list, by title or by modification time, oldest or
+// newest first; pages modified at the same time are ordered by title
+const (
+	sortTitle        = "title"
+	sortTitleDesc    = "-title"
+	sortModified     = "modified"
+	sortModifiedDesc = "-modified"
+)
+
+// apiPageList is one batch of the JSON page list. NextCursor is passed as
+// the cursor parameter to get the next batch and is empty after the last one.
+type apiPageList struct {
+	Pages      []apiPageInfo `json:"pages"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// pageCursor marks the last page of a batch, encoded as an opaque token
+type pageCursor struct {
+	Sort     string `json:"s"`
+	Title    string `json:"t"`
+	Modified int64  `json:"m,omitempty"` // Unix nanoseconds, for orders by modification time
+}
+
+// encode returns the token a client passes back as the cursor parameter
+func (c pageCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodePageCursor reads a cursor token, which must have been issued for the same order
+func decodePageCursor(token, order string) (pageCursor, error) {
+	var c pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil || c.Sort != order {
+		return pageCursor{}, errors.New("invalid cursor")
+	}
+	return c, nil
+}
+
+// pageListLess returns the comparison ordering the page list
+func pageListLess(order string) func(a, b apiPageInfo) bool {
+	byTitle := func(a, b apiPageInfo) bool { return a.Title < b.Title }
+	switch order {
+	case sortTitleDesc:
+		return func(a, b apiPageInfo) bool { return a.Title > b.Title }
+	case sortModified:
+		return func(a, b apiPageInfo) bool {
+			if !a.Modified.Equal(b.Modified) {
+				return a.Modified.Before(b.Modified)
+			}
+			return byTitle(a, b)
+		}
+	case sortModifiedDesc:
+		return func(a, b apiPageInfo) bool {
+			if !a.Modified.Equal(b.Modified) {
+				return a.Modified.After(b.Modified)
+			}
+			return byTitle(a, b)
+		}
+	}
+	return byTitle
+}
+
+// listPagesHandler returns the titles and modification times of pages as
+// JSON, in batches of at most limit pages. The namespace, tag and
+// modified_since (RFC 3339) parameters narrow the list, and sort orders it by
+// title, -title, modified or -modified. Since the order is total, following
+// next_cursor visits every page once even while pages change. Pages the
+// client may not read are left out before filtering, so that neither the
+// list nor its batches reveal their tags.
+func (s *Server) listPagesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	badRequest := func(msg string) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+	}
+
+	order := q.Get("sort")
+	switch order {
+	case "":
+		order = sortTitle
+	case sortTitle, sortTitleDesc, sortModified, sortModifiedDesc:
+	default:
+		badRequest("sort must be title, -title, modified or -modified")
+		return
+	}
+	limit := defaultPageListLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageListLimit {
+			badRequest("limit must be between 1 and " + strconv.Itoa(maxPageListLimit))
+			return
+		}
+		limit = n
+	}
+	var since time.Time
+	if v := q.Get("modified_since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			badRequest("modified_since must be an RFC 3339 time")
+			return
+		}
+		since = t
+	}
+	namespace, tag := q.Get("namespace"), q.Get("tag")
+	var after *apiPageInfo
+	if v := q.Get("cursor"); v != "" {
+		c, err := decodePageCursor(v, order)
+		if err != nil {
+			badRequest(err.Error())
+			return
+		}
+		after = &apiPageInfo{Title: c.Title, Modified: time.Unix(0, c.Modified).UTC()}
+	}
+
+	titles, err := s.store.List(r.Context())
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	canRead := s.readChecker(r)
+	titles = slices.DeleteFunc(titles, func(title string) bool { return !canRead(title) })
+	less := pageListLess(order)
+	pages := make([]apiPageInfo, 0, len(titles))
+	for _, title := range titles {
+		if !inNamespace(title, namespace) {
+			continue
+		}
+		modTime, err := s.store.ModTime(r.Context(), title)
+		if err != nil || modTime.Before(since) {
+			continue
+		}
+		info := apiPageInfo{Title: title, Modified: modTime.UTC()}
+		if after != nil && !less(*after, info) {
+			continue
+		}
+		if tag != "" {
+			p, err := s.store.Load(r.Context(), title)
+			if err != nil || !slices.Contains(p.Meta.Tags, tag) {
+				continue
+			}
+		}
+		pages = append(pages, info)
+	}
+	if err := r.Context().Err(); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	sort.Slice(pages, func(i, j int) bool { return less(pages[i], pages[j]) })
+
+	list := apiPageList{Pages: pages}
+	if len(pages) > limit {
+		list.Pages = pages[:limit]
+		last := list.Pages[limit-1]
+		c := pageCursor{Sort: order, Title: last.Title}
+		if order == sortModified || order == sortModifiedDesc {
+			c.Modified = last.Modified.UnixNano()
+		}
+		list.NextCursor = c.encode()
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getPageHandler returns a page as JSON, or its raw body when the client
+// accepts text/plain or text/markdown but not JSON, with its ETag for a later
+// conditional update
+func (s *Server) getPageHandler(w http.ResponseWriter, r *http.Request) {
+	title := r.PathValue("title")
+	if !validTitle.MatchString(title) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+	mediaType := negotiate(r.Header.Get("Accept"), apiMediaTypes)
+	if mediaType == "" {
+		writeJSON(w, http.StatusNotAcceptable, map[string]any{"error": "no acceptable representation", "available": apiMediaTypes})
+		return
+	}
+	p, err := s.store.Load(r.Context(), title)
+	if errors.Is(err, os.ErrNotExist) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "page not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("ETag", bodyETag(p.Body))
+	if mediaType != mediaJSON {
+		w.Header().Set("Content-Type", mediaType+"; charset=utf-8")
+		w.Write(p.Body)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiPage{Title: title, Body: string(p.Body)})
+}
+
+// readPageWrite reads the body of a PUT request: a JSON pageWrite, or the
+// new page body itself sent as text/plain or text/markdown, with the summary
+// in the summary parameter. It answers 400 or 415 and reports false when
+// the body can't be read.
+func readPageWrite(w http.ResponseWriter, r *http.Request) (pageWrite, bool) {
+	var write pageWrite
+	mediaType := mediaJSON
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(ct); err != nil || !slices.Contains(apiMediaTypes, mediaType) {
+			writeJSON(w, http.StatusUnsupportedMediaType, map[string]any{"error": "unsupported content type " + ct, "accepted": apiMediaTypes})
+			return write, false
+		}
+	}
+	body := http.MaxBytesReader(w, r.Body, maxAPIBodyBytes)
+	if mediaType != mediaJSON {
+		text, err := io.ReadAll(body)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "reading body: " + err.Error()})
+			return write, false
+		}
+		return pageWrite{Body: string(text), Summary: r.URL.Query().Get("summary")}, true
+	}
+	if err := json.NewDecoder(body).Decode(&write); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return write, false
+	}
+	return write, true
+}
+
+// putPageHandler replaces the whole body of a page, creating it if needed.
+// Sending the page's ETag in If-Match makes the update fail with 412 if
+// someone else changed the page in the meantime.
+func (s *Server) putPageHandler(w http.ResponseWriter, r *http.Request) {
+	title := r.PathValue("title")
+	if !validTitle.MatchString(title) {
+		http.NotFound(w, r)
+		return
+	}
+
+	write, ok := readPageWrite(w, r)
+	if !ok {
+		return
+	}
+
+	unlock := s.store.Lock(title)
+	defer unlock()
+
+	p, err := s.store.Load(r.Context(), title)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if match := r.Header.Get("If-Match"); match != "" {
+		if !exists || (match != "*" && match != bodyETag(p.Body)) {
+			writeJSON(w, http.StatusPreconditionFailed, map[string]string{"error": "page has changed since it was read"})
+			return
+		}
+	}
+
+	p = &Page{Title: title, Body: []byte(write.Body), Summary: write.Summary, Author: s.tokenName(r)}
+	if s.needsReview(r) {
+		s.holdAPIEdit(w, r, p)
+		return
+	}
+	if err := s.savePage(r.Context(), p); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	status := http.StatusOK
+	if !exists {
+		status = http.StatusCreated
+	}
+	w.Header().Set("ETag", bodyETag(p.Body))
+	writeJSON(w, status, apiPage{Title: title, Body: write.Body})
+}
+
+// deletePageHandler moves a page to the trash, from where an administrator
+// can restore it, answering 204 No Content. Sending the page's ETag in
+// If-Match makes the deletion fail with 412 if someone else changed the page
+// in the meantime. Deletions can't be held for review, so clients whose
+// edits would be are refused.
+func (s *Server) deletePageHandler(w http.ResponseWriter, r *http.Request) {
+	title := r.PathValue("title")
+	if !validTitle.MatchString(title) {
+		http.NotFound(w, r)
+		return
+	}
+	if s.needsReview(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "deleting pages needs the write scope"})
+		return
+	}
+
+	unlock := s.store.Lock(title)
+	defer unlock()
+
+	p, err := s.store.Load(r.Context(), title)
+	if errors.Is(err, os.ErrNotExist) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "page not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != bodyETag(p.Body) {
+		writeJSON(w, http.StatusPreconditionFailed, map[string]string{"error": "page has changed since it was read"})
+		return
+	}
+	if err := s.trashPage(r.Context(), title, s.tokenName(r), strings.TrimSpace(r.URL.Query().Get("reason"))); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiPendingEdit describes an edit the API held for review
+type apiPendingEdit struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Status string `json:"status"`
+}
+
+// holdAPIEdit holds an API edit for review, answering 202 Accepted
+func (s *Server) holdAPIEdit(w http.ResponseWriter, r *http.Request, p *Page) {
+	edit, err := s.holdEdit(r, p)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, apiPendingEdit{ID: edit.ID, Title: edit.Title, Status: "pending"})
+}
+
+// searchAPIHandler returns the pages matching the q parameter as JSON, in the
+// order of the search page, optionally restricted to the language in lang
+func (s *Server) searchAPIHandler(w http.ResponseWriter, r *http.Request) {
+	lang := r.URL.Query().Get("lang")
+	if lang != "" && !validLang.MatchString(lang) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid lang"})
+		return
+	}
+	results, err := searchPages(r.Context(), s.store, r.URL.Query().Get("q"), lang, s.cfg().DefaultLang)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	results = slices.DeleteFunc(results, func(res SearchResult) bool { return !s.canRead(r, res.Title) })
+	matches := make([]apiSearchResult, len(results))
+	for i, res := range results {
+		matches[i] = apiSearchResult{Title: res.Title, Lang: res.Lang, Snippet: res.Snippet}
+	}
+	writeJSON(w, http.StatusOK, matches)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// TestListPagesPermissions checks that the page list leaves out the pages
+// its client may not read, with or without a tag filter
+func TestListPagesPermissions(t *testing.T) {
+	s, reqs := newCredentialServer(t, nil)
+	savePages(t, s, map[string]string{
+		"Guide":     "---\ntags: howto\n---\nRead me.\n",
+		"Team/Plan": "---\ntags: howto, launch\n---\nShip it.\n",
+		"Team/Log":  "Nothing yet.\n",
+	})
+	if err := s.permissions.set(s.cfg().DataDir, Permission{Target: "Team/", Read: []string{"alice"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		reader, query string
+		want          []string
+	}{
+		{"reader", "", []string{"Guide"}},
+		{"reader", "?tag=howto", []string{"Guide"}},
+		{"reader", "?tag=launch", []string{}},
+		{"reader", "?limit=1", []string{"Guide"}},
+		{"user session", "", []string{"Guide", "Team/Log", "Team/Plan"}},
+		{"user session", "?tag=howto", []string{"Guide", "Team/Plan"}},
+		{"admin token", "?tag=launch", []string{"Team/Plan"}},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/pages"+tc.query, nil)
+		r.Header = reqs[tc.reader].Header.Clone()
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		var list apiPageList
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: GET %s: status %d, %v", tc.reader, r.URL, w.Code, err)
+		}
+		titles := []string{}
+		for _, p := range list.Pages {
+			titles = append(titles, p.Title)
+		}
+		if !slices.Equal(titles, tc.want) {
+			t.Errorf("%s: GET %s: pages %q, want %q", tc.reader, r.URL, titles, tc.want)
+		}
+		if tc.query == "?limit=1" && list.NextCursor != "" {
+			t.Errorf("%s: GET %s: a next batch of pages it may not read", tc.reader, r.URL)
+		}
+	}
+}
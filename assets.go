@@ -0,0 +1,72 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+// =============================================================================
+// ASSETS
+// =============================================================================
+
+// The templates and static files are built into the binary so it runs from
+// any working directory; a directory given in the configuration replaces them
+
+//go:embed templates/*.html
+var embeddedTemplates embed.FS
+
+//go:embed static
+var embeddedStatic embed.FS
+
+// templateDir returns the directory the templates are read from, or "" for
+// the built-in ones. Development mode reads them from the source tree so
+// edits show without rebuilding.
+func (cfg *Config) templateDir() string {
+	if cfg.TemplateDir == "" && cfg.Dev {
+		return templatePath
+	}
+	return cfg.TemplateDir
+}
+
+// staticDir returns the directory static files are served from, or "" for
+// the built-in ones, following the same rules as templateDir
+func (cfg *Config) staticDir() string {
+	if cfg.StaticDir == "" && cfg.Dev {
+		return staticPath
+	}
+	return cfg.StaticDir
+}
+
+// templateFS returns the templates in dir, or the built-in ones when dir is empty
+func templateFS(dir string) fs.FS {
+	if dir == "" {
+		sub, _ := fs.Sub(embeddedTemplates, "templates")
+		return sub
+	}
+	return os.DirFS(dir)
+}
+
+// staticFS returns the static files in dir, or the built-in ones when dir is empty
+func staticFS(dir string) fs.FS {
+	if dir == "" {
+		sub, _ := fs.Sub(embeddedStatic, "static")
+		return sub
+	}
+	return os.DirFS(dir)
+}
+
+// assetSource describes where assets are read from, for messages
+func assetSource(dir string) string {
+	if dir == "" {
+		return "the binary"
+	}
+	return dir
+}
+
+// staticHandler serves the stylesheet and other static files from the
+// configured directory or the binary
+func (s *Server) staticHandler(w http.ResponseWriter, r *http.Request) {
+	http.FileServerFS(staticFS(s.cfg().staticDir())).ServeHTTP(w, r)
+}
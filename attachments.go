@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// =============================================================================
+// ATTACHMENTS
+// =============================================================================
+
+// Regular expression matching attachment file names: no separators or leading dots
+var validAttachmentName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// uploadTypes maps the extensions of files that may be uploaded to the media
+// type their content must be detected as, so a script can't be uploaded
+// under an image's name. SVG and HTML are left out as they can carry scripts.
+var uploadTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".pdf":  "application/pdf",
+	".zip":  "application/zip",
+	".txt":  "text/plain",
+	".md":   "text/plain",
+	".csv":  "text/plain",
+}
+
+// attachmentRef matches markup showing a file attached to the page:
+// [[img:NAME]] for an image, [[file:NAME]] for a download link
+var attachmentRef = regexp.MustCompile(`^\[\[(img|file):([A-Za-z0-9_][A-Za-z0-9_.-]*)\]\]`)
+
+// Attachment describes a file attached to a page
+type Attachment struct {
+	Name  string
+	Size  int64
+	URL   string
+	Image bool // Whether the file is an image, shown inline by [[img:NAME]]
+}
+
+// UploadPage is the data for the attachments page of a wiki page
+type UploadPage struct {
+	Title       string
+	Attachments []Attachment
+	MaxBytes    int64
+	Types       []string // Extensions that may be uploaded
+	Uploaded    string   // Name of the file just uploaded
+	Error       string
+
+	csrfForm
+	themedPage
+}
+
+// attachmentPath returns where a file attached to a page is stored
+func attachmentPath(dataDir, title, name string) string {
+	return filepath.Join(dataDir, attachmentsDir, fileStem(title), name)
+}
+
+// attachmentURL returns the address a file attached to a page is served at
+func attachmentURL(title, name string) string {
+	return "/attachments/" + titleURL(title) + "/" + name
+}
+
+// attachmentName turns a file name from elsewhere into a valid attachment
+// name, replacing unsupported characters with underscores
+func attachmentName(name string) string {
+	b := []byte(filepath.Base(name))
+	for i, c := range b {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '-' || c == '_') {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || b[0] == '.' || b[0] == '-' {
+		b = append([]byte{'_'}, b...)
+	}
+	return string(b)
+}
+
+// writeAttachment stores a file attached to a page
+func writeAttachment(dataDir, title, name string, data []byte) error {
+	path := attachmentPath(dataDir, title, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// attachment writes an image or download link for a file attached to the
+// page being rendered, reporting whether there was a page to attach it to
+func (rd *renderer) attachment(kind, name string) bool {
+	if len(rd.stack) == 0 {
+		return false
+	}
+	href := template.HTMLEscapeString(attachmentURL(rd.stack[len(rd.stack)-1], name))
+	if kind == "img" {
+		rd.out.WriteString(`<img src="` + href + `" alt="` + name + `">`)
+	} else {
+		rd.out.WriteString(`<a href="` + href + `" download>` + name + `</a>`)
+	}
+	return true
+}
+
+// listAttachments returns the files attached to a page, sorted by name
+func listAttachments(dataDir, title string) ([]Attachment, error) {
+	entries, err := os.ReadDir(filepath.Dir(attachmentPath(dataDir, title, "x")))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var attachments []Attachment
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || !validAttachmentName.MatchString(e.Name()) {
+			continue
+		}
+		attachments = append(attachments, Attachment{
+			Name:  e.Name(),
+			Size:  info.Size(),
+			URL:   attachmentURL(title, e.Name()),
+			Image: strings.HasPrefix(uploadTypes[strings.ToLower(filepath.Ext(e.Name()))], "image/"),
+		})
+	}
+	sort.Slice(attachments, func(i, j int) bool { return attachments[i].Name < attachments[j].Name })
+	return attachments, nil
+}
+
+// checkUpload verifies that an uploaded file has an allowed extension and
+// that its content is what the extension claims
+func checkUpload(name string, data []byte) error {
+	ext := strings.ToLower(filepath.Ext(name))
+	want, ok := uploadTypes[ext]
+	if !ok {
+		return fmt.Errorf("%s files can't be uploaded", strings.TrimPrefix(ext, "."))
+	}
+	got, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if got != want {
+		return fmt.Errorf("%s doesn't contain what its extension says: expected %s, found %s", name, want, got)
+	}
+	return nil
+}
+
+// uploadHandler lists the files attached to a page and attaches the file
+// posted as a multipart form, replacing any attachment with the same name
+func (s *Server) uploadHandler(w http.ResponseWriter, r *http.Request, title string) {
+	if !s.store.Exists(r.Context(), title) {
+		http.NotFound(w, r)
+		return
+	}
+	cfg := s.cfg()
+	data := &UploadPage{Title: title, MaxBytes: cfg.MaxUploadBytes, Uploaded: r.URL.Query().Get("uploaded")}
+	for ext := range uploadTypes {
+		data.Types = append(data.Types, ext)
+	}
+	sort.Strings(data.Types)
+
+	if r.Method == http.MethodPost {
+		// Attachments can't be held for review
+		if s.needsReview(r) {
+			http.Error(w, "Uploading files needs the write scope", http.StatusForbidden)
+			return
+		}
+		name, err := s.saveUpload(w, r, title)
+		if err == nil {
+			http.Redirect(w, r, "/upload/"+titleURL(title)+"?uploaded="+name, http.StatusSeeOther)
+			return
+		}
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			data.Error = "The file is larger than the limit of " + formatBytes(cfg.MaxUploadBytes) + "."
+		case errors.Is(err, errBadUpload):
+			w.WriteHeader(http.StatusBadRequest)
+			data.Error = strings.TrimPrefix(err.Error(), errBadUpload.Error()+": ")
+		default:
+			serverError(w, r, err)
+			return
+		}
+	}
+
+	var err error
+	if data.Attachments, err = listAttachments(cfg.DataDir, title); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	s.renderTemplate(w, r, "upload", data)
+}
+
+// errBadUpload wraps the reasons an uploaded file is refused
+var errBadUpload = errors.New("bad upload")
+
+// saveUpload stores the file posted to the upload form as an attachment of a
+// page and returns its name
+func (s *Server) saveUpload(w http.ResponseWriter, r *http.Request, title string) (string, error) {
+	cfg := s.cfg()
+	// Leave room for the multipart headers around the file
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxUploadBytes+64<<10)
+	file, header, err := r.FormFile("file")
+	if errors.Is(err, http.ErrMissingFile) {
+		return "", fmt.Errorf("%w: choose a file to upload", errBadUpload)
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return "", err
+		}
+		return "", fmt.Errorf("%w: %v", errBadUpload, err)
+	}
+	defer file.Close()
+	if header.Size > cfg.MaxUploadBytes {
+		return "", &http.MaxBytesError{Limit: cfg.MaxUploadBytes}
+	}
+	body, err := io.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+
+	name := attachmentName(header.Filename)
+	if err := checkUpload(name, body); err != nil {
+		return "", fmt.Errorf("%w: %v", errBadUpload, err)
+	}
+	if err := writeAttachment(cfg.DataDir, title, name, body); err != nil {
+		return "", err
+	}
+	s.audit.record(AuditEvent{Type: eventUpload, Title: title, Actor: s.tokenName(r), Detail: name})
+	return name, nil
+}
+
+// attachmentHandler serves a file attached to a page at
+// /attachments/TITLE/NAME. Files are sandboxed so uploaded HTML or SVG can't
+// run scripts in the wiki's origin.
+func (s *Server) attachmentHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("path")
+	i := strings.LastIndexByte(path, '/')
+	if i < 0 || !validTitle.MatchString(path[:i]) || !validAttachmentName.MatchString(path[i+1:]) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, attachmentPath(s.cfg().DataDir, path[:i], path[i+1:]))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// =============================================================================
+// AUDIT LOG
+// =============================================================================
+
+// auditFile is the append-only log of everything that happened to the wiki,
+// one JSON event per line. The leading dot keeps it out of page listings.
+const auditFile = ".audit.jsonl"
+
+// maxActivityEvents caps the number of events shown on the activity page
+const maxActivityEvents = 200
+
+// Audit event types
+const (
+	eventCreate  = "create"
+	eventEdit    = "edit"
+	eventDelete  = "delete"
+	eventRename  = "rename"
+	eventUpload  = "upload"
+	eventComment = "comment"
+	eventPurge   = "purge"
+	eventReview  = "review"
+	eventMention = "mention" // Detail holds the name of the user mentioned
+)
+
+// activityTypes lists the event types that can be filtered on the activity page
+var activityTypes = []string{eventCreate, eventEdit, eventDelete, eventRename, eventUpload, eventComment, eventPurge, eventReview, eventMention}
+
+// AuditEvent is a single entry of the audit log
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Title    string    `json:"title,omitempty"`
+	Actor    string    `json:"actor,omitempty"`
+	Revision int       `json:"rev,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+
+	PreviousTitle string `json:"from,omitempty"` // Title before a rename
+}
+
+// auditLog is an append-only JSON lines file of audit events
+type auditLog struct {
+	path string
+	mu   sync.Mutex
+}
+
+// newAuditLog returns the audit log stored at path
+func newAuditLog(path string) *auditLog {
+	return &auditLog{path: path}
+}
+
+// record appends an event to the audit log. Failures are logged rather
+// than returned so auditing never breaks the operation being audited.
+func (a *auditLog) record(ev AuditEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	entry, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("Encoding audit event failed", "err", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		slog.Error("Opening audit log failed", "err", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(entry, '\n')); err != nil {
+		slog.Error("Writing audit log failed", "err", err)
+	}
+}
+
+// events returns the audit log, oldest first
+func (a *auditLog) events() ([]AuditEvent, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.Open(a.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			continue // Skip lines truncated by a crash mid-write
+		}
+		events = append(events, ev)
+	}
+	return events, scanner.Err()
+}
+
+// =============================================================================
+// ACTIVITY FEED
+// =============================================================================
+
+// ActivityPage contains data for rendering the activity stream
+type ActivityPage struct {
+	Events   []AuditEvent
+	Types    []string        // All event types that can be filtered on
+	Selected map[string]bool // Types currently shown, empty for all
+
+	themedPage
+}
+
+// activityHandler shows audit events newest first, optionally limited to the
+// event types given by repeated type query parameters
+func (s *Server) activityHandler(w http.ResponseWriter, r *http.Request) {
+	events, err := s.audit.events()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	selected := make(map[string]bool)
+	for _, t := range r.URL.Query()["type"] {
+		selected[t] = true
+	}
+
+	data := &ActivityPage{Types: activityTypes, Selected: selected}
+	for i := len(events) - 1; i >= 0 && len(data.Events) < maxActivityEvents; i-- {
+		if len(selected) == 0 || selected[events[i].Type] {
+			data.Events = append(data.Events, events[i])
+		}
+	}
+
+	s.renderTemplate(w, r, "activity", data)
+}
+
+// =============================================================================
+// RECENT CHANGES
+// =============================================================================
+
+// maxRecentChanges caps the number of pages listed on the recent changes page
+const maxRecentChanges = 100
+
+// PageChange is the latest change to a page, as listed on the recent changes page
+type PageChange struct {
+	Title    string
+	Modified time.Time
+	Revision int    // Revision the change created, 0 when unknown
+	Author   string // Who made the change, empty when anonymous or unknown
+	Summary  string
+}
+
+// RecentChangesPage contains data for rendering the recent changes page
+type RecentChangesPage struct {
+	Changes []PageChange
+
+	themedPage
+}
+
+// changesHandler lists pages by when they were last modified, newest first,
+// with the author and summary of their latest edit
+func (s *Server) changesHandler(w http.ResponseWriter, r *http.Request) {
+	titles, err := s.store.List(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	events, err := s.audit.events()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	latest := make(map[string]AuditEvent)
+	for _, ev := range events {
+		if ev.Type == eventCreate || ev.Type == eventEdit {
+			latest[ev.Title] = ev
+		}
+	}
+
+	data := &RecentChangesPage{}
+	for _, title := range titles {
+		modTime, err := s.store.ModTime(r.Context(), title)
+		if err != nil {
+			continue
+		}
+		change := PageChange{Title: title, Modified: modTime}
+		if ev, ok := latest[title]; ok {
+			change.Revision, change.Author, change.Summary = ev.Revision, ev.Actor, ev.Detail
+		}
+		data.Changes = append(data.Changes, change)
+	}
+	sort.Slice(data.Changes, func(i, j int) bool { return data.Changes[i].Modified.After(data.Changes[j].Modified) })
+	if len(data.Changes) > maxRecentChanges {
+		data.Changes = data.Changes[:maxRecentChanges]
+	}
+	s.renderTemplate(w, r, "changes", data)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// BOOKS
+// =============================================================================
+
+// A book is a page declaring "book: true" in its metadata. Its chapters are
+// the pages it links to, in the order of their first link, so a book is
+// written and reordered like any other page:
+//
+//	---
+//	book: true
+//	---
+//	[GettingStarted]
+//	[Installation]
+//	[Troubleshooting]
+
+// bookChapters loads the pages a book links to, in order. Redirects are
+// followed, and links to missing pages or to the book itself are skipped.
+func bookChapters(ctx context.Context, store PageStore, book *Page) ([]*Page, error) {
+	seen := map[string]bool{book.Title: true}
+	var chapters []*Page
+	for _, line := range bytes.Split(pageContent(book.Body), []byte("\n")) {
+		for i := bytes.IndexByte(line, '['); i >= 0; i = bytes.IndexByte(line, '[') {
+			line = line[i+1:]
+			name, n := scanTitle(line, "]")
+			if n == 0 {
+				continue
+			}
+			line = line[n:]
+
+			p, err := store.Load(ctx, string(name))
+			if err == nil {
+				if target, ok := redirectTarget(p.Body); ok {
+					p, err = store.Load(ctx, target)
+				}
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				continue
+			}
+			if seen[p.Title] {
+				continue
+			}
+			seen[p.Title] = true
+			chapters = append(chapters, p)
+		}
+	}
+	return chapters, nil
+}
+
+// bookBlock is a heading or a line of text of a chapter
+type bookBlock struct {
+	Level int // Heading level, 0 for text
+	Text  string
+}
+
+// bookBlocks turns a page body into plain text blocks for print: links become
+// their titles, transclusions are expanded as in the web view, and HTML is
+// reduced to its text. stack holds the titles being expanded, outermost first.
+func bookBlocks(ctx context.Context, store PageStore, body []byte, stack []string) ([]bookBlock, error) {
+	var blocks []bookBlock
+	for _, line := range bytes.Split(pageContent(body), []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if level, text := parseHeading(line); level > 0 {
+			blocks = append(blocks, bookBlock{Level: level, Text: plainText(text)})
+			continue
+		}
+
+		var text []byte
+		for len(line) > 0 {
+			i := bytes.Index(line, []byte(includePrefix))
+			if i < 0 {
+				text = append(text, line...)
+				break
+			}
+			name, n := scanTitle(line[i+len(includePrefix):], includeSuffix)
+			if n == 0 {
+				text = append(text, line[:i+1]...)
+				line = line[i+1:]
+				continue
+			}
+			text = append(text, line[:i]...)
+			line = line[i+len(includePrefix)+n:]
+
+			if len(bytes.TrimSpace(text)) > 0 {
+				blocks = append(blocks, bookBlock{Text: plainText(text)})
+			}
+			text = nil
+			included, err := includeBlocks(ctx, store, string(name), stack)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, included...)
+		}
+		blocks = append(blocks, bookBlock{Text: plainText(text)})
+	}
+	return blocks, nil
+}
+
+// includeBlocks returns the blocks of a transcluded page, or a note in their
+// place when the page is missing, unreadable to the reader, already being
+// expanded, or nested too deeply
+func includeBlocks(ctx context.Context, store PageStore, title string, stack []string) ([]bookBlock, error) {
+	for _, t := range stack {
+		if t == title {
+			return []bookBlock{{Text: "[Include cycle: " + strings.Join(append(stack, title), " > ") + "]"}}, nil
+		}
+	}
+	if len(stack) > maxIncludeDepth {
+		return []bookBlock{{Text: fmt.Sprintf("[Include of %s skipped: pages may only be nested %d levels deep]", title, maxIncludeDepth)}}, nil
+	}
+	p, err := store.Load(ctx, title)
+	if errors.Is(err, errUnreadable) {
+		return []bookBlock{{Text: "[You may not read the included page " + title + "]"}}, nil
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return []bookBlock{{Text: "[Included page " + title + " does not exist]"}}, nil
+	}
+	return bookBlocks(ctx, store, p.Body, append(stack, title))
+}
+
+// plainText returns a line of page text as it reads in print, with links
+// replaced by the titles they name and HTML tags removed
+func plainText(line []byte) string {
+	var b strings.Builder
+	for len(line) > 0 {
+		i := bytes.IndexByte(line, '[')
+		if i < 0 {
+			b.Write(line)
+			break
+		}
+		b.Write(line[:i])
+		if name, n := scanTitle(line[i+1:], "]"); n > 0 {
+			b.Write(name)
+			line = line[i+1+n:]
+			continue
+		}
+		b.WriteByte('[')
+		line = line[i+1:]
+	}
+	text := b.String()
+	if strings.IndexByte(text, '<') >= 0 {
+		text = htmlTag.ReplaceAllString(text, "")
+	}
+	return html.UnescapeString(text)
+}
+
+// =============================================================================
+// BOOK PDF EXPORT
+// =============================================================================
+
+// errEmptyBook is returned when none of the pages a book links to exist
+var errEmptyBook = errors.New("book lists no existing pages")
+
+// Type sizes and line spacing of printed books, in points
+const (
+	bookTextSize       = 11.0
+	bookTextLeading    = 15.0
+	bookChapterSize    = 22.0
+	bookChapterLeading = 28.0
+	bookTOCSize        = 12.0
+	bookTOCLeading     = 20.0
+	bookFooterSize     = 9.0
+)
+
+// bookHeadingSizes are the type size and line spacing of headings by level
+var bookHeadingSizes = [...][2]float64{{18, 24}, {15, 20}, {13, 18}, {12, 16}, {11, 15}, {11, 15}}
+
+// writeBookPDF compiles a book's chapters into one paginated PDF: a cover, a
+// table of contents linking to each chapter, then every chapter starting on a
+// new page. Pages after the cover are numbered, and each chapter is bookmarked.
+func writeBookPDF(ctx context.Context, w io.Writer, store PageStore, book *Page, chapters []*Page) error {
+	if len(chapters) == 0 {
+		return errEmptyBook
+	}
+
+	// Lay out the chapters first, so the contents can show where each begins
+	body := &pdfDocument{}
+	starts := make([]int, len(chapters))
+	for i, p := range chapters {
+		var err error
+		if starts[i], err = writeChapter(ctx, body, store, p); err != nil {
+			return err
+		}
+	}
+
+	doc := &pdfDocument{Title: book.Title}
+	writeBookCover(doc, book, len(chapters))
+	usable := pdfPageHeight - 2*pdfMargin - bookChapterLeading - bookTOCLeading // Below the contents heading
+	perPage := int(usable / bookTOCLeading)
+	tocPages := (len(chapters) + perPage - 1) / perPage
+	offset := 1 + tocPages
+	writeBookContents(doc, chapters, starts, offset, perPage)
+	doc.Pages = append(doc.Pages, body.Pages...)
+	for i, p := range chapters {
+		doc.Outlines = append(doc.Outlines, pdfOutline{Title: p.Title, Page: offset + starts[i], Top: pdfPageHeight - pdfMargin})
+	}
+
+	numberPages(doc, 1)
+	_, err := doc.WriteTo(w)
+	return err
+}
+
+// numberPages writes the page number at the foot of each page from first on
+func numberPages(doc *pdfDocument, first int) {
+	for i := first; i < len(doc.Pages); i++ {
+		footer := strconv.Itoa(i + 1)
+		doc.text(i, fontRegular, bookFooterSize, (pdfPageWidth-textWidth(footer, fontRegular, bookFooterSize))/2, pdfMargin/2, footer)
+	}
+}
+
+// writeChapter lays out a page on new pages of doc, under its title, and
+// returns the index of the first
+func writeChapter(ctx context.Context, doc *pdfDocument, store PageStore, p *Page) (int, error) {
+	blocks, err := bookBlocks(ctx, store, p.Body, []string{p.Title})
+	if err != nil {
+		return 0, err
+	}
+	l := newLayout(doc)
+	start := l.page
+	l.paragraph(p.Title, fontBold, bookChapterSize, bookChapterLeading)
+	l.space(bookTextLeading)
+	for _, b := range blocks {
+		switch {
+		case b.Level > 0:
+			size := bookHeadingSizes[b.Level-1]
+			l.space(size[1] / 2)
+			l.paragraph(b.Text, fontBold, size[0], size[1])
+		case strings.TrimSpace(b.Text) == "":
+			l.space(bookTextLeading / 2)
+		default:
+			l.paragraph(b.Text, fontRegular, bookTextSize, bookTextLeading)
+		}
+	}
+	return start, nil
+}
+
+// writeBookCover adds the cover page: the book's title, centred, above the
+// number of chapters and the date it was compiled
+func writeBookCover(doc *pdfDocument, book *Page, chapters int) {
+	page := doc.addPage()
+	y := pdfPageHeight * 2 / 3
+	for _, line := range wrapText(book.Title, fontBold, 28, pdfPageWidth-2*pdfMargin) {
+		doc.text(page, fontBold, 28, (pdfPageWidth-textWidth(line, fontBold, 28))/2, y, line)
+		y -= 36
+	}
+	noun := "chapters"
+	if chapters == 1 {
+		noun = "chapter"
+	}
+	sub := fmt.Sprintf("%d %s · %s", chapters, noun, time.Now().Format("2 January 2006"))
+	doc.text(page, fontRegular, bookTOCSize, (pdfPageWidth-textWidth(sub, fontRegular, bookTOCSize))/2, y-bookTOCLeading, sub)
+}
+
+// writeBookContents adds the table of contents pages, listing each chapter
+// with the number of its first page and linking the line to it
+func writeBookContents(doc *pdfDocument, chapters []*Page, starts []int, offset, perPage int) {
+	width := pdfPageWidth - 2*pdfMargin
+	page := 0
+	var y float64
+	for i, p := range chapters {
+		if i%perPage == 0 {
+			page = doc.addPage()
+			y = pdfPageHeight - pdfMargin - bookChapterLeading
+			doc.text(page, fontBold, bookChapterSize, pdfMargin, y, "Contents")
+			y -= bookTOCLeading
+		}
+		y -= bookTOCLeading
+
+		target := offset + starts[i]
+		number := strconv.Itoa(target + 1)
+		numberWidth := textWidth(number, fontRegular, bookTOCSize)
+		title := fitText(p.Title, fontRegular, bookTOCSize, width-numberWidth-2*bookTOCSize)
+		doc.text(page, fontRegular, bookTOCSize, pdfMargin, y, title)
+		doc.text(page, fontRegular, bookTOCSize, pdfMargin+width-numberWidth, y, number)
+
+		// Dot leader between the title and the page number
+		from := pdfMargin + textWidth(title, fontRegular, bookTOCSize) + bookTOCSize/2
+		to := pdfMargin + width - numberWidth - bookTOCSize/2
+		if dots := int((to - from) / textWidth(". ", fontRegular, bookTOCSize)); dots > 0 {
+			leader := strings.Repeat(". ", dots)
+			doc.text(page, fontRegular, bookTOCSize, to-textWidth(leader, fontRegular, bookTOCSize), y, leader)
+		}
+		doc.Pages[page].links = append(doc.Pages[page].links, pdfLink{
+			X1: pdfMargin, Y1: y - bookTOCSize/3, X2: pdfMargin + width, Y2: y + bookTOCSize, Page: target,
+		})
+	}
+}
+
+// fitText shortens text with an ellipsis until it fits in width
+func fitText(text string, font pdfFont, size, width float64) string {
+	if textWidth(text, font, size) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 && textWidth(string(runes)+"…", font, size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "…"
+}
+
+// bookPDF loads a book and its chapters and compiles them into a PDF. It
+// fails with os.ErrNotExist when the page doesn't exist or isn't a book.
+func bookPDF(ctx context.Context, store PageStore, title string) ([]byte, error) {
+	book, err := store.Load(ctx, title)
+	if err != nil {
+		return nil, err
+	}
+	if !book.Meta.Book {
+		return nil, fmt.Errorf("%s is not a book, add \"book: true\" to its metadata: %w", title, os.ErrNotExist)
+	}
+	chapters, err := bookChapters(ctx, store, book)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeBookPDF(ctx, &buf, store, book, chapters); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// bookHandler downloads a book as a PDF
+func (s *Server) bookHandler(w http.ResponseWriter, r *http.Request, title string) {
+	data, err := bookPDF(r.Context(), s.readableBy(r), title)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, "Not a book: "+title, http.StatusNotFound)
+		return
+	case errors.Is(err, errEmptyBook):
+		http.Error(w, "Book "+title+" lists no existing pages", http.StatusNotFound)
+		return
+	case err != nil:
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+fileStem(title)+`.pdf"`)
+	w.Write(data)
+}
+
+// =============================================================================
+// PAGE PDF EXPORT
+// =============================================================================
+
+// pagePDF lays out a single page for print, as a chapter of a book would be,
+// with numbered pages
+func pagePDF(ctx context.Context, store PageStore, p *Page) ([]byte, error) {
+	doc := &pdfDocument{Title: p.Title}
+	if _, err := writeChapter(ctx, doc, store, p); err != nil {
+		return nil, err
+	}
+	numberPages(doc, 0)
+	var buf bytes.Buffer
+	if _, err := doc.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pdfHandler downloads a page as a PDF, for attaching to emails or
+// archiving, or its markup as a Markdown file with ?format=md
+func (s *Server) pdfHandler(w http.ResponseWriter, r *http.Request, title string) {
+	p, err := s.store.Load(r.Context(), title)
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "md":
+		w.Header().Set("Content-Type", mediaMarkdown+"; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+fileStem(title)+`.md"`)
+		w.Write(p.Body)
+		return
+	case "", "pdf":
+	default:
+		http.Error(w, "Unknown format "+format+": use pdf or md", http.StatusBadRequest)
+		return
+	}
+
+	data, err := pagePDF(r.Context(), s.readableBy(r), p)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+fileStem(title)+`.pdf"`)
+	w.Write(data)
+}
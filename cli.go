@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// COMMAND-LINE TOOLS
+// =============================================================================
+
+// cliCommand is a subcommand run instead of the server, as "wiki <name> [flags] [args]"
+type cliCommand struct {
+	usage string // Arguments following the flags
+	help  string
+	run   func(cfg Config, fs *flag.FlagSet, out io.Writer) int
+	flags func(fs *flag.FlagSet) // Defines command-specific flags, may be nil
+}
+
+// cliCommands lists the subcommands by name. They work directly on the data
+// directory, so they can be used from shell scripts and cron jobs whether or
+// not the server is running.
+var cliCommands map[string]*cliCommand
+
+func init() {
+	cliCommands = map[string]*cliCommand{
+		"doctor": {help: "check the environment the server would run in", run: doctorCommand},
+		"ls":     {help: "list pages", run: lsCommand, flags: lsFlags},
+		"cat":    {usage: "TITLE", help: "print a page, or one of its revisions", run: catCommand, flags: catFlags},
+		"grep":   {usage: "PATTERN [TITLE...]", help: "print page lines matching a regular expression", run: grepCommand, flags: grepFlags},
+		"epub":   {usage: "FILE", help: "compile pages into an EPUB book for e-readers", run: epubCommand, flags: epubFlags},
+		"book":   {usage: "TITLE FILE", help: "compile a book page and the pages it lists into a PDF", run: bookCommand},
+		"hugo":   {usage: "DIR", help: "write pages into the content directory of a Hugo site", run: hugoCommand, flags: hugoFlags},
+		"site":   {usage: "DIR", help: "render every page into a static HTML site for hosting without the server", run: siteCommand},
+		"remote": {usage: "get TITLE | put TITLE [FILE] | ls | search QUERY", help: "read and edit the pages of a running wiki through its HTTP API", run: remoteCommand, flags: remoteFlags},
+		"token":  {usage: "add NAME | ls | rm NAME", help: "issue, list and revoke API tokens", run: tokenCommand, flags: tokenFlags},
+		"user":   {usage: "add NAME | passwd NAME | ls | rm NAME", help: "add, list and remove the accounts users log in to", run: userCommand, flags: userFlags},
+		"watch":  {usage: "add EMAIL TITLE... | ls | rm EMAIL [TITLE...]", help: "subscribe email addresses to digests of changes to pages", run: watchCommand, flags: watchFlags},
+		"notify": {usage: "add NAME URL | ls | rm NAME", help: "post page changes to Slack or Discord webhooks", run: notifyCommand, flags: notifyFlags},
+		"import": {usage: "FORMAT SOURCE", help: "add the pages and files of another wiki's export (formats: " + strings.Join(importFormats(), ", ") + ")", run: importCommand, flags: importFlags},
+	}
+}
+
+// flagString, flagBool and flagInt return the value of a command-specific
+// flag, defined by the command's flags function
+func flagString(fs *flag.FlagSet, name string) string {
+	return fs.Lookup(name).Value.String()
+}
+
+func flagBool(fs *flag.FlagSet, name string) bool {
+	return fs.Lookup(name).Value.(flag.Getter).Get().(bool)
+}
+
+func flagInt(fs *flag.FlagSet, name string) int {
+	return fs.Lookup(name).Value.(flag.Getter).Get().(int)
+}
+
+// runCommand runs the named subcommand with its arguments and returns the process exit status
+func runCommand(name string, args []string) int {
+	cmd := cliCommands[name]
+	fs := flag.NewFlagSet("wiki "+name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: wiki %s [flags] %s\n\n%s.\n\nFlags:\n", name, cmd.usage, strings.ToUpper(cmd.help[:1])+cmd.help[1:])
+		fs.PrintDefaults()
+	}
+
+	cfg := DefaultConfig()
+	cfg.registerFlags(fs)
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Parse(args)
+	cfg, _, err := resolveConfig(fs, cfg)
+	if err != nil {
+		return commandError(name, err)
+	}
+	return cmd.run(cfg, fs, os.Stdout)
+}
+
+// commandError reports a failed subcommand on stderr and returns the exit status for it
+func commandError(name string, err error) int {
+	fmt.Fprintf(os.Stderr, "wiki %s: %v\n", name, err)
+	return 2
+}
+
+// doctorCommand checks the environment, failing when the server couldn't start
+func doctorCommand(cfg Config, fs *flag.FlagSet, out io.Writer) int {
+	if !runDoctor(cfg, out) {
+		return 1
+	}
+	return 0
+}
+
+// lsFlags defines the flags of the ls command
+func lsFlags(fs *flag.FlagSet) {
+	fs.Bool("l", false, "also print each page's size, last modification time and revision count")
+}
+
+// lsCommand prints the titles of all pages in alphabetical order
+func lsCommand(cfg Config, fs *flag.FlagSet, out io.Writer) int {
+	ctx := context.Background()
+	store, err := openStore(cfg)
+	if err != nil {
+		return commandError("ls", err)
+	}
+	titles, err := store.List(ctx)
+	if err != nil {
+		return commandError("ls", err)
+	}
+	sort.Strings(titles)
+
+	for _, title := range titles {
+		if !flagBool(fs, "l") {
+			fmt.Fprintln(out, title)
+			continue
+		}
+		p, err := store.Load(ctx, title)
+		if err != nil {
+			return commandError("ls", err)
+		}
+		revs, err := store.Revisions(ctx, title)
+		if err != nil {
+			return commandError("ls", err)
+		}
+		fmt.Fprintf(out, "%8d  %s  %4d  %s\n", len(p.Body), p.ModTime.Format(time.DateTime), len(revs), title)
+	}
+	return 0
+}
+
+// catFlags defines the flags of the cat command
+func catFlags(fs *flag.FlagSet) {
+	fs.Int("rev", 0, "print this revision instead of the current version")
+}
+
+// catCommand prints the body of a page
+func catCommand(cfg Config, fs *flag.FlagSet, out io.Writer) int {
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	title := fs.Arg(0)
+	ctx := context.Background()
+	store, err := openStore(cfg)
+	if err != nil {
+		return commandError("cat", err)
+	}
+
+	var body []byte
+	if rev := flagInt(fs, "rev"); rev > 0 {
+		var err error
+		if body, err = store.Revision(ctx, title, rev); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				err = errors.New(title + " has no revision " + strconv.Itoa(rev))
+			}
+			return commandError("cat", err)
+		}
+	} else {
+		p, err := store.Load(ctx, title)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				err = errors.New("no page named " + title)
+			}
+			return commandError("cat", err)
+		}
+		body = p.Body
+	}
+
+	out.Write(body)
+	if len(body) > 0 && body[len(body)-1] != '\n' {
+		fmt.Fprintln(out)
+	}
+	return 0
+}
+
+// grepFlags defines the flags of the grep command
+func grepFlags(fs *flag.FlagSet) {
+	fs.Bool("i", false, "match case-insensitively")
+	fs.Bool("l", false, "print only the titles of matching pages")
+}
+
+// grepCommand prints "Title:line:text" for every page line matching a regular
+// expression, searching all pages or only those named. Like grep, it exits
+// with status 1 when nothing matches.
+func grepCommand(cfg Config, fs *flag.FlagSet, out io.Writer) int {
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+	pattern := fs.Arg(0)
+	if flagBool(fs, "i") {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return commandError("grep", err)
+	}
+
+	ctx := context.Background()
+	store, err := openStore(cfg)
+	if err != nil {
+		return commandError("grep", err)
+	}
+	titles := fs.Args()[1:]
+	if len(titles) == 0 {
+		if titles, err = store.List(ctx); err != nil {
+			return commandError("grep", err)
+		}
+		sort.Strings(titles)
+	}
+
+	matched := false
+	for _, title := range titles {
+		p, err := store.Load(ctx, title)
+		if err != nil {
+			return commandError("grep", err)
+		}
+		for n, line := range strings.Split(string(p.Body), "\n") {
+			if !re.MatchString(line) {
+				continue
+			}
+			matched = true
+			if flagBool(fs, "l") {
+				fmt.Fprintln(out, title)
+				break
+			}
+			fmt.Fprintf(out, "%s:%d:%s\n", title, n+1, strings.TrimRight(line, "\r"))
+		}
+	}
+	if !matched {
+		return 1
+	}
+	return 0
+}
+
+// epubFlags defines the flags of the epub command
+func epubFlags(fs *flag.FlagSet) {
+	fs.String("namespace", "", "only include pages whose title starts with this")
+	fs.String("lang", "", "only include pages in this language")
+	fs.String("title", "", "title of the book (default the namespace, or Wiki)")
+}
+
+// epubCommand writes the selected pages as an EPUB book to a file, or to
+// standard output when the file is "-"
+func epubCommand(cfg Config, fs *flag.FlagSet, out io.Writer) int {
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	ctx := context.Background()
+	store, err := openStore(cfg)
+	if err != nil {
+		return commandError("epub", err)
+	}
+	sel := exportSelection{Namespace: flagString(fs, "namespace"), Lang: flagString(fs, "lang")}
+	pages, err := selectPages(ctx, store, sel, cfg.DefaultLang)
+	if err != nil {
+		return commandError("epub", err)
+	}
+	lang := sel.Lang
+	if lang == "" {
+		lang = cfg.DefaultLang
+	}
+
+	var buf bytes.Buffer
+	if err := writeEPUB(ctx, &buf, store, bookTitle(flagString(fs, "title"), sel), lang, pages); err != nil {
+		return commandError("epub", err)
+	}
+	if name := fs.Arg(0); name != "-" {
+		err = os.WriteFile(name, buf.Bytes(), 0644)
+	} else {
+		_, err = out.Write(buf.Bytes())
+	}
+	if err != nil {
+		return commandError("epub", err)
+	}
+	return 0
+}
+
+// bookCommand writes a book as a PDF to a file, or to standard output when
+// the file is "-"
+func bookCommand(cfg Config, fs *flag.FlagSet, out io.Writer) int {
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		return commandError("book", err)
+	}
+	data, err := bookPDF(context.Background(), store, fs.Arg(0))
+	if err != nil {
+		return commandError("book", err)
+	}
+	if name := fs.Arg(1); name != "-" {
+		err = os.WriteFile(name, data, 0644)
+	} else {
+		_, err = out.Write(data)
+	}
+	if err != nil {
+		return commandError("book", err)
+	}
+	return 0
+}
+
+// hugoFlags defines the flags of the hugo command
+func hugoFlags(fs *flag.FlagSet) {
+	fs.String("namespace", "", "only export pages whose title starts with this")
+}
+
+// hugoCommand exports pages as a Hugo site in a directory, creating it if needed
+func hugoCommand(cfg Config, fs *flag.FlagSet, out io.Writer) int {
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		return commandError("hugo", err)
+	}
+	res, err := exportHugo(context.Background(), store, cfg.DataDir, fs.Arg(0), flagString(fs, "namespace"), cfg.DefaultLang)
+	if err != nil {
+		return commandError("hugo", err)
+	}
+	fmt.Fprintf(out, "%d pages and %d attachments written to %s\n", res.Pages, res.Files, fs.Arg(0))
+	return 0
+}
+
+// siteCommand exports the wiki as a static site in a directory, creating it if needed
+func siteCommand(cfg Config, fs *flag.FlagSet, out io.Writer) int {
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		return commandError("site", err)
+	}
+	server, err := NewServer(cfg, store)
+	if err != nil {
+		return commandError("site", err)
+	}
+	defer server.Close()
+	res, err := server.exportSite(context.Background(), fs.Arg(0))
+	if err != nil {
+		return commandError("site", err)
+	}
+	fmt.Fprintf(out, "%d pages, %d redirects and %d attachments written to %s\n", res.Pages, res.Redirects, res.Files, fs.Arg(0))
+	return 0
+}
+
+// importFlags defines the flags of the import command
+func importFlags(fs *flag.FlagSet) {
+	fs.Bool("overwrite", false, "replace pages that already exist instead of skipping them")
+	fs.Bool("n", false, "only list the pages that would be imported")
+}
+
+// importCommand converts another wiki's export and adds its pages to the data directory
+func importCommand(cfg Config, fs *flag.FlagSet, out io.Writer) int {
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	imp, ok := importers[fs.Arg(0)]
+	if !ok {
+		return commandError("import", fmt.Errorf("unknown format %q, expected one of %s", fs.Arg(0), strings.Join(importFormats(), ", ")))
+	}
+	export, err := imp.read(fs.Arg(1))
+	if err != nil {
+		return commandError("import", err)
+	}
+	for _, reason := range export.Skipped {
+		fmt.Fprintf(out, "skipped %s\n", reason)
+	}
+
+	if flagBool(fs, "n") {
+		for _, p := range export.Pages {
+			fmt.Fprintln(out, p.Title)
+		}
+		for _, f := range export.Files {
+			fmt.Fprintf(out, "%s (attached to %s)\n", f.Name, f.Page)
+		}
+		return 0
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		return commandError("import", err)
+	}
+	res, err := importExport(context.Background(), store, cfg.DataDir, export, imp.name, flagBool(fs, "overwrite"))
+	fmt.Fprintf(out, "%d pages created, %d updated, %d skipped as existing; %d attachments\n", res.Created, res.Updated, res.Skipped, res.Files)
+	if err != nil {
+		return commandError("import", err)
+	}
+	return 0
+}
+
+// parseInterspersed parses flags mixed with positional arguments, returning the latter
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// remoteFlags defines the flags of the remote command
+func remoteFlags(fs *flag.FlagSet) {
+	server := os.Getenv("WIKI_SERVER")
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+	fs.String("server", server, "base URL of the wiki (env WIKI_SERVER)")
+	fs.String("token", os.Getenv("WIKI_API_TOKEN"), "API token of the wiki (env WIKI_API_TOKEN)")
+	fs.String("summary", "", "edit summary recorded by put")
+	fs.String("lang", "", "only search pages in this language")
+}
+
+// remoteCommand runs an operation on a wiki server: get prints a page, put
+// replaces one with the contents of a file or standard input, ls lists the
+// pages and search prints the pages matching a query. Flags may also follow
+// the operation and its arguments.
+func remoteCommand(cfg Config, fs *flag.FlagSet, out io.Writer) int {
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	op, args := fs.Arg(0), parseInterspersed(fs, fs.Args()[1:])
+	ctx := context.Background()
+	client := &remoteClient{server: flagString(fs, "server"), token: flagString(fs, "token")}
+
+	switch {
+	case op == "get" && len(args) == 1:
+		body, err := client.page(ctx, args[0])
+		if err != nil {
+			return commandError("remote", err)
+		}
+		io.WriteString(out, body)
+	case op == "put" && (len(args) == 1 || len(args) == 2):
+		var body []byte
+		var err error
+		if len(args) == 1 || args[1] == "-" {
+			body, err = io.ReadAll(os.Stdin)
+		} else {
+			body, err = os.ReadFile(args[1])
+		}
+		if err != nil {
+			return commandError("remote", err)
+		}
+		if _, err := client.putPage(ctx, args[0], string(body), flagString(fs, "summary")); err != nil {
+			return commandError("remote", err)
+		}
+	case op == "ls" && len(args) == 0:
+		pages, err := client.pages(ctx)
+		if err != nil {
+			return commandError("remote", err)
+		}
+		for _, p := range pages {
+			fmt.Fprintln(out, p.Title)
+		}
+	case op == "search" && len(args) > 0:
+		results, err := client.search(ctx, strings.Join(args, " "), flagString(fs, "lang"))
+		if err != nil {
+			return commandError("remote", err)
+		}
+		for _, res := range results {
+			fmt.Fprintf(out, "%s\t%s\n", res.Title, res.Snippet)
+		}
+		if len(results) == 0 {
+			return 1
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
+
+// tokenFlags defines the flags of the token command
+func tokenFlags(fs *flag.FlagSet) {
+	fs.String("scopes", scopeRead, "comma-separated scopes granted by an added token: "+strings.Join(apiScopes, ", "))
+	fs.Int("rate", 0, "requests per minute allowed to an added token (0 for no limit)")
+	fs.String("email", "", "address mentions of an added token's name are mailed to")
+}
+
+// tokenCommand manages the API tokens of the data directory: add issues one
+// and prints it, ls lists them and rm revokes one. A running server picks up
+// changes without restarting.
+func tokenCommand(cfg Config, fs *flag.FlagSet, out io.Writer) int {
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	op, args := fs.Arg(0), parseInterspersed(fs, fs.Args()[1:])
+
+	switch {
+	case op == "add" && len(args) == 1:
+		rate := flagInt(fs, "rate")
+		scopes, err := parseScopes(flagString(fs, "scopes"))
+		if err == nil && rate < 0 {
+			err = errors.New("-rate must not be negative")
+		}
+		if err != nil {
+			return commandError("token", err)
+		}
+		token, err := issueToken(cfg.DataDir, args[0], scopes, rate, flagString(fs, "email"))
+		if err != nil {
+			return commandError("token", err)
+		}
+		fmt.Fprintln(out, token)
+	case op == "ls" && len(args) == 0:
+		tokens, err := readTokens(cfg.DataDir)
+		if err != nil {
+			return commandError("token", err)
+		}
+		for _, t := range tokens {
+			rate := "unlimited"
+			if t.RateLimit > 0 {
+				rate = strconv.Itoa(t.RateLimit) + "/min"
+			}
+			fmt.Fprintf(out, "%-20s  %-16s  %-10s  %s  %s\n", t.Name, strings.Join(t.Scopes, ","), rate, t.Created.Local().Format(time.DateTime), t.Email)
+		}
+	case op == "rm" && len(args) == 1:
+		if err := revokeToken(cfg.DataDir, args[0]); err != nil {
+			return commandError("token", err)
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
+
+// userFlags defines the flags of the user command
+func userFlags(fs *flag.FlagSet) {
+	fs.String("scopes", scopeRead+","+scopeWrite, "comma-separated scopes granted to an added user: "+strings.Join(apiScopes, ", "))
+	fs.String("email", "", "address mentions of an added user are mailed to")
+}
+
+// userCommand manages the user accounts of the data directory: add creates
+// one and passwd changes its password, both reading the password from the
+// first line of standard input, ls lists the accounts and rm removes one.
+// Once accounts exist, editing pages requires logging in. A running server
+// picks up changes without restarting.
+func userCommand(cfg Config, fs *flag.FlagSet, out io.Writer) int {
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	op, args := fs.Arg(0), parseInterspersed(fs, fs.Args()[1:])
+
+	switch {
+	case (op == "add" || op == "passwd") && len(args) == 1:
+		var scopes []string
+		var err error
+		if op == "add" {
+			scopes, err = parseScopes(flagString(fs, "scopes"))
+		}
+		var password string
+		if err == nil {
+			password, err = readPassword(os.Stdin)
+		}
+		if err == nil && op == "add" {
+			err = addUser(cfg.DataDir, args[0], password, scopes, flagString(fs, "email"))
+		} else if err == nil {
+			err = changePassword(cfg.DataDir, args[0], password)
+		}
+		if err != nil {
+			return commandError("user", err)
+		}
+	case op == "ls" && len(args) == 0:
+		users, err := readUsers(cfg.DataDir)
+		if err != nil {
+			return commandError("user", err)
+		}
+		for _, u := range users {
+			fmt.Fprintf(out, "%-20s  %-16s  %s  %s\n", u.Name, strings.Join(u.Scopes, ","), u.Created.Local().Format(time.DateTime), u.Email)
+		}
+	case op == "rm" && len(args) == 1:
+		if err := removeUser(cfg.DataDir, args[0]); err != nil {
+			return commandError("user", err)
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
+
+// readPassword reads a password from the first line of in, prompting for it
+// on standard error
+func readPassword(in io.Reader) (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+		return "", errors.New("no password given on standard input")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// watchFlags defines the flags of the watch command
+func watchFlags(fs *flag.FlagSet) {
+	fs.String("digest", "daily", "how often an added watch is mailed a digest: daily or weekly")
+}
+
+// watchCommand manages who receives digests of changes: add subscribes an
+// address to pages, a title ending in * standing for every page starting with
+// it, ls lists the watches and rm removes pages from a watch, or the whole
+// watch when none are given. The server mails the digests.
+func watchCommand(cfg Config, fs *flag.FlagSet, out io.Writer) int {
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	op, args := fs.Arg(0), parseInterspersed(fs, fs.Args()[1:])
+
+	switch {
+	case op == "add" && len(args) >= 2:
+		if err := addWatch(cfg.DataDir, args[0], flagString(fs, "digest"), args[1:]); err != nil {
+			return commandError("watch", err)
+		}
+	case op == "ls" && len(args) == 0:
+		watches, err := readWatches(cfg.DataDir)
+		if err != nil {
+			return commandError("watch", err)
+		}
+		for _, w := range watches {
+			fmt.Fprintf(out, "%-30s  %-6s  %s\n", w.Email, w.Digest, strings.Join(w.Pages, " "))
+		}
+	case op == "rm" && len(args) >= 1:
+		if err := removeWatch(cfg.DataDir, args[0], args[1:]); err != nil {
+			return commandError("watch", err)
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
+
+// notifyFlags defines the flags of the notify command
+func notifyFlags(fs *flag.FlagSet) {
+	fs.String("kind", notifySlack, "service of an added webhook: "+notifySlack+" or "+notifyDiscord)
+	fs.String("namespace", "", "only post changes to pages whose titles start with this prefix")
+	fs.String("tag", "", "only post changes to pages with this tag")
+}
+
+// notifyCommand manages the chat webhooks told about page changes: add
+// registers one, ls lists them and rm removes one. A running server picks up
+// changes without restarting.
+func notifyCommand(cfg Config, fs *flag.FlagSet, out io.Writer) int {
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	op, args := fs.Arg(0), parseInterspersed(fs, fs.Args()[1:])
+
+	switch {
+	case op == "add" && len(args) == 2:
+		n := Notifier{Name: args[0], Kind: flagString(fs, "kind"), URL: args[1], Namespace: flagString(fs, "namespace"), Tag: flagString(fs, "tag")}
+		if err := addNotifier(cfg.DataDir, n); err != nil {
+			return commandError("notify", err)
+		}
+	case op == "ls" && len(args) == 0:
+		notifiers, err := readNotifiers(cfg.DataDir)
+		if err != nil {
+			return commandError("notify", err)
+		}
+		for _, n := range notifiers {
+			scope := "all pages"
+			if n.Namespace != "" {
+				scope = n.Namespace + "*"
+			}
+			if n.Tag != "" {
+				scope += " tagged " + n.Tag
+			}
+			fmt.Fprintf(out, "%-20s  %-7s  %-30s  %s\n", n.Name, n.Kind, scope, n.URL)
+		}
+	case op == "rm" && len(args) == 1:
+		if err := removeNotifier(cfg.DataDir, args[0]); err != nil {
+			return commandError("notify", err)
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =============================================================================
+// COMMENTS
+// =============================================================================
+
+// maxCommentBytes is the longest comment accepted
+const maxCommentBytes = 8 << 10
+
+// commentExcerptRunes is how much of a comment the activity stream quotes
+const commentExcerptRunes = 120
+
+// Comment is a remark left in the discussion below a page
+type Comment struct {
+	ID     string    `json:"id"`
+	Parent string    `json:"parent,omitempty"` // Comment this one replies to, empty for a new thread
+	Author string    `json:"author,omitempty"` // Empty for anonymous comments
+	Body   string    `json:"body"`
+	Time   time.Time `json:"time"`
+}
+
+// CommentEntry is a comment placed in the discussion, below the comment it
+// replies to
+type CommentEntry struct {
+	Comment
+	Depth int // Number of replies up to the start of the thread
+}
+
+// commentStore keeps the comments on each page in a JSON file below the
+// data directory, serializing changes so concurrent posts aren't lost
+type commentStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// newCommentStore returns the comments stored below the data directory
+func newCommentStore(dataDir string) *commentStore {
+	return &commentStore{dir: filepath.Join(dataDir, commentsDir)}
+}
+
+// path returns the file holding the comments on a page
+func (cs *commentStore) path(title string) string {
+	return filepath.Join(cs.dir, fileStem(title)+".json")
+}
+
+// load returns the comments on a page in the order they were posted
+func (cs *commentStore) load(title string) ([]Comment, error) {
+	data, err := os.ReadFile(cs.path(title))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var comments []Comment
+	if err := json.Unmarshal(data, &comments); err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+// store replaces the comments on a page, removing the file once none are left
+func (cs *commentStore) store(title string, comments []Comment) error {
+	if len(comments) == 0 {
+		if err := os.Remove(cs.path(title)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(comments, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cs.dir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(cs.path(title), data, 0644)
+}
+
+// add appends a comment to a page's discussion. Replies must answer a
+// comment still on the page.
+func (cs *commentStore) add(title string, c Comment) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	comments, err := cs.load(title)
+	if err != nil {
+		return err
+	}
+	if c.Parent != "" && !slices.ContainsFunc(comments, func(o Comment) bool { return o.ID == c.Parent }) {
+		return os.ErrNotExist
+	}
+	return cs.store(title, append(comments, c))
+}
+
+// remove deletes a comment and the replies below it, reporting false when
+// the page has no such comment
+func (cs *commentStore) remove(title, id string) (bool, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	comments, err := cs.load(title)
+	if err != nil {
+		return false, err
+	}
+	doomed := map[string]bool{id: true}
+	// Replies are always posted after what they answer, so one pass finds them all
+	kept := comments[:0]
+	for _, c := range comments {
+		if doomed[c.ID] || doomed[c.Parent] {
+			doomed[c.ID] = true
+			continue
+		}
+		kept = append(kept, c)
+	}
+	if len(kept) == len(comments) {
+		return false, nil
+	}
+	return true, cs.store(title, kept)
+}
+
+// rename moves a page's comments along with the page
+func (cs *commentStore) rename(from, to string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	err := os.Rename(cs.path(from), cs.path(to))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// discussion returns the comments on a page in threads, each comment followed
+// by the replies to it, oldest first. Replies whose comment is gone start
+// threads of their own.
+func (cs *commentStore) discussion(title string) ([]CommentEntry, error) {
+	comments, err := cs.load(title)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(comments, func(i, j int) bool { return comments[i].Time.Before(comments[j].Time) })
+	ids := make(map[string]bool, len(comments))
+	for _, c := range comments {
+		ids[c.ID] = true
+	}
+	replies := make(map[string][]Comment)
+	var roots []Comment
+	for _, c := range comments {
+		if c.Parent != "" && ids[c.Parent] {
+			replies[c.Parent] = append(replies[c.Parent], c)
+		} else {
+			roots = append(roots, c)
+		}
+	}
+	entries := make([]CommentEntry, 0, len(comments))
+	var walk func(list []Comment, depth int)
+	walk = func(list []Comment, depth int) {
+		for _, c := range list {
+			entries = append(entries, CommentEntry{Comment: c, Depth: depth})
+			walk(replies[c.ID], depth+1)
+		}
+	}
+	walk(roots, 0)
+	return entries, nil
+}
+
+// commentExcerpt shortens a comment for the activity stream
+func commentExcerpt(body string) string {
+	body = strings.Join(strings.Fields(body), " ")
+	if r := []rune(body); len(r) > commentExcerptRunes {
+		return string(r[:commentExcerptRunes]) + "…"
+	}
+	return body
+}
+
+// commentHandler posts a comment, or a reply when parent names another
+// comment, to the discussion below a page. Administrators moderate the
+// discussion by posting action=delete with the id of a comment to remove,
+// which removes the replies to it as well.
+func (s *Server) commentHandler(w http.ResponseWriter, r *http.Request, title string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	actor := s.tokenName(r)
+
+	if r.FormValue("action") == "delete" {
+		if !s.hasScope(r, scopeAdmin) {
+			http.Error(w, "Only administrators may delete comments", http.StatusForbidden)
+			return
+		}
+		id := r.FormValue("id")
+		removed, err := s.comments.remove(title, id)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if !removed {
+			http.NotFound(w, r)
+			return
+		}
+		slog.Info("Comment deleted", "by", actor, "comment", id, "title", title)
+		http.Redirect(w, r, "/view/"+titleURL(title)+"#comments", http.StatusSeeOther)
+		return
+	}
+
+	// Comments can't be held for review, so those that would need it are refused
+	if s.needsReview(r) {
+		http.Error(w, "Your edits are held for review, which comments can't be, so you can't comment", http.StatusForbidden)
+		return
+	}
+	body := strings.TrimSpace(strings.ReplaceAll(r.FormValue("body"), "\r\n", "\n"))
+	if body == "" {
+		http.Error(w, "The comment is empty", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxCommentBytes {
+		http.Error(w, "The comment is too long", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !s.store.Exists(r.Context(), title) {
+		http.NotFound(w, r)
+		return
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	c := Comment{
+		ID:     hex.EncodeToString(id),
+		Parent: r.FormValue("parent"),
+		Author: actor,
+		Body:   body,
+		Time:   time.Now().UTC(),
+	}
+	if err := s.comments.add(title, c); errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "The comment replied to has been deleted", http.StatusConflict)
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	s.audit.record(AuditEvent{Type: eventComment, Title: title, Actor: actor, Detail: commentExcerpt(body)})
+	http.Redirect(w, r, "/view/"+titleURL(title)+"#comment-"+c.ID, http.StatusSeeOther)
+}
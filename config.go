@@ -0,0 +1,373 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// CONFIGURATION
+// =============================================================================
+
+// Default locations, relative to the working directory
+const (
+	savePath     = "data"      // Directory where wiki pages are stored
+	templatePath = "templates" // Directory containing HTML templates, read from disk in development mode
+	staticPath   = "static"    // Directory containing static files, served from disk in development mode
+)
+
+// Config holds settings supplied on the command line or through the environment
+type Config struct {
+	ConfigFile string // File of settings applied beneath the command-line flags, reread on reload
+
+	DataDir     string // Directory holding pages, revisions and other wiki data
+	TemplateDir string // Directory containing the HTML templates; empty uses the ones built into the binary
+	StaticDir   string // Directory containing the stylesheet and other static files; empty uses the built-in ones
+	Dev         bool   // Whether templates are parsed again for every request, so edits show without a reload
+
+	// S3-compatible bucket holding pages and revisions in place of the data
+	// directory, which still holds the other wiki data
+	S3Bucket    string // Bucket name, empty to keep pages in the data directory
+	S3Prefix    string // Key prefix the wiki's objects are stored under, empty for the top of the bucket
+	S3Endpoint  string // Base URL of the object store; empty uses AWS in S3Region
+	S3Region    string // Region requests are signed for
+	S3AccessKey string // Access key ID signing requests
+	S3SecretKey string // Secret access key signing requests
+
+	// Git repository the data directory is kept in, committing every save
+	Git       bool   // Whether page history is kept as git commits instead of revision files
+	GitRemote string // Remote commits are pushed to as they are made, empty to keep them local
+
+	Addr string // TCP address the HTTP server listens on
+
+	// HTTPS, with a certificate from files or obtained from Let's Encrypt
+	TLSCert       string // Certificate file, PEM encoded with any intermediates; empty serves plain HTTP
+	TLSKey        string // Private key file of TLSCert
+	Autocert      string // Comma-separated host names to obtain certificates for, instead of TLSCert
+	AutocertCache string // Directory caching obtained certificates; empty uses .autocert in the data directory
+	AutocertEmail string // Contact address given to Let's Encrypt for expiry notices, optional
+	RedirectAddr  string // TCP address of a plain HTTP listener redirecting to HTTPS, such as :80; empty for none
+
+	// HTTP server limits protecting against slow and hung clients; a zero timeout means no limit
+	ReadHeaderTimeout time.Duration // Time allowed to read request headers
+	ReadTimeout       time.Duration // Time allowed to read an entire request, including the body
+	WriteTimeout      time.Duration // Time allowed to write a response, from the end of the request headers
+	IdleTimeout       time.Duration // Time a keep-alive connection may wait for its next request
+	MaxHeaderBytes    int           // Largest accepted request header size
+
+	RequestTimeout time.Duration // Time after which a request's storage and rendering work is abandoned, 0 for no limit
+
+	LogTarget   string        // Where the log goes: stderr, file, syslog or journald; empty picks file when LogFile is set
+	LogFile     string        // File receiving the log for the file target
+	LogMaxSize  int64         // Size in bytes at which the log file is rotated, 0 to never rotate
+	LogMaxAge   time.Duration // How long rotated log files are kept, 0 to keep them forever
+	LogCompress bool          // Whether rotated log files are gzipped
+	LogFormat   string        // Format of log entries: text or json
+	LogLevel    string        // Least severe level logged: debug, info, warn or error
+
+	AdminToken string // Token required by admin endpoints, which are disabled when empty
+	APIToken   string // Token granting the read and write API scopes, besides tokens issued with the token command
+
+	DiskAlertBytes   int64  // Data directory size that triggers a disk usage alert, 0 to disable
+	DiskAlertWebhook string // URL receiving a JSON POST when the disk alert fires
+
+	TrashRetention time.Duration // How long deleted pages stay in the trash, 0 to keep them forever
+
+	MaxUploadBytes int64 // Largest file that may be attached to a page
+
+	EditRate  int // Requests a minute each client address may make to edit and save pages, 0 for no limit
+	EditBurst int // Requests to edit and save pages a client may make at once before EditRate applies
+
+	ReviewEdits       bool   // Whether edits without a token allowed to write are held for review
+	ModerateAnonymous bool   // Whether edits without any token are held for editors to moderate
+	ReviewWebhook     string // URL receiving a JSON POST for each edit held for review
+	ReadOnly          bool   // Whether pages can't be changed, for public mirrors and maintenance windows
+
+	DefaultLang string // Language of pages that don't declare one
+
+	EmojiFile string // JSON file mapping extra emoji shortcodes to emoji, empty for the built-in ones only
+
+	SummaryURL   string // OpenAI-compatible chat completions endpoint generating page summaries, empty to disable them
+	SummaryKey   string // Bearer token sent to SummaryURL
+	SummaryModel string // Model named in summary requests
+
+	EmbeddingURL   string // OpenAI-compatible embeddings endpoint for semantic search, empty to disable it
+	EmbeddingKey   string // Bearer token sent to EmbeddingURL
+	EmbeddingModel string // Model named in embedding requests
+
+	SMTPAddr     string // host:port of the SMTP server mailing digests, empty to disable them
+	SMTPFrom     string // Sender address of digests
+	SMTPUser     string // User authenticating with the SMTP server, empty to send without authenticating
+	SMTPPassword string // Password of SMTPUser
+	PublicURL    string // URL readers reach the wiki at, used for links in notifications
+
+	GitHubRepo     string        // Repository pages are synced with, as owner/name; empty to disable the sync
+	GitHubToken    string        // Token authorizing the sync to read and write the repository
+	GitHubBranch   string        // Branch pages are synced with
+	GitHubDir      string        // Directory of the page files in the repository, empty for the top level
+	GitHubAPI      string        // Base URL of the GitHub API
+	GitHubInterval time.Duration // How often commits made on GitHub are pulled
+}
+
+// DefaultConfig returns the configuration used when no flags are given: the
+// built-in defaults, with the data directory, template directory and port
+// taken from the environment when set there
+func DefaultConfig() Config {
+	cfg := Config{
+		DataDir:        savePath,
+		S3Region:       "us-east-1",
+		Addr:           ":8080",
+		RequestTimeout: 30 * time.Second,
+
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    1 << 20,
+
+		LogMaxSize:  100 << 20,
+		LogMaxAge:   30 * 24 * time.Hour,
+		LogCompress: true,
+		LogFormat:   logFormatText,
+		LogLevel:    "info",
+
+		TrashRetention: 30 * 24 * time.Hour,
+
+		MaxUploadBytes: 10 << 20,
+
+		EditRate:  30,
+		EditBurst: 10,
+
+		DefaultLang: "en",
+
+		GitHubBranch:   "main",
+		GitHubAPI:      "https://api.github.com",
+		GitHubInterval: time.Minute,
+	}
+	if dir := os.Getenv("WIKI_DATA_DIR"); dir != "" {
+		cfg.DataDir = dir
+	}
+	if dir := os.Getenv("WIKI_TEMPLATE_DIR"); dir != "" {
+		cfg.TemplateDir = dir
+	}
+	if dir := os.Getenv("WIKI_STATIC_DIR"); dir != "" {
+		cfg.StaticDir = dir
+	}
+	if port := os.Getenv("WIKI_PORT"); port != "" {
+		cfg.Addr = ":" + port
+	}
+	if readOnly, err := strconv.ParseBool(os.Getenv("WIKI_READONLY")); err == nil {
+		cfg.ReadOnly = readOnly
+	}
+	return cfg
+}
+
+// loadConfig parses command-line flags on top of the defaults and the config
+// file, returning the configuration and the source to reload it from
+func loadConfig() (Config, *configSource, error) {
+	cfg := DefaultConfig()
+	cfg.registerFlags(flag.CommandLine)
+	flag.Parse()
+	return resolveConfig(flag.CommandLine, cfg)
+}
+
+// resolveConfig applies the config file named on the command line, if any,
+// beneath the flags set on fs
+func resolveConfig(fs *flag.FlagSet, cfg Config) (Config, *configSource, error) {
+	src := newConfigSource(fs, cfg.ConfigFile)
+	if cfg.ConfigFile == "" {
+		return cfg, src, nil
+	}
+	cfg, err := src.load()
+	return cfg, src, err
+}
+
+// configSource rebuilds the configuration from the defaults, the config file
+// and the command-line flags, in increasing order of precedence
+type configSource struct {
+	file  string
+	flags map[string]string // Values of the flags set on the command line
+}
+
+// newConfigSource records the flags set on fs so they keep overriding the config file on reload
+func newConfigSource(fs *flag.FlagSet, file string) *configSource {
+	src := &configSource{file: file, flags: make(map[string]string)}
+	fs.Visit(func(f *flag.Flag) {
+		src.flags[f.Name] = f.Value.String()
+	})
+	return src
+}
+
+// load reads the config file and returns the resulting configuration
+func (src *configSource) load() (Config, error) {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	cfg.registerFlags(fs)
+
+	if src.file != "" {
+		if err := applyConfigFile(fs, src.file); err != nil {
+			return Config{}, err
+		}
+	}
+	for name, value := range src.flags {
+		if fs.Lookup(name) != nil { // Skip flags of subcommands
+			fs.Set(name, value)
+		}
+	}
+	return cfg, nil
+}
+
+// applyConfigFile sets flags from a file of "name = value" lines, where name
+// is a command-line flag without its dash. Blank lines and lines starting with
+// # are ignored.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" {
+			return fmt.Errorf("%s:%d: want name = value", path, n+1)
+		}
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, n+1, name)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n+1, err)
+		}
+	}
+	return nil
+}
+
+// registerFlags defines a flag for every setting on fs, defaulting to the
+// current values. Environment variables provide defaults for secrets so they
+// don't have to appear in the process list.
+func (cfg *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.ConfigFile, "config", cfg.ConfigFile,
+		"file of name = value settings named like these flags; flags take precedence and SIGHUP rereads it")
+	fs.StringVar(&cfg.DataDir, "data", cfg.DataDir, "directory holding pages, revisions and other wiki data (env WIKI_DATA_DIR)")
+	fs.StringVar(&cfg.TemplateDir, "templates", cfg.TemplateDir,
+		"directory containing the HTML templates, replacing the built-in ones (env WIKI_TEMPLATE_DIR)")
+	fs.StringVar(&cfg.StaticDir, "static", cfg.StaticDir,
+		"directory containing the stylesheet and other static files, replacing the built-in ones (env WIKI_STATIC_DIR)")
+	fs.StringVar(&cfg.S3Bucket, "s3-bucket", cfg.S3Bucket,
+		"S3-compatible bucket to keep pages and revisions in instead of the data directory; -data must then be set to persistent storage, as it still holds accounts, tokens, attachments, comments and other data")
+	fs.StringVar(&cfg.S3Prefix, "s3-prefix", cfg.S3Prefix, "key prefix of the objects in -s3-bucket, such as wiki/ (default the top of the bucket)")
+	fs.StringVar(&cfg.S3Endpoint, "s3-endpoint", cfg.S3Endpoint,
+		"base URL of an S3-compatible object store, such as http://minio:9000 (default AWS S3 in -s3-region); buckets are addressed by path")
+	fs.StringVar(&cfg.S3Region, "s3-region", cfg.S3Region, "region of -s3-bucket, which requests are signed for")
+	fs.StringVar(&cfg.S3AccessKey, "s3-access-key", os.Getenv("AWS_ACCESS_KEY_ID"),
+		"access key ID for -s3-bucket (env AWS_ACCESS_KEY_ID, with AWS_SESSION_TOKEN for temporary credentials)")
+	fs.StringVar(&cfg.S3SecretKey, "s3-secret-key", os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		"secret access key for -s3-bucket (env AWS_SECRET_ACCESS_KEY)")
+	fs.BoolVar(&cfg.Git, "git", cfg.Git,
+		"keep the data directory in a git repository, committing every save with its author and summary, instead of keeping revisions in .history")
+	fs.StringVar(&cfg.GitRemote, "git-remote", cfg.GitRemote, "git remote name or URL to push commits to as they are made, with -git")
+	fs.BoolVar(&cfg.Dev, "dev", cfg.Dev,
+		"development mode: parse the templates again for every request, so edits to them show without a restart; templates and static files default to the directories in the working directory")
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "TCP address to listen on; env WIKI_PORT sets the port on all interfaces")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert,
+		"PEM certificate file, with intermediates, to serve HTTPS with; reread when it changes on disk")
+	fs.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "private key file of -tls-cert")
+	fs.StringVar(&cfg.Autocert, "autocert", cfg.Autocert,
+		"comma-separated host names to serve HTTPS for with certificates obtained from Let's Encrypt, accepting its terms of service; the wiki must be reachable on port 443, or on port 80 through -redirect-addr")
+	fs.StringVar(&cfg.AutocertCache, "autocert-cache", cfg.AutocertCache,
+		"directory caching the certificates obtained with -autocert (default .autocert in the data directory)")
+	fs.StringVar(&cfg.AutocertEmail, "autocert-email", cfg.AutocertEmail, "contact address given to Let's Encrypt for certificate expiry notices")
+	fs.StringVar(&cfg.RedirectAddr, "redirect-addr", cfg.RedirectAddr,
+		"TCP address of a plain HTTP listener redirecting to HTTPS, such as :80, which also answers -autocert challenges")
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", cfg.ReadHeaderTimeout,
+		"time allowed to read request headers (0 disables)")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", cfg.ReadTimeout,
+		"time allowed to read an entire request including its body (0 disables)")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", cfg.WriteTimeout,
+		"time allowed to write a response (0 disables); book, PDF and EPUB exports get at least 5m")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout,
+		"how long idle keep-alive connections are kept open (0 uses -read-timeout)")
+	fs.IntVar(&cfg.MaxHeaderBytes, "max-header-bytes", cfg.MaxHeaderBytes,
+		"largest request header accepted, in bytes")
+	fs.DurationVar(&cfg.RequestTimeout, "request-timeout", cfg.RequestTimeout,
+		"abandon a request's storage, search and rendering work after this long (0 disables); book, PDF and EPUB exports get at least 5m")
+	fs.StringVar(&cfg.LogTarget, "log-target", cfg.LogTarget,
+		"where to log: stderr, file, syslog or journald (default file when -log-file is set, stderr otherwise)")
+	fs.StringVar(&cfg.LogFile, "log-file", cfg.LogFile,
+		"write the log to this file instead of stderr; SIGUSR1 reopens it")
+	fs.Int64Var(&cfg.LogMaxSize, "log-max-size", cfg.LogMaxSize,
+		"rotate the log file once it reaches this many bytes (0 disables)")
+	fs.DurationVar(&cfg.LogMaxAge, "log-max-age", cfg.LogMaxAge,
+		"delete rotated log files older than this (0 keeps them forever)")
+	fs.BoolVar(&cfg.LogCompress, "log-compress", cfg.LogCompress,
+		"gzip rotated log files")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat,
+		"format of log entries: text (key=value pairs) or json")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel,
+		"least severe level logged: debug, info, warn or error; debug includes requests for static files")
+	fs.StringVar(&cfg.AdminToken, "admin-token", os.Getenv("WIKI_ADMIN_TOKEN"),
+		"token required by admin endpoints (env WIKI_ADMIN_TOKEN); admin endpoints are disabled when empty")
+	fs.StringVar(&cfg.APIToken, "api-token", os.Getenv("WIKI_API_TOKEN"),
+		"token allowed to read and change pages through the API (env WIKI_API_TOKEN); anyone may change them when neither this nor issued tokens exist")
+	fs.Int64Var(&cfg.DiskAlertBytes, "disk-alert-bytes", cfg.DiskAlertBytes,
+		"alert when the data directory grows beyond this many bytes (0 disables)")
+	fs.StringVar(&cfg.DiskAlertWebhook, "disk-alert-webhook", os.Getenv("WIKI_DISK_ALERT_WEBHOOK"),
+		"URL to POST a JSON alert to when disk usage exceeds -disk-alert-bytes (env WIKI_DISK_ALERT_WEBHOOK)")
+	fs.DurationVar(&cfg.TrashRetention, "trash-retention", cfg.TrashRetention,
+		"how long deleted pages are kept in the trash before being purged (0 keeps them forever)")
+	fs.Int64Var(&cfg.MaxUploadBytes, "max-upload-bytes", cfg.MaxUploadBytes,
+		"largest file that may be attached to a page, in bytes")
+	fs.IntVar(&cfg.EditRate, "edit-rate", cfg.EditRate,
+		"requests a minute each client address may make to edit and save pages, answered with 429 beyond that (0 disables)")
+	fs.IntVar(&cfg.EditBurst, "edit-burst", cfg.EditBurst,
+		"requests to edit and save pages a client address may make in a burst before -edit-rate applies")
+	fs.BoolVar(&cfg.ReviewEdits, "review-edits", cfg.ReviewEdits,
+		"hold edits made without a token granting the write scope until a token with the review scope approves them at /review")
+	fs.BoolVar(&cfg.ModerateAnonymous, "moderate-anonymous", cfg.ModerateAnonymous,
+		"hold edits made without a token until a token with the write or review scope approves them at /review")
+	fs.BoolVar(&cfg.ReadOnly, "readonly", cfg.ReadOnly,
+		"refuse every change to pages and hide the links to make them, pausing the GitHub sync and trash purging, for public mirrors and maintenance windows (env WIKI_READONLY)")
+	fs.StringVar(&cfg.ReviewWebhook, "review-webhook", os.Getenv("WIKI_REVIEW_WEBHOOK"),
+		"URL to POST a JSON notification to for each edit held for review (env WIKI_REVIEW_WEBHOOK)")
+	fs.StringVar(&cfg.SMTPAddr, "smtp-addr", cfg.SMTPAddr,
+		"host:port of the SMTP server mailing digests of changes to watched pages; digests are disabled when empty")
+	fs.StringVar(&cfg.SMTPFrom, "smtp-from", cfg.SMTPFrom,
+		"sender address of digest emails")
+	fs.StringVar(&cfg.SMTPUser, "smtp-user", cfg.SMTPUser,
+		"user authenticating with -smtp-addr, which is used without authentication when empty")
+	fs.StringVar(&cfg.SMTPPassword, "smtp-password", os.Getenv("WIKI_SMTP_PASSWORD"),
+		"password of -smtp-user (env WIKI_SMTP_PASSWORD)")
+	fs.StringVar(&cfg.PublicURL, "public-url", cfg.PublicURL,
+		"URL readers reach the wiki at, such as https://wiki.example.com, for links in notifications")
+	fs.StringVar(&cfg.DefaultLang, "default-lang", cfg.DefaultLang,
+		"language tag of pages that don't declare one, such as en or pt-BR")
+	fs.StringVar(&cfg.EmojiFile, "emoji-file", cfg.EmojiFile,
+		`JSON file mapping extra :shortcode: names to emoji, such as {"shipit": "🐿️"}; its shortcodes replace built-in ones of the same name`)
+	fs.StringVar(&cfg.SummaryURL, "summary-url", cfg.SummaryURL,
+		"OpenAI-compatible chat completions URL used to summarize pages when they change; summaries are disabled when empty")
+	fs.StringVar(&cfg.SummaryKey, "summary-key", os.Getenv("WIKI_SUMMARY_KEY"),
+		"API key sent to -summary-url (env WIKI_SUMMARY_KEY)")
+	fs.StringVar(&cfg.SummaryModel, "summary-model", cfg.SummaryModel,
+		"model named in summary requests")
+	fs.StringVar(&cfg.EmbeddingURL, "embedding-url", cfg.EmbeddingURL,
+		"OpenAI-compatible embeddings URL used for semantic search; semantic search is disabled when empty")
+	fs.StringVar(&cfg.EmbeddingKey, "embedding-key", os.Getenv("WIKI_EMBEDDING_KEY"),
+		"API key sent to -embedding-url (env WIKI_EMBEDDING_KEY)")
+	fs.StringVar(&cfg.EmbeddingModel, "embedding-model", cfg.EmbeddingModel,
+		"model named in embedding requests")
+	fs.StringVar(&cfg.GitHubRepo, "github-repo", cfg.GitHubRepo,
+		"GitHub repository, as owner/name, that page changes are pushed to and commits are pulled from; the sync is disabled when empty")
+	fs.StringVar(&cfg.GitHubToken, "github-token", os.Getenv("WIKI_GITHUB_TOKEN"),
+		"token with write access to the contents and pull requests of -github-repo (env WIKI_GITHUB_TOKEN)")
+	fs.StringVar(&cfg.GitHubBranch, "github-branch", cfg.GitHubBranch, "branch of -github-repo that pages are synced with")
+	fs.StringVar(&cfg.GitHubDir, "github-dir", cfg.GitHubDir, "directory of -github-repo holding the page files (default the top level)")
+	fs.StringVar(&cfg.GitHubAPI, "github-api", cfg.GitHubAPI, "base URL of the GitHub API, for GitHub Enterprise servers")
+	fs.DurationVar(&cfg.GitHubInterval, "github-interval", cfg.GitHubInterval, "how often to pull commits made on GitHub")
+}
@@ -0,0 +1,721 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// CONFLUENCE IMPORT
+// =============================================================================
+
+// confluencePage is a page read from a Confluence space export
+type confluencePage struct {
+	ID       string
+	Title    string
+	Parent   string // ID of the parent page, empty at the top of the tree
+	Content  *xmlNode
+	Modified time.Time
+}
+
+// confluenceAttachment is a file attached to a page in a Confluence space export
+type confluenceAttachment struct {
+	Page string // ID of the page it is attached to
+	Name string
+	Path string // Location in the export
+	Ref  string // Path pages of an HTML export refer to it by, empty for XML exports
+}
+
+// confluenceSpace is the content of a space export
+type confluenceSpace struct {
+	Pages       []*confluencePage
+	Attachments []confluenceAttachment
+}
+
+// readConfluence reads a Confluence space export, either the XML export with
+// its entities.xml or the HTML export, as a zip file or unpacked into a
+// directory. The page tree is kept in the titles: a page's title is prefixed
+// with its parent's, except below the top-level pages, so a Laptop page under
+// Onboarding becomes OnboardingLaptop. Attachments are attached to their pages.
+func readConfluence(src string) (*wikiExport, error) {
+	var fsys fs.FS
+	if info, err := os.Stat(src); err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		fsys = os.DirFS(src)
+	} else {
+		zr, err := zip.OpenReader(src)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a directory or zip file: %w", src, err)
+		}
+		defer zr.Close()
+		fsys = zr
+	}
+
+	// Exports are usually wrapped in a directory named after the space
+	root := "."
+	if entries, err := fs.ReadDir(fsys, "."); err == nil && len(entries) == 1 && entries[0].IsDir() {
+		root = entries[0].Name()
+	}
+
+	var space *confluenceSpace
+	var err error
+	if _, statErr := fs.Stat(fsys, path.Join(root, "entities.xml")); statErr == nil {
+		space, err = readConfluenceXML(fsys, root)
+	} else {
+		space, err = readConfluenceHTML(fsys, root)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return convertConfluence(fsys, space)
+}
+
+// convertConfluence assigns titles to the pages of a space and converts their content
+func convertConfluence(fsys fs.FS, space *confluenceSpace) (*wikiExport, error) {
+	byID := make(map[string]*confluencePage)
+	for _, p := range space.Pages {
+		byID[p.ID] = p
+	}
+	sort.Slice(space.Pages, func(i, j int) bool { return space.Pages[i].Title < space.Pages[j].Title })
+
+	conv := &confluenceConverter{pages: make(map[string]string), originals: make(map[string]string), refs: make(map[string]string)}
+	ids := make(map[string]string) // Page ID to title
+	used := make(map[string]bool)
+	visiting := make(map[string]bool) // Guards against cycles in broken exports
+	var assign func(p *confluencePage) string
+	assign = func(p *confluencePage) string {
+		if t, ok := ids[p.ID]; ok {
+			return t
+		}
+		visiting[p.ID] = true
+		prefix := ""
+		if parent, ok := byID[p.Parent]; ok && !visiting[parent.ID] {
+			if _, grand := byID[parent.Parent]; grand {
+				prefix = assign(parent)
+			}
+		}
+		words := titleWords(p.Title)
+		if prefix == "" && words == "" {
+			words = "Page"
+		}
+		ids[p.ID] = uniqueTitle(prefix+words, used)
+		return ids[p.ID]
+	}
+	for _, p := range space.Pages {
+		conv.pages[p.Title] = assign(p)
+		conv.originals[ids[p.ID]] = p.Title
+		conv.refs[p.ID] = ids[p.ID] // HTML exports link to page files
+	}
+
+	export := &wikiExport{}
+	for _, a := range space.Attachments {
+		owner, ok := ids[a.Page]
+		if !ok {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, a.Path)
+		if err != nil {
+			return nil, err
+		}
+		name := attachmentName(a.Name)
+		export.Files = append(export.Files, importedFile{Page: owner, Name: name, Data: data})
+		if a.Ref != "" {
+			conv.refs[a.Ref] = attachmentURL(owner, name)
+		}
+	}
+	for _, p := range space.Pages {
+		export.Pages = append(export.Pages, importedPage{
+			Title:    ids[p.ID],
+			Body:     conv.convert(p.Content, ids[p.ID]),
+			Modified: p.Modified,
+		})
+	}
+	return export, nil
+}
+
+// =============================================================================
+// CONFLUENCE XML EXPORT
+// =============================================================================
+
+// confluenceObject is an object of entities.xml, a dump of Confluence's database
+type confluenceObject struct {
+	Class      string `xml:"class,attr"`
+	ID         string `xml:"id"`
+	Properties []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:",chardata"`
+		ID    string `xml:"id"` // Set for references to other objects
+	} `xml:"property"`
+}
+
+// property returns the value of a property, or the ID of the object it refers to
+func (o *confluenceObject) property(name string) string {
+	for _, p := range o.Properties {
+		if p.Name == name {
+			if p.ID != "" {
+				return strings.TrimSpace(p.ID)
+			}
+			return p.Value
+		}
+	}
+	return ""
+}
+
+// readConfluenceXML reads the current version of every page of an XML
+// export, with their bodies in Confluence's storage format, and the latest
+// version of every attachment
+func readConfluenceXML(fsys fs.FS, root string) (*confluenceSpace, error) {
+	f, err := fsys.Open(path.Join(root, "entities.xml"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pages := make(map[string]*confluencePage)
+	bodies := make(map[string]string) // Page ID to storage format body
+	latest := make(map[string]int)    // Attachment ID to latest version
+	var attachments []confluenceAttachment
+	dec := xml.NewDecoder(f)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading entities.xml: %w", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "object" {
+			continue
+		}
+		var obj confluenceObject
+		if err := dec.DecodeElement(&obj, &start); err != nil {
+			return nil, fmt.Errorf("reading entities.xml: %w", err)
+		}
+		id := strings.TrimSpace(obj.ID)
+		// Earlier versions of pages and attachments refer to their current version
+		historical := obj.property("originalVersion") != "" || obj.property("contentStatus") != "" && obj.property("contentStatus") != "current"
+
+		switch obj.Class {
+		case "Page":
+			if historical {
+				continue
+			}
+			modified, _ := time.Parse("2006-01-02 15:04:05.000", obj.property("lastModificationDate"))
+			pages[id] = &confluencePage{ID: id, Title: obj.property("title"), Parent: obj.property("parent"), Modified: modified}
+		case "BodyContent":
+			bodies[obj.property("content")] = obj.property("body")
+		case "Attachment":
+			if historical {
+				continue
+			}
+			version, _ := strconv.Atoi(obj.property("version"))
+			latest[id] = version
+			page := obj.property("containerContent")
+			if page == "" {
+				page = obj.property("content") // Older exports
+			}
+			attachments = append(attachments, confluenceAttachment{Page: page, Name: obj.property("title"), Path: id})
+		}
+	}
+
+	space := &confluenceSpace{}
+	for id, p := range pages {
+		p.Content = parseMarkup(bodies[id], false)
+		space.Pages = append(space.Pages, p)
+	}
+	for _, a := range attachments {
+		// Files are stored as attachments/PAGE/ATTACHMENT/VERSION, or without
+		// the version directory in older exports
+		dir := path.Join(root, "attachments", a.Page, a.Path)
+		a.Path = path.Join(dir, strconv.Itoa(latest[a.Path]))
+		if info, err := fs.Stat(fsys, dir); err == nil && !info.IsDir() {
+			a.Path = dir
+		}
+		if _, err := fs.Stat(fsys, a.Path); err == nil {
+			space.Attachments = append(space.Attachments, a)
+		}
+	}
+	return space, nil
+}
+
+// =============================================================================
+// CONFLUENCE HTML EXPORT
+// =============================================================================
+
+// Regular expressions reading the pages of an HTML export
+var (
+	confluencePageFile = regexp.MustCompile(`(?:^|_)(\d+)\.html$`)
+	confluenceModified = regexp.MustCompile(`last (?:modified|updated)(?: by .*?)? on ([A-Z][a-z]{2} \d{1,2}, \d{4})`)
+	htmlScript         = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)>`)
+)
+
+// readConfluenceHTML reads the pages of an HTML export, one file per page with
+// the ancestors in its breadcrumbs, and the files below its attachments directory
+func readConfluenceHTML(fsys fs.FS, root string) (*confluenceSpace, error) {
+	entries, err := fs.ReadDir(fsys, root)
+	if err != nil {
+		return nil, err
+	}
+	space := &confluenceSpace{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".html") || e.Name() == "index.html" {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, path.Join(root, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		doc := parseMarkup(htmlScript.ReplaceAllString(string(data), ""), true)
+		content := doc.find(func(n *xmlNode) bool { return n.attr("id") == "main-content" })
+		if content == nil {
+			continue // Not a page, such as a blog index
+		}
+
+		p := &confluencePage{ID: e.Name(), Content: content}
+		if t := doc.find(func(n *xmlNode) bool { return n.attr("id") == "title-text" }); t != nil {
+			p.Title = strings.TrimSpace(t.text())
+		} else if t := doc.find(func(n *xmlNode) bool { return n.Name.Local == "title" }); t != nil {
+			p.Title = strings.TrimSpace(t.text())
+		}
+		// Titles are shown as "Space : Page"
+		if _, title, ok := strings.Cut(p.Title, " : "); ok {
+			p.Title = strings.TrimSpace(title)
+		}
+		if crumbs := doc.find(func(n *xmlNode) bool { return n.attr("id") == "breadcrumbs" }); crumbs != nil {
+			for _, a := range crumbs.findAll(func(n *xmlNode) bool { return n.Name.Local == "a" }) {
+				if href := a.attr("href"); href != "index.html" && strings.HasSuffix(href, ".html") {
+					p.Parent = href
+				}
+			}
+		}
+		if m := confluenceModified.FindStringSubmatch(string(data)); m != nil {
+			p.Modified, _ = time.Parse("Jan 2, 2006", m[1])
+		}
+		space.Pages = append(space.Pages, p)
+	}
+
+	// Attachments are stored as attachments/PAGEID/FILE, PAGEID being the
+	// number ending the name of the page's file
+	pageIDs := make(map[string]string)
+	for _, p := range space.Pages {
+		if m := confluencePageFile.FindStringSubmatch(p.ID); m != nil {
+			pageIDs[m[1]] = p.ID
+		}
+	}
+	dir := path.Join(root, "attachments")
+	err = fs.WalkDir(fsys, dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel := strings.TrimPrefix(name, dir+"/")
+		pageID, file, ok := strings.Cut(rel, "/")
+		if page, found := pageIDs[pageID]; ok && found {
+			space.Attachments = append(space.Attachments, confluenceAttachment{Page: page, Name: path.Base(file), Path: name, Ref: "attachments/" + rel})
+		}
+		return nil
+	})
+	return space, err
+}
+
+// =============================================================================
+// MARKUP TREES
+// =============================================================================
+
+// xmlNode is an element or, when Name is empty, a run of text in a parsed
+// XHTML or HTML document
+type xmlNode struct {
+	Name     xml.Name
+	Attr     []xml.Attr
+	Text     string
+	Children []*xmlNode
+}
+
+// parseMarkup parses XHTML, such as Confluence's storage format, or with
+// html set reasonably well-formed HTML, into a tree under a root node.
+// Parsing stops at the first unrecoverable error, keeping what was read.
+func parseMarkup(markup string, html bool) *xmlNode {
+	dec := xml.NewDecoder(strings.NewReader("<root>" + markup + "</root>"))
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	if html {
+		// Not for XHTML, where this would also close elements such as ac:link
+		dec.AutoClose = xml.HTMLAutoClose
+	}
+
+	root := &xmlNode{Name: xml.Name{Local: "root"}}
+	stack := []*xmlNode{root}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return root
+		}
+		top := stack[len(stack)-1]
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{Name: t.Name, Attr: t.Attr}
+			n.Name.Local = strings.ToLower(n.Name.Local)
+			top.Children = append(top.Children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			top.Children = append(top.Children, &xmlNode{Text: string(t)})
+		}
+	}
+}
+
+// attr returns the value of an attribute given by its local name, or by
+// prefix:name for namespaced attributes such as ri:filename
+func (n *xmlNode) attr(name string) string {
+	for _, a := range n.Attr {
+		if a.Name.Local == name || a.Name.Space+":"+a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// is reports whether the node is an element with the given local name and
+// namespace prefix
+func (n *xmlNode) is(space, local string) bool {
+	return n.Name.Local == local && n.Name.Space == space
+}
+
+// find returns the first node in document order below n matching match
+func (n *xmlNode) find(match func(*xmlNode) bool) *xmlNode {
+	for _, c := range n.Children {
+		if c.Text == "" && match(c) {
+			return c
+		}
+		if found := c.find(match); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// findAll returns every node below n matching match, in document order
+func (n *xmlNode) findAll(match func(*xmlNode) bool) []*xmlNode {
+	var found []*xmlNode
+	for _, c := range n.Children {
+		if c.Text == "" && match(c) {
+			found = append(found, c)
+		}
+		found = append(found, c.findAll(match)...)
+	}
+	return found
+}
+
+// child returns the first direct child element with the given prefix and local name
+func (n *xmlNode) child(space, local string) *xmlNode {
+	for _, c := range n.Children {
+		if c.is(space, local) {
+			return c
+		}
+	}
+	return nil
+}
+
+// text returns the text below a node
+func (n *xmlNode) text() string {
+	if n == nil {
+		return ""
+	}
+	var b strings.Builder
+	var walk func(*xmlNode)
+	walk = func(n *xmlNode) {
+		b.WriteString(n.Text)
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	walk(n)
+	return b.String()
+}
+
+// =============================================================================
+// CONFLUENCE MARKUP CONVERSION
+// =============================================================================
+
+// confluenceTags maps the HTML elements kept in converted pages to the element
+// written for them, and whether it is a block, ending its line
+var confluenceTags = map[string]struct {
+	tag   string
+	block bool
+}{
+	"p": {"p", true}, "blockquote": {"blockquote", true}, "ul": {"ul", true}, "ol": {"ol", true}, "li": {"li", true},
+	"table": {"table", true}, "tr": {"tr", true}, "th": {"th", false}, "td": {"td", false},
+	"strong": {"strong", false}, "b": {"strong", false}, "em": {"em", false}, "i": {"em", false},
+	"u": {"u", false}, "s": {"del", false}, "del": {"del", false}, "strike": {"del", false},
+	"code": {"code", false}, "sub": {"sub", false}, "sup": {"sup", false},
+}
+
+// Confluence macros converted to quoted panels and to code blocks
+var (
+	confluencePanels = map[string]bool{"info": true, "note": true, "warning": true, "tip": true, "panel": true}
+	confluenceCode   = map[string]bool{"code": true, "noformat": true}
+)
+
+// Regular expressions tidying converted HTML: runs of whitespace, collapsed
+// in HTML text, and runs of blank lines left between blocks
+var (
+	whitespace = regexp.MustCompile(`\s+`)
+	blankLines = regexp.MustCompile(`\n[ \t]*\n(?:[ \t]*\n)*`)
+)
+
+// confluenceConverter turns Confluence page content into the wiki's markup:
+// headings become # lines, links to pages [Title] links, Confluence's macros
+// and links plain HTML, and the rest simplified HTML
+type confluenceConverter struct {
+	pages     map[string]string // Original page title to page title
+	originals map[string]string // Page title to original page title
+	refs      map[string]string // Paths an HTML export links to, to titles and attachment URLs
+
+	title string // Page being converted
+	out   strings.Builder
+	pre   int // Depth of preformatted elements, where text is kept as is
+}
+
+// convert returns the content of a page in the wiki's markup
+func (c *confluenceConverter) convert(content *xmlNode, title string) []byte {
+	c.title = title
+	c.out.Reset()
+	if content != nil {
+		c.children(content)
+	}
+	return []byte(strings.TrimSpace(blankLines.ReplaceAllString(c.out.String(), "\n\n")))
+}
+
+// children converts the children of a node
+func (c *confluenceConverter) children(n *xmlNode) {
+	for _, child := range n.Children {
+		c.node(child)
+	}
+}
+
+// node converts a node and its children
+func (c *confluenceConverter) node(n *xmlNode) {
+	if n.Name.Local == "" {
+		if c.pre > 0 {
+			c.out.WriteString(preText(n.Text))
+		} else {
+			c.out.WriteString(importText.Replace(whitespace.ReplaceAllString(n.Text, " ")))
+		}
+		return
+	}
+
+	switch n.Name.Space {
+	case "ac":
+		c.macro(n)
+		return
+	case "ri":
+		return
+	}
+
+	switch local := n.Name.Local; {
+	case len(local) == 2 && local[0] == 'h' && local[1] >= '1' && local[1] <= '6':
+		var inner confluenceConverter
+		inner.pages, inner.originals, inner.refs, inner.title = c.pages, c.originals, c.refs, c.title
+		inner.children(n)
+		if text := strings.TrimSpace(whitespace.ReplaceAllString(inner.out.String(), " ")); text != "" {
+			c.out.WriteString("\n" + strings.Repeat("#", int(local[1]-'0')) + " " + text + "\n")
+		}
+	case local == "pre":
+		c.pre++
+		c.out.WriteString("\n<pre>")
+		c.children(n)
+		c.out.WriteString("</pre>\n")
+		c.pre--
+	case local == "br":
+		c.out.WriteString("<br>")
+	case local == "hr":
+		c.out.WriteString("\n<hr>\n")
+	case local == "a":
+		c.link(n)
+	case local == "img":
+		c.image(c.resolveRef(n.attr("src")), n.attr("alt"))
+	case local == "script" || local == "style" || local == "colgroup":
+	default:
+		t, ok := confluenceTags[local]
+		if !ok {
+			c.children(n)
+			return
+		}
+		if t.block {
+			c.out.WriteString("\n")
+		}
+		c.out.WriteString("<" + t.tag)
+		for _, name := range []string{"colspan", "rowspan"} {
+			if v := n.attr(name); v != "" && (local == "td" || local == "th") {
+				c.out.WriteString(" " + name + `="` + importText.Replace(v) + `"`)
+			}
+		}
+		c.out.WriteString(">")
+		c.children(n)
+		c.out.WriteString("</" + t.tag + ">")
+		if t.block {
+			c.out.WriteString("\n")
+		}
+	}
+}
+
+// resolveRef maps a link of an HTML export to the page or attachment it
+// points to, leaving other links as they are
+func (c *confluenceConverter) resolveRef(href string) string {
+	ref, _, _ := strings.Cut(href, "?")
+	if target, ok := c.refs[ref]; ok {
+		return target
+	}
+	return href
+}
+
+// link converts an HTML link, turning links to exported pages into page links
+func (c *confluenceConverter) link(n *xmlNode) {
+	href := n.attr("href")
+	page, anchor, _ := strings.Cut(href, "#")
+	if title, ok := c.refs[page]; ok && !strings.HasPrefix(title, "/") {
+		c.pageLink(title, anchor, n)
+		return
+	}
+	c.out.WriteString(`<a href="` + importText.Replace(c.resolveRef(href)) + `">`)
+	c.children(n)
+	c.out.WriteString("</a>")
+}
+
+// pageLink writes a link to a page: [Title] when the label is the page's
+// title and there is no anchor, else an HTML link with the label
+func (c *confluenceConverter) pageLink(title, anchor string, label *xmlNode) {
+	text := strings.TrimSpace(label.text())
+	if anchor == "" && (text == "" || c.pages[text] == title) {
+		c.out.WriteString("[" + title + "]")
+		return
+	}
+	href := "/view/" + titleURL(title)
+	if anchor != "" {
+		// HTML exports prefix heading anchors with the page's title
+		anchor = strings.TrimPrefix(anchor, strings.ReplaceAll(c.originals[title], " ", "")+"-")
+		href += "#" + headingSlug(anchor)
+	}
+	c.out.WriteString(`<a href="` + href + `">`)
+	c.children(label)
+	c.out.WriteString("</a>")
+}
+
+// image writes an image, or a link for attachments that aren't images
+func (c *confluenceConverter) image(src, alt string) {
+	if !dokuImageExts[strings.ToLower(path.Ext(src))] && strings.HasPrefix(src, "/attachments/") {
+		c.out.WriteString(`<a href="` + importText.Replace(src) + `">` + importText.Replace(path.Base(src)) + `</a>`)
+		return
+	}
+	c.out.WriteString(`<img src="` + importText.Replace(src) + `" alt="` + strings.ReplaceAll(importText.Replace(alt), `"`, "&quot;") + `">`)
+}
+
+// macro converts the Confluence-specific elements of the storage format:
+// links, images, macros and task lists. Macros without an equivalent keep
+// their body, if any.
+func (c *confluenceConverter) macro(n *xmlNode) {
+	switch n.Name.Local {
+	case "link":
+		label := n.child("ac", "link-body")
+		if label == nil {
+			label = n.child("ac", "plain-text-link-body")
+		}
+		if label == nil {
+			label = &xmlNode{}
+		}
+		anchor := n.attr("ac:anchor")
+		switch {
+		case n.child("ri", "page") != nil:
+			title, ok := c.pages[n.child("ri", "page").attr("ri:content-title")]
+			if !ok {
+				c.children(label)
+				return
+			}
+			c.pageLink(title, anchor, label)
+		case n.child("ri", "attachment") != nil:
+			name := attachmentName(n.child("ri", "attachment").attr("ri:filename"))
+			c.out.WriteString(`<a href="` + attachmentURL(c.title, name) + `">`)
+			if len(label.Children) > 0 {
+				c.children(label)
+			} else {
+				c.out.WriteString(importText.Replace(name))
+			}
+			c.out.WriteString("</a>")
+		case anchor != "":
+			c.out.WriteString(`<a href="#` + headingSlug(anchor) + `">`)
+			c.children(label)
+			c.out.WriteString("</a>")
+		default:
+			c.children(label)
+		}
+	case "image":
+		alt := n.attr("ac:alt")
+		if a := n.child("ri", "attachment"); a != nil {
+			owner := c.title
+			if p := a.child("ri", "page"); p != nil {
+				if t, ok := c.pages[p.attr("ri:content-title")]; ok {
+					owner = t
+				}
+			}
+			c.image(attachmentURL(owner, attachmentName(a.attr("ri:filename"))), alt)
+		} else if u := n.child("ri", "url"); u != nil {
+			c.image(u.attr("ri:value"), alt)
+		}
+	case "structured-macro", "macro":
+		name := n.attr("ac:name")
+		switch {
+		case confluenceCode[name]:
+			c.out.WriteString("\n<pre>" + preText(n.child("ac", "plain-text-body").text()) + "</pre>\n")
+		case confluencePanels[name]:
+			c.out.WriteString("\n<blockquote>")
+			if body := n.child("ac", "rich-text-body"); body != nil {
+				c.children(body)
+			}
+			c.out.WriteString("</blockquote>\n")
+		default:
+			if body := n.child("ac", "rich-text-body"); body != nil {
+				c.children(body)
+			}
+		}
+	case "task-list":
+		c.out.WriteString("\n<ul>")
+		for _, task := range n.Children {
+			if !task.is("ac", "task") {
+				continue
+			}
+			mark := "☐ "
+			if strings.TrimSpace(task.child("ac", "task-status").text()) == "complete" {
+				mark = "☑ "
+			}
+			c.out.WriteString("\n<li>" + mark)
+			if body := task.child("ac", "task-body"); body != nil {
+				c.children(body)
+			}
+			c.out.WriteString("</li>")
+		}
+		c.out.WriteString("\n</ul>\n")
+	case "rich-text-body", "layout", "layout-section", "layout-cell":
+		c.children(n)
+	}
+}
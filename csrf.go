@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// =============================================================================
+// CSRF PROTECTION
+// =============================================================================
+
+// csrfCookie is the cookie holding a browser's CSRF token. Forms post the
+// token back, which pages on other sites can't read, so they can't make a
+// reader's browser submit changes on the reader's behalf.
+const csrfCookie = "wiki_csrf"
+
+// csrfField is the form field, and csrfHeader the header for scripts, carrying the token
+const (
+	csrfField  = "csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfForm is embedded in the data of templates with forms that change the
+// wiki, and filled in by renderTemplate
+type csrfForm struct {
+	CSRF string // Token the forms post back in the csrf field
+}
+
+// setCSRF gives the template the reader's CSRF token
+func (f *csrfForm) setCSRF(token string) {
+	f.CSRF = token
+}
+
+// csrfToken returns the browser's CSRF token, issuing one in a cookie if it
+// has none yet. The token lasts as long as the browser session.
+func (s *Server) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	token := make([]byte, 16)
+	rand.Read(token)
+	c := &http.Cookie{
+		Name:     csrfCookie,
+		Value:    hex.EncodeToString(token),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(s.cfg().PublicURL, "https:"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, c)
+	// Later reads within this request see the new token
+	r.AddCookie(c)
+	return c.Value
+}
+
+// checkCSRF verifies that a request changing the wiki carries the token from
+// the browser's CSRF cookie, answering 403 and reporting false when it
+// doesn't. Requests with a bearer token are exempt, as browsers never send
+// those by themselves, and so are API, raw page and WebDAV requests without a
+// session, which carry no credentials for another site to borrow. Browsers
+// do resend basic auth credentials, with forms posted from other sites too,
+// so those only exempt the other methods, which WebDAV clients send them with
+// and other sites' forms can't use.
+func (s *Server) checkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	if bearerToken(r) != "" {
+		return true
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/raw/") || strings.HasPrefix(r.URL.Path, davPrefix+"/") {
+		_, _, basic := r.BasicAuth()
+		if _, err := r.Cookie(sessionCookie); err != nil && (!basic || r.Method != http.MethodPost) {
+			return true
+		}
+	}
+
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		// Multipart bodies are left for their handlers to read within their
+		// size limits, so those forms send the token in the URL instead
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+			token = r.URL.Query().Get(csrfField)
+		} else {
+			token = r.PostFormValue(csrfField)
+		}
+	}
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(c.Value)) != 1 {
+		http.Error(w, "Forbidden: the form has expired or was sent from another site; reload the page and try again", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckCSRF(t *testing.T) {
+	const token = "0123456789abcdef"
+	s := newTestServer(t, nil)
+	form := func(method, path, body string) *http.Request {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+	withCookie := func(r *http.Request) *http.Request {
+		r.AddCookie(&http.Cookie{Name: csrfCookie, Value: token})
+		return r
+	}
+	withSession := func(r *http.Request) *http.Request {
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "session"})
+		return r
+	}
+	withHeader := func(name, value string) func(r *http.Request) *http.Request {
+		return func(r *http.Request) *http.Request {
+			r.Header.Set(name, value)
+			return r
+		}
+	}
+	multipart := func(r *http.Request) *http.Request {
+		r.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+		return r
+	}
+
+	for _, tc := range []struct {
+		name string
+		r    *http.Request
+		ok   bool
+	}{
+		{"GET", httptest.NewRequest(http.MethodGet, "/edit/Home", nil), true},
+		{"HEAD", httptest.NewRequest(http.MethodHead, "/view/Home", nil), true},
+		{"OPTIONS", withSession(httptest.NewRequest(http.MethodOptions, "/api/v1/pages", nil)), true},
+		{"TRACE", httptest.NewRequest(http.MethodTrace, "/view/Home", nil), true},
+		{"missing token", form(http.MethodPost, "/save/Home", "body=x"), false},
+		{"missing cookie", form(http.MethodPost, "/save/Home", "body=x&csrf="+token), false},
+		{"missing field", withCookie(form(http.MethodPost, "/save/Home", "body=x")), false},
+		{"mismatched field", withCookie(form(http.MethodPost, "/save/Home", "body=x&csrf=fedcba9876543210")), false},
+		{"matching field", withCookie(form(http.MethodPost, "/save/Home", "body=x&csrf="+token)), true},
+		{"matching header", withHeader(csrfHeader, token)(withCookie(form(http.MethodPost, "/api/v1/pages/Home/tasks/0", ""))), true},
+		{"mismatched header", withHeader(csrfHeader, "x")(withCookie(form(http.MethodPost, "/save/Home", "csrf="+token))), false},
+		{"multipart in URL", multipart(withCookie(httptest.NewRequest(http.MethodPost, "/upload/Home?csrf="+token, nil))), true},
+		{"multipart without", multipart(withCookie(httptest.NewRequest(http.MethodPost, "/upload/Home", nil))), false},
+		{"bearer form", withHeader("Authorization", "Bearer wiki_x")(form(http.MethodPost, "/save/Home", "body=x")), true},
+		{"bearer API with session", withHeader("Authorization", "Bearer wiki_x")(withSession(httptest.NewRequest(http.MethodDelete, "/api/v1/pages/Home", nil))), true},
+		{"API without session", httptest.NewRequest(http.MethodPut, "/api/v1/pages/Home", nil), true},
+		{"raw without session", httptest.NewRequest(http.MethodPut, "/raw/Home", nil), true},
+		{"WebDAV without session", httptest.NewRequest("PROPPATCH", davPrefix+"/Home.md", nil), true},
+		{"API with session", withSession(httptest.NewRequest(http.MethodDelete, "/api/v1/pages/Home", nil)), false},
+		{"API basic auth PUT", withHeader("Authorization", "Basic YWxpY2U6cHc=")(httptest.NewRequest(http.MethodPut, "/api/v1/pages/Home", nil)), true},
+		{"API basic auth POST", withHeader("Authorization", "Basic YWxpY2U6cHc=")(form(http.MethodPost, "/api/v1/pages/Home/tasks/0", "")), false},
+		{"form basic auth", withHeader("Authorization", "Basic YWxpY2U6cHc=")(form(http.MethodPost, "/save/Home", "body=x")), false},
+	} {
+		w := httptest.NewRecorder()
+		if ok := s.checkCSRF(w, tc.r); ok != tc.ok {
+			t.Errorf("%s: checkCSRF = %v, want %v", tc.name, ok, tc.ok)
+		}
+		if !tc.ok && w.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want %d", tc.name, w.Code, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// =============================================================================
+// LINE DIFFS
+// =============================================================================
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// DiffLine is a single line of a unified diff
+type DiffLine struct {
+	Kind byte // ' ' for context, '-' for removed, '+' for added
+	Text string
+}
+
+// DiffHunk is a group of nearby changes with surrounding context
+type DiffHunk struct {
+	Header string // Unified diff range header, e.g. "@@ -1,4 +1,5 @@"
+	Lines  []DiffLine
+}
+
+// splitLines breaks text into lines without their terminators
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(strings.ReplaceAll(text, "\r\n", "\n"), "\n"), "\n")
+}
+
+// diffLines computes the line-by-line edit script turning a into b, using the
+// longest common subsequence of the lines that differ after trimming the
+// common prefix and suffix
+func diffLines(a, b []string) []DiffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	// lcs[i][j] is the length of the longest common subsequence of ma[i:] and mb[j:]
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	lines := make([]DiffLine, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		lines = append(lines, DiffLine{Kind: ' ', Text: line})
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			lines = append(lines, DiffLine{Kind: ' ', Text: ma[i]})
+			i++
+			j++
+		case i < len(ma) && (j == len(mb) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, DiffLine{Kind: '-', Text: ma[i]})
+			i++
+		default:
+			lines = append(lines, DiffLine{Kind: '+', Text: mb[j]})
+			j++
+		}
+	}
+	for _, line := range a[len(a)-suffix:] {
+		lines = append(lines, DiffLine{Kind: ' ', Text: line})
+	}
+	return lines
+}
+
+// unifiedDiff groups the differences between two texts into hunks with
+// diffContext lines of context, like diff -u. Identical texts yield no hunks.
+func unifiedDiff(from, to string) []DiffHunk {
+	lines := diffLines(splitLines(from), splitLines(to))
+
+	var hunks []DiffHunk
+	for start := 0; start < len(lines); {
+		// Find the next change
+		for start < len(lines) && lines[start].Kind == ' ' {
+			start++
+		}
+		if start == len(lines) {
+			break
+		}
+
+		// Extend the hunk while changes are close enough to share context
+		end := start
+		for k := start; k < len(lines); k++ {
+			if lines[k].Kind != ' ' {
+				end = k + 1
+			} else if k-end >= 2*diffContext {
+				break
+			}
+		}
+
+		lo, hi := max(start-diffContext, 0), min(end+diffContext, len(lines))
+		hunks = append(hunks, DiffHunk{Header: hunkHeader(lines, lo, hi), Lines: lines[lo:hi]})
+		start = hi
+	}
+	return hunks
+}
+
+// hunkHeader formats the "@@ -a,b +c,d @@" range line for lines[lo:hi]
+func hunkHeader(lines []DiffLine, lo, hi int) string {
+	oldStart, newStart := 1, 1
+	for _, l := range lines[:lo] {
+		if l.Kind != '+' {
+			oldStart++
+		}
+		if l.Kind != '-' {
+			newStart++
+		}
+	}
+	oldCount, newCount := 0, 0
+	for _, l := range lines[lo:hi] {
+		if l.Kind != '+' {
+			oldCount++
+		}
+		if l.Kind != '-' {
+			newCount++
+		}
+	}
+	// Empty ranges point at the line before, as diff -u does
+	if oldCount == 0 {
+		oldStart--
+	}
+	if newCount == 0 {
+		newStart--
+	}
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@", oldStart, oldCount, newStart, newCount)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// EMAIL DIGESTS
+// =============================================================================
+
+// watchesFile lists who receives digests of changes to which pages. The
+// leading dot keeps it out of page listings.
+const watchesFile = ".watches.json"
+
+// digestCheckInterval is how often the digest job looks for digests that are due
+const digestCheckInterval = time.Hour
+
+// digestPeriods are the digest frequencies watchers can choose, by name
+var digestPeriods = map[string]time.Duration{
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// digestTypes are the audit event types reported in digests
+var digestTypes = []string{eventCreate, eventEdit, eventDelete, eventRename, eventUpload, eventComment}
+
+// Watch subscribes an email address to a periodic digest of the changes made
+// to some pages
+type Watch struct {
+	Email  string    `json:"email"`
+	Pages  []string  `json:"pages"`  // Titles watched; one ending in * watches every page starting with it
+	Digest string    `json:"digest"` // Name of the digest period
+	Sent   time.Time `json:"sent"`   // End of the period the last digest covered
+}
+
+// watches reports whether a page is one of those watched
+func (w *Watch) watches(title string) bool {
+	if title == "" {
+		return false
+	}
+	for _, p := range w.Pages {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok && inNamespace(title, prefix) || p == title {
+			return true
+		}
+	}
+	return false
+}
+
+// readWatches returns the watches of a data directory
+func readWatches(dataDir string) ([]Watch, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, watchesFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var watches []Watch
+	if err := json.Unmarshal(data, &watches); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", watchesFile, err)
+	}
+	return watches, nil
+}
+
+// writeWatches replaces the watches of a data directory
+func writeWatches(dataDir string, watches []Watch) error {
+	data, err := json.MarshalIndent(watches, "", "\t")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, watchesFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// addWatch subscribes an email address to digests of changes to pages,
+// adding them to those it already watches and switching it to digest
+func addWatch(dataDir, email, digest string, pages []string) error {
+	if !validEmail(email) {
+		return fmt.Errorf("invalid email address %q", email)
+	}
+	if _, ok := digestPeriods[digest]; !ok {
+		return fmt.Errorf("unknown digest %q, expected daily or weekly", digest)
+	}
+	for _, p := range pages {
+		if !validTitle.MatchString(strings.TrimSuffix(p, "*")) {
+			return fmt.Errorf("invalid page %q", p)
+		}
+	}
+	watches, err := readWatches(dataDir)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(watches, func(w Watch) bool { return w.Email == email })
+	if i < 0 {
+		// The first digest covers changes from now on
+		watches = append(watches, Watch{Email: email, Sent: time.Now().UTC()})
+		i = len(watches) - 1
+	}
+	w := &watches[i]
+	w.Digest = digest
+	for _, p := range pages {
+		if !slices.Contains(w.Pages, p) {
+			w.Pages = append(w.Pages, p)
+		}
+	}
+	return writeWatches(dataDir, watches)
+}
+
+// removeWatch stops an email address watching pages, or unsubscribes it
+// altogether when no pages are given or none remain
+func removeWatch(dataDir, email string, pages []string) error {
+	watches, err := readWatches(dataDir)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(watches, func(w Watch) bool { return w.Email == email })
+	if i < 0 {
+		return fmt.Errorf("%s watches no pages", email)
+	}
+	watches[i].Pages = slices.DeleteFunc(watches[i].Pages, func(p string) bool { return slices.Contains(pages, p) })
+	if len(pages) == 0 || len(watches[i].Pages) == 0 {
+		watches = slices.Delete(watches, i, i+1)
+	}
+	return writeWatches(dataDir, watches)
+}
+
+// runDigests periodically mails the digests that are due, while an SMTP
+// server is configured
+func (s *Server) runDigests(ctx context.Context) {
+	for {
+		if s.cfg().SMTPAddr != "" {
+			if err := s.sendDigests(ctx, time.Now().UTC()); err != nil {
+				slog.Error("Sending digests failed", "err", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(digestCheckInterval):
+		}
+	}
+}
+
+// sendDigests mails each watcher whose digest period has passed the changes
+// made to their pages since their last digest. Watchers whose pages didn't
+// change get no mail; a digest that fails to send is retried on the next run.
+func (s *Server) sendDigests(ctx context.Context, now time.Time) error {
+	cfg := s.cfg()
+	watches, err := readWatches(cfg.DataDir)
+	if err != nil || len(watches) == 0 {
+		return err
+	}
+	events, err := s.audit.events()
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for i := range watches {
+		w := &watches[i]
+		if now.Sub(w.Sent) < digestPeriods[w.Digest] {
+			continue
+		}
+		var changes []AuditEvent
+		for _, ev := range events {
+			if ev.Time.After(w.Sent) && !ev.Time.After(now) && slices.Contains(digestTypes, ev.Type) && (w.watches(ev.Title) || w.watches(ev.PreviousTitle)) {
+				changes = append(changes, ev)
+			}
+		}
+		if len(changes) > 0 {
+			subject := fmt.Sprintf("Wiki %s digest: %d change", w.Digest, len(changes))
+			if len(changes) > 1 {
+				subject += "s"
+			}
+			if err := sendMail(ctx, cfg, w.Email, subject, digestText(cfg.PublicURL, w, changes)); err != nil {
+				slog.Error("Mailing digest failed", "to", w.Email, "err", err)
+				continue
+			}
+		}
+		w.Sent = now
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return writeWatches(cfg.DataDir, watches)
+}
+
+// digestText lays out the changes of a digest as plain text, grouped by
+// page, with links to the pages and their changes when the wiki's public URL
+// is known
+func digestText(publicURL string, w *Watch, changes []AuditEvent) string {
+	byTitle := make(map[string][]AuditEvent)
+	for _, ev := range changes {
+		byTitle[ev.Title] = append(byTitle[ev.Title], ev)
+	}
+	titles := make([]string, 0, len(byTitle))
+	for title := range byTitle {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+
+	base := strings.TrimRight(publicURL, "/")
+	var b strings.Builder
+	fmt.Fprintf(&b, "Changes to the pages you watch from %s to %s:\n", w.Sent.Local().Format(time.DateTime), changes[len(changes)-1].Time.Local().Format(time.DateTime))
+	for _, title := range titles {
+		fmt.Fprintf(&b, "\n%s\n", title)
+		if base != "" {
+			fmt.Fprintf(&b, "%s/view/%s\n", base, titleURL(title))
+		}
+		for _, ev := range byTitle[title] {
+			fmt.Fprintf(&b, "  %s  %s", ev.Time.Local().Format(time.DateTime), ev.Type)
+			if ev.Actor != "" {
+				fmt.Fprintf(&b, " by %s", ev.Actor)
+			}
+			if ev.PreviousTitle != "" {
+				fmt.Fprintf(&b, " from %s", ev.PreviousTitle)
+			}
+			if ev.Detail != "" {
+				fmt.Fprintf(&b, ": %s", ev.Detail)
+			}
+			b.WriteString("\n")
+			if base != "" && ev.Revision > 0 {
+				fmt.Fprintf(&b, "    %s/diff/%s?to=%d\n", base, titleURL(title), ev.Revision)
+			}
+		}
+	}
+	fmt.Fprintf(&b, "\nYou receive this %s digest because %s watches %s.\n", w.Digest, w.Email, strings.Join(w.Pages, ", "))
+	return b.String()
+}
+
+// sendMail sends a plain text email through the configured SMTP server,
+// authenticating when a user is configured
+func sendMail(ctx context.Context, cfg *Config, to, subject, body string) error {
+	host, _, err := net.SplitHostPort(cfg.SMTPAddr)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if cfg.SMTPUser != "" {
+		auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPassword, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		cfg.SMTPFrom, to, subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+
+	// smtp.SendMail takes no context, so give up on it when ctx ends
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(cfg.SMTPAddr, auth, cfg.SMTPFrom, []string{to}, []byte(msg)) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// validEmail reports whether s is a bare email address
+func validEmail(s string) bool {
+	a, err := mail.ParseAddress(s)
+	return err == nil && a.Address == s
+}
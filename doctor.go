@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// DOCTOR
+// =============================================================================
+
+// Severities of doctor findings
+const (
+	findingOK   = "ok"
+	findingWarn = "warn"
+	findingFail = "FAIL"
+)
+
+// certExpiryWarning is how soon before -tls-cert expires the doctor warns about it
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// finding is the outcome of one doctor check
+type finding struct {
+	Level   string
+	Check   string
+	Message string
+}
+
+// doctor checks the environment the wiki is about to run in
+type doctor struct {
+	cfg      Config
+	findings []finding
+}
+
+// report records the outcome of a check
+func (d *doctor) report(level, check, format string, args ...any) {
+	d.findings = append(d.findings, finding{Level: level, Check: check, Message: fmt.Sprintf(format, args...)})
+}
+
+// runDoctor checks configuration, data directory, templates, the listen
+// address and revision history, prints its findings to out and reports
+// whether the server can be started
+func runDoctor(cfg Config, out io.Writer) bool {
+	d := &doctor{cfg: cfg}
+	d.checkConfig()
+	if d.checkDataDir() {
+		d.checkPages()
+	}
+	d.checkTemplates()
+	d.checkStatic()
+	d.checkPort()
+
+	healthy := true
+	for _, f := range d.findings {
+		fmt.Fprintf(out, "[%-4s] %-10s %s\n", f.Level, f.Check, f.Message)
+		if f.Level == findingFail {
+			healthy = false
+		}
+	}
+	return healthy
+}
+
+// checkConfig validates settings that are only used long after startup
+func (d *doctor) checkConfig() {
+	const check = "config"
+	problems := 0
+
+	if _, err := resolveLogTarget(d.cfg); err != nil {
+		d.report(findingFail, check, "%v", err)
+		problems++
+	}
+	if err := checkLogFormat(d.cfg); err != nil {
+		d.report(findingFail, check, "%v", err)
+		problems++
+	}
+	if _, err := parseLogLevel(d.cfg.LogLevel); err != nil {
+		d.report(findingFail, check, "%v", err)
+		problems++
+	}
+	if _, _, err := net.SplitHostPort(d.cfg.Addr); err != nil {
+		d.report(findingFail, check, "-addr %q is not a host:port address: %v", d.cfg.Addr, err)
+		problems++
+	}
+	if d.cfg.DiskAlertWebhook != "" {
+		if u, err := url.Parse(d.cfg.DiskAlertWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			d.report(findingFail, check, "-disk-alert-webhook must be an http or https URL")
+			problems++
+		}
+		if d.cfg.DiskAlertBytes <= 0 {
+			d.report(findingWarn, check, "-disk-alert-webhook is set but never used; set -disk-alert-bytes to enable disk alerts")
+			problems++
+		}
+	}
+	if d.cfg.ReviewWebhook != "" {
+		if u, err := url.Parse(d.cfg.ReviewWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			d.report(findingFail, check, "-review-webhook must be an http or https URL")
+			problems++
+		}
+		if !d.cfg.ReviewEdits && !d.cfg.ModerateAnonymous {
+			d.report(findingWarn, check, "-review-webhook is set but never used; set -review-edits or -moderate-anonymous to hold edits for review")
+			problems++
+		}
+	}
+	if d.cfg.SMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(d.cfg.SMTPAddr); err != nil {
+			d.report(findingFail, check, "-smtp-addr %q is not a host:port address: %v", d.cfg.SMTPAddr, err)
+			problems++
+		}
+		if !validEmail(d.cfg.SMTPFrom) {
+			d.report(findingFail, check, "-smtp-addr is set but -smtp-from is not an email address")
+			problems++
+		}
+	}
+	if d.cfg.RequestTimeout > 0 && d.cfg.WriteTimeout > 0 && d.cfg.RequestTimeout > d.cfg.WriteTimeout {
+		d.report(findingWarn, check, "-request-timeout %v exceeds -write-timeout %v; slow pages are cut off before they can time out cleanly",
+			d.cfg.RequestTimeout, d.cfg.WriteTimeout)
+		problems++
+	}
+	if d.cfg.SummaryURL != "" {
+		if u, err := url.Parse(d.cfg.SummaryURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			d.report(findingFail, check, "-summary-url must be an http or https URL")
+			problems++
+		}
+		if d.cfg.SummaryModel == "" {
+			d.report(findingFail, check, "-summary-url is set but -summary-model is empty; name the model to summarize pages with")
+			problems++
+		}
+	}
+	if d.cfg.EmbeddingURL != "" {
+		if u, err := url.Parse(d.cfg.EmbeddingURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			d.report(findingFail, check, "-embedding-url must be an http or https URL")
+			problems++
+		}
+		if d.cfg.EmbeddingModel == "" {
+			d.report(findingFail, check, "-embedding-url is set but -embedding-model is empty; name the model to embed pages with")
+			problems++
+		}
+	}
+	if !validLang.MatchString(d.cfg.DefaultLang) {
+		d.report(findingFail, check, "-default-lang %q is not a language tag such as en or pt-BR", d.cfg.DefaultLang)
+		problems++
+	}
+	if d.cfg.S3Bucket != "" {
+		if _, err := newS3Store(d.cfg); err != nil {
+			d.report(findingFail, check, "%v", err)
+			problems++
+		}
+	}
+	if _, _, err := d.cfg.tlsSetup(); err != nil {
+		d.report(findingFail, check, "%v", err)
+		problems++
+	} else if d.cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(d.cfg.TLSCert, d.cfg.TLSKey)
+		if err == nil && time.Until(cert.Leaf.NotAfter) < certExpiryWarning {
+			d.report(findingWarn, check, "-tls-cert expires on %s; renew it", cert.Leaf.NotAfter.Format(time.DateOnly))
+			problems++
+		}
+	}
+	if d.cfg.Git {
+		if d.cfg.S3Bucket != "" {
+			d.report(findingFail, check, "-git and -s3-bucket are both set; pages are kept in the bucket, so choose one")
+			problems++
+		}
+		if _, err := exec.LookPath("git"); err != nil {
+			d.report(findingFail, check, "-git is set but the git command can't be found: %v", err)
+			problems++
+		}
+	} else if d.cfg.GitRemote != "" {
+		d.report(findingWarn, check, "-git-remote is set without -git and is ignored")
+		problems++
+	}
+	if d.cfg.AdminToken == "" {
+		d.report(findingWarn, check, "no -admin-token; the admin dashboard and API are disabled")
+		problems++
+	}
+	if problems == 0 {
+		d.report(findingOK, check, "configuration is valid")
+	}
+}
+
+// checkDataDir verifies the data directory exists or can be created and is
+// writable, reporting whether the page checks can run
+func (d *doctor) checkDataDir() bool {
+	const check = "data dir"
+	dir := d.cfg.DataDir
+
+	info, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+		d.report(findingWarn, check, "%s does not exist yet and will be created on startup", dir)
+		return false
+	case err != nil:
+		d.report(findingFail, check, "cannot access %s: %v", dir, err)
+		return false
+	case !info.IsDir():
+		d.report(findingFail, check, "%s is not a directory", dir)
+		return false
+	}
+
+	f, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		d.report(findingFail, check, "%s is not writable: %v; fix its ownership or permissions", dir, err)
+		return false
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	d.report(findingOK, check, "%s is writable", dir)
+	return true
+}
+
+// checkPages verifies every page is reachable and its revision history is
+// readable and up to date
+func (d *doctor) checkPages() {
+	const check = "pages"
+	ctx := context.Background()
+	store, err := openStore(d.cfg)
+	if err != nil {
+		d.report(findingFail, check, "%v", err)
+		return
+	}
+
+	titles, err := store.List(ctx)
+	if err != nil {
+		d.report(findingFail, check, "cannot list pages: %v", err)
+		return
+	}
+
+	problems := 0
+	for _, title := range titles {
+		if !validTitle.MatchString(title) {
+			d.report(findingWarn, check, "%s can't be reached because page names may only contain letters, numbers, hyphens, underscores and single spaces, with slashes between namespaces and before the language tag of a translation; rename it", pageFile(title))
+			problems++
+			continue
+		}
+		p, err := store.Load(ctx, title)
+		if err != nil {
+			d.report(findingFail, check, "cannot read %s: %v", title, err)
+			problems++
+			continue
+		}
+		revs, err := store.Revisions(ctx, title)
+		if err != nil {
+			d.report(findingFail, check, "revision history of %s is unreadable: %v", title, err)
+			problems++
+			continue
+		}
+		if len(revs) == 0 {
+			continue
+		}
+		latest, err := store.Revision(ctx, title, revs[len(revs)-1].Number)
+		if err != nil {
+			d.report(findingFail, check, "revision %d of %s is missing: %v", revs[len(revs)-1].Number, title, err)
+			problems++
+		} else if !bytes.Equal(latest, p.Body) {
+			d.report(findingWarn, check, "%s was changed on disk while the wiki wasn't running; the change is recorded as a revision once the server sees it", title)
+			problems++
+		}
+	}
+
+	if problems == 0 {
+		d.report(findingOK, check, "%d pages with healthy revision history", len(titles))
+	}
+}
+
+// checkTemplates parses the templates the server renders with
+func (d *doctor) checkTemplates() {
+	const check = "templates"
+	dir := d.cfg.templateDir()
+	if _, err := parseTemplates(dir); err != nil {
+		d.report(findingFail, check, "%v", err)
+		return
+	}
+	d.report(findingOK, check, "%d templates in %s parse", len(templateFiles), assetSource(dir))
+}
+
+// checkStatic verifies the stylesheet can be served
+func (d *doctor) checkStatic() {
+	const check = "static"
+	dir := d.cfg.staticDir()
+	if _, err := fs.Stat(staticFS(dir), "style.css"); err != nil {
+		d.report(findingWarn, check, "style.css not found in %s, so pages won't be styled", assetSource(dir))
+		return
+	}
+	d.report(findingOK, check, "stylesheet found in %s", assetSource(dir))
+}
+
+// checkPort verifies the listen address is free, unless systemd passes the socket
+func (d *doctor) checkPort() {
+	const check = "listen"
+	if os.Getenv("LISTEN_FDS") != "" {
+		d.report(findingOK, check, "socket passed by systemd")
+		return
+	}
+	ln, err := net.Listen("tcp", d.cfg.Addr)
+	if err != nil {
+		hint := ""
+		if strings.Contains(err.Error(), "address already in use") {
+			hint = "; stop the process using it or pick another -addr"
+		}
+		d.report(findingFail, check, "cannot listen on %s: %v%s", d.cfg.Addr, err, hint)
+		return
+	}
+	ln.Close()
+	d.report(findingOK, check, "%s is available", d.cfg.Addr)
+}
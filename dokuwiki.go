@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// =============================================================================
+// DOKUWIKI IMPORT
+// =============================================================================
+
+// readDokuWiki reads the pages and media of a DokuWiki installation, or of its
+// data directory, converting page ids to titles and the markup to the wiki's
+// own. Namespaces become title prefixes, so wiki:syntax becomes WikiSyntax and
+// the namespace's start page becomes Wiki. Media files are attached to the
+// page of their namespace. Old revisions in the attic aren't imported.
+func readDokuWiki(src string) (*wikiExport, error) {
+	root := filepath.Join(src, "data")
+	if _, err := os.Stat(filepath.Join(root, "pages")); err != nil {
+		root = src
+	}
+	pagesDir := filepath.Join(root, "pages")
+	if _, err := os.Stat(pagesDir); err != nil {
+		return nil, fmt.Errorf("%s is not a DokuWiki installation or data directory: %w", src, err)
+	}
+
+	// Titles are assigned before converting, so links can be resolved to them
+	ids, err := dokuIDs(pagesDir, ".txt")
+	if err != nil {
+		return nil, err
+	}
+	conv := &dokuConverter{titles: make(map[string]string)}
+	used := make(map[string]bool)
+	for _, id := range ids {
+		conv.titles[id] = uniqueTitle(dokuTitle(id), used)
+	}
+
+	export := &wikiExport{}
+	for _, id := range ids {
+		path := filepath.Join(pagesDir, filepath.FromSlash(strings.ReplaceAll(id, ":", "/"))+".txt")
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		export.Pages = append(export.Pages, importedPage{
+			Title:    conv.titles[id],
+			Body:     conv.convert(body, dokuNamespace(id)),
+			Modified: info.ModTime(),
+		})
+	}
+
+	mediaDir := filepath.Join(root, "media")
+	media, err := dokuIDs(mediaDir, "")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, id := range media {
+		data, err := os.ReadFile(filepath.Join(mediaDir, filepath.FromSlash(strings.ReplaceAll(id, ":", "/"))))
+		if err != nil {
+			return nil, err
+		}
+		owner, name := conv.mediaTarget(id)
+		export.Files = append(export.Files, importedFile{Page: owner, Name: name, Data: data})
+	}
+	return export, nil
+}
+
+// dokuIDs returns the ids of the files below dir with the given extension,
+// which is removed, sorted so titles are assigned in a stable order
+func dokuIDs(dir, ext string) ([]string, error) {
+	var ids []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !strings.HasSuffix(path, ext) || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		ids = append(ids, strings.ReplaceAll(filepath.ToSlash(strings.TrimSuffix(rel, ext)), "/", ":"))
+		return nil
+	})
+	sort.Strings(ids)
+	return ids, err
+}
+
+// dokuNamespace returns the namespace of a page id, empty for the root
+func dokuNamespace(id string) string {
+	if i := strings.LastIndexByte(id, ':'); i >= 0 {
+		return id[:i]
+	}
+	return ""
+}
+
+// dokuTitle derives a page title from a page id. A namespace's start page,
+// ns:start or ns:ns, takes the title of the namespace.
+func dokuTitle(id string) string {
+	parts := strings.Split(strings.Trim(id, ":"), ":")
+	if n := len(parts); n > 1 && (parts[n-1] == "start" || parts[n-1] == parts[n-2]) {
+		parts = parts[:n-1]
+	}
+	title := ""
+	for _, part := range parts {
+		title += titleWords(part)
+	}
+	if title == "" {
+		return "Page"
+	}
+	return title
+}
+
+// resolveDokuID turns a link target as written on a page in namespace ns into
+// a full id, following DokuWiki's rules: targets are relative to the page's
+// namespace unless they contain a colon, ".:" and "..:" walk the namespaces,
+// and a target ending in a colon names the namespace's start page
+func resolveDokuID(target, ns string) string {
+	id := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(target), " ", "_"))
+	switch {
+	case strings.HasPrefix(id, "."):
+		parts := strings.Split(ns, ":")
+		if ns == "" {
+			parts = nil
+		}
+		for _, part := range strings.Split(id, ":") {
+			switch part {
+			case ".":
+			case "..":
+				if len(parts) > 0 {
+					parts = parts[:len(parts)-1]
+				}
+			default:
+				parts = append(parts, part)
+			}
+		}
+		id = strings.Join(parts, ":")
+	case strings.Contains(id, ":"):
+		id = strings.TrimPrefix(id, ":")
+	case ns != "":
+		id = ns + ":" + id
+	}
+	if id == "" || strings.HasSuffix(id, ":") {
+		id += "start"
+	}
+	return id
+}
+
+// =============================================================================
+// DOKUWIKI MARKUP CONVERSION
+// =============================================================================
+
+// Regular expressions matching DokuWiki block markup
+var (
+	dokuHeading   = regexp.MustCompile(`^\s*(={2,6})\s*(.+?)\s*={2,6}\s*$`)
+	dokuRule      = regexp.MustCompile(`^\s*-{4,}\s*$`)
+	dokuListItem  = regexp.MustCompile(`^( {2,}|\t+)([*-])\s?(.*)$`)
+	dokuTableRow  = regexp.MustCompile(`^\s*[\^|]`)
+	dokuQuote     = regexp.MustCompile(`^(>+)\s?(.*)$`)
+	dokuCodeStart = regexp.MustCompile(`^\s*<(code|file)\b[^>]*>(.*)$`)
+	dokuMacro     = regexp.MustCompile(`~~[A-Z_]+~~`)
+)
+
+// dokuInline matches DokuWiki inline markup: links, media and includes,
+// bare URLs, unformatted text, footnotes, formatting toggles, a few HTML-like
+// tags and forced line breaks
+var dokuInline = regexp.MustCompile(`\[\[(.*?)\]\]|\{\{(.*?)\}\}|(?:https?|ftp)://[^\s<>\[\]|{}]+|%%(.*?)%%|<nowiki>(.*?)</nowiki>|\(\((.*?)\)\)|\*\*|//|__|''|</?(?:del|sub|sup)>|\\\\(?:[ \t]|$)`)
+
+// dokuToggles maps formatting markers to the HTML elements they open and close
+var dokuToggles = map[string]string{"**": "strong", "//": "em", "__": "u", "''": "code"}
+
+// dokuImageExts lists the media extensions shown as images rather than linked
+var dokuImageExts = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true, ".webp": true}
+
+// dokuConverter turns DokuWiki markup into the wiki's own: headings become #
+// lines, links to pages [Title] links, includes transclusions, and the rest
+// HTML, as the wiki passes HTML through
+type dokuConverter struct {
+	titles map[string]string // Page id to title
+
+	// State of the page being converted
+	ns    string
+	out   bytes.Buffer
+	notes []string // Converted footnotes, numbered from 1
+	block string   // Open block: "p", "pre", "table", "quote" or "" for none
+	lists []string // Open lists, outermost first: "ul" or "ol"
+}
+
+// title returns the title of the page with the given id
+func (c *dokuConverter) title(id string) string {
+	if t, ok := c.titles[id]; ok {
+		return t
+	}
+	return dokuTitle(id)
+}
+
+// mediaTarget returns the page a media file with the given id is attached to
+// and its attachment name
+func (c *dokuConverter) mediaTarget(id string) (string, string) {
+	ns, name := dokuNamespace(id), id[strings.LastIndexByte(id, ':')+1:]
+	return c.title(resolveDokuID(ns+":", "")), attachmentName(name)
+}
+
+// convert returns a page body in the wiki's markup
+func (c *dokuConverter) convert(body []byte, ns string) []byte {
+	c.ns, c.notes = ns, nil
+	c.out.Reset()
+
+	code := "" // Closing tag of the open code block
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if code != "" {
+			if before, _, ok := strings.Cut(line, code); ok {
+				c.out.WriteString(preText(before) + "</pre>\n")
+				code = ""
+			} else {
+				c.out.WriteString(preText(line) + "\n")
+			}
+			continue
+		}
+		line = dokuMacro.ReplaceAllString(line, "")
+
+		if m := dokuCodeStart.FindStringSubmatch(line); m != nil {
+			c.closeBlocks()
+			closing := "</" + m[1] + ">"
+			c.out.WriteString("<pre>")
+			if before, _, ok := strings.Cut(m[2], closing); ok {
+				c.out.WriteString(preText(before) + "</pre>\n")
+			} else {
+				if m[2] != "" {
+					c.out.WriteString(preText(m[2]) + "\n")
+				}
+				code = closing
+			}
+			continue
+		}
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			c.closeBlocks()
+			c.out.WriteString("\n")
+		case dokuHeading.MatchString(line):
+			m := dokuHeading.FindStringSubmatch(line)
+			c.closeBlocks()
+			c.out.WriteString(strings.Repeat("#", 7-len(m[1])) + " " + c.inline(m[2]) + "\n")
+		case dokuRule.MatchString(line):
+			c.closeBlocks()
+			c.out.WriteString("<hr>\n")
+		case dokuListItem.MatchString(line):
+			m := dokuListItem.FindStringSubmatch(line)
+			c.listItem(m[1], m[2], m[3])
+		case dokuTableRow.MatchString(line):
+			c.tableRow(strings.TrimSpace(line))
+		case dokuQuote.MatchString(line):
+			c.openBlock("quote", "<blockquote>")
+			c.out.WriteString(c.inline(dokuQuote.FindStringSubmatch(line)[2]))
+		case strings.HasPrefix(line, "  ") || strings.HasPrefix(line, "\t"):
+			c.openBlock("pre", "<pre>")
+			c.out.WriteString(preText(strings.TrimPrefix(strings.TrimPrefix(line, "  "), "\t")))
+		default:
+			c.openBlock("p", "<p>")
+			c.out.WriteString(c.inline(line))
+		}
+	}
+	if code != "" {
+		c.out.WriteString("</pre>\n")
+	}
+	c.closeBlocks()
+
+	if len(c.notes) > 0 {
+		c.out.WriteString("<hr>\n")
+		for i, note := range c.notes {
+			fmt.Fprintf(&c.out, "<p id=\"fn%[1]d\"><sup><a href=\"#fnref%[1]d\">%[1]d</a></sup> %s</p>\n", i+1, note)
+		}
+	}
+	return bytes.Clone(bytes.TrimSpace(c.out.Bytes()))
+}
+
+// openBlock starts a block of the given kind with its opening tag, or
+// continues the open one on a new line
+func (c *dokuConverter) openBlock(kind, open string) {
+	if c.block == kind {
+		c.out.WriteString("\n")
+		return
+	}
+	c.closeBlocks()
+	c.block = kind
+	c.out.WriteString(open)
+}
+
+// closeBlocks ends the open block and lists
+func (c *dokuConverter) closeBlocks() {
+	switch c.block {
+	case "p":
+		c.out.WriteString("</p>\n")
+	case "pre":
+		c.out.WriteString("</pre>\n")
+	case "table":
+		c.out.WriteString("</table>\n")
+	case "quote":
+		c.out.WriteString("</blockquote>\n")
+	}
+	c.block = ""
+	for len(c.lists) > 0 {
+		c.closeList()
+	}
+}
+
+// closeList ends the innermost open list
+func (c *dokuConverter) closeList() {
+	c.out.WriteString("</li></" + c.lists[len(c.lists)-1] + ">\n")
+	c.lists = c.lists[:len(c.lists)-1]
+}
+
+// listItem writes a list item, nesting it by its indentation: two spaces or a
+// tab per level. "*" marks unordered items and "-" numbered ones.
+func (c *dokuConverter) listItem(indent, marker, text string) {
+	if c.block != "" {
+		lists := c.lists
+		c.lists = nil
+		c.closeBlocks()
+		c.lists = lists
+	}
+	depth := len(indent) / 2
+	if indent[0] == '\t' {
+		depth = len(indent)
+	}
+	kind := "ul"
+	if marker == "-" {
+		kind = "ol"
+	}
+
+	for len(c.lists) > depth {
+		c.closeList()
+	}
+	if len(c.lists) == depth && c.lists[depth-1] != kind {
+		c.closeList()
+	}
+	if len(c.lists) == depth {
+		c.out.WriteString("</li>\n<li>")
+	}
+	for len(c.lists) < depth {
+		c.lists = append(c.lists, kind)
+		c.out.WriteString("<" + kind + ">\n<li>")
+	}
+	c.out.WriteString(c.inline(text))
+}
+
+// tableRow writes a table row. Cells following ^ are headers, cells following | data.
+func (c *dokuConverter) tableRow(line string) {
+	c.openBlock("table", "<table>\n")
+	c.out.WriteString("<tr>")
+	for _, cell := range splitDokuCells(line) {
+		tag := "td"
+		if cell[0] == '^' {
+			tag = "th"
+		}
+		text := strings.TrimSpace(cell[1:])
+		if text == ":::" { // Continues the cell above
+			text = ""
+		}
+		c.out.WriteString("<" + tag + ">" + c.inline(text) + "</" + tag + ">")
+	}
+	c.out.WriteString("</tr>")
+}
+
+// splitDokuCells splits a table row into its cells, each starting with its
+// separator. Separators inside links and media don't split cells, and the
+// closing separator of the row is dropped.
+func splitDokuCells(line string) []string {
+	var cells []string
+	depth, start := 0, 0
+	for i := 0; i < len(line); i++ {
+		switch {
+		case strings.HasPrefix(line[i:], "[[") || strings.HasPrefix(line[i:], "{{"):
+			depth++
+			i++
+		case depth > 0 && (strings.HasPrefix(line[i:], "]]") || strings.HasPrefix(line[i:], "}}")):
+			depth--
+			i++
+		case depth == 0 && (line[i] == '^' || line[i] == '|') && i > start:
+			cells = append(cells, line[start:i])
+			start = i
+		}
+	}
+	if rest := strings.TrimSpace(line[start:]); len(rest) > 1 {
+		cells = append(cells, line[start:])
+	}
+	return cells
+}
+
+// inline converts the inline markup of a line. Formatting left open at the
+// end of the line is closed there.
+func (c *dokuConverter) inline(text string) string {
+	var b strings.Builder
+	var open []string // Markers of open formatting, innermost last
+	last := 0
+	for _, m := range dokuInline.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(importText.Replace(text[last:m[0]]))
+		last = m[1]
+		token := text[m[0]:m[1]]
+		group := func(n int) string { return text[m[2*n]:m[2*n+1]] }
+
+		switch {
+		case m[2] >= 0:
+			b.WriteString(c.link(group(1)))
+		case m[4] >= 0:
+			b.WriteString(c.media(group(2)))
+		case m[6] >= 0:
+			b.WriteString(importText.Replace(group(3)))
+		case m[8] >= 0:
+			b.WriteString(importText.Replace(group(4)))
+		case m[10] >= 0:
+			c.notes = append(c.notes, c.inline(group(5)))
+			fmt.Fprintf(&b, "<sup id=\"fnref%[1]d\"><a href=\"#fn%[1]d\">%[1]d</a></sup>", len(c.notes))
+		case strings.Contains(token, "://"):
+			url := strings.TrimRight(token, ".,;:!?)") // Punctuation ending a sentence
+			b.WriteString(`<a href="` + url + `">` + url + `</a>` + token[len(url):])
+		case strings.HasPrefix(token, `\\`):
+			b.WriteString("<br>")
+		case token[0] == '<':
+			b.WriteString(token)
+		default:
+			tag := dokuToggles[token]
+			if i := indexOf(open, token); i >= 0 {
+				b.WriteString("</" + tag + ">")
+				open = append(open[:i], open[i+1:]...)
+			} else {
+				b.WriteString("<" + tag + ">")
+				open = append(open, token)
+			}
+		}
+	}
+	b.WriteString(importText.Replace(text[last:]))
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + dokuToggles[open[i]] + ">")
+	}
+	return b.String()
+}
+
+// indexOf returns the position of s in list, or -1
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// link converts the target and optional label of a [[link]]
+func (c *dokuConverter) link(inner string) string {
+	target, label, hasLabel := strings.Cut(inner, "|")
+	target = strings.TrimSpace(target)
+	if hasLabel {
+		label = c.inline(strings.TrimSpace(label))
+	}
+
+	switch {
+	case strings.Contains(target, "://") || strings.HasPrefix(target, "mailto:"):
+		if !hasLabel {
+			label = importText.Replace(target)
+		}
+		return `<a href="` + importText.Replace(target) + `">` + label + `</a>`
+	case strings.Contains(target, ">"): // Interwiki links have no equivalent
+		if hasLabel {
+			return label
+		}
+		return importText.Replace(target)
+	}
+
+	page, anchor, _ := strings.Cut(target, "#")
+	if page == "" {
+		if !hasLabel {
+			label = importText.Replace(anchor)
+		}
+		return `<a href="#` + headingSlug(anchor) + `">` + label + `</a>`
+	}
+	title := c.title(resolveDokuID(page, c.ns))
+	if !hasLabel && anchor == "" {
+		return "[" + title + "]"
+	}
+	href := "/view/" + titleURL(title)
+	if anchor != "" {
+		href += "#" + headingSlug(anchor)
+	}
+	if !hasLabel {
+		label = title
+	}
+	return `<a href="` + href + `">` + label + `</a>`
+}
+
+// media converts a {{media}} reference to an image or file link, or an
+// include plugin reference {{page>id}} to a transclusion
+func (c *dokuConverter) media(inner string) string {
+	ref, caption, _ := strings.Cut(inner, "|")
+	ref, caption = strings.TrimSpace(ref), strings.TrimSpace(caption)
+	if id, ok := strings.CutPrefix(ref, "page>"); ok {
+		id, _, _ = strings.Cut(id, "#")
+		return includePrefix + c.title(resolveDokuID(id, c.ns)) + includeSuffix
+	}
+
+	ref, params, _ := strings.Cut(ref, "?")
+	var src, name string
+	if strings.Contains(ref, "://") {
+		src, name = ref, ref[strings.LastIndexByte(ref, '/')+1:]
+	} else {
+		id := strings.ToLower(strings.TrimPrefix(ref, ":"))
+		if !strings.Contains(ref, ":") && c.ns != "" {
+			id = c.ns + ":" + id
+		}
+		owner, file := c.mediaTarget(id)
+		src, name = attachmentURL(owner, file), file
+	}
+	src = importText.Replace(src)
+
+	if !dokuImageExts[strings.ToLower(filepath.Ext(name))] {
+		if caption == "" {
+			caption = name
+		}
+		return `<a href="` + src + `">` + importText.Replace(caption) + `</a>`
+	}
+	img := `<img src="` + src + `" alt="` + strings.ReplaceAll(importText.Replace(caption), `"`, "&quot;") + `"`
+	width, _, _ := strings.Cut(params, "x")
+	if width != "" && strings.Trim(width, "0123456789") == "" {
+		img += ` width="` + width + `"`
+	}
+	return img + ">"
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// =============================================================================
+// DRAFTS
+// =============================================================================
+
+// Draft is the text of the edit form autosaved while someone edits a page, so
+// it can be restored after the browser crashes or the tab is closed
+type Draft struct {
+	Title   string    `json:"title"`
+	Body    string    `json:"body"`
+	Summary string    `json:"summary,omitempty"`
+	Base    string    `json:"base,omitempty"` // ETag of the page the edit started from
+	Saved   time.Time `json:"saved"`
+}
+
+// draftOwner names whose drafts a request reads and writes: the account or
+// token it carries, or else the browser, known by its CSRF cookie. It is ""
+// for clients with neither, which get no drafts.
+func (s *Server) draftOwner(r *http.Request) string {
+	if name := s.tokenName(r); name != "" {
+		return "user-" + escapeStem(name)
+	}
+	if c, err := r.Cookie(csrfCookie); err == nil && c.Value != "" {
+		return "browser-" + escapeStem(c.Value)
+	}
+	return ""
+}
+
+// draftPath returns the file holding an owner's draft of a page
+func draftPath(dataDir, owner, title string) string {
+	return filepath.Join(dataDir, draftsDir, owner, fileStem(title)+".json")
+}
+
+// loadDraft returns the reader's draft of a page, or nil when there is none
+func (s *Server) loadDraft(r *http.Request, title string) (*Draft, error) {
+	owner := s.draftOwner(r)
+	if owner == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(draftPath(s.cfg().DataDir, owner, title))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var d Draft
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// discardDraft removes the reader's draft of a page, if there is one
+func (s *Server) discardDraft(r *http.Request, title string) error {
+	owner := s.draftOwner(r)
+	if owner == "" {
+		return nil
+	}
+	dir := filepath.Join(s.cfg().DataDir, draftsDir)
+	if err := os.Remove(draftPath(s.cfg().DataDir, owner, title)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	removeEmptyDirs(dir, filepath.Join(dir, owner))
+	return nil
+}
+
+// draftHandler stores the edit form's text as the reader's draft of a page,
+// answering 204 No Content to the form's background autosaves. Posting
+// discard removes the draft and returns to the edit form.
+func (s *Server) draftHandler(w http.ResponseWriter, r *http.Request, title string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.FormValue("discard") != "" {
+		if err := s.discardDraft(r, title); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/edit/"+titleURL(title), http.StatusSeeOther)
+		return
+	}
+
+	owner := s.draftOwner(r)
+	if owner == "" {
+		http.Error(w, "Drafts are kept for logged-in users and browsers accepting cookies", http.StatusBadRequest)
+		return
+	}
+	data, err := json.MarshalIndent(Draft{
+		Title:   title,
+		Body:    r.FormValue("body"),
+		Summary: r.FormValue("summary"),
+		Base:    r.FormValue("base"),
+		Saved:   time.Now().UTC(),
+	}, "", "\t")
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	path := draftPath(s.cfg().DataDir, owner, title)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// =============================================================================
+// NEAR-DUPLICATE DETECTION
+// =============================================================================
+
+// Parameters of near-duplicate detection. Pages are compared by the word
+// shingles they share: MinHash signatures estimate the Jaccard similarity of
+// two pages' shingle sets, and locality-sensitive hashing over bands of the
+// signature finds candidate pairs without comparing every page to every other.
+const (
+	shingleSize         = 5   // Words per shingle
+	minHashes           = 64  // Signature length
+	minHashBands        = 16  // Bands of minHashes/minHashBands rows each
+	duplicateThreshold  = 0.7 // Estimated similarity from which pages are reported
+	duplicateCheckEvery = 10 * time.Minute
+)
+
+// duplicatesFile is the file below indexDir caching the latest report
+const duplicatesFile = "duplicates.json"
+
+// DuplicatePair is two pages with highly similar content
+type DuplicatePair struct {
+	A          string  `json:"a"`
+	B          string  `json:"b"`
+	Similarity float64 `json:"similarity"` // Estimated Jaccard similarity of their shingles, 0 to 1
+}
+
+// Percent returns the similarity as a whole percentage for display
+func (d DuplicatePair) Percent() int {
+	return int(d.Similarity*100 + 0.5)
+}
+
+// DuplicateReport is the outcome of one scan for near-duplicate pages
+type DuplicateReport struct {
+	Scanned time.Time       `json:"scanned"`
+	Pages   int             `json:"pages"` // Pages compared
+	Pairs   []DuplicatePair `json:"pairs"` // Most similar first
+}
+
+// shingles returns the hashes of the overlapping word sequences of text, with
+// case and spacing ignored. Texts shorter than a shingle form one.
+func shingles(text string) map[uint64]bool {
+	words := strings.Fields(strings.ToLower(text))
+	if len(words) == 0 {
+		return nil
+	}
+	n := min(shingleSize, len(words))
+	set := make(map[uint64]bool, len(words)-n+1)
+	for i := 0; i+n <= len(words); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(words[i:i+n], " ")))
+		set[h.Sum64()] = true
+	}
+	return set
+}
+
+// mix64 scrambles x so each seed yields an independent hash function (splitmix64 finalizer)
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// minHash returns the MinHash signature of a shingle set
+func minHash(set map[uint64]bool) []uint64 {
+	sig := make([]uint64, minHashes)
+	for i := range sig {
+		sig[i] = ^uint64(0)
+	}
+	for sh := range set {
+		for i := range sig {
+			if h := mix64(sh ^ mix64(uint64(i)+1)); h < sig[i] {
+				sig[i] = h
+			}
+		}
+	}
+	return sig
+}
+
+// signatureSimilarity estimates the Jaccard similarity of two sets from their signatures
+func signatureSimilarity(a, b []uint64) float64 {
+	same := 0
+	for i := range a {
+		if a[i] == b[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(len(a))
+}
+
+// findDuplicates compares every page's content and reports the pairs whose
+// estimated similarity reaches the threshold. Redirects and empty pages are skipped.
+func findDuplicates(ctx context.Context, store PageStore) (*DuplicateReport, error) {
+	titles, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(titles)
+
+	report := &DuplicateReport{}
+	signatures := make(map[string][]uint64)
+	buckets := make(map[[2]uint64][]string) // Band number and band hash to the pages sharing it
+	rows := minHashes / minHashBands
+	for _, title := range titles {
+		p, err := store.Load(ctx, title)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		if _, ok := redirectTarget(p.Body); ok {
+			continue
+		}
+		set := shingles(string(pageContent(p.Body)))
+		if len(set) == 0 {
+			continue
+		}
+		sig := minHash(set)
+		signatures[title] = sig
+		report.Pages++
+
+		for band := 0; band < minHashBands; band++ {
+			h := fnv.New64a()
+			for _, v := range sig[band*rows : (band+1)*rows] {
+				var b [8]byte
+				for i := range b {
+					b[i] = byte(v >> (8 * i))
+				}
+				h.Write(b[:])
+			}
+			key := [2]uint64{uint64(band), h.Sum64()}
+			buckets[key] = append(buckets[key], title)
+		}
+	}
+
+	seen := make(map[[2]string]bool)
+	for _, bucket := range buckets {
+		for i, a := range bucket {
+			for _, b := range bucket[i+1:] {
+				pair := [2]string{a, b}
+				if seen[pair] {
+					continue
+				}
+				seen[pair] = true
+				if sim := signatureSimilarity(signatures[a], signatures[b]); sim >= duplicateThreshold {
+					report.Pairs = append(report.Pairs, DuplicatePair{A: a, B: b, Similarity: sim})
+				}
+			}
+		}
+	}
+	sort.Slice(report.Pairs, func(i, j int) bool {
+		pi, pj := report.Pairs[i], report.Pairs[j]
+		if pi.Similarity != pj.Similarity {
+			return pi.Similarity > pj.Similarity
+		}
+		if pi.A != pj.A {
+			return pi.A < pj.A
+		}
+		return pi.B < pj.B
+	})
+	report.Scanned = time.Now().UTC()
+	return report, nil
+}
+
+// =============================================================================
+// DUPLICATE SCANNING JOB
+// =============================================================================
+
+// duplicateScanner caches the latest near-duplicate report and rescans in the
+// background once pages have changed
+type duplicateScanner struct {
+	path  string
+	stale atomic.Bool   // Set when a page changed since the last scan
+	now   chan struct{} // Requests an immediate scan
+
+	mu     sync.RWMutex
+	report *DuplicateReport // Nil until the first scan
+}
+
+// newDuplicateScanner returns a scanner caching its report below the data
+// directory, starting from the report of the previous run if there is one
+func newDuplicateScanner(dataDir string) *duplicateScanner {
+	ds := &duplicateScanner{path: filepath.Join(dataDir, indexDir, duplicatesFile), now: make(chan struct{}, 1)}
+	ds.stale.Store(true)
+	if data, err := os.ReadFile(ds.path); err == nil {
+		var report DuplicateReport
+		if json.Unmarshal(data, &report) == nil {
+			ds.report = &report
+		}
+	}
+	return ds
+}
+
+// markStale records that the cached report may be out of date
+func (ds *duplicateScanner) markStale(title string) {
+	ds.stale.Store(true)
+}
+
+// requestScan asks the background job to scan as soon as possible
+func (ds *duplicateScanner) requestScan() {
+	ds.stale.Store(true)
+	select {
+	case ds.now <- struct{}{}:
+	default:
+	}
+}
+
+// latest returns the cached report, nil before the first scan
+func (ds *duplicateScanner) latest() *DuplicateReport {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return ds.report
+}
+
+// scan finds near-duplicates and caches the report
+func (ds *duplicateScanner) scan(ctx context.Context, store PageStore) error {
+	ds.stale.Store(false)
+	report, err := findDuplicates(ctx, store)
+	if err != nil {
+		ds.stale.Store(true)
+		return err
+	}
+
+	ds.mu.Lock()
+	ds.report = report
+	ds.mu.Unlock()
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ds.path), 0755); err != nil {
+		return err
+	}
+	tmp := ds.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ds.path)
+}
+
+// runDuplicateScan rescans for near-duplicates whenever pages changed since
+// the last scan, checking periodically, until ctx is done
+func (s *Server) runDuplicateScan(ctx context.Context) {
+	for {
+		if s.duplicates.stale.Load() {
+			if err := s.duplicates.scan(ctx, s.store); err != nil && !errors.Is(err, context.Canceled) {
+				slog.Error("Scanning for duplicate pages failed", "err", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.duplicates.now:
+		case <-time.After(duplicateCheckEvery):
+		}
+	}
+}
+
+// DuplicatesPage contains data for rendering the near-duplicate report
+type DuplicatesPage struct {
+	Report    *DuplicateReport // Nil before the first scan
+	Stale     bool             // Whether pages changed since the report was made
+	CanRescan bool             // Whether the reader may request a rescan
+
+	csrfForm
+	themedPage
+}
+
+// duplicatesHandler displays the cached near-duplicate report
+func (s *Server) duplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	s.renderTemplate(w, r, "duplicates", &DuplicatesPage{
+		Report:    s.duplicates.latest(),
+		Stale:     s.duplicates.stale.Load(),
+		CanRescan: s.hasScope(r, scopeAdmin),
+	})
+}
+
+// rescanDuplicatesHandler requests a rescan, which runs in the background.
+// Scans compare every page, so only admins may ask for one.
+func (s *Server) rescanDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	s.duplicates.requestScan()
+	http.Redirect(w, r, "/reports/duplicates", http.StatusSeeOther)
+}
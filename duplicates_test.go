@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRescanDuplicates checks that only admins may ask for a duplicate scan
+func TestRescanDuplicates(t *testing.T) {
+	s, reqs := newCredentialServer(t, nil)
+	for name, status := range map[string]int{
+		"anonymous":    http.StatusUnauthorized,
+		"writer":       http.StatusForbidden,
+		"user session": http.StatusForbidden,
+		"ops":          http.StatusSeeOther,
+		"admin token":  http.StatusSeeOther,
+	} {
+		for len(s.duplicates.now) > 0 {
+			<-s.duplicates.now
+		}
+		r := httptest.NewRequest(http.MethodPost, "/reports/duplicates", strings.NewReader("csrf=token"))
+		r.Header = reqs[name].Header.Clone()
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: csrfCookie, Value: "token"})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != status {
+			t.Errorf("%s: status %d, want %d", name, w.Code, status)
+		}
+		if requested := len(s.duplicates.now) > 0; requested != (status == http.StatusSeeOther) {
+			t.Errorf("%s: scan requested = %v", name, requested)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/reports/duplicates", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "Rescan now") {
+		t.Errorf("anonymous GET: status %d, rescan offered = %v", w.Code, strings.Contains(w.Body.String(), "Rescan now"))
+	}
+}
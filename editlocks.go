@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// =============================================================================
+// EDIT LOCKS
+// =============================================================================
+
+// editLockTTL is how long an edit lock lasts without a heartbeat from the
+// edit form, which sends one every editLockTTL/3 while it is open
+const editLockTTL = 90 * time.Second
+
+// editLock marks a page as being edited. It is advisory: others are warned
+// off the page but may still save it, with conflicts caught when they do.
+type editLock struct {
+	owner   string    // Editor holding the lock, told apart like draft owners
+	name    string    // Account or token name shown to others, empty for anonymous editors
+	since   time.Time // When the editor opened the edit form
+	expires time.Time
+}
+
+// editLockManager tracks who is editing which page, shared by the edit form,
+// its heartbeats and saves
+type editLockManager struct {
+	mu    sync.Mutex
+	locks map[string]*editLock
+}
+
+// newEditLockManager returns a manager with no page locked
+func newEditLockManager() *editLockManager {
+	return &editLockManager{locks: make(map[string]*editLock)}
+}
+
+// acquire locks a page for owner, or extends the lock owner already holds,
+// unless another editor holds it, returning that editor's lock. takeover
+// takes the lock from them regardless. The edit form's heartbeats acquire
+// the lock again, so it lasts while the form is open.
+func (m *editLockManager) acquire(title, owner, name string, takeover bool, now time.Time) *editLock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune(now)
+	l := m.locks[title]
+	switch {
+	case l != nil && l.owner != owner && !takeover:
+		held := *l
+		return &held
+	case l != nil && l.owner == owner:
+		l.expires = now.Add(editLockTTL)
+	default:
+		m.locks[title] = &editLock{owner: owner, name: name, since: now, expires: now.Add(editLockTTL)}
+	}
+	return nil
+}
+
+// release drops owner's lock on a page, leaving others' locks alone
+func (m *editLockManager) release(title, owner string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l := m.locks[title]; l != nil && l.owner == owner {
+		delete(m.locks, title)
+	}
+}
+
+// prune forgets the locks whose editors stopped sending heartbeats
+func (m *editLockManager) prune(now time.Time) {
+	for title, l := range m.locks {
+		if !now.Before(l.expires) {
+			delete(m.locks, title)
+		}
+	}
+}
+
+// lockForEditing locks the page the reader opened the edit form for,
+// filling in who else is editing it when someone is. Browsers on their first
+// visit are issued their CSRF cookie first, which tells them apart.
+func (s *Server) lockForEditing(w http.ResponseWriter, r *http.Request, p *Page) {
+	s.csrfToken(w, r)
+	owner := s.draftOwner(r)
+	if l := s.editLocks.acquire(p.Title, owner, s.tokenName(r), false, time.Now()); l != nil {
+		p.Locked = true
+		p.LockedBy, p.LockedSince = l.name, l.since
+	}
+}
+
+// editLockHandler receives the heartbeats of an open edit form, answering
+// 204 No Content while the reader holds the page's lock and 409 Conflict
+// naming the editor who took it over. Posting release drops the lock when
+// the form is closed, and posting takeover takes the lock from whoever holds
+// it, returning to the edit form.
+func (s *Server) editLockHandler(w http.ResponseWriter, r *http.Request, title string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	owner := s.draftOwner(r)
+	if owner == "" {
+		http.Error(w, "Edit locks are kept for logged-in users and browsers accepting cookies", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("release") != "" {
+		s.editLocks.release(title, owner)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	takeover := r.FormValue("takeover") != ""
+	if l := s.editLocks.acquire(title, owner, s.tokenName(r), takeover, time.Now()); l != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"editor": l.name})
+		return
+	}
+	if takeover {
+		http.Redirect(w, r, "/edit/"+titleURL(title), http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestEditLockTakeover checks that a browser takes over another's edit lock
+// only by posting the takeover form with its CSRF token
+func TestEditLockTakeover(t *testing.T) {
+	s := newTestServer(t, nil)
+	savePages(t, s, map[string]string{"Home": "Hello.\n"})
+	send := func(browser, method, target, form string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(form))
+		if form != "" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		r.AddCookie(&http.Cookie{Name: csrfCookie, Value: browser})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	send("first", http.MethodGet, "/edit/Home", "")
+	if w := send("second", http.MethodGet, "/edit/Home", ""); !strings.Contains(w.Body.String(), `value="Take over editing"`) {
+		t.Fatalf("the second editor isn't offered to take over:\n%s", w.Body)
+	}
+	send("second", http.MethodGet, "/edit/Home?takeover", "")
+	if w := send("second", http.MethodPost, "/editlock/Home", "takeover=1"); w.Code != http.StatusForbidden {
+		t.Errorf("takeover without the CSRF token: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := send("first", http.MethodPost, "/editlock/Home", "csrf=first"); w.Code != http.StatusNoContent {
+		t.Fatalf("first editor's heartbeat: status %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	w := send("second", http.MethodPost, "/editlock/Home", "csrf=second&takeover=1")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/edit/Home" {
+		t.Errorf("takeover: status %d to %q, want %d to /edit/Home", w.Code, w.Header().Get("Location"), http.StatusSeeOther)
+	}
+	if w := send("first", http.MethodPost, "/editlock/Home", "csrf=first"); w.Code != http.StatusConflict {
+		t.Errorf("first editor's heartbeat after the takeover: status %d, want %d", w.Code, http.StatusConflict)
+	}
+}
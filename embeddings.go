@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// =============================================================================
+// EMBEDDINGS
+// =============================================================================
+
+// Limits on semantic search
+const (
+	maxEmbeddingInput  = 8 << 10 // Bytes of page content embedded
+	maxSemanticResults = 20
+	minSemanticScore   = 0.2 // Cosine similarity below which pages aren't considered related
+	embeddingTimeout   = time.Minute
+)
+
+// embeddingsFile is the file below indexDir holding the page vectors
+const embeddingsFile = "embeddings.json"
+
+// Embedder turns texts into vectors whose cosine similarity reflects how
+// related their meanings are. It is the integration point for embedding providers.
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// embedder returns the provider configured for semantic search, or nil when
+// semantic search is disabled
+func (s *Server) embedder() Embedder {
+	cfg := s.cfg()
+	if cfg.EmbeddingURL == "" {
+		return nil
+	}
+	return &apiEmbedder{url: cfg.EmbeddingURL, key: cfg.EmbeddingKey, model: cfg.EmbeddingModel}
+}
+
+// apiEmbedder requests vectors from an OpenAI-compatible embeddings endpoint
+type apiEmbedder struct {
+	url   string
+	key   string // Sent as a bearer token when set
+	model string
+}
+
+// embeddingRequest is the body of an embeddings request
+type embeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+// embeddingResponse is the part of an embeddings response the wiki reads
+type embeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+// Embed sends the texts to the embeddings endpoint and returns their vectors in order
+func (e *apiEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	payload, err := json.Marshal(embeddingRequest{Model: e.model, Input: texts})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.key != "" {
+		req.Header.Set("Authorization", "Bearer "+e.key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("embedding provider responded with %s", resp.Status)
+	}
+
+	var reply embeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("decoding embedding response: %w", err)
+	}
+	vectors := make([][]float32, len(texts))
+	for _, d := range reply.Data {
+		if d.Index >= 0 && d.Index < len(vectors) {
+			vectors[d.Index] = d.Embedding
+		}
+	}
+	for _, v := range vectors {
+		if len(v) == 0 {
+			return nil, errors.New("embedding provider returned fewer vectors than texts")
+		}
+	}
+	return vectors, nil
+}
+
+// cosineSimilarity returns the cosine of the angle between two vectors, 0 when
+// their dimensions differ or either is zero
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(normA*normB)
+}
+
+// =============================================================================
+// VECTOR INDEX
+// =============================================================================
+
+// pageVector is the embedding of a page's content
+type pageVector struct {
+	Source string    `json:"source"` // ETag of the content that was embedded
+	Lang   string    `json:"lang"`
+	Vector []float32 `json:"vector"`
+}
+
+// vectorIndex holds the embedding of every page in memory, persisted as one
+// JSON file with the other rebuildable indexes
+type vectorIndex struct {
+	path string
+
+	mu      sync.RWMutex
+	loaded  bool
+	entries map[string]pageVector
+}
+
+// newVectorIndex returns the vector index stored below the data directory
+func newVectorIndex(dataDir string) *vectorIndex {
+	return &vectorIndex{path: filepath.Join(dataDir, indexDir, embeddingsFile), entries: make(map[string]pageVector)}
+}
+
+// load reads the index file the first time the index is used. Callers hold mu for writing.
+func (vi *vectorIndex) load() {
+	if vi.loaded {
+		return
+	}
+	vi.loaded = true
+	data, err := os.ReadFile(vi.path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Reading vector index failed", "err", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &vi.entries); err != nil {
+		slog.Warn("Decoding vector index failed, rebuilding it", "err", err)
+		vi.entries = make(map[string]pageVector)
+	}
+}
+
+// save writes the index file. Callers hold mu.
+func (vi *vectorIndex) save() error {
+	data, err := json.Marshal(vi.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(vi.path), 0755); err != nil {
+		return err
+	}
+	tmp := vi.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, vi.path)
+}
+
+// get returns the vector of a page, reporting false when it has none
+func (vi *vectorIndex) get(title string) (pageVector, bool) {
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+	vi.load()
+	v, ok := vi.entries[title]
+	return v, ok
+}
+
+// put stores the vector of a page
+func (vi *vectorIndex) put(title string, v pageVector) error {
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+	vi.load()
+	vi.entries[title] = v
+	return vi.save()
+}
+
+// remove deletes the vector of a page
+func (vi *vectorIndex) remove(title string) error {
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+	vi.load()
+	if _, ok := vi.entries[title]; !ok {
+		return nil
+	}
+	delete(vi.entries, title)
+	return vi.save()
+}
+
+// rename moves a page's vector along with the page
+func (vi *vectorIndex) rename(from, to string) error {
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+	vi.load()
+	v, ok := vi.entries[from]
+	if !ok {
+		return nil
+	}
+	delete(vi.entries, from)
+	vi.entries[to] = v
+	return vi.save()
+}
+
+// nearest returns the pages whose vectors are most similar to query, best
+// first, optionally limited to a language
+func (vi *vectorIndex) nearest(query []float32, lang string, limit int) []SearchResult {
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+	vi.load()
+
+	var results []SearchResult
+	for title, v := range vi.entries {
+		if lang != "" && !langMatches(v.Lang, lang) {
+			continue
+		}
+		if score := cosineSimilarity(query, v.Vector); score >= minSemanticScore {
+			results = append(results, SearchResult{Title: title, Lang: v.Lang, Score: score})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Title < results[j].Title
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// =============================================================================
+// INDEXING AND SEMANTIC SEARCH
+// =============================================================================
+
+// queueEmbedding schedules a changed page to be embedded, when semantic search is enabled
+func (s *Server) queueEmbedding(title string) {
+	if s.embedder() != nil {
+		s.embeddingQueue.add(title)
+	}
+}
+
+// runEmbeddings keeps the vector index up to date in the background until ctx
+// is done. Pages are first checked once so those saved before semantic search
+// was enabled get indexed too.
+func (s *Server) runEmbeddings(ctx context.Context) {
+	if s.embedder() != nil {
+		if titles, err := s.store.List(ctx); err == nil {
+			for _, title := range titles {
+				s.embeddingQueue.add(title)
+			}
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.embeddingQueue.wake:
+		}
+		for _, title := range s.embeddingQueue.take() {
+			if err := s.embedPage(ctx, title); err != nil && ctx.Err() == nil {
+				slog.Error("Indexing for semantic search failed", "title", title, "err", err)
+			}
+		}
+	}
+}
+
+// embedPage updates the vector of a page unless its current content is
+// already indexed. Pages that were removed, emptied or turned into redirects
+// are dropped from the index.
+func (s *Server) embedPage(ctx context.Context, title string) error {
+	embedder := s.embedder()
+	if embedder == nil {
+		return nil
+	}
+
+	p, err := s.store.Load(ctx, title)
+	if errors.Is(err, os.ErrNotExist) {
+		return s.vectors.remove(title)
+	}
+	if err != nil {
+		return err
+	}
+	content := bytes.TrimSpace(pageContent(p.Body))
+	if _, ok := redirectTarget(p.Body); ok || len(content) == 0 {
+		return s.vectors.remove(title)
+	}
+	source := bodyETag(content)
+	if v, ok := s.vectors.get(title); ok && v.Source == source {
+		return nil
+	}
+
+	if len(content) > maxEmbeddingInput {
+		content = content[:maxEmbeddingInput]
+		for len(content) > 0 && !isRuneStart(content[len(content)-1]) {
+			content = content[:len(content)-1]
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, embeddingTimeout)
+	defer cancel()
+	vectors, err := embedder.Embed(ctx, []string{title + "\n\n" + string(content)})
+	if err != nil {
+		return err
+	}
+	return s.vectors.put(title, pageVector{Source: source, Lang: contentLang(p, s.cfg().DefaultLang), Vector: vectors[0]})
+}
+
+// semanticSearch returns the pages whose meaning is closest to query
+func (s *Server) semanticSearch(ctx context.Context, embedder Embedder, query, lang string) ([]SearchResult, error) {
+	vectors, err := embedder.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	return s.vectors.nearest(vectors[0], lang, maxSemanticResults), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// =============================================================================
+// EMOJI SHORTCODES
+// =============================================================================
+
+// defaultEmoji maps the built-in shortcodes, written between colons as in
+// :warning:, to the emoji they stand for
+var defaultEmoji = map[string]string{
+	"+1":                       "👍",
+	"-1":                       "👎",
+	"100":                      "💯",
+	"arrow_down":               "⬇️",
+	"arrow_left":               "⬅️",
+	"arrow_right":              "➡️",
+	"arrow_up":                 "⬆️",
+	"bangbang":                 "‼️",
+	"bell":                     "🔔",
+	"book":                     "📖",
+	"bookmark":                 "🔖",
+	"bug":                      "🐛",
+	"bulb":                     "💡",
+	"calendar":                 "📅",
+	"chart_with_upwards_trend": "📈",
+	"check":                    "✔️",
+	"clap":                     "👏",
+	"clipboard":                "📋",
+	"construction":             "🚧",
+	"cry":                      "😢",
+	"eyes":                     "👀",
+	"fire":                     "🔥",
+	"gear":                     "⚙️",
+	"grin":                     "😁",
+	"hammer":                   "🔨",
+	"heart":                    "❤️",
+	"heavy_check_mark":         "✔️",
+	"hourglass":                "⌛",
+	"information_source":       "ℹ️",
+	"key":                      "🔑",
+	"laughing":                 "😆",
+	"link":                     "🔗",
+	"lock":                     "🔒",
+	"mag":                      "🔍",
+	"memo":                     "📝",
+	"no_entry":                 "⛔",
+	"ok":                       "🆗",
+	"ok_hand":                  "👌",
+	"package":                  "📦",
+	"pencil":                   "✏️",
+	"pushpin":                  "📌",
+	"question":                 "❓",
+	"rocket":                   "🚀",
+	"rotating_light":           "🚨",
+	"smile":                    "😄",
+	"sparkles":                 "✨",
+	"star":                     "⭐",
+	"stop_sign":                "🛑",
+	"tada":                     "🎉",
+	"thinking":                 "🤔",
+	"thumbsdown":               "👎",
+	"thumbsup":                 "👍",
+	"unlock":                   "🔓",
+	"warning":                  "⚠️",
+	"wave":                     "👋",
+	"white_check_mark":         "✅",
+	"wink":                     "😉",
+	"wrench":                   "🔧",
+	"x":                        "❌",
+	"zap":                      "⚡",
+}
+
+// emojiShortcode matches a shortcode at the start of text
+var emojiShortcode = regexp.MustCompile(`^:([a-z0-9_+\-]{1,40}):`)
+
+// maxEmojiSuggestions is the most shortcodes suggested for one query
+const maxEmojiSuggestions = 10
+
+// loadEmoji returns the built-in shortcodes together with those of a JSON
+// file mapping shortcodes, without colons, to emoji. The file's shortcodes
+// replace built-in ones of the same name. An empty path keeps the built-ins.
+func loadEmoji(path string) (map[string]string, error) {
+	emoji := maps.Clone(defaultEmoji)
+	if path == "" {
+		return emoji, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var extra map[string]string
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for code, e := range extra {
+		if !emojiShortcode.MatchString(":" + code + ":") {
+			return nil, fmt.Errorf("%s: invalid shortcode %q: use lowercase letters, digits, _, + and -", path, code)
+		}
+		emoji[code] = e
+	}
+	return emoji, nil
+}
+
+// shortcode writes the emoji of the shortcode at the start of text, returning
+// the length of the shortcode, or 0 when text doesn't start with a known one
+func (rd *renderer) shortcode(text []byte) int {
+	m := emojiShortcode.FindSubmatch(text)
+	if m == nil {
+		return 0
+	}
+	emoji := rd.emoji
+	if emoji == nil {
+		emoji = defaultEmoji
+	}
+	e, ok := emoji[string(m[1])]
+	if !ok {
+		return 0
+	}
+	rd.out.WriteString(`<span class="emoji" title="` + string(m[0]) + `">`)
+	rd.text([]byte(e))
+	rd.out.WriteString(`</span>`)
+	return len(m[0])
+}
+
+// EmojiSuggestion is a shortcode offered to complete what an author typed
+type EmojiSuggestion struct {
+	Code  string `json:"code"`
+	Emoji string `json:"emoji"`
+}
+
+// emojiSuggestHandler returns the shortcodes starting with, then containing,
+// the q query parameter, for the edit form to complete shortcodes as they are typed
+func (s *Server) emojiSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	needle := strings.Trim(strings.ToLower(r.URL.Query().Get("q")), ":")
+
+	codes := make([]string, 0, len(s.emoji))
+	for code := range s.emoji {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	var prefixed, contained []string
+	for _, code := range codes {
+		switch {
+		case strings.HasPrefix(code, needle):
+			prefixed = append(prefixed, code)
+		case strings.Contains(code, needle):
+			contained = append(contained, code)
+		}
+	}
+	suggestions := []EmojiSuggestion{}
+	for _, code := range append(prefixed, contained...) {
+		if len(suggestions) == maxEmojiSuggestions {
+			break
+		}
+		suggestions = append(suggestions, EmojiSuggestion{Code: code, Emoji: s.emoji[code]})
+	}
+	writeJSON(w, http.StatusOK, suggestions)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// =============================================================================
+// ERROR PAGES
+// =============================================================================
+
+// ErrorPage contains data for rendering the page shown to browsers when a
+// request fails: 404.html for missing pages and 500.html for server errors
+type ErrorPage struct {
+	Status     int
+	StatusText string
+	Path       string // Path of the request that failed
+	Query      string // Search suggested to find what the reader was looking for
+
+	themedPage
+}
+
+// errorPageWriter holds back the plain-text bodies http.Error and
+// http.NotFound write for missing pages and server errors, so the request
+// can be answered with a styled page instead. Responses already started, and
+// errors written in other formats, pass through untouched.
+type errorPageWriter struct {
+	http.ResponseWriter
+	started bool // Whether the response went through to the client
+	status  int  // Status of the error held back, 0 if none
+}
+
+// WriteHeader holds back 404 and 5xx statuses of plain-text responses
+func (ew *errorPageWriter) WriteHeader(code int) {
+	if ew.started || ew.status != 0 {
+		return
+	}
+	if (code == http.StatusNotFound || code >= 500) && strings.HasPrefix(ew.Header().Get("Content-Type"), mediaPlain) {
+		ew.status = code
+		return
+	}
+	ew.started = true
+	ew.ResponseWriter.WriteHeader(code)
+}
+
+// Write discards the body of an error held back
+func (ew *errorPageWriter) Write(p []byte) (int, error) {
+	if ew.status != 0 {
+		return len(p), nil
+	}
+	ew.started = true
+	return ew.ResponseWriter.Write(p)
+}
+
+// Unwrap gives http.ResponseController the underlying writer, for flushing
+func (ew *errorPageWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// wantsErrorPage reports whether failures of a request are shown as pages:
+// those of readers preferring HTML, leaving the API, raw page and WebDAV
+// clients their own error formats
+func wantsErrorPage(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/raw/") || strings.HasPrefix(r.URL.Path, davPrefix+"/") {
+		return false
+	}
+	return negotiate(r.Header.Get("Accept"), []string{mediaHTML, mediaPlain}) == mediaHTML
+}
+
+// renderError answers a failed request with the error page for its status,
+// suggesting a search for the last part of the path it asked for. The
+// underlying error is logged where it happens, by serverError.
+func (s *Server) renderError(w http.ResponseWriter, r *http.Request, status int) {
+	data := &ErrorPage{Status: status, StatusText: http.StatusText(status), Path: r.URL.Path}
+	if base := path.Base(r.URL.Path); base != "/" && base != "." {
+		data.Query = base
+	}
+	tmpl := "500"
+	if status == http.StatusNotFound {
+		tmpl = "404"
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	s.renderTemplate(w, r, tmpl, data)
+}
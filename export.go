@@ -0,0 +1,339 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// PAGE SELECTION
+// =============================================================================
+
+// exportSelection picks the pages compiled into an export
+type exportSelection struct {
+	Namespace string // Only pages whose title starts with this, empty for all
+	Lang      string // Only pages in this language or its regional variants, empty for all
+}
+
+// inNamespace reports whether a page belongs to a namespace, which groups the
+// pages whose titles start with it, as DeployGuide and DeployRollback belong to Deploy
+func inNamespace(title, namespace string) bool {
+	return strings.HasPrefix(title, namespace)
+}
+
+// selectPages loads the selected pages in reading order: the page named like
+// the namespace first, as its introduction, then the rest by title. Redirects
+// are left out.
+func selectPages(ctx context.Context, store PageStore, sel exportSelection, defaultLang string) ([]*Page, error) {
+	titles, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(titles, func(i, j int) bool {
+		if (titles[i] == sel.Namespace) != (titles[j] == sel.Namespace) {
+			return titles[i] == sel.Namespace
+		}
+		return titles[i] < titles[j]
+	})
+
+	var pages []*Page
+	for _, title := range titles {
+		if !inNamespace(title, sel.Namespace) {
+			continue
+		}
+		p, err := store.Load(ctx, title)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		if _, ok := redirectTarget(p.Body); ok {
+			continue
+		}
+		p.Lang = contentLang(p, defaultLang)
+		if sel.Lang != "" && !langMatches(p.Lang, sel.Lang) {
+			continue
+		}
+		pages = append(pages, p)
+	}
+	return pages, nil
+}
+
+// =============================================================================
+// EPUB EXPORT
+// =============================================================================
+
+// epubStylesheet styles the chapters of exported books. Page text keeps its
+// line breaks, as in the wiki, and the heading self-links are hidden.
+const epubStylesheet = `body { font-family: serif; line-height: 1.4; }
+.page { white-space: pre-wrap; }
+a.anchor { display: none; }
+.include-error { color: #c00; }
+`
+
+// epubBook describes the book being written
+type epubBook struct {
+	ID       string
+	Title    string
+	Lang     string
+	Modified time.Time
+	Pages    []*Page
+	files    map[string]string // Title to chapter file name
+}
+
+// chapterFile returns the file name of the chapter holding a page
+func chapterFile(n int) string {
+	return fmt.Sprintf("page%04d.xhtml", n+1)
+}
+
+// writeEPUB compiles pages into an EPUB 3 book with a generated table of
+// contents. Links between pages in the book are kept; links to pages outside
+// it become plain text.
+func writeEPUB(ctx context.Context, w io.Writer, store PageStore, title, lang string, pages []*Page) error {
+	if len(pages) == 0 {
+		return errors.New("no pages selected")
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	book := &epubBook{ID: "urn:uuid:" + hex.EncodeToString(id), Title: title, Lang: lang, Pages: pages, files: make(map[string]string)}
+	for i, p := range pages {
+		book.files[p.Title] = chapterFile(i)
+		if p.ModTime.After(book.Modified) {
+			book.Modified = p.ModTime
+		}
+	}
+
+	zw := zip.NewWriter(w)
+	create := func(name string, method uint16) (io.Writer, error) {
+		return zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: book.Modified})
+	}
+	// The mimetype must come first and be stored uncompressed so readers can sniff it
+	mt, err := create("mimetype", zip.Store)
+	if err != nil {
+		return err
+	}
+	io.WriteString(mt, "application/epub+zip")
+
+	files := []struct {
+		name string
+		data func() ([]byte, error)
+	}{
+		{"META-INF/container.xml", func() ([]byte, error) { return []byte(epubContainer), nil }},
+		{"OEBPS/content.opf", book.packageDocument},
+		{"OEBPS/nav.xhtml", book.navDocument},
+		{"OEBPS/style.css", func() ([]byte, error) { return []byte(epubStylesheet), nil }},
+	}
+	for _, f := range files {
+		data, err := f.data()
+		if err != nil {
+			return err
+		}
+		fw, err := create(f.name, zip.Deflate)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(data); err != nil {
+			return err
+		}
+	}
+
+	for i, p := range pages {
+		data, err := book.chapter(ctx, store, p)
+		if err != nil {
+			return err
+		}
+		fw, err := create("OEBPS/"+chapterFile(i), zip.Deflate)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// epubContainer points readers at the package document
+const epubContainer = xml.Header + `<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+	<rootfiles>
+		<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+	</rootfiles>
+</container>
+`
+
+// xmlText escapes s for use in XML text and attribute values
+func xmlText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// packageDocument returns the OPF file listing the book's metadata, files and reading order
+func (b *epubBook) packageDocument() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id">` + "\n")
+	buf.WriteString("\t<metadata xmlns:dc=\"http://purl.org/dc/elements/1.1/\">\n")
+	fmt.Fprintf(&buf, "\t\t<dc:identifier id=\"book-id\">%s</dc:identifier>\n", xmlText(b.ID))
+	fmt.Fprintf(&buf, "\t\t<dc:title>%s</dc:title>\n", xmlText(b.Title))
+	fmt.Fprintf(&buf, "\t\t<dc:language>%s</dc:language>\n", xmlText(b.Lang))
+	fmt.Fprintf(&buf, "\t\t<meta property=\"dcterms:modified\">%s</meta>\n", b.Modified.UTC().Format("2006-01-02T15:04:05Z"))
+	buf.WriteString("\t</metadata>\n\t<manifest>\n")
+	buf.WriteString("\t\t<item id=\"nav\" href=\"nav.xhtml\" media-type=\"application/xhtml+xml\" properties=\"nav\"/>\n")
+	buf.WriteString("\t\t<item id=\"style\" href=\"style.css\" media-type=\"text/css\"/>\n")
+	for i := range b.Pages {
+		fmt.Fprintf(&buf, "\t\t<item id=\"page%d\" href=\"%s\" media-type=\"application/xhtml+xml\"/>\n", i+1, chapterFile(i))
+	}
+	buf.WriteString("\t</manifest>\n\t<spine>\n")
+	buf.WriteString("\t\t<itemref idref=\"nav\"/>\n")
+	for i := range b.Pages {
+		fmt.Fprintf(&buf, "\t\t<itemref idref=\"page%d\"/>\n", i+1)
+	}
+	buf.WriteString("\t</spine>\n</package>\n")
+	return buf.Bytes(), nil
+}
+
+// navDocument returns the table of contents, listing every page and its top-level sections
+func (b *epubBook) navDocument() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	fmt.Fprintf(&buf, "<!DOCTYPE html>\n<html xmlns=\"http://www.w3.org/1999/xhtml\" xmlns:epub=\"http://www.idpf.org/2007/ops\" lang=\"%[1]s\" xml:lang=\"%[1]s\">\n", xmlText(b.Lang))
+	fmt.Fprintf(&buf, "<head>\n\t<title>%s</title>\n\t<link rel=\"stylesheet\" href=\"style.css\"/>\n</head>\n<body>\n", xmlText(b.Title))
+	fmt.Fprintf(&buf, "\t<h1>%s</h1>\n\t<nav epub:type=\"toc\" id=\"toc\">\n\t\t<h2>Contents</h2>\n\t\t<ol>\n", xmlText(b.Title))
+	for i, p := range b.Pages {
+		fmt.Fprintf(&buf, "\t\t\t<li><a href=\"%s\">%s</a>", chapterFile(i), xmlText(p.Title))
+		sections := pageSections(p.Body)
+		if len(sections) > 0 {
+			buf.WriteString("\n\t\t\t\t<ol>\n")
+			for _, sec := range sections {
+				fmt.Fprintf(&buf, "\t\t\t\t\t<li><a href=\"%s#%s\">%s</a></li>\n", chapterFile(i), sec.ID, xmlText(sec.Text))
+			}
+			buf.WriteString("\t\t\t\t</ol>\n\t\t\t")
+		}
+		buf.WriteString("</li>\n")
+	}
+	buf.WriteString("\t\t</ol>\n\t</nav>\n</body>\n</html>\n")
+	return buf.Bytes(), nil
+}
+
+// pageSection is a top-level heading of a page, listed in tables of contents
+type pageSection struct {
+	ID   string
+	Text string
+}
+
+// pageSections returns the level 1 and 2 headings of a page body with the
+// anchors the renderer gives them
+func pageSections(body []byte) []pageSection {
+	anchors := make(anchorSet)
+	var sections []pageSection
+	lines := contentLines(pageContent(body))
+	fenced := fencedLines(lines)
+	for i, line := range lines {
+		level, text := parseHeading(line)
+		if level == 0 || fenced[i] {
+			continue
+		}
+		id := anchors.next(string(text))
+		if level <= 2 {
+			sections = append(sections, pageSection{ID: id, Text: string(text)})
+		}
+	}
+	return sections
+}
+
+// chapter renders a page as an XHTML content document
+func (b *epubBook) chapter(ctx context.Context, store PageStore, p *Page) ([]byte, error) {
+	var content bytes.Buffer
+	rd := &renderer{
+		ctx: ctx, store: store, out: &content, anchors: make(anchorSet), deps: make(map[string]bool),
+		escapeText: true,
+		linkHref: func(title string) string {
+			return b.files[title]
+		},
+	}
+	rd.render(p.Title, p.Body)
+	if rd.err != nil {
+		return nil, rd.err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	fmt.Fprintf(&buf, "<!DOCTYPE html>\n<html xmlns=\"http://www.w3.org/1999/xhtml\" lang=\"%[1]s\" xml:lang=\"%[1]s\">\n", xmlText(p.Lang))
+	fmt.Fprintf(&buf, "<head>\n\t<title>%s</title>\n\t<link rel=\"stylesheet\" href=\"style.css\"/>\n</head>\n<body>\n", xmlText(p.Title))
+	fmt.Fprintf(&buf, "\t<h1>%s</h1>\n\t<div class=\"page\">", xmlText(p.Title))
+	buf.Write(content.Bytes())
+	buf.WriteString("</div>\n</body>\n</html>\n")
+	return buf.Bytes(), nil
+}
+
+// epubHandler downloads the selected pages as an EPUB book. The namespace and
+// lang query parameters narrow the selection and title names the book.
+func (s *Server) epubHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sel := exportSelection{Namespace: q.Get("namespace"), Lang: q.Get("lang")}
+	if sel.Namespace != "" && !validTitle.MatchString(sel.Namespace) || sel.Lang != "" && !validLang.MatchString(sel.Lang) {
+		http.Error(w, "invalid namespace or lang", http.StatusBadRequest)
+		return
+	}
+
+	pages, err := selectPages(r.Context(), s.store, sel, s.cfg().DefaultLang)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	pages = slices.DeleteFunc(pages, func(p *Page) bool { return !s.canRead(r, p.Title) })
+	if len(pages) == 0 {
+		http.Error(w, "no pages selected", http.StatusNotFound)
+		return
+	}
+
+	title, lang := bookTitle(q.Get("title"), sel), sel.Lang
+	if lang == "" {
+		lang = s.cfg().DefaultLang
+	}
+	var buf bytes.Buffer
+	if err := writeEPUB(r.Context(), &buf, s.readableBy(r), title, lang, pages); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/epub+zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+bookFileName(sel)+`.epub"`)
+	w.Write(buf.Bytes())
+}
+
+// bookTitle returns the title of an exported book, defaulting to one naming the selection
+func bookTitle(title string, sel exportSelection) string {
+	if title != "" {
+		return title
+	}
+	if sel.Namespace != "" {
+		return sel.Namespace
+	}
+	return "Wiki"
+}
+
+// bookFileName returns the base name of an exported book's file
+func bookFileName(sel exportSelection) string {
+	name := "wiki"
+	if sel.Namespace != "" {
+		name = sel.Namespace
+	}
+	if sel.Lang != "" {
+		name += "-" + sel.Lang
+	}
+	return name
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// =============================================================================
+// ATOM FEEDS
+// =============================================================================
+
+// maxFeedEntries caps the number of entries in a feed
+const maxFeedEntries = 50
+
+// Regular expression to validate and extract page names from per-page feed URLs
+var validFeedPath = regexp.MustCompile(`^/feed/(` + titlePattern + `)\.atom$`)
+
+// atomFeed is an Atom 1.0 feed document
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Lang    string      `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// atomEntry is a single entry of an Atom feed
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Updated string     `xml:"updated"`
+	Links   []atomLink `xml:"link"`
+	Summary string     `xml:"summary,omitempty"`
+}
+
+// atomLink is an Atom link element
+type atomLink struct {
+	Rel      string `xml:"rel,attr,omitempty"`
+	Type     string `xml:"type,attr,omitempty"`
+	Href     string `xml:"href,attr"`
+	HrefLang string `xml:"hreflang,attr,omitempty"`
+}
+
+// writeAtom encodes an Atom feed as the response body
+func writeAtom(w http.ResponseWriter, feed *atomFeed) {
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(feed); err != nil {
+		slog.Error("Encoding Atom feed failed", "err", err)
+	}
+}
+
+// pageFeedHandler serves the revision history of a single page as an Atom
+// feed, newest first, with each entry linking to the diff it introduced
+func (s *Server) pageFeedHandler(w http.ResponseWriter, r *http.Request) {
+	m := validFeedPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	title := m[1]
+
+	revs, err := s.store.Revisions(r.Context(), title)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if len(revs) == 0 && !s.store.Exists(r.Context(), title) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Deleted pages keep their history but no longer declare a language
+	lang := s.cfg().DefaultLang
+	if p, err := s.store.Load(r.Context(), title); err == nil {
+		lang = contentLang(p, lang)
+	}
+
+	base := baseURL(r)
+	feed := &atomFeed{
+		Lang:    lang,
+		Title:   title + " revision history",
+		ID:      base + "/feed/" + titleURL(title) + ".atom",
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: base + "/feed/" + titleURL(title) + ".atom"},
+			{Rel: "alternate", Type: "text/html", Href: base + "/view/" + titleURL(title), HrefLang: lang},
+		},
+	}
+	if len(revs) > 0 {
+		feed.Updated = revs[len(revs)-1].Time.Format(time.RFC3339)
+	}
+
+	for i := len(revs) - 1; i >= 0 && len(feed.Entries) < maxFeedEntries; i-- {
+		rev := revs[i]
+		diffURL := base + "/diff/" + titleURL(title) + "?from=" + strconv.Itoa(rev.Number-1) + "&to=" + strconv.Itoa(rev.Number)
+		summary := rev.Summary
+		if summary == "" {
+			summary = "No edit summary"
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   fmt.Sprintf("%s: revision %d", title, rev.Number),
+			ID:      diffURL,
+			Updated: rev.Time.Format(time.RFC3339),
+			Links:   []atomLink{{Rel: "alternate", Type: "text/html", Href: diffURL}},
+			Summary: summary,
+		})
+	}
+
+	writeAtom(w, feed)
+}
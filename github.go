@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// GITHUB SYNC
+// =============================================================================
+
+// Settings of the GitHub sync
+const (
+	githubStateFile = "github.json" // Below indexDir, what both sides held at the last sync
+	githubTimeout   = 5 * time.Minute
+)
+
+// githubClient calls the GitHub REST API on one repository
+type githubClient struct {
+	api   string // Base URL of the API, which differs for GitHub Enterprise
+	repo  string // owner/name
+	token string
+}
+
+// githubError is an unsuccessful API response
+type githubError struct {
+	Status  int
+	Message string
+}
+
+func (e *githubError) Error() string {
+	return fmt.Sprintf("GitHub responded with %d %s", e.Status, e.Message)
+}
+
+// do sends a request about the repository, encoding body and decoding the
+// response into reply when they aren't nil
+func (c *githubClient) do(ctx context.Context, method, endpoint string, body, reply any) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.api, "/")+"/repos/"+c.repo+endpoint, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var msg struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&msg)
+		return &githubError{Status: resp.StatusCode, Message: msg.Message}
+	}
+	if reply == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		return fmt.Errorf("decoding GitHub response: %w", err)
+	}
+	return nil
+}
+
+// contentsPath returns the endpoint of a file in the repository
+func contentsPath(file string) string {
+	return "/contents/" + (&url.URL{Path: file}).EscapedPath()
+}
+
+// head returns the latest commit on a branch and its tree
+func (c *githubClient) head(ctx context.Context, branch string) (commit, tree string, err error) {
+	var reply struct {
+		Commit struct {
+			SHA    string `json:"sha"`
+			Commit struct {
+				Tree struct {
+					SHA string `json:"sha"`
+				} `json:"tree"`
+			} `json:"commit"`
+		} `json:"commit"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/branches/"+url.PathEscape(branch), nil, &reply); err != nil {
+		return "", "", err
+	}
+	return reply.Commit.SHA, reply.Commit.Commit.Tree.SHA, nil
+}
+
+// files returns the blob hash of every file in a tree by path
+func (c *githubClient) files(ctx context.Context, tree string) (map[string]string, error) {
+	var reply struct {
+		Tree []struct {
+			Path string `json:"path"`
+			Type string `json:"type"`
+			SHA  string `json:"sha"`
+		} `json:"tree"`
+		Truncated bool `json:"truncated"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/git/trees/"+tree+"?recursive=1", nil, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Truncated {
+		return nil, errors.New("repository too large to list in one request")
+	}
+	files := make(map[string]string)
+	for _, e := range reply.Tree {
+		if e.Type == "blob" {
+			files[e.Path] = e.SHA
+		}
+	}
+	return files, nil
+}
+
+// blob returns the content of a file by its hash
+func (c *githubClient) blob(ctx context.Context, sha string) ([]byte, error) {
+	var reply struct {
+		Content  string `json:"content"`
+		Encoding string `json:"encoding"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/git/blobs/"+sha, nil, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Encoding != "base64" {
+		return nil, fmt.Errorf("unexpected blob encoding %q", reply.Encoding)
+	}
+	return base64.StdEncoding.DecodeString(strings.ReplaceAll(reply.Content, "\n", ""))
+}
+
+// putFile commits a file to a branch, replacing the version with hash sha, or
+// creating the file when sha is empty. It returns the hash of the new version.
+func (c *githubClient) putFile(ctx context.Context, file, branch, sha, message string, content []byte) (string, error) {
+	body := map[string]string{"message": message, "branch": branch, "content": base64.StdEncoding.EncodeToString(content)}
+	if sha != "" {
+		body["sha"] = sha
+	}
+	var reply struct {
+		Content struct {
+			SHA string `json:"sha"`
+		} `json:"content"`
+	}
+	if err := c.do(ctx, http.MethodPut, contentsPath(file), body, &reply); err != nil {
+		return "", err
+	}
+	return reply.Content.SHA, nil
+}
+
+// deleteFile commits the removal of the version of a file with hash sha
+func (c *githubClient) deleteFile(ctx context.Context, file, branch, sha, message string) error {
+	return c.do(ctx, http.MethodDelete, contentsPath(file), map[string]string{"message": message, "branch": branch, "sha": sha}, nil)
+}
+
+// createBranch starts a branch at a commit
+func (c *githubClient) createBranch(ctx context.Context, branch, commit string) error {
+	return c.do(ctx, http.MethodPost, "/git/refs", map[string]string{"ref": "refs/heads/" + branch, "sha": commit}, nil)
+}
+
+// createPull opens a pull request merging head into base and returns its URL
+func (c *githubClient) createPull(ctx context.Context, head, base, title, body string) (string, error) {
+	var reply struct {
+		URL string `json:"html_url"`
+	}
+	err := c.do(ctx, http.MethodPost, "/pulls", map[string]string{"head": head, "base": base, "title": title, "body": body}, &reply)
+	return reply.URL, err
+}
+
+// gitBlobSHA returns the hash git gives a file's content, so pages can be
+// compared with the repository without downloading it
+func gitBlobSHA(content []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// githubState records the version of each page both sides held after the
+// last sync, the common ancestor telling which side changed a page since
+type githubState struct {
+	Remote string                // Repository, branch and directory the state belongs to
+	Pages  map[string]githubPage // By title
+}
+
+// githubPage is the last synced version of a page
+type githubPage struct {
+	SHA     string    // Git blob hash of the content
+	ModTime time.Time // Modification time of the page file holding it, to skip hashing unchanged pages
+}
+
+// githubSync is one sync of the wiki with its repository
+type githubSync struct {
+	s      *Server
+	client *githubClient
+	branch string
+	dir    string // Directory of the page files in the repository
+	commit string // Commit at the head of the branch when the sync started
+	state  *githubState
+}
+
+// githubSyncer returns the sync configured for the wiki, or nil when the GitHub sync is disabled
+func (s *Server) githubSyncer() *githubSync {
+	cfg := s.cfg()
+	if cfg.GitHubRepo == "" {
+		return nil
+	}
+	return &githubSync{
+		s:      s,
+		client: &githubClient{api: cfg.GitHubAPI, repo: cfg.GitHubRepo, token: cfg.GitHubToken},
+		branch: cfg.GitHubBranch,
+		dir:    strings.Trim(cfg.GitHubDir, "/"),
+	}
+}
+
+// file returns the path of a page's file in the repository, named as in the data directory
+func (g *githubSync) file(title string) string {
+	return path.Join(g.dir, fileStem(title)+".txt")
+}
+
+// statePath returns the file holding the sync state
+func (g *githubSync) statePath() string {
+	return filepath.Join(g.s.cfg().DataDir, indexDir, githubStateFile)
+}
+
+// loadState reads the sync state, starting afresh when there is none or it
+// belongs to another repository, branch or directory
+func (g *githubSync) loadState() {
+	remote := g.client.repo + "@" + g.branch + ":" + g.dir
+	g.state = &githubState{Remote: remote, Pages: make(map[string]githubPage)}
+	data, err := os.ReadFile(g.statePath())
+	if err != nil {
+		return
+	}
+	var state githubState
+	if json.Unmarshal(data, &state) == nil && state.Remote == remote && state.Pages != nil {
+		g.state = &state
+	}
+}
+
+// saveState writes the sync state
+func (g *githubSync) saveState() error {
+	data, err := json.Marshal(g.state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(g.statePath()), 0755); err != nil {
+		return err
+	}
+	tmp := g.statePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, g.statePath())
+}
+
+// run syncs every page the wiki or the repository has, or had at the last
+// sync. Each page is compared with its last synced version: changes made on
+// one side only are copied to the other, and pages changed on both sides are
+// conflicts, resolved by conflict. A failure with one page doesn't stop the others.
+func (g *githubSync) run(ctx context.Context) error {
+	g.loadState()
+	commit, tree, err := g.client.head(ctx, g.branch)
+	if err != nil {
+		return err
+	}
+	g.commit = commit
+	files, err := g.client.files(ctx, tree)
+	if err != nil {
+		return err
+	}
+
+	dir := g.dir
+	if dir == "" {
+		dir = "."
+	}
+	remote := make(map[string]string)
+	for file, sha := range files {
+		stem, ok := strings.CutSuffix(file, ".txt")
+		if !ok || path.Dir(file) != dir {
+			continue
+		}
+		if title := stemTitle(path.Base(stem)); validTitle.MatchString(title) {
+			remote[title] = sha
+		}
+	}
+	local, err := g.s.store.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	titles := make(map[string]bool)
+	for _, t := range local {
+		titles[t] = true
+	}
+	for t := range remote {
+		titles[t] = true
+	}
+	for t := range g.state.Pages {
+		titles[t] = true
+	}
+	sorted := make([]string, 0, len(titles))
+	for t := range titles {
+		sorted = append(sorted, t)
+	}
+	sort.Strings(sorted)
+
+	var firstErr error
+	for _, title := range sorted {
+		if err := g.page(ctx, title, remote[title]); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.Error("Syncing with GitHub failed", "title", title, "err", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if err := g.saveState(); err != nil {
+			return err
+		}
+	}
+	return firstErr
+}
+
+// localVersion returns the hash of a page's content in the wiki, empty when
+// the page doesn't exist, and the modification time it was read at
+func (g *githubSync) localVersion(ctx context.Context, title string) (string, time.Time, error) {
+	// The time is taken before reading, so an edit racing the read shows up as a change next time
+	mod, err := g.s.store.ModTime(ctx, title)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", time.Time{}, nil
+	} else if err != nil {
+		return "", time.Time{}, err
+	}
+	if synced := g.state.Pages[title]; synced.SHA != "" && synced.ModTime.Equal(mod) {
+		return synced.SHA, mod, nil
+	}
+	p, err := g.s.store.Load(ctx, title)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", time.Time{}, nil
+	} else if err != nil {
+		return "", time.Time{}, err
+	}
+	return gitBlobSHA(p.Body), mod, nil
+}
+
+// page syncs one page, given the hash of its file in the repository
+func (g *githubSync) page(ctx context.Context, title, remote string) error {
+	base := g.state.Pages[title].SHA
+	local, mod, err := g.localVersion(ctx, title)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case local == remote:
+		g.synced(title, local, mod)
+		return nil
+	case remote == base:
+		return g.push(ctx, title, remote)
+	case local == base:
+		return g.pull(ctx, title, local, remote, "Synced from GitHub commit "+g.commit[:min(7, len(g.commit))])
+	default:
+		return g.conflict(ctx, title, local, remote)
+	}
+}
+
+// synced records the version both sides now hold
+func (g *githubSync) synced(title, sha string, mod time.Time) {
+	if sha == "" {
+		delete(g.state.Pages, title)
+		return
+	}
+	g.state.Pages[title] = githubPage{SHA: sha, ModTime: mod}
+}
+
+// push copies the wiki's version of a page to the repository, replacing the
+// file with hash remote, or removes the file when the page was deleted
+func (g *githubSync) push(ctx context.Context, title, remote string) error {
+	mod, err := g.s.store.ModTime(ctx, title)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := g.client.deleteFile(ctx, g.file(title), g.branch, remote, "Delete "+title); err != nil {
+			return err
+		}
+		g.synced(title, "", time.Time{})
+		return nil
+	} else if err != nil {
+		return err
+	}
+	p, err := g.s.store.Load(ctx, title)
+	if err != nil {
+		return err
+	}
+	sha, err := g.client.putFile(ctx, g.file(title), g.branch, remote, g.s.commitMessage(ctx, title, remote == ""), p.Body)
+	if err != nil {
+		return err
+	}
+	g.synced(title, sha, mod)
+	return nil
+}
+
+// commitMessage describes the latest edit of a page for the commit copying it
+func (s *Server) commitMessage(ctx context.Context, title string, created bool) string {
+	msg := "Update " + title
+	if created {
+		msg = "Create " + title
+	}
+	if revs, err := s.store.Revisions(ctx, title); err == nil && len(revs) > 0 && revs[len(revs)-1].Summary != "" {
+		msg += "\n\n" + revs[len(revs)-1].Summary
+	}
+	return msg
+}
+
+// pull replaces the wiki's version of a page, with hash local, by the
+// repository's, with hash remote, or moves the page to the trash when its file
+// was deleted. Pages edited in the wiki since they were compared are left for
+// the next sync.
+func (g *githubSync) pull(ctx context.Context, title, local, remote, summary string) error {
+	var content []byte
+	if remote != "" {
+		var err error
+		if content, err = g.client.blob(ctx, remote); err != nil {
+			return err
+		}
+	}
+
+	unlock := g.s.store.Lock(title)
+	defer unlock()
+	if current, _, err := g.localVersion(ctx, title); err != nil || current != local {
+		return err
+	}
+	if remote == "" {
+		if err := g.s.trashPage(ctx, title, "github", "Deleted on GitHub"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		g.synced(title, "", time.Time{})
+		return nil
+	}
+	if err := g.s.savePage(ctx, &Page{Title: title, Body: content, Summary: summary, Author: "github"}); err != nil {
+		return err
+	}
+	mod, err := g.s.store.ModTime(ctx, title)
+	if err != nil {
+		return err
+	}
+	g.synced(title, remote, mod)
+	return nil
+}
+
+// conflict resolves a page changed on both sides since the last sync, the
+// wiki's version having hash local and the repository's remote. The repository
+// stays the reference: when both versions exist, the wiki's is committed to a
+// new branch with a pull request for writers to merge, and the wiki takes the
+// repository's version meanwhile. A page deleted on one side and edited on
+// the other is restored with the edit.
+func (g *githubSync) conflict(ctx context.Context, title, local, remote string) error {
+	switch {
+	case remote == "":
+		slog.Warn("GitHub sync: page deleted on GitHub but edited in the wiki, restoring it", "title", title)
+		return g.push(ctx, title, "")
+	case local == "":
+		slog.Warn("GitHub sync: page deleted in the wiki but edited on GitHub, restoring it", "title", title)
+		return g.pull(ctx, title, "", remote, "Restored from GitHub")
+	}
+
+	p, err := g.s.store.Load(ctx, title)
+	if err != nil {
+		return err
+	}
+	branch := fmt.Sprintf("wiki/%s-%d", fileStem(title), time.Now().Unix())
+	if err := g.client.createBranch(ctx, branch, g.commit); err != nil {
+		return err
+	}
+	if _, err := g.client.putFile(ctx, g.file(title), branch, remote, g.s.commitMessage(ctx, title, false), p.Body); err != nil {
+		return err
+	}
+	pr, err := g.client.createPull(ctx, branch, g.branch, "Conflicting wiki edit of "+title,
+		"This page was edited both in the wiki and on GitHub since they were last synced. "+
+			"The wiki now shows the version on "+g.branch+"; this pull request holds the wiki's edit.")
+	if err != nil {
+		return err
+	}
+	slog.Warn("GitHub sync: page edited on both sides, moved the wiki's edit aside", "title", title, "moved_to", pr)
+	return g.pull(ctx, title, local, remote, "Synced from GitHub; the conflicting wiki edit is in "+pr)
+}
+
+// queueGitHubSync starts a sync soon after a page changes, when the sync is enabled
+func (s *Server) queueGitHubSync(title string) {
+	if s.githubSyncer() == nil {
+		return
+	}
+	select {
+	case s.githubWake <- struct{}{}:
+	default:
+	}
+}
+
+// runGitHubSync syncs the wiki with its GitHub repository until ctx is done:
+// after pages change, to push them promptly, and at the configured interval,
+// to pull commits made on GitHub. It pauses while the wiki is read-only, as
+// pulling would change pages.
+func (s *Server) runGitHubSync(ctx context.Context) {
+	for {
+		if g := s.githubSyncer(); g != nil && !s.cfg().ReadOnly {
+			syncCtx, cancel := context.WithTimeout(ctx, githubTimeout)
+			if err := g.run(syncCtx); err != nil && ctx.Err() == nil {
+				slog.Error("Syncing with GitHub failed", "err", err)
+			}
+			cancel()
+		}
+		interval := s.cfg().GitHubInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.githubWake:
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =============================================================================
+// GIT STORAGE
+// =============================================================================
+
+// gitIgnore keeps the wiki's other data, such as accounts, tokens and the
+// audit log, out of the repository, which only tracks the page files
+const gitIgnore = "# Wiki data other than pages\n.*\n!.gitignore\n"
+
+// gitCommitter is the committer of every commit, and the author of those
+// made without one, such as renames
+const gitCommitter = "wiki"
+
+// gitPushTimeout bounds each push to the remote
+const gitPushTimeout = 2 * time.Minute
+
+// gitStore is a PageStore keeping the data directory in a git repository,
+// where every save is a commit authored by the editor with the edit summary
+// as its message. The revisions of a page are the commits changing its file,
+// following renames, so history, blame and backups come from git's own
+// tools; commits can be pushed to a remote as they are made. Pages are read
+// and written as files like the file store does.
+type gitStore struct {
+	*fileStore
+	gitMu  sync.Mutex    // Serializes git commands, which share the index
+	remote string        // Remote pushed to after commits, empty for none
+	push   chan struct{} // Signals the push loop that commits were made
+}
+
+// gitRevision is a revision of a page, with the blob holding its body
+type gitRevision struct {
+	Revision
+	blob string
+}
+
+// newGitStore returns a store keeping dir under git, creating the repository
+// when it doesn't exist yet
+func newGitStore(dir, remote string) (*gitStore, error) {
+	fs, err := newFileStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("-git needs the git command: %w", err)
+	}
+	g := &gitStore{fileStore: fs, remote: remote}
+
+	// Pages there before the repository, or changed while the wiki wasn't
+	// running, are committed at once
+	message := "Record pages changed outside the wiki"
+	if _, err := os.Stat(filepath.Join(dir, ".git")); errors.Is(err, os.ErrNotExist) {
+		if _, err := g.git(nil, "init", "-q"); err != nil {
+			return nil, err
+		}
+		message = "Start revision history"
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".gitignore")); errors.Is(err, os.ErrNotExist) {
+		if err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte(gitIgnore), 0644); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := g.commit("", message, "."); err != nil {
+		return nil, err
+	}
+
+	if remote != "" {
+		g.push = make(chan struct{}, 1)
+		go g.pushLoop()
+	}
+	return g, nil
+}
+
+// git runs a git command in the data directory and returns its output. The
+// committer is always the wiki, whatever the user's git configuration says.
+func (g *gitStore) git(stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-c", "commit.gpgsign=false", "-c", "core.quotepath=false"}, args...)...)
+	cmd.Dir = g.dir
+	cmd.Stdin = stdin
+	cmd.Env = append(os.Environ(), "GIT_COMMITTER_NAME="+gitCommitter, "GIT_COMMITTER_EMAIL="+gitCommitter+"@localhost")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// commit stages the given paths, relative to the data directory, and commits
+// them by author with message, reporting whether there was anything to commit
+func (g *gitStore) commit(author, message string, paths ...string) (bool, error) {
+	g.gitMu.Lock()
+	defer g.gitMu.Unlock()
+
+	// git add refuses paths matching no file, such as pages renamed away
+	// whose removal was already committed
+	paths = slices.DeleteFunc(paths, func(path string) bool {
+		if _, err := os.Stat(filepath.Join(g.dir, filepath.FromSlash(path))); err == nil {
+			return false
+		}
+		tracked, err := g.git(nil, "ls-files", "--", path)
+		return err == nil && len(tracked) == 0
+	})
+	if len(paths) == 0 {
+		return false, nil
+	}
+	if _, err := g.git(nil, append([]string{"add", "-A", "--"}, paths...)...); err != nil {
+		return false, err
+	}
+	if _, err := g.git(nil, append([]string{"diff", "--cached", "--quiet", "--"}, paths...)...); err == nil {
+		return false, nil
+	}
+	if author == "" {
+		author = gitCommitter
+	}
+	args := []string{"commit", "-q", "--author", author + " <" + author + "@localhost>", "-m", message, "--"}
+	if _, err := g.git(nil, append(args, paths...)...); err != nil {
+		return false, err
+	}
+	if g.push != nil {
+		select {
+		case g.push <- struct{}{}:
+		default:
+		}
+	}
+	return true, nil
+}
+
+// pushLoop pushes the current branch to the remote whenever commits were
+// made, one push at a time, logging failures and trying again with the next
+// commit
+func (g *gitStore) pushLoop() {
+	for range g.push {
+		ctx, cancel := context.WithTimeout(context.Background(), gitPushTimeout)
+		cmd := exec.CommandContext(ctx, "git", "push", "-q", g.remote, "HEAD")
+		cmd.Dir = g.dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			slog.Error("Pushing pages failed", "remote", g.remote, "err", err, "output", strings.TrimSpace(string(out)))
+		}
+		cancel()
+	}
+}
+
+// Save writes the page's file and commits it, with the edit summary as the
+// message. Unchanged bodies aren't committed and return revision 0.
+func (g *gitStore) Save(ctx context.Context, p *Page) (int, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, false, err
+	}
+	path := g.pagePath(p.Title)
+	previous, _ := os.ReadFile(path) // nil for new pages
+	if previous != nil && bytes.Equal(previous, p.Body) {
+		return 0, false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, false, err
+	}
+	if err := writeFileAtomic(path, p.Body, 0600); err != nil {
+		return 0, false, err
+	}
+
+	message := p.Summary
+	switch {
+	case message != "":
+	case previous == nil:
+		message = "Create " + p.Title
+	default:
+		message = "Edit " + p.Title
+	}
+	author := p.Author
+	if author == "" {
+		author = anonymousAuthor
+	}
+	if _, err := g.commit(author, message, pageFile(p.Title)); err != nil {
+		return 0, false, err
+	}
+	revs, err := g.revisions(p.Title)
+	return len(revs), previous == nil, err
+}
+
+// Rename moves the page's file and attachments as the file store does and
+// commits the move
+func (g *gitStore) Rename(ctx context.Context, from, to string) error {
+	if err := g.fileStore.Rename(ctx, from, to); err != nil {
+		return err
+	}
+	_, err := g.commit("", "Rename "+from+" to "+to, pageFile(from), pageFile(to))
+	return err
+}
+
+// Delete removes the page's file and commits its removal. Its commits stay
+// in the history.
+func (g *gitStore) Delete(ctx context.Context, title string) error {
+	if err := g.fileStore.Delete(ctx, title); err != nil {
+		return err
+	}
+	_, err := g.commit("", "Delete "+title, pageFile(title))
+	return err
+}
+
+// snapshot commits a page changed in the data directory outside the wiki,
+// returning its revision number or 0 if nothing changed
+func (g *gitStore) snapshot(title, summary string) (int, error) {
+	unlock := g.Lock(title)
+	defer unlock()
+	committed, err := g.commit("", summary, pageFile(title))
+	if err != nil || !committed {
+		return 0, err
+	}
+	if !g.Exists(context.Background(), title) {
+		return 0, nil // Removed pages keep their history
+	}
+	revs, err := g.revisions(title)
+	return len(revs), err
+}
+
+// Watch commits the pages changed in the data directory outside the wiki
+// and reports them, as the file store does
+func (g *gitStore) Watch(onChange func(title string, rev int)) (io.Closer, error) {
+	return g.watch(g.snapshot, onChange)
+}
+
+// Revisions returns the commits that changed a page's file, oldest first
+func (g *gitStore) Revisions(ctx context.Context, title string) ([]Revision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	revs, err := g.revisions(title)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Revision, len(revs))
+	for i, rev := range revs {
+		list[i] = rev.Revision
+	}
+	return list, nil
+}
+
+// Revision returns the body of a page's file as of its nth commit
+func (g *gitStore) Revision(ctx context.Context, title string, n int) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	revs, err := g.revisions(title)
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 || n > len(revs) {
+		return nil, fmt.Errorf("revision %d of %s: %w", n, title, os.ErrNotExist)
+	}
+	g.gitMu.Lock()
+	defer g.gitMu.Unlock()
+	return g.git(nil, "cat-file", "blob", revs[n-1].blob)
+}
+
+// revisions lists the commits changing a page's file through git log,
+// following renames. Commits removing the file are left out, so each
+// revision has a body.
+func (g *gitStore) revisions(title string) ([]gitRevision, error) {
+	g.gitMu.Lock()
+	defer g.gitMu.Unlock()
+	out, err := g.git(nil, "log", "--follow", "--raw", "--no-abbrev", "--format=%x1e%at%x00%s", "--", pageFile(title))
+	if err != nil {
+		// A repository without commits has no history yet
+		if _, headErr := g.git(nil, "rev-parse", "--verify", "-q", "HEAD"); headErr != nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var revs []gitRevision
+	for _, entry := range strings.Split(string(out), "\x1e")[1:] {
+		header, raw, _ := strings.Cut(entry, "\n")
+		unix, summary, _ := strings.Cut(header, "\x00")
+		var blob string
+		for _, line := range strings.Split(raw, "\n") {
+			// :100644 100644 <old blob> <new blob> M	<path>
+			if fields := strings.Fields(line); len(fields) >= 5 && strings.HasPrefix(fields[0], ":") {
+				blob = fields[3]
+			}
+		}
+		if blob == "" || strings.Trim(blob, "0") == "" {
+			continue
+		}
+		sec, _ := strconv.ParseInt(unix, 10, 64)
+		revs = append(revs, gitRevision{Revision: Revision{Time: time.Unix(sec, 0).UTC(), Summary: summary}, blob: blob})
+	}
+	if len(revs) == 0 {
+		return nil, nil
+	}
+
+	// Sizes come from one batch query for all the blobs
+	var blobs strings.Builder
+	for _, rev := range revs {
+		blobs.WriteString(rev.blob + "\n")
+	}
+	out, err = g.git(strings.NewReader(blobs.String()), "cat-file", "--batch-check=%(objectsize)")
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for i := 0; i < len(revs) && scanner.Scan(); i++ {
+		revs[i].Size, _ = strconv.Atoi(scanner.Text())
+	}
+
+	// git log lists the newest commit first
+	for i, j := 0, len(revs)-1; i < j; i, j = i+1, j-1 {
+		revs[i], revs[j] = revs[j], revs[i]
+	}
+	for i := range revs {
+		revs[i].Number = i + 1
+	}
+	return revs, nil
+}
@@ -1,3 +1,14 @@
 module alyz/gowiki
 
 go 1.24.0
+
+require (
+	github.com/fsnotify/fsnotify v1.10.1
+	golang.org/x/crypto v0.45.0
+	golang.org/x/net v0.47.0
+)
+
+require (
+	golang.org/x/sys v0.38.0 // indirect
+	golang.org/x/text v0.31.0 // indirect
+)
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// =============================================================================
+// SYNTAX HIGHLIGHTING
+// =============================================================================
+
+// syntax describes the tokens of a programming language well enough to color
+// its comments, strings, numbers and words. Code is highlighted on the server,
+// as spans with the classes hl-comment, hl-string, hl-number, hl-keyword,
+// hl-type and hl-literal, so the stylesheet decides the colors.
+type syntax struct {
+	lineComments  []string    // Markers starting a comment running to the end of the line
+	blockComments [][2]string // Start and end markers of comments
+	quotes        string      // Characters opening strings with backslash escapes
+	rawQuotes     string      // Characters opening strings without escapes, which may span lines
+	tripleQuotes  bool        // Whether tripled quotes open strings spanning lines
+	ignoreCase    bool        // Whether keywords match regardless of case
+
+	keywords map[string]bool
+	types    map[string]bool // Built-in types and functions
+	literals map[string]bool // Constants such as true and null
+}
+
+// words returns the set of space-separated words
+func words(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(list) {
+		set[w] = true
+	}
+	return set
+}
+
+// cLike returns the syntax of a language with C's comments and strings
+func cLike(keywords, types, literals string) *syntax {
+	return &syntax{
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        `"'`,
+		keywords:      words(keywords),
+		types:         words(types),
+		literals:      words(literals),
+	}
+}
+
+// syntaxes are the languages code blocks are highlighted in, by the names
+// given after the opening fence
+var syntaxes = func() map[string]*syntax {
+	goSyntax := cLike(
+		"break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var",
+		"bool byte complex64 complex128 error float32 float64 int int8 int16 int32 int64 rune string uint uint8 uint16 uint32 uint64 uintptr any comparable "+
+			"append cap clear close complex copy delete imag len make max min new panic print println real recover",
+		"true false nil iota")
+	goSyntax.rawQuotes = "`"
+
+	js := cLike(
+		"as async await break case catch class const continue debugger default delete do else export extends finally for from function if import in instanceof let new of return static super switch this throw try typeof var void while with yield "+
+			"enum implements interface namespace private protected public readonly type declare abstract keyof",
+		"Array Boolean Date Error JSON Map Math Number Object Promise RegExp Set String Symbol console document window "+
+			"any boolean never number string unknown void",
+		"true false null undefined NaN Infinity")
+	js.rawQuotes = "`"
+
+	python := &syntax{
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+		tripleQuotes: true,
+		keywords:     words("and as assert async await break class continue def del elif else except finally for from global if import in is lambda match case nonlocal not or pass raise return try while with yield"),
+		types: words("bool bytes dict float int list object set str tuple type " +
+			"abs all any enumerate filter isinstance len map max min open print range repr sorted sum super zip"),
+		literals: words("True False None self"),
+	}
+
+	shell := &syntax{
+		lineComments: []string{"#"},
+		quotes:       `"`,
+		rawQuotes:    "'",
+		keywords:     words("case do done elif else esac fi for function if in local return select then until while export readonly declare"),
+		types:        words("cd echo printf read set shift source test trap unset exit eval exec"),
+		literals:     words("true false"),
+	}
+
+	c := cLike(
+		"auto break case const continue default do else enum extern for goto if inline register restrict return sizeof static struct switch typedef union volatile while",
+		"char double float int long short signed unsigned void size_t bool int8_t int16_t int32_t int64_t uint8_t uint16_t uint32_t uint64_t",
+		"true false NULL")
+	cpp := cLike(
+		"auto break case catch class const constexpr continue default delete do else enum explicit export extern for friend goto if inline mutable namespace new noexcept operator private protected public return sizeof static static_cast struct switch template this throw try typedef typename union using virtual volatile while",
+		"bool char double float int long short signed unsigned void size_t string vector map std",
+		"true false nullptr NULL")
+	java := cLike(
+		"abstract assert break case catch class continue default do else enum extends final finally for if implements import instanceof interface native new package private protected public return static super switch synchronized this throw throws transient try var void volatile while record",
+		"boolean byte char double float int long short String Object Integer List Map",
+		"true false null")
+	rust := cLike(
+		"as async await break const continue crate dyn else enum extern fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait type unsafe use where while",
+		"bool char f32 f64 i8 i16 i32 i64 i128 isize str u8 u16 u32 u64 u128 usize String Vec Option Result Box",
+		"true false None Some Ok Err")
+	rust.quotes = `"` // ' also starts lifetimes
+	ruby := &syntax{
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+		keywords:     words("alias and begin break case class def defined do else elsif end ensure for if in module next not or redo rescue retry return self super then undef unless until when while yield require"),
+		types:        words("puts print attr_accessor attr_reader attr_writer"),
+		literals:     words("true false nil"),
+	}
+	sql := &syntax{
+		lineComments:  []string{"--"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		rawQuotes:     "'",
+		quotes:        `"`,
+		ignoreCase:    true,
+		keywords:      words("add all alter and as asc begin between by case check column commit constraint create delete desc distinct drop else end exists foreign from group having if in index inner insert into is join key left like limit not null offset on or order outer primary references right rollback select set table then union unique update values view when where with"),
+		types:         words("bigint blob boolean char date decimal double float int integer numeric real serial smallint text time timestamp varchar count sum avg min max"),
+		literals:      words("true false"),
+	}
+	json := &syntax{quotes: `"`, literals: words("true false null")}
+	yaml := &syntax{lineComments: []string{"#"}, quotes: `"`, rawQuotes: "'", literals: words("true false null yes no on off")}
+	css := &syntax{blockComments: [][2]string{{"/*", "*/"}}, quotes: `"'`, keywords: words("important media import")}
+
+	return map[string]*syntax{
+		"go": goSyntax, "golang": goSyntax,
+		"js": js, "javascript": js, "jsx": js, "ts": js, "typescript": js, "tsx": js,
+		"py": python, "python": python,
+		"sh": shell, "bash": shell, "shell": shell, "zsh": shell, "console": shell,
+		"c": c, "h": c,
+		"cpp": cpp, "c++": cpp, "hpp": cpp, "cc": cpp,
+		"java": java, "kotlin": java,
+		"rust": rust, "rs": rust,
+		"ruby": ruby, "rb": ruby,
+		"sql":  sql,
+		"json": json,
+		"yaml": yaml, "yml": yaml,
+		"css": css,
+	}
+}()
+
+// highlight returns code as HTML with its tokens wrapped in classed spans,
+// reporting false when the language isn't known
+func highlight(lang, code string) (string, bool) {
+	syn := syntaxes[strings.ToLower(lang)]
+	if syn == nil {
+		return "", false
+	}
+	var b strings.Builder
+	span := func(class, text string) {
+		b.WriteString(`<span class="hl-` + class + `">`)
+		template.HTMLEscape(&b, []byte(text))
+		b.WriteString(`</span>`)
+	}
+
+	for i := 0; i < len(code); {
+		rest := code[i:]
+		if n := syn.comment(rest); n > 0 {
+			span("comment", rest[:n])
+			i += n
+			continue
+		}
+		// A quote right after a word is an apostrophe, as in don't, rather
+		// than the start of a string
+		prev, _ := utf8.DecodeLastRuneInString(code[:i])
+		if n := syn.str(rest); n > 0 && !isWordRune(prev) {
+			span("string", rest[:n])
+			i += n
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(rest)
+		switch {
+		case unicode.IsDigit(r):
+			n := strings.IndexFunc(rest, func(r rune) bool { return !isWordRune(r) && r != '.' })
+			if n < 0 {
+				n = len(rest)
+			}
+			span("number", rest[:n])
+			i += n
+		case isWordRune(r):
+			n := strings.IndexFunc(rest, func(r rune) bool { return !isWordRune(r) })
+			if n < 0 {
+				n = len(rest)
+			}
+			word := rest[:n]
+			if syn.ignoreCase {
+				word = strings.ToLower(word)
+			}
+			switch {
+			case syn.keywords[word]:
+				span("keyword", rest[:n])
+			case syn.types[word]:
+				span("type", rest[:n])
+			case syn.literals[word]:
+				span("literal", rest[:n])
+			default:
+				template.HTMLEscape(&b, []byte(rest[:n]))
+			}
+			i += n
+		default:
+			template.HTMLEscape(&b, []byte(rest[:size]))
+			i += size
+		}
+	}
+	return b.String(), true
+}
+
+// isWordRune reports whether r can be part of an identifier
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// comment returns the length of the comment code starts with, or 0. A block
+// comment left open runs to the end of the code.
+func (syn *syntax) comment(code string) int {
+	for _, marker := range syn.lineComments {
+		if strings.HasPrefix(code, marker) {
+			if n := strings.IndexByte(code, '\n'); n >= 0 {
+				return n
+			}
+			return len(code)
+		}
+	}
+	for _, markers := range syn.blockComments {
+		if strings.HasPrefix(code, markers[0]) {
+			if n := strings.Index(code[len(markers[0]):], markers[1]); n >= 0 {
+				return len(markers[0]) + n + len(markers[1])
+			}
+			return len(code)
+		}
+	}
+	return 0
+}
+
+// str returns the length of the string literal code starts with, or 0.
+// Strings with escapes end at the end of their line when left open.
+func (syn *syntax) str(code string) int {
+	if code == "" {
+		return 0
+	}
+	q := code[0]
+	if syn.tripleQuotes && strings.IndexByte(syn.quotes, q) >= 0 && strings.HasPrefix(code, strings.Repeat(string(q), 3)) {
+		delim := code[:3]
+		if n := strings.Index(code[3:], delim); n >= 0 {
+			return 3 + n + 3
+		}
+		return len(code)
+	}
+	if strings.IndexByte(syn.rawQuotes, q) >= 0 {
+		if n := strings.IndexByte(code[1:], q); n >= 0 {
+			return n + 2
+		}
+		return len(code)
+	}
+	if strings.IndexByte(syn.quotes, q) < 0 {
+		return 0
+	}
+	for i := 1; i < len(code); i++ {
+		switch code[i] {
+		case '\\':
+			i++
+		case '\n':
+			return i
+		case q:
+			return i + 1
+		}
+	}
+	return len(code)
+}
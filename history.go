@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// REVISION HISTORY
+// =============================================================================
+
+// historyDir holds one subdirectory per page with a copy of every saved
+// revision and a log describing them. The leading dot keeps it out of page listings.
+const historyDir = ".history"
+
+// Revision describes a single saved version of a page
+type Revision struct {
+	Number  int       `json:"rev"`
+	Time    time.Time `json:"time"`
+	Summary string    `json:"summary,omitempty"`
+	Size    int       `json:"size"`
+}
+
+// historyPath returns the directory containing a page's revisions
+func (fs *fileStore) historyPath(title string) string {
+	return filepath.Join(fs.dir, historyDir, fileStem(title))
+}
+
+// revisionPath returns the location of the body of revision n of a page
+func (fs *fileStore) revisionPath(title string, n int) string {
+	return filepath.Join(fs.historyPath(title), strconv.Itoa(n)+".txt")
+}
+
+// Revisions returns the revisions of a page, oldest first. Pages that have
+// never been saved through the wiki have no revisions.
+func (fs *fileStore) Revisions(ctx context.Context, title string) ([]Revision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return fs.readRevisionLog(title)
+}
+
+// readRevisionLog parses the revision log of a page
+func (fs *fileStore) readRevisionLog(title string) ([]Revision, error) {
+	f, err := os.Open(filepath.Join(fs.historyPath(title), "log.jsonl"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseRevisionLog(title, f)
+}
+
+// parseRevisionLog reads a page's revision log, one JSON revision per line
+func parseRevisionLog(title string, r io.Reader) ([]Revision, error) {
+	var revs []Revision
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var rev Revision
+		if err := json.Unmarshal(scanner.Bytes(), &rev); err != nil {
+			return nil, fmt.Errorf("corrupt revision log for %s: %w", title, err)
+		}
+		revs = append(revs, rev)
+	}
+	return revs, scanner.Err()
+}
+
+// Revision returns the body of revision n of a page
+func (fs *fileStore) Revision(ctx context.Context, title string, n int) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(fs.revisionPath(title, n))
+}
+
+// recordRevision stores body as the next revision of a page and returns its
+// number, or 0 if body is identical to the latest revision. The first recorded
+// revision of a page that already existed on disk is preceded by a snapshot of
+// the previous content so the change can still be diffed.
+func (fs *fileStore) recordRevision(title string, body []byte, summary string, previous []byte) (int, error) {
+	fs.historyMu.Lock()
+	defer fs.historyMu.Unlock()
+
+	revs, err := fs.readRevisionLog(title)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(revs) == 0 && previous != nil && !bytes.Equal(previous, body) {
+		if err := fs.appendRevision(title, 1, previous, "Content before revision history"); err != nil {
+			return 0, err
+		}
+		revs = append(revs, Revision{Number: 1})
+	}
+
+	if len(revs) > 0 {
+		latest, err := os.ReadFile(fs.revisionPath(title, revs[len(revs)-1].Number))
+		if err == nil && bytes.Equal(latest, body) {
+			return 0, nil
+		}
+	}
+	n := len(revs) + 1
+	return n, fs.appendRevision(title, n, body, summary)
+}
+
+// appendRevision writes a revision body and appends its entry to the page's revision log
+func (fs *fileStore) appendRevision(title string, n int, body []byte, summary string) error {
+	if err := os.MkdirAll(fs.historyPath(title), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(fs.revisionPath(title, n), body, 0600); err != nil {
+		return err
+	}
+
+	entry, err := json.Marshal(Revision{Number: n, Time: time.Now().UTC(), Summary: summary, Size: len(body)})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(fs.historyPath(title), "log.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(entry, '\n'))
+	return err
+}
+
+// snapshot records the current content of a page changed directly on disk as
+// a new revision, returning its number or 0 if nothing changed
+func (fs *fileStore) snapshot(title, summary string) (int, error) {
+	unlock := fs.Lock(title)
+	defer unlock()
+
+	body, err := os.ReadFile(fs.pagePath(title))
+	if err != nil {
+		return 0, nil // Removed pages keep their history
+	}
+	return fs.recordRevision(title, body, summary, nil)
+}
+
+// =============================================================================
+// REVISION HANDLERS
+// =============================================================================
+
+// DiffPage contains data for rendering the differences between two revisions
+type DiffPage struct {
+	Title string
+	From  int // Revision number of the old side, 0 for an empty page
+	To    int
+	Hunks []DiffHunk
+
+	themedPage
+}
+
+// Class returns the CSS class used to highlight a diff line
+func (l DiffLine) Class() string {
+	switch l.Kind {
+	case '+':
+		return "diff-add"
+	case '-':
+		return "diff-del"
+	}
+	return "diff-context"
+}
+
+// Prefix returns the marker shown in front of a diff line
+func (l DiffLine) Prefix() string {
+	return string(l.Kind)
+}
+
+// diffHandler shows a unified diff between two revisions given by the from and
+// to query parameters. to defaults to the latest revision and from to the one before it.
+func (s *Server) diffHandler(w http.ResponseWriter, r *http.Request, title string) {
+	revs, err := s.store.Revisions(r.Context(), title)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if len(revs) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	to, err := revisionParam(r, "to", len(revs))
+	if err != nil || to < 1 || to > len(revs) {
+		http.Error(w, "invalid to revision", http.StatusBadRequest)
+		return
+	}
+	from, err := revisionParam(r, "from", to-1)
+	if err != nil || from < 0 || from > len(revs) {
+		http.Error(w, "invalid from revision", http.StatusBadRequest)
+		return
+	}
+
+	var oldBody, newBody []byte
+	if from > 0 {
+		if oldBody, err = s.store.Revision(r.Context(), title, from); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	if newBody, err = s.store.Revision(r.Context(), title, to); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	data := &DiffPage{Title: title, From: from, To: to, Hunks: unifiedDiff(string(oldBody), string(newBody))}
+	s.renderTemplate(w, r, "diff", data)
+}
+
+// HistoryPage contains data for rendering the list of a page's revisions
+type HistoryPage struct {
+	Title     string
+	Revisions []Revision // Newest first
+	Latest    int        // Number of the current revision
+	ReadOnly  bool       // Whether the wiki is read-only, so revisions can't be restored
+
+	csrfForm
+	themedPage
+}
+
+// historyHandler lists the revisions of a page, newest first, with links to
+// view and diff each one. Posting a revision number in rev restores the page
+// to that revision as a new one, held for review when edits need it.
+func (s *Server) historyHandler(w http.ResponseWriter, r *http.Request, title string) {
+	revs, err := s.store.Revisions(r.Context(), title)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if len(revs) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if !s.editAllowed(w, r) {
+			return
+		}
+		n, err := strconv.Atoi(r.PostFormValue("rev"))
+		if err != nil || n < 1 || n > len(revs) {
+			http.Error(w, "invalid rev", http.StatusBadRequest)
+			return
+		}
+		s.restoreRevision(w, r, title, n)
+		return
+	}
+
+	data := &HistoryPage{Title: title, Latest: len(revs), ReadOnly: s.cfg().ReadOnly}
+	for i := len(revs) - 1; i >= 0; i-- {
+		data.Revisions = append(data.Revisions, revs[i])
+	}
+	s.renderTemplate(w, r, "history", data)
+}
+
+// restoreRevision saves an old revision of a page as its current content
+func (s *Server) restoreRevision(w http.ResponseWriter, r *http.Request, title string, n int) {
+	body, err := s.store.Revision(r.Context(), title, n)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	p := &Page{Title: title, Body: body, Summary: fmt.Sprintf("Restored revision %d", n), Author: s.tokenName(r)}
+	if s.needsReview(r) {
+		if _, err := s.holdEdit(r, p); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/view/"+titleURL(title)+"?held", http.StatusSeeOther)
+		return
+	}
+	unlock := s.store.Lock(title)
+	err = s.savePage(r.Context(), p)
+	unlock()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/view/"+titleURL(title), http.StatusSeeOther)
+}
+
+// revisionParam parses a revision number query parameter, returning def when it is absent
+func revisionParam(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// revisionAt returns the revision of a page that was current at a time, or
+// false when the page had no revision yet
+func revisionAt(revs []Revision, t time.Time) (Revision, bool) {
+	for i := len(revs) - 1; i >= 0; i-- {
+		if !revs[i].Time.After(t) {
+			return revs[i], true
+		}
+	}
+	return Revision{}, false
+}
+
+// parseAsOf reads the asof parameter of the time-travel view: an RFC 3339
+// time, or a date standing for the end of that day in UTC
+func parseAsOf(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	d, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, errors.New("asof must be a date such as 2024-01-01 or an RFC 3339 time")
+	}
+	return d.Add(24*time.Hour - time.Nanosecond), nil
+}
+
+// viewRevisionHandler shows a page as it was at the revision given by the rev
+// parameter, or at the time given by asof. Pages it transcludes are shown as
+// they were at the same time. Revisions never change, so their markup can be
+// cached for good, by the reader's own browser only since pages may be read
+// restricted. The HTML view also depends on who reads it, so it is revalidated
+// like the current page.
+func (s *Server) viewRevisionHandler(w http.ResponseWriter, r *http.Request, title, mediaType string) {
+	revs, err := s.store.Revisions(r.Context(), title)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	var rev Revision
+	final := true // Whether the request always leads to this revision
+	if v := r.URL.Query().Get("rev"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > len(revs) {
+			http.Error(w, "invalid rev", http.StatusBadRequest)
+			return
+		}
+		rev = revs[n-1]
+	} else {
+		asOf, err := parseAsOf(r.URL.Query().Get("asof"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var ok bool
+		if rev, ok = revisionAt(revs, asOf); !ok {
+			http.NotFound(w, r)
+			return
+		}
+		final = asOf.Before(time.Now())
+	}
+
+	body, err := s.store.Revision(r.Context(), title, rev.Number)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	if mediaType != mediaHTML {
+		etag := fmt.Sprintf(`"r%d-%s"`, rev.Number, strings.Trim(bodyETag(body), `"`))
+		w.Header().Set("ETag", etag)
+		if final {
+			w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "private, no-cache")
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if mediaType == mediaJSON {
+			writeJSON(w, http.StatusOK, apiPage{Title: title, Body: string(body)})
+			return
+		}
+		w.Header().Set("Content-Type", mediaType+"; charset=utf-8")
+		w.Write(body)
+		return
+	}
+
+	p := &Page{Title: title, Body: body, ModTime: rev.Time, Meta: parsePageMeta(body), Revision: rev.Number, Revisions: len(revs)}
+	var out bytes.Buffer
+	rd := &renderer{ctx: r.Context(), store: s.readableBy(r), out: &out, anchors: make(anchorSet), deps: make(map[string]bool), asOf: rev.Time, emoji: s.emoji}
+	rd.render(title, body)
+	if rd.err != nil {
+		serverError(w, r, rd.err)
+		return
+	}
+	p.HTML = template.HTML(sanitizeHTML(rd.contents() + out.String()))
+	p.Lang = contentLang(p, s.cfg().DefaultLang)
+	s.setReader(r, p)
+	p.setCSRF(s.csrfToken(w, r))
+	p.setTheme(readerTheme(r))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if !s.cfg().Dev && notModified(w, r, s.viewETag(p), rev.Time) {
+		return
+	}
+	s.renderTemplate(w, r, "view", p)
+}
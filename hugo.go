@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// HUGO EXPORT
+// =============================================================================
+
+// hugoConfigFiles are the names Hugo looks for its site configuration under
+var hugoConfigFiles = []string{"hugo.toml", "hugo.yaml", "hugo.json", "config.toml", "config.yaml", "config.json"}
+
+// Patterns cleaning up rendered pages for Hugo: heading self-links, which
+// themes add themselves, and links to wiki pages written as raw HTML
+var (
+	headingAnchor = regexp.MustCompile(` <a class="anchor" href="#[^"]*">#</a>`)
+	viewHref      = regexp.MustCompile(`href="/view/([^"#?]+)(#[^"]*)?"`)
+	hugoRef       = regexp.MustCompile(hugoMark + "([^" + hugoMark + "]*)" + hugoMark)
+)
+
+// hugoMark encloses the titles of links to exported pages until they are
+// replaced with shortcodes. It is a private use character, which page HTML
+// sanitization keeps.
+const hugoMark = "\uE000"
+
+// hugoSite lays out exported pages as a Hugo content tree. Namespaces become
+// sections: a page whose title starts other exported titles is the index of a
+// section holding them, so Deploy, DeployGuide and DeployGuideLinux are
+// written as Deploy/_index.html, Deploy/DeployGuide/_index.html and
+// Deploy/DeployGuide/DeployGuideLinux.html. Translations sit next to their
+// page with the language in the file name, as Hugo expects.
+type hugoSite struct {
+	defaultLang string
+	pages       map[string]*Page // Exported pages by title
+	sections    map[string]bool  // Base titles that are section indexes
+}
+
+// newHugoSite lays out pages, finding the sections among their titles
+func newHugoSite(pages []*Page, defaultLang string) *hugoSite {
+	h := &hugoSite{defaultLang: defaultLang, pages: make(map[string]*Page), sections: make(map[string]bool)}
+	bases := make(map[string]bool)
+	for _, p := range pages {
+		h.pages[p.Title] = p
+		base, _ := splitTitle(p.Title)
+		bases[base] = true
+	}
+	for base := range bases {
+		if parent := h.parent(base, bases); parent != "" {
+			h.sections[parent] = true
+		}
+	}
+	return h
+}
+
+// parent returns the longest of titles that is a proper prefix of base, or "" when none is
+func (h *hugoSite) parent(base string, titles map[string]bool) string {
+	for n := len(base) - 1; n > 0; n-- {
+		if titles[base[:n]] {
+			return base[:n]
+		}
+	}
+	return ""
+}
+
+// dir returns the directory a page goes in: the path of the sections containing it
+func (h *hugoSite) dir(base string) string {
+	parent := h.parent(base, h.sections)
+	if parent == "" {
+		return ""
+	}
+	return path.Join(h.dir(parent), parent)
+}
+
+// contentPath returns the file a page is written to, relative to the content directory
+func (h *hugoSite) contentPath(title string) string {
+	base, lang := splitTitle(title)
+	suffix := ".html"
+	if lang != "" {
+		suffix = "." + strings.ToLower(lang) + suffix
+	}
+	if h.sections[base] {
+		return path.Join(h.dir(base), base, "_index"+suffix)
+	}
+	return path.Join(h.dir(base), base+suffix)
+}
+
+// refPath returns the path Hugo's ref shortcodes find a page's content file
+// by, which leaves out the language
+func (h *hugoSite) refPath(title string) string {
+	base, _ := splitTitle(title)
+	return "/" + h.contentPath(base)
+}
+
+// urlPath returns where Hugo publishes a page in the default language with
+// its default settings: lowercased, with a directory for each section
+func (h *hugoSite) urlPath(title string) string {
+	return strings.ToLower(path.Join("/", h.dir(title), title)) + "/"
+}
+
+// lang returns the language of a page's content file, as given in its name
+func (h *hugoSite) lang(title string) string {
+	if _, lang := splitTitle(title); lang != "" {
+		return strings.ToLower(lang)
+	}
+	return h.defaultLang
+}
+
+// ref returns the relref shortcode linking from one page to an exported page,
+// naming the target's language when it differs
+func (h *hugoSite) ref(from, title, anchor string) string {
+	args := fmt.Sprintf("path=%q", h.refPath(title)+anchor)
+	if lang := h.lang(title); lang != h.lang(from) {
+		args += fmt.Sprintf(" lang=%q", lang)
+	}
+	return "{{< relref " + args + " >}}"
+}
+
+// content renders a page as the HTML body of its content file. Links to
+// exported pages become relref shortcodes, so they follow the site's URL
+// settings, and links to other pages become plain text. HTML written in the
+// page is sanitized as on the wiki.
+func (h *hugoSite) content(ctx context.Context, store PageStore, p *Page) ([]byte, error) {
+	var out bytes.Buffer
+	rd := &renderer{
+		ctx: ctx, store: store, out: &out, anchors: make(anchorSet), deps: make(map[string]bool),
+		linkHref: func(title string) string {
+			if h.pages[title] == nil {
+				return ""
+			}
+			return hugoMark + title + hugoMark
+		},
+	}
+	rd.render(p.Title, p.Body)
+	if rd.err != nil {
+		return nil, rd.err
+	}
+
+	html := headingAnchor.ReplaceAll(out.Bytes(), nil)
+	html = viewHref.ReplaceAllFunc(html, func(m []byte) []byte {
+		sub := viewHref.FindSubmatch(m)
+		title, err := url.PathUnescape(string(sub[1]))
+		if err != nil || h.pages[title] == nil {
+			return m
+		}
+		return []byte(`href="` + hugoMark + title + string(sub[2]) + hugoMark + `"`)
+	})
+	html = []byte(sanitizeHTML(string(html)))
+	// Braces in the page itself mustn't be read as shortcodes
+	html = bytes.ReplaceAll(html, []byte("{{"), []byte("{&#123;"))
+	html = hugoRef.ReplaceAllFunc(html, func(m []byte) []byte {
+		title, anchor, _ := strings.Cut(strings.Trim(string(m), hugoMark), "#")
+		if anchor != "" {
+			anchor = "#" + userContentID(anchor)
+		}
+		return []byte(h.ref(p.Title, title, anchor))
+	})
+	return html, nil
+}
+
+// frontMatter returns the YAML front matter of a page's content file. Strings
+// are written as JSON, which YAML reads unchanged.
+func (h *hugoSite) frontMatter(p *Page, aliases []string) []byte {
+	title, _ := splitTitle(p.Title)
+	if p.Meta.Title != "" {
+		title = p.Meta.Title
+	}
+	date := p.ModTime
+	if !p.Meta.Created.IsZero() {
+		date = p.Meta.Created
+	}
+
+	quote := func(s string) string {
+		b, _ := json.Marshal(s)
+		return string(b)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("---\n")
+	fmt.Fprintf(&buf, "title: %s\n", quote(title))
+	fmt.Fprintf(&buf, "date: %s\n", date.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&buf, "lastmod: %s\n", p.ModTime.UTC().Format(time.RFC3339))
+	if p.Meta.Author != "" {
+		fmt.Fprintf(&buf, "author: %s\n", quote(p.Meta.Author))
+	}
+	list := func(name string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		fmt.Fprintf(&buf, "%s:\n", name)
+		for _, v := range values {
+			fmt.Fprintf(&buf, "  - %s\n", quote(v))
+		}
+	}
+	list("tags", p.Meta.Tags)
+	list("aliases", aliases)
+	buf.WriteString("---\n")
+	return buf.Bytes()
+}
+
+// config returns a minimal site configuration declaring the languages of the
+// exported pages, the wiki's default first
+func (h *hugoSite) config(title string) []byte {
+	langs := map[string]bool{h.defaultLang: true}
+	for t := range h.pages {
+		langs[h.lang(t)] = true
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "baseURL = \"/\"\ntitle = %q\ndefaultContentLanguage = %q\n", title, h.defaultLang)
+	if len(langs) > 1 {
+		others := make([]string, 0, len(langs))
+		for lang := range langs {
+			if lang != h.defaultLang {
+				others = append(others, lang)
+			}
+		}
+		sort.Strings(others)
+		buf.WriteString("\n[languages]\n")
+		for i, lang := range append([]string{h.defaultLang}, others...) {
+			fmt.Fprintf(&buf, "  [languages.%s]\n    weight = %d\n", lang, i+1)
+		}
+	}
+	return buf.Bytes()
+}
+
+// hugoResult counts what a Hugo export wrote
+type hugoResult struct {
+	Pages, Files int
+}
+
+// exportHugo writes the pages of a namespace, or of the whole wiki, into the
+// content directory of a Hugo site at dir, and their attachments into its
+// static directory. Redirects become aliases of the pages they lead to. A
+// hugo.toml declaring the languages is written when the site has no
+// configuration yet, so the result builds once a theme is added.
+func exportHugo(ctx context.Context, store PageStore, dataDir, dir, namespace, defaultLang string) (hugoResult, error) {
+	var res hugoResult
+	pages, err := selectPages(ctx, store, exportSelection{Namespace: namespace}, defaultLang)
+	if err != nil {
+		return res, err
+	}
+	if len(pages) == 0 {
+		return res, errors.New("no pages selected")
+	}
+	h := newHugoSite(pages, defaultLang)
+
+	aliases := make(map[string][]string)
+	titles, err := store.List(ctx)
+	if err != nil {
+		return res, err
+	}
+	for _, title := range titles {
+		if h.pages[title] != nil || !inNamespace(title, namespace) {
+			continue
+		}
+		if chain := followRedirects(ctx, store, title); len(chain.Titles) > 1 && chain.Fixable() && h.pages[chain.Final()] != nil {
+			aliases[chain.Final()] = append(aliases[chain.Final()], h.urlPath(title))
+		}
+	}
+
+	for _, p := range pages {
+		content, err := h.content(ctx, store, p)
+		if err != nil {
+			return res, err
+		}
+		name := filepath.Join(dir, "content", filepath.FromSlash(h.contentPath(p.Title)))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return res, err
+		}
+		data := append(h.frontMatter(p, aliases[p.Title]), content...)
+		if err := os.WriteFile(name, append(data, '\n'), 0644); err != nil {
+			return res, err
+		}
+		res.Pages++
+
+		n, err := copyAttachments(dataDir, p.Title, filepath.Join(dir, "static", "attachments", filepath.FromSlash(p.Title)))
+		res.Files += n
+		if err != nil {
+			return res, err
+		}
+	}
+
+	for _, name := range hugoConfigFiles {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return res, nil
+		}
+	}
+	return res, os.WriteFile(filepath.Join(dir, "hugo.toml"), h.config(bookTitle("", exportSelection{Namespace: namespace})), 0644)
+}
+
+// copyAttachments copies the files attached to a page into dst, where the
+// exported site serves them under the same /attachments/ URLs as the wiki
+func copyAttachments(dataDir, title, dst string) (int, error) {
+	entries, err := os.ReadDir(filepath.Join(dataDir, attachmentsDir, fileStem(title)))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(attachmentPath(dataDir, title, e.Name()))
+		if err != nil {
+			return n, err
+		}
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return n, err
+		}
+		if err := os.WriteFile(filepath.Join(dst, e.Name()), data, 0644); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
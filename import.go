@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// IMPORTING FROM OTHER WIKIS
+// =============================================================================
+
+// importedPage is a page converted from another wiki
+type importedPage struct {
+	Title    string
+	Body     []byte
+	Modified time.Time // Zero when the source doesn't record it
+}
+
+// importedFile is an attachment converted from another wiki
+type importedFile struct {
+	Page string // Title of the page the file is attached to
+	Name string
+	Data []byte
+}
+
+// wikiExport is everything read from another wiki's export
+type wikiExport struct {
+	Pages   []importedPage
+	Files   []importedFile
+	Skipped []string // Source items left out, each with the reason
+}
+
+// importer reads the export of one kind of wiki
+type importer struct {
+	name string // Name of the wiki, for edit summaries
+	read func(src string) (*wikiExport, error)
+}
+
+// importers lists the supported source formats by name
+var importers = map[string]importer{
+	"dokuwiki":   {name: "DokuWiki", read: readDokuWiki},
+	"tiddlywiki": {name: "TiddlyWiki", read: readTiddlyWiki},
+	"confluence": {name: "Confluence", read: readConfluence},
+	"files":      {name: "text files", read: readTextFiles},
+}
+
+// importFormats returns the names of the supported source formats, sorted
+func importFormats() []string {
+	names := make([]string, 0, len(importers))
+	for name := range importers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// titleWords joins the ASCII letters and digits of a name from another wiki
+// into a page title, capitalizing each word: "getting started" becomes
+// GettingStarted. It returns "" when nothing usable is left.
+func titleWords(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		switch {
+		case 'a' <= r && r <= 'z':
+			if upper {
+				r -= 'a' - 'A'
+			}
+			b.WriteRune(r)
+			upper = false
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			b.WriteRune(r)
+			upper = false
+		default:
+			upper = true
+		}
+	}
+	return b.String()
+}
+
+// uniqueTitle returns title, or title followed by the lowest number from 2
+// making it unused, and marks the result as used
+func uniqueTitle(title string, used map[string]bool) string {
+	candidate := title
+	for n := 2; used[candidate]; n++ {
+		candidate = title + strconv.Itoa(n)
+	}
+	used[candidate] = true
+	return candidate
+}
+
+// importText escapes literal text of imported pages so it isn't read as HTML
+// tags, wiki links or transclusions
+var importText = strings.NewReplacer("<", "&lt;", ">", "&gt;", "[", "&#91;", "{", "&#123;")
+
+// preText escapes preformatted text of imported pages, where lines starting
+// with # mustn't be read as headings either
+func preText(text string) string {
+	text = strings.ReplaceAll(importText.Replace(text), "\n#", "\n&#35;")
+	if strings.HasPrefix(text, "#") {
+		text = "&#35;" + text[1:]
+	}
+	return text
+}
+
+// importResult counts what an import did
+type importResult struct {
+	Created, Updated, Skipped, Files int
+}
+
+// importExport saves converted pages into the store and attachments into the
+// data directory. Pages and attachments that already exist are left alone
+// unless overwrite is set, in which case an imported page is recorded as a
+// new revision. Modification times from the source are kept for pages in the
+// data directory.
+func importExport(ctx context.Context, store PageStore, dataDir string, export *wikiExport, source string, overwrite bool) (importResult, error) {
+	var res importResult
+	for _, ip := range export.Pages {
+		if store.Exists(ctx, ip.Title) && !overwrite {
+			res.Skipped++
+			continue
+		}
+		unlock := store.Lock(ip.Title)
+		_, created, err := store.Save(ctx, &Page{Title: ip.Title, Body: ip.Body, Summary: "Imported from " + source})
+		if fs, ok := store.(*fileStore); ok && err == nil && !ip.Modified.IsZero() {
+			err = os.Chtimes(fs.pagePath(ip.Title), ip.Modified, ip.Modified)
+		}
+		unlock()
+		if err != nil {
+			return res, fmt.Errorf("importing %s: %w", ip.Title, err)
+		}
+		if created {
+			res.Created++
+		} else {
+			res.Updated++
+		}
+	}
+	for _, f := range export.Files {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		if _, err := os.Stat(attachmentPath(dataDir, f.Page, f.Name)); err == nil && !overwrite {
+			continue
+		}
+		if err := writeAttachment(dataDir, f.Page, f.Name, f.Data); err != nil {
+			return res, fmt.Errorf("importing attachment %s of %s: %w", f.Name, f.Page, err)
+		}
+		res.Files++
+	}
+	return res, nil
+}
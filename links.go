@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// =============================================================================
+// BACKLINKS
+// =============================================================================
+
+// linkGraph records the pages each page links to or transcludes, so the
+// pages referencing one can be listed without reading every page
+type linkGraph struct {
+	mu    sync.RWMutex
+	links map[string][]string // Page to the titles it references, sorted
+	ready atomic.Bool         // Whether every page has been indexed since startup
+	queue *pageQueue
+}
+
+// newLinkGraph returns an empty link graph
+func newLinkGraph() *linkGraph {
+	return &linkGraph{links: make(map[string][]string), queue: newPageQueue()}
+}
+
+// set replaces the references of a page, removing the page when refs is nil
+func (g *linkGraph) set(title string, refs []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if refs == nil {
+		delete(g.links, title)
+	} else {
+		g.links[title] = refs
+	}
+}
+
+// backlinks returns the pages referencing a title, sorted
+func (g *linkGraph) backlinks(title string) []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var pages []string
+	for page, refs := range g.links {
+		if _, ok := slices.BinarySearch(refs, title); ok && page != title {
+			pages = append(pages, page)
+		}
+	}
+	sort.Strings(pages)
+	return pages
+}
+
+// pageRefs returns the titles a page body links to or transcludes, sorted
+// and without duplicates. Text in code blocks isn't markup, so it's skipped.
+func pageRefs(body []byte) []string {
+	lines := contentLines(pageContent(body))
+	fenced := fencedLines(lines)
+	seen := make(map[string]bool)
+	for i, line := range lines {
+		if fenced[i] {
+			continue
+		}
+		for len(line) > 0 {
+			j := bytes.IndexAny(line, "[{")
+			if j < 0 {
+				break
+			}
+			line = line[j:]
+			var name []byte
+			n := 0
+			if line[0] == '[' {
+				name, n = scanTitle(line[1:], "]")
+				n++
+			} else if bytes.HasPrefix(line, []byte(includePrefix)) {
+				name, n = scanTitle(line[len(includePrefix):], includeSuffix)
+				n += len(includePrefix)
+			}
+			if len(name) == 0 {
+				line = line[1:]
+				continue
+			}
+			seen[string(name)] = true
+			line = line[n:]
+		}
+	}
+	refs := make([]string, 0, len(seen))
+	for title := range seen {
+		refs = append(refs, title)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// queueLinks schedules a changed page for reindexing
+func (s *Server) queueLinks(title string) {
+	s.links.queue.add(title)
+}
+
+// runLinkIndex keeps the link graph up to date in the background until ctx is
+// done, after first indexing every page
+func (s *Server) runLinkIndex(ctx context.Context) {
+	if titles, err := s.store.List(ctx); err == nil {
+		for _, title := range titles {
+			s.links.queue.add(title)
+		}
+	} else {
+		slog.Error("Listing pages for the link index failed", "err", err)
+	}
+	for {
+		for _, title := range s.links.queue.take() {
+			if err := s.indexLinks(ctx, title); err != nil && ctx.Err() == nil {
+				slog.Error("Indexing links failed", "title", title, "err", err)
+			}
+		}
+		s.links.ready.Store(true)
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.links.queue.wake:
+		}
+	}
+}
+
+// indexLinks records the references of a page's current content, dropping
+// the page from the graph when it no longer exists
+func (s *Server) indexLinks(ctx context.Context, title string) error {
+	p, err := s.store.Load(ctx, title)
+	if errors.Is(err, os.ErrNotExist) {
+		s.links.set(title, nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.links.set(title, pageRefs(p.Body))
+	return nil
+}
+
+// BacklinksPage is the data for the list of pages referencing a page
+type BacklinksPage struct {
+	Title    string
+	Pages    []string
+	Indexing bool // Whether pages are still being indexed, so the list may be incomplete
+
+	themedPage
+}
+
+// backlinksHandler lists the pages linking to or transcluding a page
+func (s *Server) backlinksHandler(w http.ResponseWriter, r *http.Request, title string) {
+	s.renderTemplate(w, r, "backlinks", &BacklinksPage{
+		Title:    title,
+		Pages:    s.links.backlinks(title),
+		Indexing: !s.links.ready.Load(),
+	})
+}
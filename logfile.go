@@ -0,0 +1,185 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =============================================================================
+// LOG FILE ROTATION
+// =============================================================================
+
+// rotatedSuffix is the timestamp layout appended to the names of rotated log files
+const rotatedSuffix = "20060102T150405.000"
+
+// rotatingFile is a log file that is moved aside once it grows past a size
+// limit. Rotated files are optionally gzipped and removed after a maximum age.
+type rotatingFile struct {
+	path     string
+	maxSize  int64         // Size that triggers rotation, 0 to never rotate on size
+	maxAge   time.Duration // How long rotated files are kept, 0 to keep them forever
+	compress bool          // Whether rotated files are gzipped
+
+	mu   sync.Mutex
+	f    *os.File // The log file, or stderr when it couldn't be reopened
+	size int64
+}
+
+// openRotatingFile opens or creates the log file at path for appending
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, compress bool) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, compress: compress}
+	f, size, err := rf.open()
+	if err != nil {
+		return nil, err
+	}
+	rf.f, rf.size = f, size
+	return rf, nil
+}
+
+// open opens the log file, returning the size of anything already written to it
+func (rf *rotatingFile) open() (*os.File, int64, error) {
+	if err := os.MkdirAll(filepath.Dir(rf.path), 0755); err != nil {
+		return nil, 0, err
+	}
+	f, err := os.OpenFile(rf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// reopen switches to a newly opened log file, closing the one written so far.
+// When the log file can't be opened, entries go to stderr until a later
+// Reopen succeeds, rather than to a closed file. Callers hold mu.
+func (rf *rotatingFile) reopen() error {
+	f, size, err := rf.open()
+	if err != nil {
+		f, size = os.Stderr, 0
+	}
+	if rf.f != os.Stderr {
+		rf.f.Close()
+	}
+	rf.f, rf.size = f, size
+	return err
+}
+
+// Write appends p to the log file, rotating it first if p would take it past the size limit
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize && rf.f != os.Stderr {
+		if err := rf.rotate(); err != nil {
+			// Keep logging to the oversized file rather than losing entries
+			io.WriteString(os.Stderr, "log rotation failed: "+err.Error()+"\n")
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current log file aside under a timestamped name and starts
+// a new one, only closing the old file once the new one is open. Compression
+// and cleanup of old files happen in the background.
+func (rf *rotatingFile) rotate() error {
+	rotated := rf.path + "." + time.Now().UTC().Format(rotatedSuffix)
+	if err := os.Rename(rf.path, rotated); err != nil {
+		return err
+	}
+	if err := rf.reopen(); err != nil {
+		return err
+	}
+
+	go rf.cleanup(rotated)
+	return nil
+}
+
+// Reopen closes and reopens the log file, for use after an external tool
+// such as logrotate has moved it away
+func (rf *rotatingFile) Reopen() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.reopen()
+}
+
+// Close closes the log file
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == os.Stderr {
+		return nil
+	}
+	return rf.f.Close()
+}
+
+// cleanup compresses a freshly rotated file and removes rotated files older
+// than the maximum age. Errors are reported on stderr since the log itself may
+// be what is failing.
+func (rf *rotatingFile) cleanup(rotated string) {
+	if rf.compress {
+		if err := gzipFile(rotated); err != nil {
+			io.WriteString(os.Stderr, "compressing rotated log failed: "+err.Error()+"\n")
+		}
+	}
+	if rf.maxAge <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().UTC().Add(-rf.maxAge)
+	prefix := filepath.Base(rf.path) + "."
+	for _, name := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), prefix), ".gz")
+		t, err := time.Parse(rotatedSuffix, stamp)
+		if err != nil || t.After(cutoff) {
+			continue
+		}
+		if err := os.Remove(name); err != nil {
+			slog.Error("Removing expired log failed", "file", name, "err", err)
+		}
+	}
+}
+
+// gzipFile replaces a file by a gzip-compressed copy with a .gz suffix
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
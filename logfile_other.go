@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+// reopenOnSignal does nothing on platforms without SIGUSR1; the log file is
+// only rotated by size there
+func reopenOnSignal(rf *rotatingFile) {}
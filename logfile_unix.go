@@ -0,0 +1,24 @@
+//go:build unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reopenOnSignal reopens the log file whenever the process receives SIGUSR1,
+// so external rotation tools can move it away without restarting the wiki
+func reopenOnSignal(rf *rotatingFile) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	go func() {
+		for range sig {
+			if err := rf.Reopen(); err != nil {
+				slog.Error("Reopening log file failed", "err", err)
+			}
+		}
+	}()
+}
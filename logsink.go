@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// =============================================================================
+// LOG TARGETS
+// =============================================================================
+
+// Log targets selectable with -log-target
+const (
+	logTargetStderr   = "stderr"
+	logTargetFile     = "file"
+	logTargetSyslog   = "syslog"
+	logTargetJournald = "journald"
+)
+
+// Log formats selectable with -log-format
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logIdentifier tags entries sent to syslog and the journal
+const logIdentifier = "wiki"
+
+// Syslog severities (RFC 5424), shared by the syslog and journald targets
+const (
+	severityErr     = 3
+	severityWarning = 4
+	severityInfo    = 6
+	severityDebug   = 7
+)
+
+// logSeverity returns the syslog severity of a log level
+func logSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return severityErr
+	case level >= slog.LevelWarn:
+		return severityWarning
+	case level >= slog.LevelInfo:
+		return severityInfo
+	}
+	return severityDebug
+}
+
+// severityWriter is a log target taking the severity of each entry along
+// with it, as syslog and the journal do
+type severityWriter interface {
+	writeEntry(severity int, p []byte) error
+	Close() error
+}
+
+// severityTarget passes the lines a handler formats on to a severityWriter,
+// at the severity of the record being handled
+type severityTarget struct {
+	mu       sync.Mutex // Held while a record is handled
+	w        severityWriter
+	severity int
+}
+
+// Write sends one formatted record on. Callers hold mu.
+func (t *severityTarget) Write(p []byte) (int, error) {
+	return len(p), t.w.writeEntry(t.severity, bytes.TrimSuffix(p, []byte("\n")))
+}
+
+// Close closes the writer
+func (t *severityTarget) Close() error {
+	return t.w.Close()
+}
+
+// severityHandler wraps the handler formatting records for a severityTarget,
+// setting the target's severity from each record's level. The text and JSON
+// handlers write each record in a single Write.
+type severityHandler struct {
+	slog.Handler
+	target *severityTarget
+}
+
+// Handle formats a record and sends it at the severity of its level
+func (h severityHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.target.mu.Lock()
+	defer h.target.mu.Unlock()
+	h.target.severity = logSeverity(r.Level)
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler
+func (h severityHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return severityHandler{h.Handler.WithAttrs(attrs), h.target}
+}
+
+// WithGroup implements slog.Handler
+func (h severityHandler) WithGroup(name string) slog.Handler {
+	return severityHandler{h.Handler.WithGroup(name), h.target}
+}
+
+// resolveLogTarget returns the configured log target, defaulting to the log
+// file when one is set and stderr otherwise
+func resolveLogTarget(cfg Config) (string, error) {
+	switch cfg.LogTarget {
+	case "":
+		if cfg.LogFile != "" {
+			return logTargetFile, nil
+		}
+		return logTargetStderr, nil
+	case logTargetFile:
+		if cfg.LogFile == "" {
+			return "", fmt.Errorf("log target %q requires -log-file", cfg.LogTarget)
+		}
+		return cfg.LogTarget, nil
+	case logTargetStderr, logTargetSyslog, logTargetJournald:
+		return cfg.LogTarget, nil
+	}
+	return "", fmt.Errorf("unknown log target %q, want stderr, file, syslog or journald", cfg.LogTarget)
+}
+
+// parseLogLevel returns the level named by -log-level
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q, want debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// checkLogFormat verifies the configured log format is one the wiki writes
+func checkLogFormat(cfg Config) error {
+	switch cfg.LogFormat {
+	case logFormatText, logFormatJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown log format %q, want text or json", cfg.LogFormat)
+}
+
+// setupLogging directs the structured and standard loggers to the configured
+// target, in the configured format and from the configured level. It returns
+// that level, for reloading the configuration to change, and a function
+// closing the log.
+func setupLogging(cfg Config) (*slog.LevelVar, func(), error) {
+	target, err := resolveLogTarget(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkLogFormat(cfg); err != nil {
+		return nil, nil, err
+	}
+	level, err := parseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, nil, err
+	}
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(level)
+
+	var w io.WriteCloser
+	var sw *severityTarget
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch target {
+	case logTargetStderr:
+		w = nopCloser{os.Stderr}
+	case logTargetFile:
+		rf, err := openRotatingFile(cfg.LogFile, cfg.LogMaxSize, cfg.LogMaxAge, cfg.LogCompress)
+		if err != nil {
+			return nil, nil, err
+		}
+		reopenOnSignal(rf)
+		w = rf
+	case logTargetSyslog, logTargetJournald:
+		open := openSyslog
+		if target == logTargetJournald {
+			open = openJournal
+		}
+		out, err := open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("log target %s: %w", target, err)
+		}
+		sw = &severityTarget{w: out}
+		w = sw
+		// Syslog and the journal timestamp entries themselves
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+
+	var handler slog.Handler = slog.NewTextHandler(w, opts)
+	if cfg.LogFormat == logFormatJSON {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	if sw != nil {
+		handler = severityHandler{handler, sw}
+	}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(handler))
+	// What is still written through the standard logger comes from log.Fatal
+	// and from libraries reporting failures, such as net/http
+	log.SetFlags(0)
+	log.SetOutput(slog.NewLogLogger(handler, slog.LevelError).Writer())
+	return logLevel, func() {
+		slog.SetDefault(prev)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+		w.Close()
+	}, nil
+}
+
+// nopCloser is a writer that stays open when the log is closed
+type nopCloser struct {
+	io.Writer
+}
+
+// Close does nothing
+func (nopCloser) Close() error {
+	return nil
+}
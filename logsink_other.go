@@ -0,0 +1,19 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+)
+
+var errLogTargetUnsupported = errors.New("log target not supported on this platform")
+
+// openSyslog fails on platforms without a local syslog daemon
+func openSyslog() (severityWriter, error) {
+	return nil, errLogTargetUnsupported
+}
+
+// openJournal fails on platforms without the systemd journal
+func openJournal() (severityWriter, error) {
+	return nil, errLogTargetUnsupported
+}
@@ -0,0 +1,94 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/syslog"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// journalSocket is where systemd-journald accepts entries in its native protocol
+const journalSocket = "/run/systemd/journal/socket"
+
+// syslogWriter sends each log line to the local syslog daemon at the severity of its entry
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+// openSyslog connects to the local syslog daemon
+func openSyslog() (severityWriter, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, logIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+// writeEntry sends one log line to syslog
+func (sw *syslogWriter) writeEntry(severity int, p []byte) error {
+	msg := string(p)
+	switch severity {
+	case severityErr:
+		return sw.w.Err(msg)
+	case severityWarning:
+		return sw.w.Warning(msg)
+	case severityDebug:
+		return sw.w.Debug(msg)
+	}
+	return sw.w.Info(msg)
+}
+
+// Close disconnects from syslog
+func (sw *syslogWriter) Close() error {
+	return sw.w.Close()
+}
+
+// journalWriter sends each log line to systemd-journald as a structured entry
+type journalWriter struct {
+	conn *net.UnixConn
+}
+
+// openJournal connects to the systemd journal
+func openJournal() (severityWriter, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalWriter{conn: conn}, nil
+}
+
+// writeEntry sends one log line to the journal with its priority and
+// identifier as separate fields
+func (jw *journalWriter) writeEntry(severity int, p []byte) error {
+	var entry bytes.Buffer
+	journalField(&entry, "PRIORITY", strconv.Itoa(severity))
+	journalField(&entry, "SYSLOG_IDENTIFIER", logIdentifier)
+	journalField(&entry, "MESSAGE", string(p))
+	_, err := jw.conn.Write(entry.Bytes())
+	return err
+}
+
+// Close disconnects from the journal
+func (jw *journalWriter) Close() error {
+	return jw.conn.Close()
+}
+
+// journalField appends a field in the journal's native protocol. Values
+// spanning several lines use the length-prefixed binary form.
+func journalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"regexp"
+	"strconv"
+)
+
+// =============================================================================
+// LISTS, CODE BLOCKS, PARAGRAPHS AND EMPHASIS
+// =============================================================================
+
+// listItem matches a list item: its indentation, then a bullet (-, * or +) or
+// a number followed by . or ), then the item's text
+var listItem = regexp.MustCompile(`^([ \t]*)([-*+]|[0-9]{1,9}[.)])[ \t]+(.*)$`)
+
+// fenceMarker returns the fence a line opens or closes a code block with,
+// ``` or ~~~, or "" when it isn't a fence
+func fenceMarker(line []byte) string {
+	line = bytes.TrimLeft(line, " ")
+	for _, fence := range []string{"```", "~~~"} {
+		if bytes.HasPrefix(line, []byte(fence)) {
+			return fence
+		}
+	}
+	return ""
+}
+
+// fencedLines reports which of a page's lines are inside fenced code blocks,
+// fences included, so that nothing in them is taken for markup
+func fencedLines(lines [][]byte) []bool {
+	fenced := make([]bool, len(lines))
+	open := ""
+	for i, line := range lines {
+		if open == "" {
+			open = fenceMarker(line)
+			fenced[i] = open != ""
+			continue
+		}
+		fenced[i] = true
+		if closesFence(line, open) {
+			open = ""
+		}
+	}
+	return fenced
+}
+
+// closesFence reports whether a line is the fence closing a code block
+// opened with fence: the same fence with nothing after it
+func closesFence(line []byte, fence string) bool {
+	return fenceMarker(line) == fence && len(bytes.Trim(line, " \t"+fence[:1])) == 0
+}
+
+// codeBlock writes the fenced code block starting at the first of lines, its
+// text escaped and left as it is, tagged with the language named after the
+// opening fence and highlighted when it is one highlight knows. A block left
+// open runs to the end of the page. It returns the number of lines used, 0
+// when lines don't start with a code block.
+func (rd *renderer) codeBlock(lines [][]byte) int {
+	fence := fenceMarker(lines[0])
+	if fence == "" {
+		return 0
+	}
+	info := bytes.TrimSpace(bytes.TrimLeft(bytes.TrimSpace(lines[0]), fence[:1]))
+	lang, _, _ := bytes.Cut(info, []byte(" "))
+	if len(lang) > 0 {
+		rd.out.WriteString(`<pre><code class="language-`)
+		template.HTMLEscape(rd.out, lang)
+		rd.out.WriteString(`">`)
+	} else {
+		rd.out.WriteString("<pre><code>")
+	}
+	var code bytes.Buffer
+	n := 1
+	for ; n < len(lines); n++ {
+		if closesFence(lines[n], fence) {
+			n++
+			break
+		}
+		code.Write(lines[n])
+		code.WriteByte('\n')
+	}
+	if html, ok := highlight(string(lang), code.String()); ok {
+		rd.out.WriteString(html)
+	} else {
+		template.HTMLEscape(rd.out, code.Bytes())
+	}
+	rd.out.WriteString("</code></pre>")
+	return n
+}
+
+// parseListItem recognizes a list item other than a task, returning its
+// indentation, the list element it belongs to, its number in an ordered list
+// and its text, or ok false for any other line
+func parseListItem(line []byte) (indent int, tag string, number int, text []byte, ok bool) {
+	if _, _, task := parseTask(line); task {
+		return 0, "", 0, nil, false
+	}
+	m := listItem.FindSubmatch(line)
+	if m == nil {
+		return 0, "", 0, nil, false
+	}
+	indent = len(bytes.ReplaceAll(m[1], []byte("\t"), []byte("    ")))
+	if n, err := strconv.Atoi(string(m[2][:len(m[2])-1])); err == nil {
+		return indent, "ol", n, m[3], true
+	}
+	return indent, "ul", 0, m[3], true
+}
+
+// list writes the list starting at the first of lines, nesting the items
+// indented further than the one before them in a list of their own. It
+// returns the number of lines used, 0 when lines don't start with a list.
+func (rd *renderer) list(lines [][]byte) int {
+	type level struct {
+		indent int
+		tag    string
+	}
+	var open []level
+	openList := func(indent int, tag string, number int) {
+		if tag == "ol" && number != 1 {
+			rd.out.WriteString(`<ol start="` + strconv.Itoa(number) + `">` + "\n")
+		} else {
+			rd.out.WriteString("<" + tag + ">\n")
+		}
+		open = append(open, level{indent, tag})
+	}
+	closeList := func() {
+		rd.out.WriteString("</li>\n</" + open[len(open)-1].tag + ">")
+		open = open[:len(open)-1]
+	}
+
+	n := 0
+	for ; n < len(lines); n++ {
+		indent, tag, number, text, ok := parseListItem(lines[n])
+		if !ok {
+			break
+		}
+		for len(open) > 1 && indent < open[len(open)-1].indent {
+			closeList()
+			rd.out.WriteByte('\n')
+		}
+		switch {
+		case len(open) == 0:
+			openList(indent, tag, number)
+		case indent > open[len(open)-1].indent:
+			rd.out.WriteByte('\n')
+			openList(indent, tag, number)
+		case tag != open[len(open)-1].tag:
+			// A list of the other kind at the same level starts a new list
+			closeList()
+			rd.out.WriteByte('\n')
+			openList(indent, tag, number)
+		default:
+			rd.out.WriteString("</li>\n")
+		}
+		rd.out.WriteString("<li>")
+		rd.inline(text)
+	}
+	for len(open) > 0 {
+		closeList()
+		if len(open) > 0 {
+			rd.out.WriteByte('\n')
+		}
+	}
+	return n
+}
+
+// paragraph writes the paragraph starting at the first of lines: the lines
+// of text up to a blank line or a line starting another block. Lines starting
+// with HTML and lone transclusions aren't wrapped in a paragraph, so they can
+// hold blocks of their own. It returns the number of lines used, 0 when lines
+// don't start with a paragraph.
+func (rd *renderer) paragraph(lines [][]byte) int {
+	if len(bytes.TrimSpace(lines[0])) == 0 || isBlockLine(lines[0]) {
+		return 0
+	}
+	rd.out.WriteString("<p>")
+	n := 0
+	for ; n < len(lines) && len(bytes.TrimSpace(lines[n])) > 0 && (n == 0 || !startsBlock(lines[n:])); n++ {
+		if n > 0 {
+			rd.out.WriteByte('\n')
+		}
+		rd.inline(bytes.TrimSpace(lines[n]))
+	}
+	rd.out.WriteString("</p>")
+	return n
+}
+
+// isBlockLine reports whether a line is raw HTML or a lone transclusion,
+// either of which may expand to block elements
+func isBlockLine(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	return bytes.HasPrefix(line, []byte("<")) ||
+		bytes.HasPrefix(line, []byte(includePrefix)) && bytes.HasSuffix(line, []byte(includeSuffix))
+}
+
+// startsBlock reports whether lines start something other than paragraph
+// text, ending any paragraph before them
+func startsBlock(lines [][]byte) bool {
+	line := lines[0]
+	if level, _ := parseHeading(line); level > 0 {
+		return true
+	}
+	if _, _, ok := parseTask(line); ok {
+		return true
+	}
+	if _, _, _, _, ok := parseListItem(line); ok {
+		return true
+	}
+	if _, _, ok := parseFootnote(line); ok {
+		return true
+	}
+	if fenceMarker(line) != "" || isBlockLine(line) {
+		return true
+	}
+	if isTableRow(line) {
+		return true
+	}
+	// A table's header row, or the term of a definition list
+	return len(lines) > 1 && (bytes.Contains(line, []byte("|")) && tableDelimiter.Match(lines[1]) || definitionLine.Match(lines[1]))
+}
+
+// codeSpan writes the code span at the start of text, delimited by runs of
+// the same number of backticks, with its text escaped and left as it is. It
+// returns the number of bytes used, 0 when text doesn't start a code span.
+func (rd *renderer) codeSpan(text []byte) int {
+	ticks := 0
+	for ticks < len(text) && text[ticks] == '`' {
+		ticks++
+	}
+	end := bytes.Index(text[ticks:], text[:ticks])
+	if end <= 0 {
+		return 0
+	}
+	rd.out.WriteString("<code>")
+	template.HTMLEscape(rd.out, bytes.TrimSpace(text[ticks:ticks+end]))
+	rd.out.WriteString("</code>")
+	return 2*ticks + end
+}
+
+// emphasis writes the emphasis at the start of text: **strong** or *emphasized*
+// text, which mustn't start or end with a space. It returns the number of
+// bytes used, 0 when text doesn't start with emphasis.
+func (rd *renderer) emphasis(text []byte) int {
+	delim, tag := "*", "em"
+	if bytes.HasPrefix(text, []byte("**")) {
+		delim, tag = "**", "strong"
+	}
+	inner := text[len(delim):]
+	end := bytes.Index(inner, []byte(delim))
+	if end <= 0 || inner[0] == ' ' || inner[end-1] == ' ' {
+		return 0
+	}
+	rd.out.WriteString("<" + tag + ">")
+	rd.inline(inner[:end])
+	rd.out.WriteString("</" + tag + ">")
+	return 2*len(delim) + end
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// =============================================================================
+// TABLES, DEFINITION LISTS AND FOOTNOTES
+// =============================================================================
+
+// Patterns of the block markup: a footnote definition "[^id]: text", the
+// delimiter row under a table's header, such as "|---|:--:|", and the
+// leading colon of a definition
+var (
+	footnoteDef    = regexp.MustCompile(`^\[\^([A-Za-z0-9_-]+)\]:[ \t]*(.*)$`)
+	footnoteRef    = regexp.MustCompile(`^\[\^([A-Za-z0-9_-]+)\]`)
+	tableDelimiter = regexp.MustCompile(`^[ \t]*\|?[ \t]*:?-+:?[ \t]*(\|[ \t]*:?-+:?[ \t]*)*\|?[ \t]*$`)
+	definitionLine = regexp.MustCompile(`^:[ \t]+(.*)$`)
+)
+
+// parseFootnote recognizes a footnote definition, returning its ID and text
+func parseFootnote(line []byte) (id string, text []byte, ok bool) {
+	m := footnoteDef.FindSubmatch(line)
+	if m == nil {
+		return "", nil, false
+	}
+	return string(m[1]), m[2], true
+}
+
+// footnotes are the footnotes of a page: all those defined, and those
+// referenced in order of first reference, which is how they are numbered
+type footnotes struct {
+	defs    map[string][]byte // Text by ID
+	order   []string          // IDs referenced so far
+	anchors map[string]string // Anchor of each note referenced, by ID
+}
+
+// newFootnotes collects the footnotes defined in a page's lines
+func newFootnotes(lines [][]byte) *footnotes {
+	f := &footnotes{defs: make(map[string][]byte), anchors: make(map[string]string)}
+	fenced := fencedLines(lines)
+	for i, line := range lines {
+		if id, text, ok := parseFootnote(line); ok && !fenced[i] {
+			if _, dup := f.defs[id]; !dup {
+				f.defs[id] = text
+			}
+		}
+	}
+	return f
+}
+
+// footnoteRef writes a reference to a footnote as its number, linked to the
+// note. It returns false, writing nothing, when the note isn't defined.
+func (rd *renderer) footnoteRef(id string) bool {
+	f := rd.notes
+	if _, ok := f.defs[id]; !ok {
+		return false
+	}
+	anchor, seen := f.anchors[id]
+	if !seen {
+		anchor = rd.anchors.next("fn " + id)
+		f.anchors[id] = anchor
+		f.order = append(f.order, id)
+	}
+	n := strconv.Itoa(slices.Index(f.order, id) + 1)
+	if seen {
+		rd.out.WriteString(`<sup class="footnote-ref"><a href="#` + anchor + `">` + n + `</a></sup>`)
+	} else {
+		rd.out.WriteString(`<sup class="footnote-ref" id="ref-` + anchor + `"><a href="#` + anchor + `">` + n + `</a></sup>`)
+	}
+	return true
+}
+
+// footnotes writes the referenced footnotes of the page, each linking back to
+// its first reference. Notes referencing other notes add them to the list as
+// it is written.
+func (rd *renderer) footnotes() {
+	f := rd.notes
+	rd.out.WriteString("<section class=\"footnotes\">\n<ol>\n")
+	for i := 0; i < len(f.order); i++ {
+		id := f.order[i]
+		anchor := f.anchors[id]
+		rd.out.WriteString(`<li id="` + anchor + `">`)
+		rd.inline(f.defs[id])
+		rd.out.WriteString(` <a class="footnote-back" href="#ref-` + anchor + `">&#8617;</a></li>` + "\n")
+	}
+	rd.out.WriteString("</ol>\n</section>")
+}
+
+// table writes the pipe table starting at the first of lines: a header row,
+// a delimiter row giving each column's alignment, then rows up to the first
+// line without a pipe. Rows without the header and delimiter rows make a
+// table too, as long as each starts and ends with a pipe. It returns the
+// number of lines used, 0 when lines don't start with a table.
+func (rd *renderer) table(lines [][]byte) int {
+	if len(lines) < 2 || !bytes.Contains(lines[0], []byte("|")) || !tableDelimiter.Match(lines[1]) {
+		return rd.bareTable(lines)
+	}
+	header := splitCells(lines[0])
+	delims := splitCells(lines[1])
+	if len(header) != len(delims) {
+		return 0
+	}
+	aligns := make([]string, len(delims))
+	for i, d := range delims {
+		left, right := bytes.HasPrefix(d, []byte(":")), bytes.HasSuffix(d, []byte(":"))
+		switch {
+		case left && right:
+			aligns[i] = "center"
+		case right:
+			aligns[i] = "right"
+		case left:
+			aligns[i] = "left"
+		}
+	}
+
+	rd.out.WriteString("<table>\n<thead>\n")
+	rd.tableRow("th", header, aligns)
+	rd.out.WriteString("</thead>\n")
+	n := 2
+	for ; n < len(lines) && bytes.Contains(lines[n], []byte("|")) && len(bytes.TrimSpace(lines[n])) > 0; n++ {
+		if n == 2 {
+			rd.out.WriteString("<tbody>\n")
+		}
+		rd.tableRow("td", splitCells(lines[n]), aligns)
+	}
+	if n > 2 {
+		rd.out.WriteString("</tbody>\n")
+	}
+	rd.out.WriteString("</table>")
+	return n
+}
+
+// bareTable writes the table of rows starting at the first of lines, each
+// enclosed in pipes, with as many columns as its longest row. It returns the
+// number of lines used, 0 when lines don't start with such a row.
+func (rd *renderer) bareTable(lines [][]byte) int {
+	var rows [][][]byte
+	columns := 0
+	for _, line := range lines {
+		if !isTableRow(line) {
+			break
+		}
+		cells := splitCells(line)
+		rows = append(rows, cells)
+		columns = max(columns, len(cells))
+	}
+	if len(rows) == 0 {
+		return 0
+	}
+	rd.out.WriteString("<table>\n<tbody>\n")
+	aligns := make([]string, columns)
+	for _, cells := range rows {
+		rd.tableRow("td", cells, aligns)
+	}
+	rd.out.WriteString("</tbody>\n</table>")
+	return len(rows)
+}
+
+// isTableRow reports whether a line is a row enclosed in pipes
+func isTableRow(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	return len(line) >= 2 && line[0] == '|' && line[len(line)-1] == '|' && !bytes.HasSuffix(line, []byte(`\|`))
+}
+
+// tableRow writes a row of a table with one cell per column, leaving out
+// extra cells and filling in missing ones
+func (rd *renderer) tableRow(tag string, cells [][]byte, aligns []string) {
+	rd.out.WriteString("<tr>")
+	for i, align := range aligns {
+		if align != "" {
+			rd.out.WriteString("<" + tag + ` style="text-align: ` + align + `">`)
+		} else {
+			rd.out.WriteString("<" + tag + ">")
+		}
+		if i < len(cells) {
+			rd.inline(cells[i])
+		}
+		rd.out.WriteString("</" + tag + ">")
+	}
+	rd.out.WriteString("</tr>\n")
+}
+
+// splitCells splits a table row into its trimmed cells. The pipes at either
+// end of the row are optional, and \| is a pipe inside a cell.
+func splitCells(line []byte) [][]byte {
+	line = bytes.TrimSpace(line)
+	line = bytes.TrimPrefix(line, []byte("|"))
+	if bytes.HasSuffix(line, []byte("|")) && !bytes.HasSuffix(line, []byte(`\|`)) {
+		line = line[:len(line)-1]
+	}
+	var cells [][]byte
+	var cell []byte
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cell = append(cell, '|')
+			i++
+		case line[i] == '|':
+			cells = append(cells, bytes.TrimSpace(cell))
+			cell = nil
+		default:
+			cell = append(cell, line[i])
+		}
+	}
+	return append(cells, bytes.TrimSpace(cell))
+}
+
+// definitions writes the definition list starting at the first of lines: a
+// term followed by lines starting with ": " defining it, repeated for as
+// long as terms are followed by definitions. It returns the number of lines
+// used, 0 when lines don't start with a definition list.
+func (rd *renderer) definitions(lines [][]byte) int {
+	n := 0
+	for n+1 < len(lines) && len(bytes.TrimSpace(lines[n])) > 0 && definitionLine.Match(lines[n+1]) {
+		if n == 0 {
+			rd.out.WriteString("<dl>\n")
+		}
+		rd.out.WriteString("<dt>")
+		rd.inline(bytes.TrimSpace(lines[n]))
+		rd.out.WriteString("</dt>\n")
+		for n++; n < len(lines); n++ {
+			m := definitionLine.FindSubmatch(lines[n])
+			if m == nil {
+				break
+			}
+			rd.out.WriteString("<dd>")
+			rd.inline(m[1])
+			rd.out.WriteString("</dd>\n")
+		}
+	}
+	if n > 0 {
+		rd.out.WriteString("</dl>")
+	}
+	return n
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// =============================================================================
+// MENTIONS
+// =============================================================================
+
+// userPattern matches the names of users, which are the names of API tokens
+const userPattern = `[A-Za-z0-9_-]+`
+
+// Patterns finding @name mentions: one at the start of some text, checked by
+// the renderer after it made sure the @ doesn't continue a word, and one
+// finding every mention in a body. An @ inside a word, as in an email
+// address, doesn't mention anyone.
+var (
+	validUser      = regexp.MustCompile("^" + userPattern + "$")
+	leadingMention = regexp.MustCompile("^@(" + userPattern + ")")
+	bodyMention    = regexp.MustCompile(`(?:^|[^A-Za-z0-9_.@/-])@(` + userPattern + ")")
+)
+
+// maxProfileEvents caps the number of edits and mentions shown on a profile
+const maxProfileEvents = 50
+
+// mentionedUsers returns the names mentioned in a page body, each once, in
+// order of first mention
+func mentionedUsers(body []byte) []string {
+	var users []string
+	for _, m := range bodyMention.FindAllSubmatch(pageContent(body), -1) {
+		if name := string(m[1]); !slices.Contains(users, name) {
+			users = append(users, name)
+		}
+	}
+	return users
+}
+
+// isWordByte reports whether b continues a word, so an @ following it
+// isn't a mention
+func isWordByte(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' ||
+		b == '/' || b == '-' || b == '_' || b == '.' || b == '@'
+}
+
+// notifyMentions tells the users mentioned in a new revision of a page, and
+// not in the one before it, that they were mentioned. Each mention is
+// recorded in the audit log, where the user's profile lists it, and mailed
+// to users with an email address when an SMTP server is configured.
+func (s *Server) notifyMentions(p *Page, old []byte, rev int) {
+	cfg := s.cfg()
+	before := mentionedUsers(old)
+	for _, name := range mentionedUsers(p.Body) {
+		if slices.Contains(before, name) || name == p.Author {
+			continue
+		}
+		email, ok := s.knownUser(name)
+		if !ok {
+			continue
+		}
+		s.audit.record(AuditEvent{Type: eventMention, Title: p.Title, Actor: p.Author, Revision: rev, Detail: name})
+		if email != "" && cfg.SMTPAddr != "" {
+			go s.mailMention(email, name, p, rev)
+		}
+	}
+}
+
+// knownUser reports whether a name is that of a user account or a token,
+// returning the address mentions of it are mailed to, the account's first
+func (s *Server) knownUser(name string) (email string, ok bool) {
+	dataDir := s.cfg().DataDir
+	u, isUser := s.users.named(dataDir, name)
+	t, isToken := s.tokens.named(dataDir, name)
+	if u.Email != "" {
+		return u.Email, true
+	}
+	return t.Email, isUser || isToken
+}
+
+// mailMention mails a user that a page mentions them
+func (s *Server) mailMention(to, name string, p *Page, rev int) {
+	cfg := s.cfg()
+	by := p.Author
+	if by == "" {
+		by = anonymousAuthor
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s mentioned you, @%s, in %s", by, name, p.Title)
+	if p.Summary != "" {
+		fmt.Fprintf(&b, ": %s", p.Summary)
+	}
+	b.WriteString("\n")
+	if base := strings.TrimRight(cfg.PublicURL, "/"); base != "" {
+		fmt.Fprintf(&b, "\n%s/view/%s\n%s/diff/%s?to=%d\n", base, titleURL(p.Title), base, titleURL(p.Title), rev)
+	}
+	if err := sendMail(context.Background(), cfg, to, "You were mentioned in "+p.Title, b.String()); err != nil {
+		slog.Error("Mailing mention failed", "to", name, "err", err)
+	}
+}
+
+// UserPage contains data for rendering a user's profile
+type UserPage struct {
+	Name     string
+	Known    bool         // Whether a user account or token with the name exists
+	Edits    []AuditEvent // Changes the user made, newest first
+	Mentions []AuditEvent // Mentions of the user, newest first
+
+	themedPage
+}
+
+// userHandler shows a user's recent changes and the pages mentioning them
+func (s *Server) userHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !validUser.MatchString(name) {
+		http.NotFound(w, r)
+		return
+	}
+	events, err := s.audit.events()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	_, known := s.knownUser(name)
+	data := &UserPage{Name: name, Known: known}
+	for i := len(events) - 1; i >= 0; i-- {
+		ev := events[i]
+		switch {
+		case ev.Type == eventMention && ev.Detail == name && len(data.Mentions) < maxProfileEvents:
+			data.Mentions = append(data.Mentions, ev)
+		case ev.Type != eventMention && ev.Actor == name && len(data.Edits) < maxProfileEvents:
+			data.Edits = append(data.Edits, ev)
+		}
+	}
+	s.renderTemplate(w, r, "user", data)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// PAGE METADATA
+// =============================================================================
+
+// Lines opening and closing a page's metadata block, in YAML and TOML
+const (
+	frontMatterDelim = "---"
+	tomlMatterDelim  = "+++"
+)
+
+// PageMeta is the metadata a page declares in a front-matter block at the
+// very top of its body, either YAML between two "---" lines or TOML between
+// two "+++" lines:
+//
+//	---
+//	title: Release Process
+//	tags: [golang, infra]
+//	author: alice
+//	created: 2024-03-01
+//	---
+//
+// Only flat fields are read: strings, quoted or not, and lists of strings,
+// written inline in brackets or, in YAML, as "- item" lines. The block is
+// kept in the stored body so it survives editing, and left out when the
+// page is rendered or searched.
+type PageMeta struct {
+	Title   string    // Title shown instead of the page name, when set
+	Lang    string    // Language of the content, empty when the page doesn't declare a valid one
+	Book    bool      // Whether the page is a book, collecting the pages it links to for export
+	Tags    []string  // Labels from the comma-separated or listed tags field
+	Author  string    // Author the page credits, which may differ from its editors
+	Created time.Time // Creation date the page declares, zero when it doesn't declare a valid one
+}
+
+// splitFrontMatter separates the metadata block from the top of a page body,
+// returning its fields keyed by lowercase name and the content following it.
+// Lists are returned as their items joined with commas. Bodies that don't
+// start with a complete block are returned unchanged.
+func splitFrontMatter(body []byte) (map[string]string, []byte) {
+	line, rest, ok := bytes.Cut(body, []byte("\n"))
+	delim := string(bytes.TrimRight(line, "\r"))
+	if !ok || delim != frontMatterDelim && delim != tomlMatterDelim {
+		return nil, body
+	}
+	sep := ":"
+	if delim == tomlMatterDelim {
+		sep = "="
+	}
+
+	fields := make(map[string]string)
+	var list string // Field whose value is the YAML list on the lines that follow
+	for len(rest) > 0 {
+		line, rest, _ = bytes.Cut(rest, []byte("\n"))
+		text := strings.TrimSpace(string(line))
+		switch {
+		case text == delim:
+			return fields, rest
+		case text == "" || strings.HasPrefix(text, "#"):
+			continue
+		case list != "" && strings.HasPrefix(text, "- "):
+			if item := unquoteMeta(text[2:]); fields[list] == "" {
+				fields[list] = item
+			} else {
+				fields[list] += ", " + item
+			}
+			continue
+		}
+		list = ""
+		if name, value, ok := strings.Cut(text, sep); ok {
+			name = strings.ToLower(unquoteMeta(name))
+			value = strings.TrimSpace(value)
+			if value == "" && sep == ":" {
+				list = name
+			}
+			if inner, ok := strings.CutPrefix(value, "["); ok {
+				var items []string
+				for _, item := range strings.Split(strings.TrimSuffix(inner, "]"), ",") {
+					if item = unquoteMeta(item); item != "" {
+						items = append(items, item)
+					}
+				}
+				value = strings.Join(items, ", ")
+			} else {
+				value = unquoteMeta(value)
+			}
+			fields[name] = value
+		}
+	}
+	return nil, body // Never closed, so it's content rather than metadata
+}
+
+// unquoteMeta returns a front-matter value without the surrounding space and
+// quotes
+func unquoteMeta(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		if value[0] == '"' {
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				return unquoted
+			}
+		}
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// parsePageMeta reads the metadata block of a page body
+func parsePageMeta(body []byte) PageMeta {
+	fields, _ := splitFrontMatter(body)
+	meta := PageMeta{Title: fields["title"], Author: fields["author"]}
+	if lang := fields["lang"]; validLang.MatchString(lang) {
+		meta.Lang = lang
+	}
+	switch strings.ToLower(fields["book"]) {
+	case "true", "yes":
+		meta.Book = true
+	}
+	for _, tag := range strings.Split(fields["tags"], ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			meta.Tags = append(meta.Tags, tag)
+		}
+	}
+	for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+		if created, err := time.Parse(layout, fields["created"]); err == nil {
+			meta.Created = created
+			break
+		}
+	}
+	return meta
+}
+
+// pageContent returns a page body without its metadata block
+func pageContent(body []byte) []byte {
+	_, content := splitFrontMatter(body)
+	return content
+}
+
+// contentLang returns the language of a page's content: the one it declares,
+// else the language of the translation, else the wiki's default
+func contentLang(p *Page, defaultLang string) string {
+	if p.Meta.Lang != "" {
+		return p.Meta.Lang
+	}
+	if _, lang := splitTitle(p.Title); lang != "" {
+		return lang
+	}
+	return defaultLang
+}
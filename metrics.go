@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =============================================================================
+// METRICS
+// =============================================================================
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histograms
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricMethods are the request methods counted by name; others are counted
+// as "other", so clients can't add series at will
+var metricMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// counterVec is a counter with a series per combination of label values
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]float64 // Keyed by the label values joined with NUL
+}
+
+// add increments the series of the given label values
+func (c *counterVec) add(delta float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.series == nil {
+		c.series = make(map[string]float64)
+	}
+	c.series[strings.Join(values, "\x00")] += delta
+}
+
+// write writes the counter in the Prometheus text format
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.series) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, metricLabels(c.labels, key), formatMetric(c.series[key]))
+	}
+}
+
+// histogram counts observations into cumulative buckets
+type histogram struct {
+	counts []uint64 // Observations at or below each bucket's bound
+	count  uint64
+	sum    float64
+}
+
+// histogramVec is a histogram with a series per combination of label values
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram // Keyed by the label values joined with NUL
+}
+
+// observe records a value in the series of the given label values
+func (h *histogramVec) observe(value float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.series == nil {
+		h.series = make(map[string]*histogram)
+	}
+	key := strings.Join(values, "\x00")
+	s := h.series[key]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// write writes the histogram in the Prometheus text format
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	bucketLabels := append(slices.Clone(h.labels), "le")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		prefix := key
+		if len(h.labels) > 0 {
+			prefix += "\x00"
+		}
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, metricLabels(bucketLabels, prefix+formatMetric(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, metricLabels(bucketLabels, prefix+"+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, metricLabels(h.labels, key), formatMetric(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, metricLabels(h.labels, key), s.count)
+	}
+}
+
+// sortedKeys returns the keys of a series map in order, for stable output
+func sortedKeys[V any](series map[string]V) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// metricLabels formats the label set of a series, as {name="value",...}, from
+// the NUL-joined values it is keyed by
+func metricLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, value := range strings.Split(key, "\x00") {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(names[i] + `="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// formatMetric formats a sample value as Prometheus expects
+func formatMetric(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metrics holds the counters and histograms served on /metrics for
+// monitoring the wiki with Prometheus
+type metrics struct {
+	requests        *counterVec
+	requestDuration *histogramVec
+	saves           *counterVec
+	storeOps        *counterVec
+	storeDuration   *histogramVec
+	renderDuration  *histogramVec
+}
+
+// newMetrics returns metrics with every series at zero
+func newMetrics() *metrics {
+	return &metrics{
+		requests: &counterVec{name: "wiki_http_requests_total", help: "HTTP requests answered, by route, method and status code.",
+			labels: []string{"route", "method", "status"}},
+		requestDuration: &histogramVec{name: "wiki_http_request_duration_seconds", help: "Time taken to answer HTTP requests, by route.",
+			labels: []string{"route"}, buckets: latencyBuckets},
+		saves: &counterVec{name: "wiki_page_saves_total", help: "Page saves, by result: created, edited, unchanged or error.",
+			labels: []string{"result"}},
+		storeOps: &counterVec{name: "wiki_store_operations_total", help: "Page store operations, by operation and result: ok, not_found or error.",
+			labels: []string{"op", "result"}},
+		storeDuration: &histogramVec{name: "wiki_store_operation_duration_seconds", help: "Time taken by page store operations, by operation.",
+			labels: []string{"op"}, buckets: latencyBuckets},
+		renderDuration: &histogramVec{name: "wiki_render_duration_seconds", help: "Time taken to render page bodies missing from the render cache.",
+			buckets: latencyBuckets},
+	}
+}
+
+// observeRequest records an answered request. Requests matching no route
+// are counted under "none".
+func (m *metrics) observeRequest(route, method string, status int, elapsed time.Duration) {
+	if route == "" {
+		route = "none"
+	}
+	if !slices.Contains(metricMethods, method) {
+		method = "other"
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	m.requests.add(1, route, method, strconv.Itoa(status))
+	m.requestDuration.observe(elapsed.Seconds(), route)
+}
+
+// observeSave records the outcome of a page save
+func (m *metrics) observeSave(rev int, created bool, err error) {
+	result := "edited"
+	switch {
+	case err != nil:
+		result = "error"
+	case rev == 0:
+		result = "unchanged"
+	case created:
+		result = "created"
+	}
+	m.saves.add(1, result)
+}
+
+// observeStore records a page store operation begun at start
+func (m *metrics) observeStore(op string, start time.Time, err error) {
+	result := "ok"
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		result = "not_found"
+	case err != nil:
+		result = "error"
+	}
+	m.storeOps.add(1, op, result)
+	m.storeDuration.observe(time.Since(start).Seconds(), op)
+}
+
+// meteredStore is a PageStore recording the count, outcome and latency of the
+// operations of the store it wraps
+type meteredStore struct {
+	PageStore
+	metrics *metrics
+}
+
+// Load implements PageStore
+func (ms *meteredStore) Load(ctx context.Context, title string) (*Page, error) {
+	start := time.Now()
+	p, err := ms.PageStore.Load(ctx, title)
+	ms.metrics.observeStore("load", start, err)
+	return p, err
+}
+
+// ModTime implements PageStore
+func (ms *meteredStore) ModTime(ctx context.Context, title string) (time.Time, error) {
+	start := time.Now()
+	t, err := ms.PageStore.ModTime(ctx, title)
+	ms.metrics.observeStore("modtime", start, err)
+	return t, err
+}
+
+// Exists implements PageStore
+func (ms *meteredStore) Exists(ctx context.Context, title string) bool {
+	start := time.Now()
+	ok := ms.PageStore.Exists(ctx, title)
+	ms.metrics.observeStore("exists", start, nil)
+	return ok
+}
+
+// List implements PageStore
+func (ms *meteredStore) List(ctx context.Context) ([]string, error) {
+	start := time.Now()
+	titles, err := ms.PageStore.List(ctx)
+	ms.metrics.observeStore("list", start, err)
+	return titles, err
+}
+
+// Save implements PageStore
+func (ms *meteredStore) Save(ctx context.Context, p *Page) (int, bool, error) {
+	start := time.Now()
+	rev, created, err := ms.PageStore.Save(ctx, p)
+	ms.metrics.observeStore("save", start, err)
+	return rev, created, err
+}
+
+// Rename implements PageStore
+func (ms *meteredStore) Rename(ctx context.Context, from, to string) error {
+	start := time.Now()
+	err := ms.PageStore.Rename(ctx, from, to)
+	ms.metrics.observeStore("rename", start, err)
+	return err
+}
+
+// Delete implements PageStore
+func (ms *meteredStore) Delete(ctx context.Context, title string) error {
+	start := time.Now()
+	err := ms.PageStore.Delete(ctx, title)
+	ms.metrics.observeStore("delete", start, err)
+	return err
+}
+
+// Revisions implements PageStore
+func (ms *meteredStore) Revisions(ctx context.Context, title string) ([]Revision, error) {
+	start := time.Now()
+	revs, err := ms.PageStore.Revisions(ctx, title)
+	ms.metrics.observeStore("revisions", start, err)
+	return revs, err
+}
+
+// Revision implements PageStore
+func (ms *meteredStore) Revision(ctx context.Context, title string, n int) ([]byte, error) {
+	start := time.Now()
+	body, err := ms.PageStore.Revision(ctx, title, n)
+	ms.metrics.observeStore("revision", start, err)
+	return body, err
+}
+
+// metricsHandler serves the metrics in the Prometheus text exposition
+// format, along with the page count and render cache counters read as it is
+// scraped
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	titles, err := s.store.List(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	fmt.Fprintf(w, "# HELP wiki_pages Pages in the wiki.\n# TYPE wiki_pages gauge\nwiki_pages %d\n", len(titles))
+	fmt.Fprintf(w, "# HELP wiki_render_cache_hits_total Page renders served from the render cache.\n# TYPE wiki_render_cache_hits_total counter\nwiki_render_cache_hits_total %d\n", s.renders.hits.Load())
+	fmt.Fprintf(w, "# HELP wiki_render_cache_misses_total Page renders not found in the render cache.\n# TYPE wiki_render_cache_misses_total counter\nwiki_render_cache_misses_total %d\n", s.renders.misses.Load())
+	s.metrics.requests.write(w)
+	s.metrics.requestDuration.write(w)
+	s.metrics.saves.write(w)
+	s.metrics.storeOps.write(w)
+	s.metrics.storeDuration.write(w)
+	s.metrics.renderDuration.write(w)
+}
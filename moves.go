@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// =============================================================================
+// PAGE RENAMING
+// =============================================================================
+
+// maxMoveHops bounds how many successive renames are followed when resolving a stale title
+const maxMoveHops = 10
+
+// lockPages acquires the locks of two pages in a fixed order so concurrent
+// renames in opposite directions can't deadlock
+func lockPages(store PageStore, a, b string) (unlock func()) {
+	if a == b {
+		return store.Lock(a)
+	}
+	if b < a {
+		a, b = b, a
+	}
+	unlockA := store.Lock(a)
+	unlockB := store.Lock(b)
+	return func() {
+		unlockB()
+		unlockA()
+	}
+}
+
+// renamePage moves a page and its revision history to a new title and records
+// the move in the audit log
+func (s *Server) renamePage(ctx context.Context, from, to, actor, reason string) error {
+	unlock := lockPages(s.store, from, to)
+	defer unlock()
+
+	if err := s.store.Rename(ctx, from, to); err != nil {
+		return err
+	}
+	if err := s.summaries.rename(from, to); err != nil {
+		slog.Error("Moving summary failed", "title", from, "err", err)
+	}
+	if err := s.vectors.rename(from, to); err != nil {
+		slog.Error("Moving semantic search vector failed", "title", from, "err", err)
+	}
+	if err := s.comments.rename(from, to); err != nil {
+		slog.Error("Moving comments failed", "title", from, "err", err)
+	}
+
+	s.notifyPageChange(from)
+	s.notifyPageChange(to)
+	s.audit.record(AuditEvent{Type: eventRename, Title: to, PreviousTitle: from, Actor: actor, Detail: reason})
+	return nil
+}
+
+// rewriteLinks points the links to and transclusions of a page in body at a
+// new title, leaving code blocks alone. It returns the new body and the
+// number of references changed.
+func rewriteLinks(body []byte, from, to string) ([]byte, int) {
+	lines := bytes.SplitAfter(body, []byte("\n"))
+	trimmed := make([][]byte, len(lines))
+	for i, line := range lines {
+		trimmed[i] = bytes.TrimRight(line, "\r\n")
+	}
+	fenced := fencedLines(trimmed)
+
+	replacements := []struct{ old, new []byte }{
+		{[]byte("[" + from + "]"), []byte("[" + to + "]")},
+		{[]byte(includePrefix + from + includeSuffix), []byte(includePrefix + to + includeSuffix)},
+	}
+	var out bytes.Buffer
+	changed := 0
+	for i, line := range lines {
+		if !fenced[i] {
+			for _, r := range replacements {
+				if n := bytes.Count(line, r.old); n > 0 {
+					line = bytes.ReplaceAll(line, r.old, r.new)
+					changed += n
+				}
+			}
+		}
+		out.Write(line)
+	}
+	return out.Bytes(), changed
+}
+
+// updateLinks points the links to a renamed page at its new title, saving
+// each page that referenced it as a revision by actor. It returns the titles
+// of the pages changed.
+func (s *Server) updateLinks(ctx context.Context, from, to, actor string) ([]string, error) {
+	// The page itself may link to its old title too
+	candidates := append(s.links.backlinks(from), to)
+	if !s.links.ready.Load() {
+		var err error
+		if candidates, err = s.store.List(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	var updated []string
+	for _, title := range candidates {
+		err := func() error {
+			unlock := s.store.Lock(title)
+			defer unlock()
+			p, err := s.store.Load(ctx, title)
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			body, n := rewriteLinks(p.Body, from, to)
+			if n == 0 {
+				return nil
+			}
+			summary := "Updated links to " + from + ", which was renamed to " + to
+			if err := s.savePage(ctx, &Page{Title: title, Body: body, Summary: summary, Author: actor}); err != nil {
+				return err
+			}
+			updated = append(updated, title)
+			return nil
+		}()
+		if err != nil {
+			return updated, err
+		}
+	}
+	return updated, nil
+}
+
+// leaveRedirect saves a redirect page at the old title of a renamed page
+func (s *Server) leaveRedirect(ctx context.Context, from, to, actor string) error {
+	unlock := s.store.Lock(from)
+	defer unlock()
+	if s.store.Exists(ctx, from) {
+		return errPageExists
+	}
+	body := []byte("#REDIRECT [" + to + "]\n")
+	return s.savePage(ctx, &Page{Title: from, Body: body, Summary: "Renamed to " + to, Author: actor})
+}
+
+// pageMoves returns every recorded rename, oldest first
+func (s *Server) pageMoves() ([]AuditEvent, error) {
+	events, err := s.audit.events()
+	if err != nil {
+		return nil, err
+	}
+	var moves []AuditEvent
+	for _, ev := range events {
+		if ev.Type == eventRename {
+			moves = append(moves, ev)
+		}
+	}
+	return moves, nil
+}
+
+// resolveMove follows the rename log from a title that no longer exists to the
+// page it was most recently moved to, reporting false if there is none
+func (s *Server) resolveMove(ctx context.Context, title string) (string, bool) {
+	moves, err := s.pageMoves()
+	if err != nil {
+		return "", false
+	}
+
+	current := title
+	for hop := 0; hop < maxMoveHops; hop++ {
+		next := ""
+		for i := len(moves) - 1; i >= 0; i-- {
+			if moves[i].PreviousTitle == current {
+				next = moves[i].Title
+				break
+			}
+		}
+		if next == "" || next == title {
+			return "", false
+		}
+		if s.store.Exists(ctx, next) {
+			return next, true
+		}
+		current = next
+	}
+	return "", false
+}
+
+// =============================================================================
+// RENAME HANDLERS
+// =============================================================================
+
+// RenamePage contains data for rendering the rename form
+type RenamePage struct {
+	Title    string
+	To       string
+	Rewrite  bool // Whether links to the page in other pages are updated
+	Redirect bool // Whether a redirect page is left at the old title
+	Error    string
+
+	csrfForm
+	themedPage
+}
+
+// renameHandler shows the rename form on GET and moves the page on POST,
+// then updates the links to it or leaves a redirect behind as asked
+func (s *Server) renameHandler(w http.ResponseWriter, r *http.Request, title string) {
+	if !s.store.Exists(r.Context(), title) {
+		http.NotFound(w, r)
+		return
+	}
+	// Renames, and the link rewrites that come with them, can't be held for review
+	if s.needsReview(r) {
+		http.Error(w, "Renaming pages needs the write scope", http.StatusForbidden)
+		return
+	}
+	data := &RenamePage{Title: title, Rewrite: true}
+
+	if r.Method == http.MethodPost {
+		data.To = strings.TrimSpace(r.FormValue("to"))
+		data.Rewrite = r.FormValue("rewrite") != ""
+		data.Redirect = r.FormValue("redirect") != ""
+		actor := s.tokenName(r)
+		var err error
+		if validTitle.MatchString(data.To) {
+			err = s.renamePage(r.Context(), title, data.To, actor, strings.TrimSpace(r.FormValue("reason")))
+		}
+		switch {
+		case !validTitle.MatchString(data.To):
+			data.Error = "Page name can only contain letters, numbers, hyphens and underscores, separated by single spaces, with slashes between namespaces"
+		case errors.Is(err, errPageExists):
+			data.Error = "A page named " + data.To + " already exists"
+		case err != nil:
+			serverError(w, r, err)
+			return
+		default:
+			if data.Rewrite {
+				if _, err := s.updateLinks(r.Context(), title, data.To, actor); err != nil {
+					serverError(w, r, err)
+					return
+				}
+			}
+			if data.Redirect {
+				if err := s.leaveRedirect(r.Context(), title, data.To, actor); err != nil {
+					serverError(w, r, err)
+					return
+				}
+			}
+			http.Redirect(w, r, "/view/"+titleURL(data.To), http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+
+	s.renderTemplate(w, r, "rename", data)
+}
+
+// MovesPage contains data for rendering the move log report
+type MovesPage struct {
+	Moves []AuditEvent
+
+	themedPage
+}
+
+// movesHandler lists every rename, newest first
+func (s *Server) movesHandler(w http.ResponseWriter, r *http.Request) {
+	moves, err := s.pageMoves()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i, j := 0, len(moves)-1; i < j; i, j = i+1, j-1 {
+		moves[i], moves[j] = moves[j], moves[i]
+	}
+
+	s.renderTemplate(w, r, "moves", &MovesPage{Moves: moves})
+}
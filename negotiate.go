@@ -0,0 +1,96 @@
+package main
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// =============================================================================
+// CONTENT NEGOTIATION
+// =============================================================================
+
+// Media types a page URL can be represented as
+const (
+	mediaHTML     = "text/html"
+	mediaPlain    = "text/plain"
+	mediaMarkdown = "text/markdown"
+	mediaJSON     = "application/json"
+)
+
+// pageMediaTypes lists the representations of a page in order of server preference
+var pageMediaTypes = []string{mediaHTML, mediaPlain, mediaMarkdown, mediaJSON}
+
+// apiMediaTypes lists the representations of a page the API reads and writes
+var apiMediaTypes = []string{mediaJSON, mediaPlain, mediaMarkdown}
+
+// acceptRange is a single media range from an Accept header with its quality value
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept splits an Accept header into media ranges, skipping malformed entries
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+	}
+	return ranges
+}
+
+// matchQuality returns the quality the client assigned to offer, or -1 if no
+// range matches. More specific ranges take precedence over wildcards.
+func matchQuality(ranges []acceptRange, offer string) float64 {
+	best, specificity := -1.0, -1
+	offerType, _, _ := strings.Cut(offer, "/")
+	for _, r := range ranges {
+		var s int
+		switch {
+		case r.mediaType == offer:
+			s = 2
+		case r.mediaType == offerType+"/*":
+			s = 1
+		case r.mediaType == "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s > specificity {
+			best, specificity = r.q, s
+		}
+	}
+	return best
+}
+
+// negotiate picks the offer the client prefers according to its Accept header,
+// breaking ties by the order of offers. A missing header accepts the first
+// offer; an empty result means nothing offered is acceptable.
+func negotiate(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	ranges := parseAccept(accept)
+	chosen, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q := matchQuality(ranges, offer); q > bestQ {
+			chosen, bestQ = offer, q
+		}
+	}
+	return chosen
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// CHAT NOTIFICATIONS
+// =============================================================================
+
+// notifiersFile lists the chat webhooks told about page changes. The leading
+// dot keeps it out of page listings.
+const notifiersFile = ".notifiers.json"
+
+// Chat services notifiers can post to
+const (
+	notifySlack   = "slack"
+	notifyDiscord = "discord"
+)
+
+// Notifier posts a message to a Slack or Discord incoming webhook whenever a
+// page it covers is created or edited. It covers every page unless limited
+// to a namespace, a tag or both.
+type Notifier struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"` // notifySlack or notifyDiscord
+	URL       string `json:"url"`
+	Namespace string `json:"namespace,omitempty"`
+	Tag       string `json:"tag,omitempty"`
+}
+
+// covers reports whether a change to a page is posted by the notifier
+func (n *Notifier) covers(title string, meta PageMeta) bool {
+	return inNamespace(title, n.Namespace) && (n.Tag == "" || slices.Contains(meta.Tags, n.Tag))
+}
+
+// message returns the webhook payload announcing a change. Slack and Discord
+// take the text under different fields and mark up links differently.
+func (n *Notifier) message(ev AuditEvent, publicURL string) any {
+	author := ev.Actor
+	if author == "" {
+		author = anonymousAuthor
+	}
+	verb := "edited"
+	if ev.Type == eventCreate {
+		verb = "created"
+	}
+
+	base := strings.TrimRight(publicURL, "/")
+	title, diff := ev.Title, ""
+	if base != "" {
+		view := base + "/view/" + titleURL(ev.Title)
+		diff = fmt.Sprintf("%s/diff/%s?to=%d", base, titleURL(ev.Title), ev.Revision)
+		if n.Kind == notifyDiscord {
+			title, diff = "["+ev.Title+"](<"+view+">)", "[diff](<"+diff+">)"
+		} else {
+			title, diff = "<"+view+"|"+ev.Title+">", "<"+diff+"|diff>"
+		}
+	}
+
+	detail := ev.Detail
+	if n.Kind == notifySlack {
+		// Slack reads these three characters as markup in any text
+		escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+		author, detail = escape.Replace(author), escape.Replace(detail)
+	}
+	text := fmt.Sprintf("%s %s by %s", title, verb, author)
+	if detail != "" {
+		text += ": " + detail
+	}
+	if diff != "" {
+		text += " (" + diff + ")"
+	}
+	if n.Kind == notifyDiscord {
+		return map[string]string{"content": text}
+	}
+	return map[string]string{"text": text}
+}
+
+// readNotifiers returns the notifiers of a data directory
+func readNotifiers(dataDir string) ([]Notifier, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, notifiersFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var notifiers []Notifier
+	if err := json.Unmarshal(data, &notifiers); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", notifiersFile, err)
+	}
+	return notifiers, nil
+}
+
+// writeNotifiers replaces the notifiers of a data directory
+func writeNotifiers(dataDir string, notifiers []Notifier) error {
+	data, err := json.MarshalIndent(notifiers, "", "\t")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, notifiersFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// addNotifier adds a notifier to a data directory
+func addNotifier(dataDir string, n Notifier) error {
+	if n.Kind != notifySlack && n.Kind != notifyDiscord {
+		return fmt.Errorf("unknown kind %q, expected %s or %s", n.Kind, notifySlack, notifyDiscord)
+	}
+	if u, err := url.Parse(n.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook %q is not an http or https URL", n.URL)
+	}
+	notifiers, err := readNotifiers(dataDir)
+	if err != nil {
+		return err
+	}
+	if slices.ContainsFunc(notifiers, func(o Notifier) bool { return o.Name == n.Name }) {
+		return fmt.Errorf("a notifier named %q already exists", n.Name)
+	}
+	return writeNotifiers(dataDir, append(notifiers, n))
+}
+
+// removeNotifier removes a notifier from a data directory
+func removeNotifier(dataDir, name string) error {
+	notifiers, err := readNotifiers(dataDir)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(notifiers, func(n Notifier) bool { return n.Name == name })
+	if i < 0 {
+		return fmt.Errorf("no notifier named %q", name)
+	}
+	return writeNotifiers(dataDir, slices.Delete(notifiers, i, i+1))
+}
+
+// postChange posts a page change to the notifiers covering the page. The
+// posts happen in the background and failures are only logged, so chat
+// services never hold up or break saving.
+func (s *Server) postChange(ev AuditEvent, meta PageMeta) {
+	cfg := s.cfg()
+	notifiers, err := readNotifiers(cfg.DataDir)
+	if err != nil {
+		slog.Error("Reading notifiers failed", "err", err)
+		return
+	}
+	for _, n := range notifiers {
+		if n.covers(ev.Title, meta) {
+			go postNotification(n, n.message(ev, cfg.PublicURL))
+		}
+	}
+}
+
+// postNotification sends a message to a notifier's webhook
+func postNotification(n Notifier, msg any) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("Encoding notification failed", "notifier", n.Name, "err", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(payload))
+	if err != nil {
+		slog.Error("Creating notification request failed", "notifier", n.Name, "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Error("Sending notification failed", "notifier", n.Name, "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("Notifier webhook failed", "notifier", n.Name, "status", resp.Status)
+	}
+}
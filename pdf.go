@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// =============================================================================
+// PDF WRITER
+// =============================================================================
+
+// A4 page geometry in points
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+	pdfMargin     = 56.0
+)
+
+// pdfFont is one of the standard fonts every PDF reader provides, so no font
+// data needs to be embedded
+type pdfFont int
+
+const (
+	fontRegular pdfFont = iota
+	fontBold
+)
+
+// pdfFontNames are the PostScript names of the fonts, in pdfFont order
+var pdfFontNames = [...]string{"Helvetica", "Helvetica-Bold"}
+
+// pdfFontWidths are the advance widths of the printable ASCII characters, from
+// space to tilde, in thousandths of the font size
+var pdfFontWidths = [...][95]int{
+	{ // Helvetica
+		278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+		1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+		667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+		333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+		556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+	},
+	{ // Helvetica-Bold
+		278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+		975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+		667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+		333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+		611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+	},
+}
+
+// winAnsiSpecials maps the characters of the Windows-1252 range 0x80-0x9F that
+// commonly appear in text
+var winAnsiSpecials = map[rune]byte{
+	'€': 0x80, '…': 0x85, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97,
+}
+
+// winAnsi encodes text for the standard fonts, replacing characters they lack with ?
+func winAnsi(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r == '\t':
+			out = append(out, ' ', ' ', ' ', ' ')
+		case r >= 32 && r < 127, r >= 160 && r <= 255:
+			out = append(out, byte(r))
+		case winAnsiSpecials[r] != 0:
+			out = append(out, winAnsiSpecials[r])
+		default:
+			out = append(out, '?')
+		}
+	}
+	return out
+}
+
+// textWidth returns the width in points of text set in font at size
+func textWidth(text string, font pdfFont, size float64) float64 {
+	units := 0
+	for _, b := range winAnsi(text) {
+		if b >= 32 && b < 127 {
+			units += pdfFontWidths[font][b-32]
+		} else {
+			units += 556 // Accented letters and punctuation are close to an average letter
+		}
+	}
+	return float64(units) * size / 1000
+}
+
+// pdfString returns text as a PDF literal string
+func pdfString(text string) string {
+	var b bytes.Buffer
+	b.WriteByte('(')
+	for _, c := range winAnsi(text) {
+		if c == '(' || c == ')' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// pdfOutline is a bookmark shown in the reader's navigation pane
+type pdfOutline struct {
+	Title string
+	Page  int
+	Top   float64 // Vertical position the bookmark scrolls to
+}
+
+// pdfLink makes a rectangle of a page jump to another page when clicked
+type pdfLink struct {
+	X1, Y1, X2, Y2 float64
+	Page           int // Destination page
+}
+
+// pdfPage is one page being drawn
+type pdfPage struct {
+	content bytes.Buffer
+	links   []pdfLink
+}
+
+// pdfDocument is a PDF assembled page by page with text in the standard fonts
+type pdfDocument struct {
+	Title    string
+	Pages    []*pdfPage
+	Outlines []pdfOutline
+}
+
+// addPage appends an empty page and returns its index
+func (d *pdfDocument) addPage() int {
+	d.Pages = append(d.Pages, &pdfPage{})
+	return len(d.Pages) - 1
+}
+
+// text draws a line of text with its baseline starting at x, y, measured from
+// the bottom left of the page
+func (d *pdfDocument) text(page int, font pdfFont, size, x, y float64, text string) {
+	fmt.Fprintf(&d.Pages[page].content, "BT /F%d %.1f Tf %.2f %.2f Td %s Tj ET\n", font+1, size, x, y, pdfString(text))
+}
+
+// WriteTo writes the document in PDF format
+func (d *pdfDocument) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	var offsets []int
+	// Objects are numbered in the order they are written, starting at 1
+	obj := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// Fixed objects first: catalog, page tree, fonts, document information
+	const catalogObj, pagesObj, firstFontObj, infoObj = 1, 2, 3, 5
+	outlinesObj := infoObj + 1
+	firstOutlineObj := outlinesObj + 1
+	firstPageObj := firstOutlineObj + len(d.Outlines)
+	pageRef := func(n int) string { return strconv.Itoa(firstPageObj+2*n) + " 0 R" }
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	catalog := "<< /Type /Catalog /Pages 2 0 R"
+	if len(d.Outlines) > 0 {
+		catalog += fmt.Sprintf(" /Outlines %d 0 R /PageMode /UseOutlines", outlinesObj)
+	}
+	obj(catalog + " >>")
+
+	kids := ""
+	for i := range d.Pages {
+		kids += pageRef(i) + " "
+	}
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", kids, len(d.Pages)))
+	for _, name := range pdfFontNames {
+		obj("<< /Type /Font /Subtype /Type1 /BaseFont /" + name + " /Encoding /WinAnsiEncoding >>")
+	}
+	obj(fmt.Sprintf("<< /Title %s /Producer (wiki) /CreationDate (D:%s) >>", pdfString(d.Title), time.Now().UTC().Format("20060102150405Z")))
+
+	if len(d.Outlines) > 0 {
+		obj(fmt.Sprintf("<< /Type /Outlines /First %d 0 R /Last %d 0 R /Count %d >>",
+			firstOutlineObj, firstOutlineObj+len(d.Outlines)-1, len(d.Outlines)))
+	} else {
+		obj("<< /Type /Outlines /Count 0 >>")
+	}
+	for i, o := range d.Outlines {
+		item := fmt.Sprintf("<< /Title %s /Parent %d 0 R /Dest [%s /XYZ 0 %.2f 0]", pdfString(o.Title), outlinesObj, pageRef(o.Page), o.Top)
+		if i > 0 {
+			item += fmt.Sprintf(" /Prev %d 0 R", firstOutlineObj+i-1)
+		}
+		if i < len(d.Outlines)-1 {
+			item += fmt.Sprintf(" /Next %d 0 R", firstOutlineObj+i+1)
+		}
+		obj(item + " >>")
+	}
+
+	// Each page is followed by its content stream
+	for i, p := range d.Pages {
+		annots := ""
+		for _, l := range p.links {
+			annots += fmt.Sprintf("<< /Type /Annot /Subtype /Link /Rect [%.2f %.2f %.2f %.2f] /Border [0 0 0] /Dest [%s /Fit] >> ",
+				l.X1, l.Y1, l.X2, l.Y2, pageRef(l.Page))
+		}
+		page := fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 %d 0 R /F2 %d 0 R >> >> /Contents %d 0 R",
+			pagesObj, pdfPageWidth, pdfPageHeight, firstFontObj, firstFontObj+1, firstPageObj+2*i+1)
+		if annots != "" {
+			page += " /Annots [" + annots + "]"
+		}
+		obj(page + " >>")
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.content.Len(), p.content.Bytes()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root %d 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, catalogObj, infoObj, xref)
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// =============================================================================
+// PDF TEXT LAYOUT
+// =============================================================================
+
+// pdfLayout flows text down the pages of a document, starting a new page when
+// one is full
+type pdfLayout struct {
+	doc  *pdfDocument
+	page int
+	y    float64 // Baseline of the next line
+}
+
+// newLayout returns a layout writing to doc, starting on a new page
+func newLayout(doc *pdfDocument) *pdfLayout {
+	l := &pdfLayout{doc: doc}
+	l.newPage()
+	return l
+}
+
+// newPage moves the layout to the top of a new page
+func (l *pdfLayout) newPage() {
+	l.page = l.doc.addPage()
+	l.y = pdfPageHeight - pdfMargin
+}
+
+// space adds vertical space, moving to a new page when it runs past the bottom
+func (l *pdfLayout) space(h float64) {
+	l.y -= h
+	if l.y < pdfMargin {
+		l.newPage()
+	}
+}
+
+// paragraph writes text wrapped to the width between the margins, with each
+// line taking leading points. Words wider than a line are broken anywhere.
+func (l *pdfLayout) paragraph(text string, font pdfFont, size, leading float64) {
+	width := pdfPageWidth - 2*pdfMargin
+	for _, line := range wrapText(text, font, size, width) {
+		if l.y-leading < pdfMargin {
+			l.newPage()
+		}
+		l.y -= leading
+		l.doc.text(l.page, font, size, pdfMargin, l.y, line)
+	}
+}
+
+// wrapText breaks text into lines no wider than width
+func wrapText(text string, font pdfFont, size, width float64) []string {
+	var lines []string
+	line := ""
+	for _, word := range splitWords(text) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if textWidth(candidate, font, size) <= width {
+			line = candidate
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		// Break words that don't fit on a line of their own
+		for textWidth(word, font, size) > width {
+			cut := len([]rune(word)) - 1
+			for cut > 1 && textWidth(string([]rune(word)[:cut]), font, size) > width {
+				cut--
+			}
+			lines = append(lines, string([]rune(word)[:cut]))
+			word = string([]rune(word)[cut:])
+		}
+		line = word
+	}
+	if line != "" || len(lines) == 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// splitWords splits text at spaces, keeping runs of several spaces as
+// indentation of the following word
+func splitWords(text string) []string {
+	var words []string
+	start := 0
+	for i := 0; i < len(text); i++ {
+		if text[i] == ' ' && i > start && text[i-1] != ' ' {
+			words = append(words, text[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(text) {
+		words = append(words, text[start:])
+	}
+	return words
+}
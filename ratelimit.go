@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// =============================================================================
+// RATE LIMITING
+// =============================================================================
+
+// maxIdleBuckets is how many clients are tracked before those whose bucket
+// has refilled are forgotten
+const maxIdleBuckets = 1024
+
+// tokenBucket holds the requests a client may still make in a burst
+type tokenBucket struct {
+	tokens float64   // Requests available, up to the burst size
+	last   time.Time // When tokens was last brought up to date
+}
+
+// rateLimiter limits each client to a steady rate of requests with bursts,
+// refilling every client's bucket continuously
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter returns a limiter with every client's bucket full
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a request by client from its bucket, which refills at perMinute
+// requests a minute up to burst. When the bucket is empty it reports false
+// and how long until the next request is allowed.
+func (l *rateLimiter) allow(client string, perMinute, burst int, now time.Time) (time.Duration, bool) {
+	rate := float64(perMinute) / 60 // Requests per second
+	capacity := float64(max(burst, 1))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buckets) >= maxIdleBuckets {
+		l.prune(rate, capacity, now)
+	}
+	b := l.buckets[client]
+	if b == nil {
+		b = &tokenBucket{tokens: capacity, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// prune forgets the clients whose bucket would be full by now, since a new
+// bucket starts out the same. Callers hold mu.
+func (l *rateLimiter) prune(rate, capacity float64, now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= capacity {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// clientAddr returns the IP address a request came from
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitEdits wraps a handler so each client address may only reach it at the
+// configured edit rate, answering 429 with Retry-After beyond that
+func (s *Server) limitEdits(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg()
+		if cfg.EditRate > 0 {
+			wait, ok := s.editLimiter.allow(clientAddr(r), cfg.EditRate, cfg.EditBurst, time.Now())
+			if !ok {
+				seconds := int(math.Ceil(wait.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				http.Error(w, fmt.Sprintf("Too many edits; try again in %d seconds", seconds), http.StatusTooManyRequests)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
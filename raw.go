@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+)
+
+// =============================================================================
+// RAW PAGES
+// =============================================================================
+
+// The raw routes give scripts the page markup itself, with no HTML or JSON
+// around it:
+//
+//	curl http://localhost:8080/raw/Home > Home.txt
+//	curl -T Home.txt -H "Authorization: Bearer $TOKEN" http://localhost:8080/raw/Home?summary=Typos
+
+// rawHandler returns the unrendered body of a page as plain text, with its
+// ETag for a later conditional update, or replaces it on PUT with a token
+// allowed to write
+func (s *Server) rawHandler(w http.ResponseWriter, r *http.Request, title string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut:
+		s.requireScope(scopeWrite, func(w http.ResponseWriter, r *http.Request) { s.rawPutHandler(w, r, title) })(w, r)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, err := s.store.Load(r.Context(), title)
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if notModified(w, r, bodyETag(p.Body), p.ModTime) {
+		return
+	}
+	w.Header().Set("Content-Type", mediaPlain+"; charset=utf-8")
+	w.Write(p.Body)
+}
+
+// rawPutHandler replaces the body of a page with the request body, whatever
+// its content type, creating the page if needed, with the summary in the
+// summary parameter. It answers 201 Created for a new page and 204 No Content
+// otherwise. Sending the page's ETag in If-Match makes the update fail with
+// 412 if someone else changed the page in the meantime.
+func (s *Server) rawPutHandler(w http.ResponseWriter, r *http.Request, title string) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAPIBodyBytes))
+	if err != nil {
+		http.Error(w, "Reading body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	unlock := s.store.Lock(title)
+	defer unlock()
+
+	p, err := s.store.Load(r.Context(), title)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		serverError(w, r, err)
+		return
+	}
+	if match := r.Header.Get("If-Match"); match != "" {
+		if !exists || (match != "*" && match != bodyETag(p.Body)) {
+			http.Error(w, "The page has changed since it was read", http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	p = &Page{Title: title, Body: body, Summary: r.URL.Query().Get("summary"), Author: s.tokenName(r)}
+	if s.needsReview(r) {
+		if _, err := s.holdEdit(r, p); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		http.Error(w, "The edit was submitted for review", http.StatusAccepted)
+		return
+	}
+	if err := s.savePage(r.Context(), p); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", bodyETag(p.Body))
+	if !exists {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// =============================================================================
+// READ-ONLY MODE
+// =============================================================================
+
+// readOnlyForms are the pages holding forms that change pages, refused in
+// read-only mode even when merely viewed
+var readOnlyForms = []string{"/edit/", "/rename/", "/delete/", "/upload/"}
+
+// readOnlyExempt are the paths, or with a trailing slash the path prefixes,
+// still accepting changes in read-only mode: logging in and out, the reader's
+// settings, and the administration changing no pages, which lets
+// administrators reload the configuration to leave read-only mode
+var readOnlyExempt = []string{"/login", "/logout", "/settings", "/admin", "/admin/permissions", "/api/admin/"}
+
+// safeMethods are the request methods that change nothing
+var safeMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND"}
+
+// ReadOnlyPage contains data for rendering the page explaining that the
+// wiki can't be changed
+type ReadOnlyPage struct {
+	Title string // Page the reader tried to change, if any
+
+	themedPage
+}
+
+// checkReadOnly answers requests changing pages while the wiki is read-only
+// with 403 Forbidden, reporting false when it did
+func (s *Server) checkReadOnly(w http.ResponseWriter, r *http.Request) bool {
+	if !s.cfg().ReadOnly {
+		return true
+	}
+	for _, path := range readOnlyExempt {
+		if r.URL.Path == path || strings.HasSuffix(path, "/") && strings.HasPrefix(r.URL.Path, path) {
+			return true
+		}
+	}
+	form := slices.ContainsFunc(readOnlyForms, func(prefix string) bool { return strings.HasPrefix(r.URL.Path, prefix) })
+	if slices.Contains(safeMethods, r.Method) && !form {
+		return true
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/"):
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "the wiki is read-only"})
+	case strings.HasPrefix(r.URL.Path, "/raw/"), strings.HasPrefix(r.URL.Path, davPrefix+"/"):
+		http.Error(w, "The wiki is read-only", http.StatusForbidden)
+	default:
+		data := &ReadOnlyPage{}
+		if m := validPath.FindStringSubmatch(r.URL.Path); m != nil {
+			data.Title = m[2]
+		}
+		w.WriteHeader(http.StatusForbidden)
+		s.renderTemplate(w, r, "readonly", data)
+	}
+	return false
+}
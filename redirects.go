@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+)
+
+// =============================================================================
+// REDIRECT PAGES
+// =============================================================================
+
+// Regular expression matching the redirect directive on the first line of a
+// page, which turns the page into a pointer to another page
+var redirectDirective = regexp.MustCompile(`(?i)^#REDIRECT[ \t]*\[(` + titlePattern + `)\]`)
+
+// redirectTarget returns the page a redirect page points at, reporting false
+// for ordinary pages
+func redirectTarget(body []byte) (string, bool) {
+	m := redirectDirective.FindSubmatch(body)
+	if m == nil {
+		return "", false
+	}
+	return string(m[1]), true
+}
+
+// RedirectChain is a redirect page whose target is itself a redirect
+type RedirectChain struct {
+	Titles []string // The chain from the redirect page to its final target, inclusive
+	Loop   bool     // Whether the chain leads back to a page already in it
+	Broken bool     // Whether the chain ends at a page that doesn't exist
+}
+
+// Final returns the page the first redirect in the chain should point at directly
+func (c RedirectChain) Final() string {
+	return c.Titles[len(c.Titles)-1]
+}
+
+// Fixable reports whether the chain can be repaired by repointing its first page
+func (c RedirectChain) Fixable() bool {
+	return !c.Loop && !c.Broken
+}
+
+// followRedirects walks the chain of redirects starting at a redirect page
+func followRedirects(ctx context.Context, store PageStore, title string) RedirectChain {
+	chain := RedirectChain{Titles: []string{title}}
+	seen := map[string]bool{title: true}
+	current := title
+	for {
+		p, err := store.Load(ctx, current)
+		if err != nil {
+			chain.Broken = true
+			return chain
+		}
+		target, ok := redirectTarget(p.Body)
+		if !ok {
+			return chain
+		}
+		if seen[target] {
+			chain.Titles = append(chain.Titles, target)
+			chain.Loop = true
+			return chain
+		}
+		seen[target] = true
+		chain.Titles = append(chain.Titles, target)
+		current = target
+	}
+}
+
+// findDoubleRedirects returns every redirect page that takes more than one hop
+// to reach a real page, or never reaches one
+func (s *Server) findDoubleRedirects(ctx context.Context) ([]RedirectChain, error) {
+	titles, err := s.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(titles)
+
+	var chains []RedirectChain
+	for _, title := range titles {
+		p, err := s.store.Load(ctx, title)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		if _, ok := redirectTarget(p.Body); !ok {
+			continue
+		}
+		if chain := followRedirects(ctx, s.store, title); len(chain.Titles) > 2 || chain.Loop {
+			chains = append(chains, chain)
+		}
+	}
+	return chains, nil
+}
+
+// fixDoubleRedirect repoints a redirect page straight at the final target of
+// its chain, returning false if the chain can't be repaired
+func (s *Server) fixDoubleRedirect(ctx context.Context, title string) (bool, error) {
+	unlock := s.store.Lock(title)
+	defer unlock()
+
+	chain := followRedirects(ctx, s.store, title)
+	if len(chain.Titles) <= 2 || !chain.Fixable() {
+		return false, nil
+	}
+
+	p, err := s.store.Load(ctx, title)
+	if err != nil {
+		return false, err
+	}
+	final := chain.Final()
+	p.Body = redirectDirective.ReplaceAll(p.Body, []byte("#REDIRECT ["+final+"]"))
+	p.Summary = "Fix double redirect to " + final
+	return true, s.savePage(ctx, p)
+}
+
+// =============================================================================
+// REDIRECT HANDLERS
+// =============================================================================
+
+// DoubleRedirectsPage contains data for rendering the double redirect report
+type DoubleRedirectsPage struct {
+	Chains []RedirectChain
+	Fixed  int
+
+	csrfForm
+	themedPage
+}
+
+// doubleRedirectsHandler lists redirect chains on GET. A POST repairs the
+// redirect named by the title form value, or every fixable chain when none is given.
+func (s *Server) doubleRedirectsHandler(w http.ResponseWriter, r *http.Request) {
+	data := &DoubleRedirectsPage{}
+
+	if r.Method == http.MethodPost {
+		var titles []string
+		if title := r.FormValue("title"); validTitle.MatchString(title) {
+			titles = []string{title}
+		} else {
+			chains, err := s.findDoubleRedirects(r.Context())
+			if err != nil {
+				serverError(w, r, err)
+				return
+			}
+			for _, c := range chains {
+				titles = append(titles, c.Titles[0])
+			}
+		}
+		for _, title := range titles {
+			fixed, err := s.fixDoubleRedirect(r.Context(), title)
+			if err != nil {
+				serverError(w, r, err)
+				return
+			}
+			if fixed {
+				data.Fixed++
+			}
+		}
+	}
+
+	chains, err := s.findDoubleRedirects(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	data.Chains = chains
+
+	s.renderTemplate(w, r, "redirects", data)
+}
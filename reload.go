@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"reflect"
+)
+
+// =============================================================================
+// CONFIGURATION RELOAD
+// =============================================================================
+
+// restartOnlySettings are the Config fields that are only read at startup.
+// Changing them requires a restart; reloading keeps their current values.
+var restartOnlySettings = []string{
+	"ConfigFile", "DataDir", "Addr",
+	"TLSCert", "TLSKey", "Autocert", "AutocertCache", "AutocertEmail", "RedirectAddr",
+	"S3Bucket", "S3Prefix", "S3Endpoint", "S3Region", "S3AccessKey", "S3SecretKey", "Git", "GitRemote",
+	"ReadHeaderTimeout", "ReadTimeout", "WriteTimeout", "IdleTimeout", "MaxHeaderBytes",
+	"LogTarget", "LogFile", "LogMaxSize", "LogMaxAge", "LogCompress", "LogFormat",
+	"EmojiFile",
+}
+
+var errReloadUnsupported = errors.New("configuration reloading is not set up for this server")
+
+// SetConfigSource sets the function ReloadConfig uses to rebuild the configuration
+func (s *Server) SetConfigSource(fn func() (Config, error)) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.configSource = fn
+}
+
+// SetLogLevel sets the level of the logger the server writes to, which
+// reloading the configuration then adjusts
+func (s *Server) SetLogLevel(level *slog.LevelVar) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.logLevel = level
+}
+
+// ReloadConfig rebuilds the configuration from the config source and applies it
+func (s *Server) ReloadConfig() ([]string, error) {
+	s.reloadMu.Lock()
+	source := s.configSource
+	s.reloadMu.Unlock()
+	if source == nil {
+		return nil, errReloadUnsupported
+	}
+
+	cfg, err := source()
+	if err != nil {
+		return nil, err
+	}
+	return s.Reload(cfg)
+}
+
+// Reload switches the server to a new configuration and re-parses the
+// templates. Requests already running finish with the settings they started
+// with. Settings that only take effect at startup keep their current values;
+// their names are returned when they differ so the caller can ask for a restart.
+func (s *Server) Reload(cfg Config) ([]string, error) {
+	tmpl, err := parseTemplates(cfg.templateDir())
+	if err != nil {
+		return nil, err
+	}
+	level, err := parseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	current := s.cfg()
+	next := reflect.ValueOf(&cfg).Elem()
+	prev := reflect.ValueOf(current).Elem()
+	var pending []string
+	for _, name := range restartOnlySettings {
+		if !reflect.DeepEqual(next.FieldByName(name).Interface(), prev.FieldByName(name).Interface()) {
+			pending = append(pending, name)
+			next.FieldByName(name).Set(prev.FieldByName(name))
+		}
+	}
+
+	s.setTemplates(tmpl)
+	s.config.Store(&cfg)
+	if s.logLevel != nil {
+		s.logLevel.Set(level)
+	}
+	return pending, nil
+}
+
+// reloadHandler reloads the configuration on request of an administrator
+func (s *Server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	pending, err := s.ReloadConfig()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	logReload(pending)
+	writeJSON(w, http.StatusOK, map[string]any{"reloaded": true, "restart_required": pending})
+}
+
+// logReload records a configuration reload and any settings waiting for a restart
+func logReload(pending []string) {
+	slog.Info("Configuration reloaded")
+	if len(pending) > 0 {
+		slog.Warn("Restart required to apply changed settings", "settings", pending)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// =============================================================================
+// REMOTE API CLIENT
+// =============================================================================
+
+// remoteClient calls the page API of a running wiki server, for the remote
+// commands working on a wiki without access to its data directory
+type remoteClient struct {
+	server string // Base URL of the wiki
+	token  string // API token sent as a bearer token when set
+}
+
+// do sends an API request, encoding body and decoding the response into reply
+// when they aren't nil, and returns whether the request created something
+func (c *remoteClient) do(ctx context.Context, method, path string, body, reply any) (bool, error) {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return false, err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.server, "/")+path, payload)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", mediaJSON)
+	if body != nil {
+		req.Header.Set("Content-Type", mediaJSON)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&msg) == nil && msg.Error != "" {
+			return false, fmt.Errorf("%s: %s", resp.Status, msg.Error)
+		}
+		return false, fmt.Errorf("server responded with %s", resp.Status)
+	}
+	if reply != nil {
+		if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+			return false, fmt.Errorf("decoding response: %w", err)
+		}
+	}
+	return resp.StatusCode == http.StatusCreated, nil
+}
+
+// page returns the body of a page
+func (c *remoteClient) page(ctx context.Context, title string) (string, error) {
+	var p apiPage
+	_, err := c.do(ctx, http.MethodGet, "/api/pages/"+url.PathEscape(title), nil, &p)
+	return p.Body, err
+}
+
+// putPage replaces the body of a page, reporting whether it was created
+func (c *remoteClient) putPage(ctx context.Context, title, body, summary string) (bool, error) {
+	return c.do(ctx, http.MethodPut, "/api/pages/"+url.PathEscape(title), pageWrite{Body: body, Summary: summary}, nil)
+}
+
+// pages returns every page, sorted by title, following the cursors of the
+// list until its last batch
+func (c *remoteClient) pages(ctx context.Context) ([]apiPageInfo, error) {
+	var pages []apiPageInfo
+	q := url.Values{"limit": {strconv.Itoa(maxPageListLimit)}}
+	for {
+		var list apiPageList
+		if _, err := c.do(ctx, http.MethodGet, "/api/pages?"+q.Encode(), nil, &list); err != nil {
+			return nil, err
+		}
+		pages = append(pages, list.Pages...)
+		if list.NextCursor == "" {
+			return pages, nil
+		}
+		q.Set("cursor", list.NextCursor)
+	}
+}
+
+// search returns the pages matching a query, optionally only those in a language
+func (c *remoteClient) search(ctx context.Context, query, lang string) ([]apiSearchResult, error) {
+	q := url.Values{"q": {query}}
+	if lang != "" {
+		q.Set("lang", lang)
+	}
+	var results []apiSearchResult
+	_, err := c.do(ctx, http.MethodGet, "/api/search?"+q.Encode(), nil, &results)
+	return results, err
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// =============================================================================
+// HEADINGS AND ANCHORS
+// =============================================================================
+
+// Regular expression matching HTML tags, which are ignored when deriving anchors
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// headingSlug derives the anchor for a heading from its text: lowercase letters
+// and digits, with runs of spaces, hyphens and underscores collapsed into a
+// single hyphen, so "Installation & Setup" becomes "installation-setup"
+func headingSlug(text string) string {
+	if strings.IndexByte(text, '<') >= 0 {
+		text = htmlTag.ReplaceAllString(text, "")
+	}
+	var b strings.Builder
+	pendingHyphen := false
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if pendingHyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			pendingHyphen = false
+			b.WriteRune(r)
+		case unicode.IsSpace(r) || r == '-' || r == '_':
+			pendingHyphen = true
+		}
+	}
+	if b.Len() == 0 {
+		return "section"
+	}
+	return b.String()
+}
+
+// anchorSet hands out unique heading anchors within one page, suffixing
+// repeated headings with -1, -2, ... in document order so anchors stay stable
+type anchorSet map[string]int
+
+// next returns the unique anchor for a heading with the given text
+func (a anchorSet) next(text string) string {
+	slug := headingSlug(text)
+	n, seen := a[slug]
+	a[slug] = n + 1
+	if !seen {
+		return slug
+	}
+	return slug + "-" + strconv.Itoa(n)
+}
+
+// =============================================================================
+// PAGE RENDERING
+// =============================================================================
+
+// maxIncludeDepth limits how deeply transcluded pages may nest
+const maxIncludeDepth = 5
+
+// Markers recognized by the inline scanner
+const (
+	includePrefix = "{{include:"
+	includeSuffix = "}}"
+)
+
+// bufferPool recycles output buffers between renders to avoid regrowing them for every page
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// renderer holds the state of rendering one page, shared with every page it
+// transcludes so anchors stay unique across the whole document
+type renderer struct {
+	ctx      context.Context
+	store    PageStore
+	err      error // Set when rendering was abandoned because ctx is done
+	out      *bytes.Buffer
+	anchors  anchorSet
+	stack    []string          // Titles being rendered, outermost first
+	notes    *footnotes        // Footnotes of the page being rendered
+	asOf     time.Time         // Time transcluded pages are shown as of, zero for their current content
+	deps     map[string]bool   // Pages whose content the output depends on, besides the page itself
+	included map[string]bool   // Pages transcluded, which only readers who may read them see
+	headings []tocEntry        // Headings written so far, for the table of contents
+	emoji    map[string]string // Shortcodes expanded into emoji, nil for the built-in ones
+
+	// Options for output outside the web interface, such as exported books
+	linkHref   func(title string) string // Target of a page link, empty to leave it unlinked; nil for /view/ URLs
+	escapeText bool                      // Escape text rather than passing HTML through, for well-formed XHTML
+}
+
+// renderBody turns a page body into HTML for the view template, with a table
+// of contents at the top of long pages, reusing the cached result when
+// neither the page nor anything it transcludes has changed.
+// Transcluded pages the reader may not read, as canRead reports, are left
+// out; a nil canRead shows them all. It fails only when ctx is done before
+// the page and its transclusions are rendered.
+func (s *Server) renderBody(ctx context.Context, title string, body []byte, canRead func(title string) bool) (template.HTML, error) {
+	if canRead == nil {
+		canRead = func(string) bool { return true }
+	}
+	etag := bodyETag(body)
+	if html, ok := s.renders.get(title, etag, canRead); ok {
+		return html, nil
+	}
+
+	start := time.Now()
+	out := bufferPool.Get().(*bytes.Buffer)
+	out.Reset()
+	defer bufferPool.Put(out)
+
+	store := readableStore{PageStore: s.store, canRead: canRead}
+	rd := &renderer{ctx: ctx, store: store, out: out, anchors: make(anchorSet), deps: make(map[string]bool), included: make(map[string]bool), emoji: s.emoji}
+	rd.render(title, body)
+	if rd.err != nil {
+		return "", rd.err
+	}
+	html := template.HTML(sanitizeHTML(rd.contents() + out.String()))
+	s.metrics.renderDuration.observe(time.Since(start).Seconds())
+
+	s.renders.put(title, etag, html, rd.deps, rd.included, canRead)
+	return html, nil
+}
+
+// render writes a page body as HTML in a single pass over its lines, as
+// Markdown: fenced code blocks are written as they are, heading lines become
+// headings with id anchors and a self-link, so any section can be linked to as
+// /view/Title#anchor, task list items become checkboxes, pipe tables,
+// definition lists, lists and paragraphs become their HTML elements, footnotes
+// are collected at the end, and text has its emphasis, code, links and
+// transclusions expanded
+func (rd *renderer) render(title string, body []byte) {
+	rd.stack = append(rd.stack, title)
+	defer func() { rd.stack = rd.stack[:len(rd.stack)-1] }()
+
+	lines := contentLines(pageContent(body))
+	outer := rd.notes
+	rd.notes = newFootnotes(lines)
+	defer func() { rd.notes = outer }()
+
+	wrote := false
+	next := func() {
+		if wrote {
+			rd.out.WriteByte('\n')
+		}
+		wrote = true
+	}
+	tasks := 0
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if _, _, ok := parseFootnote(line); ok {
+			continue // Written with the other footnotes at the end
+		}
+		next()
+		if n := rd.codeBlock(lines[i:]); n > 0 {
+			i += n - 1
+		} else if level, text := parseHeading(line); level > 0 {
+			rd.heading(level, text)
+		} else if text, done, ok := parseTask(line); ok {
+			rd.task(title, tasks, done, text)
+			tasks++
+		} else if n := rd.table(lines[i:]); n > 0 {
+			i += n - 1
+		} else if n := rd.definitions(lines[i:]); n > 0 {
+			i += n - 1
+		} else if n := rd.list(lines[i:]); n > 0 {
+			i += n - 1
+		} else if n := rd.paragraph(lines[i:]); n > 0 {
+			i += n - 1
+		} else {
+			rd.inline(line)
+		}
+	}
+	if len(rd.notes.order) > 0 {
+		next()
+		rd.footnotes()
+	}
+}
+
+// contentLines splits page content into lines without their line endings
+func contentLines(content []byte) [][]byte {
+	var lines [][]byte
+	for len(content) > 0 {
+		line := content
+		if i := bytes.IndexByte(content, '\n'); i >= 0 {
+			line, content = content[:i], content[i+1:]
+		} else {
+			content = nil
+		}
+		lines = append(lines, bytes.TrimSuffix(line, []byte("\r")))
+	}
+	return lines
+}
+
+// task writes a task list item as a checkbox followed by its text. On current
+// pages in the web interface the checkbox identifies the task so checking it
+// can be saved; elsewhere it is disabled.
+func (rd *renderer) task(title string, index int, done bool, text []byte) {
+	checked := ""
+	if done {
+		checked = ` checked="checked"`
+	}
+	if rd.linkHref != nil || !rd.asOf.IsZero() {
+		rd.out.WriteString(`<label class="task"><input type="checkbox" disabled="disabled"` + checked + ` /> `)
+	} else {
+		rd.out.WriteString(`<label class="task"><input type="checkbox" data-page="` + title + `" data-task="` + strconv.Itoa(index) + `"` + checked + `> `)
+	}
+	rd.inline(text)
+	rd.out.WriteString(`</label>`)
+}
+
+// parseHeading recognizes a heading line, one to six # followed by the
+// heading text, returning its level and text, or a level of 0 for any other line
+func parseHeading(line []byte) (int, []byte) {
+	level := 0
+	for level < len(line) && line[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || level == len(line) || (line[level] != ' ' && line[level] != '\t') {
+		return 0, nil
+	}
+	text := bytes.TrimRight(bytes.TrimLeft(line[level:], " \t"), " \t")
+	// Drop an optional closing sequence of #, which must be preceded by a space
+	if closed := bytes.TrimRight(text, "#"); len(closed) < len(text) && len(closed) > 0 && (closed[len(closed)-1] == ' ' || closed[len(closed)-1] == '\t') {
+		text = bytes.TrimRight(closed, " \t")
+	}
+	if len(text) == 0 {
+		return 0, nil
+	}
+	return level, text
+}
+
+// heading writes an HTML heading with its anchor and records it for the
+// table of contents
+func (rd *renderer) heading(level int, text []byte) {
+	id := rd.anchors.next(string(text))
+	tag := strconv.Itoa(level)
+	rd.out.WriteString("<h" + tag + ` id="` + id + `">`)
+	start := rd.out.Len()
+	rd.inline(text)
+	rd.headings = append(rd.headings, tocEntry{level: level, id: id, text: htmlTag.ReplaceAllString(rd.out.String()[start:], "")})
+	rd.out.WriteString(` <a class="anchor" href="#` + id + `">#</a></h` + tag + ">")
+}
+
+// inline writes a line of text, turning [PageName] into links, [^id] into
+// footnote references, {{include:PageName}} into the rendered content of that
+// page, @name into a link to the profile of the user mentioned, :shortcode:
+// into its emoji, `code` into code and *text* and **text** into emphasis
+func (rd *renderer) inline(text []byte) {
+	var prev byte // Byte before text, 0 at the start of the line
+	for len(text) > 0 {
+		i := bytes.IndexAny(text, "[{@`*:")
+		if i < 0 {
+			rd.text(text)
+			return
+		}
+		rd.text(text[:i])
+		if i > 0 {
+			prev = text[i-1]
+		}
+		text = text[i:]
+
+		if text[0] == '`' {
+			if n := rd.codeSpan(text); n > 0 {
+				text, prev = text[n:], '`'
+				continue
+			}
+			// An unmatched run of backticks is literal text
+			n := 1
+			for n < len(text) && text[n] == '`' {
+				n++
+			}
+			rd.text(text[:n])
+			text, prev = text[n:], '`'
+			continue
+		} else if text[0] == '*' {
+			if n := rd.emphasis(text); n > 0 {
+				text, prev = text[n:], '*'
+				continue
+			}
+		} else if text[0] == ':' {
+			if n := rd.shortcode(text); n > 0 {
+				text, prev = text[n:], ':'
+				continue
+			}
+		} else if text[0] == '@' {
+			if m := leadingMention.FindSubmatch(text); m != nil && !isWordByte(prev) {
+				rd.mention(string(m[1]))
+				text, prev = text[len(m[0]):], 'x'
+				continue
+			}
+		} else if text[0] == '[' {
+			if m := footnoteRef.FindSubmatch(text); m != nil && rd.footnoteRef(string(m[1])) {
+				text = text[len(m[0]):]
+				continue
+			}
+			if m := attachmentRef.FindSubmatch(text); m != nil && rd.attachment(string(m[1]), string(m[2])) {
+				text = text[len(m[0]):]
+				continue
+			}
+			if name, n := scanTitle(text[1:], "]"); n > 0 {
+				rd.link(string(name))
+				text = text[n+1:]
+				continue
+			}
+		} else if bytes.HasPrefix(text, []byte(includePrefix)) {
+			if name, n := scanTitle(text[len(includePrefix):], includeSuffix); n > 0 {
+				rd.include(string(name))
+				text = text[len(includePrefix)+n:]
+				continue
+			}
+		}
+		rd.out.WriteByte(text[0])
+		text, prev = text[1:], text[0]
+	}
+}
+
+// text writes literal page text
+func (rd *renderer) text(text []byte) {
+	if rd.escapeText {
+		template.HTMLEscape(rd.out, text)
+		return
+	}
+	rd.out.Write(text)
+}
+
+// link writes a link to a page, or just its title when linkHref has no target
+// for it. In the web interface, links to pages that don't exist yet are marked
+// so authors can see what still needs writing; their existence is recorded as
+// a dependency, so the links change once the pages are created or deleted.
+func (rd *renderer) link(title string) {
+	if rd.linkHref == nil {
+		rd.deps[title] = true
+		if !rd.store.Exists(rd.ctx, title) {
+			rd.out.WriteString(`<a class="missing-page" href="/view/` + titleURL(title) + `" title="` + title + ` (page does not exist)">` + title + `</a>`)
+			return
+		}
+		rd.out.WriteString(`<a href="/view/` + titleURL(title) + `">` + title + `</a>`)
+		return
+	}
+	href := rd.linkHref(title)
+	if href == "" {
+		rd.out.WriteString(title)
+		return
+	}
+	rd.out.WriteString(`<a href="` + href + `">` + title + `</a>`)
+}
+
+// mention writes a mention of a user, linked to their profile in the web interface
+func (rd *renderer) mention(name string) {
+	if rd.linkHref != nil {
+		rd.out.WriteString("@" + name)
+		return
+	}
+	rd.out.WriteString(`<a class="mention" href="/users/` + name + `">@` + name + `</a>`)
+}
+
+// maxLinkTitle is the longest title, in bytes, looked for between the
+// brackets of a link or transclusion
+const maxLinkTitle = 200
+
+// scanTitle reads a page title at the start of text terminated by closing. It
+// returns the title and the number of bytes consumed including the terminator,
+// or 0 if text doesn't start with a valid title followed by closing.
+func scanTitle(text []byte, closing string) ([]byte, int) {
+	n := bytes.Index(text[:min(len(text), maxLinkTitle+len(closing))], []byte(closing))
+	if n <= 0 || !validTitle.Match(text[:n]) {
+		return nil, 0
+	}
+	return text[:n], n + len(closing)
+}
+
+// include writes another page's rendered content, or an inline error when the
+// page is missing, unreadable to the reader, already being rendered, or
+// nested too deeply
+func (rd *renderer) include(title string) {
+	rd.deps[title] = true
+	if rd.included != nil {
+		rd.included[title] = true
+	}
+	for _, t := range rd.stack {
+		if t == title {
+			rd.includeError("Include cycle: " + strings.Join(append(rd.stack, title), " → "))
+			return
+		}
+	}
+	if len(rd.stack) > maxIncludeDepth {
+		rd.includeError(fmt.Sprintf("Include of %s skipped: pages may only be nested %d levels deep", title, maxIncludeDepth))
+		return
+	}
+
+	p, err := rd.load(title)
+	if err != nil && rd.ctx.Err() != nil {
+		rd.err = rd.ctx.Err()
+		return
+	}
+	if errors.Is(err, errUnreadable) {
+		rd.includeError("You may not read the included page " + title)
+		return
+	}
+	if err != nil {
+		rd.includeError("Included page " + title + " does not exist")
+		return
+	}
+	rd.out.WriteString(`<div class="include">`)
+	rd.render(title, p.Body)
+	rd.out.WriteString(`</div>`)
+}
+
+// load returns a page to transclude: its current content, or the revision
+// current at asOf when set. Pages without revisions only have their current
+// content to show.
+func (rd *renderer) load(title string) (*Page, error) {
+	if rd.asOf.IsZero() {
+		return rd.store.Load(rd.ctx, title)
+	}
+	revs, err := rd.store.Revisions(rd.ctx, title)
+	if err != nil {
+		return nil, err
+	}
+	if len(revs) == 0 {
+		return rd.store.Load(rd.ctx, title)
+	}
+	rev, ok := revisionAt(revs, rd.asOf)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	body, err := rd.store.Revision(rd.ctx, title, rev.Number)
+	if err != nil {
+		return nil, err
+	}
+	return &Page{Title: title, Body: body, ModTime: rev.Time}, nil
+}
+
+// includeError writes a transclusion problem in place of the included content
+func (rd *renderer) includeError(msg string) {
+	rd.out.WriteString(`<span class="include-error">`)
+	template.HTMLEscape(rd.out, []byte(msg))
+	rd.out.WriteString(`</span>`)
+}
+
+// =============================================================================
+// RENDER CACHE
+// =============================================================================
+
+// renderedPage is a cached rendering of a page
+type renderedPage struct {
+	etag     string // Identifies the body that was rendered
+	html     template.HTML
+	deps     map[string]bool // Linked and transcluded pages the rendering depends on
+	included map[string]bool // Transcluded pages, shown only to readers who may read them
+	denied   map[string]bool // Transcluded pages left out, as the reader it was rendered for may not read them
+}
+
+// sameAccess reports whether a reader sees the transcluded pages of the
+// rendering as the reader it was rendered for did, able to read the same
+// ones. Linked pages show alike to every reader, so aren't checked.
+func (entry *renderedPage) sameAccess(canRead func(title string) bool) bool {
+	for title := range entry.included {
+		if canRead(title) == entry.denied[title] {
+			return false
+		}
+	}
+	return true
+}
+
+// renderCache holds the latest rendering of each page
+type renderCache struct {
+	mu      sync.RWMutex
+	entries map[string]*renderedPage
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// newRenderCache returns an empty render cache
+func newRenderCache() *renderCache {
+	return &renderCache{entries: make(map[string]*renderedPage)}
+}
+
+// get returns the cached HTML of a page if it was rendered from the body with
+// the given etag for a reader able to read the same transcluded pages
+func (c *renderCache) get(title, etag string, canRead func(title string) bool) (template.HTML, bool) {
+	c.mu.RLock()
+	entry, ok := c.entries[title]
+	c.mu.RUnlock()
+
+	if ok && entry.etag == etag && entry.sameAccess(canRead) {
+		c.hits.Add(1)
+		return entry.html, true
+	}
+	c.misses.Add(1)
+	return "", false
+}
+
+// put caches the HTML rendered from a page body, which depends on the deps
+// pages, for a reader able to read the included pages canRead reports
+func (c *renderCache) put(title, etag string, html template.HTML, deps, included map[string]bool, canRead func(title string) bool) {
+	denied := make(map[string]bool)
+	for t := range included {
+		if !canRead(t) {
+			denied[t] = true
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[title] = &renderedPage{etag: etag, html: html, deps: deps, included: included, denied: denied}
+}
+
+// invalidate drops the cached rendering of a page and of every page transcluding it
+func (c *renderCache) invalidate(title string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, title)
+	for t, entry := range c.entries {
+		if entry.deps[title] {
+			delete(c.entries, t)
+		}
+	}
+}
+
+// hitRate returns the fraction of renders served from the cache, or 0 before any render
+func (c *renderCache) hitRate() float64 {
+	hits, misses := c.hits.Load(), c.misses.Load()
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// findSection locates the section introduced by the heading with the given
+// anchor, with or without the user-content- prefix of the rendered page's
+// ids. Headings are recognized as the renderer does, leaving out front matter
+// and fenced code. It returns the byte offsets of the section content, from
+// just after the heading line up to the next heading of the same or a higher
+// level.
+func findSection(body, anchor string) (start, end int, ok bool) {
+	content := pageContent([]byte(body))
+	lines := contentLines(content)
+	fenced := fencedLines(lines)
+	anchors := make(anchorSet)
+	level := 0
+	offset := len(body) - len(content)
+	for i, line := range lines {
+		next := len(body)
+		if lineEnd := strings.IndexByte(body[offset:], '\n'); lineEnd >= 0 {
+			next = offset + lineEnd + 1
+		}
+		if n, text := parseHeading(line); n > 0 && !fenced[i] {
+			if ok && n <= level {
+				return start, offset, true
+			}
+			if id := anchors.next(string(text)); !ok && (id == anchor || userContentPrefix+id == anchor) {
+				start, level, ok = next, n, true
+			}
+		}
+		offset = next
+	}
+	return start, len(body), ok
+}
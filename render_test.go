@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// benchmarkPage returns a large page body exercising most of the markup:
+// headings, emphasis, links, lists, tables, code blocks and a transclusion
+func benchmarkPage(sections int) []byte {
+	var b strings.Builder
+	b.WriteString("Intro with {{include:Snippet}} transcluded.\n\n")
+	for i := range sections {
+		fmt.Fprintf(&b, "## Section %d\n\n", i)
+		fmt.Fprintf(&b, "Some *emphasised* and **strong** text with `code`, a link to [[Page%d]] and https://example.com/%d.\n", i, i)
+		b.WriteString("A second line of the same paragraph, long enough to be worth wrapping in an editor.\n\n")
+		b.WriteString("- [ ] A task\n- [x] A done task\n- A plain item\n\n")
+		b.WriteString("| Name | Value |\n| --- | --- |\n| one | 1 |\n| two | 2 |\n\n")
+		b.WriteString("```\nfunc main() {\n\tprintln(\"hello\")\n}\n```\n\n")
+	}
+	return []byte(b.String())
+}
+
+// BenchmarkRender renders a large generated page, rendering it over again
+// each time and then reusing the cached result, for every reader and for a
+// reader whose access to each transcluded page is checked
+func BenchmarkRender(b *testing.B) {
+	ctx := context.Background()
+	s := newTestServer(b, nil)
+	savePages(b, s, map[string]string{"Snippet": "Transcluded *text*.\n"})
+	if err := s.permissions.set(s.cfg().DataDir, Permission{Target: "Private/", Read: []string{"alice"}}); err != nil {
+		b.Fatal(err)
+	}
+	canRead := s.readChecker(httptest.NewRequest(http.MethodGet, "/view/Bench", nil))
+	body := benchmarkPage(500)
+
+	b.Run("uncached", func(b *testing.B) {
+		b.SetBytes(int64(len(body)))
+		for b.Loop() {
+			s.renders.invalidate("Bench")
+			if _, err := s.renderBody(ctx, "Bench", body, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		b.SetBytes(int64(len(body)))
+		for b.Loop() {
+			if _, err := s.renderBody(ctx, "Bench", body, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached with permissions", func(b *testing.B) {
+		b.SetBytes(int64(len(body)))
+		for b.Loop() {
+			if _, err := s.renderBody(ctx, "Bench", body, canRead); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestFindSection(t *testing.T) {
+	body := "---\ntitle: Guide\n---\n# Guide\n\n## Usage\n\nRun it.\n\n```\n## Usage\nnot a heading\n```\n\n### Flags\n\n-v\n\n## Usage\n\nAgain.\n"
+	for _, tc := range []struct {
+		anchor string
+		want   string
+		ok     bool
+	}{
+		{"usage", "\nRun it.\n\n```\n## Usage\nnot a heading\n```\n\n### Flags\n\n-v\n\n", true},
+		{"user-content-usage", "\nRun it.\n\n```\n## Usage\nnot a heading\n```\n\n### Flags\n\n-v\n\n", true},
+		{"flags", "\n-v\n\n", true},
+		{"usage-1", "\nAgain.\n", true},
+		{"usage-2", "", false},
+		{"title-guide", "", false},
+	} {
+		start, end, ok := findSection(body, tc.anchor)
+		if ok != tc.ok || ok && body[start:end] != tc.want {
+			t.Errorf("findSection(%q) = %q, %v, want %q, %v", tc.anchor, body[start:end], ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// =============================================================================
+// BULK FIND AND REPLACE
+// =============================================================================
+
+// replaceSummaryLimit is the longest pattern quoted in full in the summary of
+// the revisions a replacement creates
+const replaceSummaryLimit = 40
+
+// ReplaceLine is a line of a page changed by a replacement
+type ReplaceLine struct {
+	Number int
+	Before string
+	After  string
+}
+
+// ReplaceMatch is a page a replacement would change
+type ReplaceMatch struct {
+	Title string
+	ETag  string // ETag of the body previewed, so applying refuses pages changed since
+	Count int    // Number of occurrences of the pattern
+	Lines []ReplaceLine
+}
+
+// ReplacePage contains data for rendering the find and replace tool
+type ReplacePage struct {
+	Find      string
+	Replace   string
+	Regex     bool
+	Namespace string
+	Matches   []ReplaceMatch
+	Applied   []string // Pages changed by the replacement just applied
+	Conflicts []string // Pages changed since the preview, left alone
+	Error     string
+
+	csrfForm
+	themedPage
+}
+
+// Total returns the number of occurrences found across every page
+func (p *ReplacePage) Total() int {
+	total := 0
+	for _, m := range p.Matches {
+		total += m.Count
+	}
+	return total
+}
+
+// replacer substitutes a literal string or a regular expression line by line
+type replacer struct {
+	literal string
+	re      *regexp.Regexp
+	with    string
+}
+
+// newReplacer compiles the pattern, expanding $1 style references in the
+// replacement when it is a regular expression
+func newReplacer(find, with string, regex bool) (*replacer, error) {
+	if find == "" {
+		return nil, fmt.Errorf("nothing to find")
+	}
+	if !regex {
+		return &replacer{literal: find, with: with}, nil
+	}
+	re, err := regexp.Compile(find)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression: %w", err)
+	}
+	return &replacer{re: re, with: with}, nil
+}
+
+// line returns the line with the pattern replaced and the number of
+// occurrences replaced. Empty matches of a regular expression don't count.
+func (rp *replacer) line(s string) (string, int) {
+	if rp.re == nil {
+		n := strings.Count(s, rp.literal)
+		if n == 0 {
+			return s, 0
+		}
+		return strings.ReplaceAll(s, rp.literal, rp.with), n
+	}
+	n := 0
+	for _, loc := range rp.re.FindAllStringIndex(s, -1) {
+		if loc[1] > loc[0] {
+			n++
+		}
+	}
+	if n == 0 {
+		return s, 0
+	}
+	return rp.re.ReplaceAllString(s, rp.with), n
+}
+
+// apply returns the body with the pattern replaced on every line, with the
+// lines it changed
+func (rp *replacer) apply(body string) (string, []ReplaceLine, int) {
+	lines := strings.Split(body, "\n")
+	var changed []ReplaceLine
+	total := 0
+	for i, before := range lines {
+		after, n := rp.line(before)
+		if n == 0 || after == before {
+			continue
+		}
+		lines[i] = after
+		total += n
+		changed = append(changed, ReplaceLine{Number: i + 1, Before: before, After: after})
+	}
+	return strings.Join(lines, "\n"), changed, total
+}
+
+// findReplacements returns every page in the namespace the replacement would change
+func (s *Server) findReplacements(ctx context.Context, rp *replacer, namespace string) ([]ReplaceMatch, error) {
+	titles, err := s.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(titles)
+
+	var matches []ReplaceMatch
+	for _, title := range titles {
+		if !inNamespace(title, namespace) {
+			continue
+		}
+		p, err := s.store.Load(ctx, title)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue // Removed since it was listed
+		}
+		if _, lines, n := rp.apply(string(p.Body)); len(lines) > 0 {
+			matches = append(matches, ReplaceMatch{Title: title, ETag: bodyETag(p.Body), Count: n, Lines: lines})
+		}
+	}
+	return matches, nil
+}
+
+// applyReplacements replaces the pattern in the pages, all or nothing: the
+// pages are locked together, none is changed when any has been edited since
+// its preview, and the pages already saved are restored when a save fails.
+// etags maps each page to the ETag of the body previewed.
+func (s *Server) applyReplacements(ctx context.Context, rp *replacer, etags map[string]string, author, summary string) (applied, conflicts []string, err error) {
+	titles := make([]string, 0, len(etags))
+	for title := range etags {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles) // Lock in a fixed order so concurrent replacements can't deadlock
+	for _, title := range titles {
+		unlock := s.store.Lock(title)
+		defer unlock()
+	}
+
+	var pages, originals []*Page
+	for _, title := range titles {
+		p, err := s.store.Load(ctx, title)
+		if err != nil || bodyETag(p.Body) != etags[title] {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			conflicts = append(conflicts, title)
+			continue
+		}
+		body, lines, _ := rp.apply(string(p.Body))
+		if len(lines) == 0 {
+			continue
+		}
+		originals = append(originals, &Page{Title: title, Body: p.Body})
+		pages = append(pages, &Page{Title: title, Body: []byte(body), Summary: summary, Author: author})
+	}
+	if len(conflicts) > 0 {
+		return nil, conflicts, nil
+	}
+
+	for i, p := range pages {
+		if err := s.savePage(ctx, p); err != nil {
+			for _, orig := range originals[:i] {
+				orig.Summary = "Revert failed replacement"
+				orig.Author = author
+				if rerr := s.savePage(context.WithoutCancel(ctx), orig); rerr != nil {
+					slog.Error("Restoring page after failed replacement failed", "title", orig.Title, "err", rerr)
+				}
+			}
+			return nil, nil, fmt.Errorf("saving %s: %w", p.Title, err)
+		}
+		applied = append(applied, p.Title)
+	}
+	return applied, nil, nil
+}
+
+// replaceSummary returns the edit summary of the revisions a replacement creates
+func replaceSummary(find, with string) string {
+	quote := func(s string) string {
+		if r := []rune(s); len(r) > replaceSummaryLimit {
+			s = string(r[:replaceSummaryLimit]) + "…"
+		}
+		return `"` + s + `"`
+	}
+	return "Replace " + quote(find) + " with " + quote(with)
+}
+
+// replaceHandler previews the pages a replacement would change on GET and
+// applies it to the pages checked in the preview on POST
+func (s *Server) replaceHandler(w http.ResponseWriter, r *http.Request) {
+	data := &ReplacePage{
+		Find:      r.FormValue("find"),
+		Replace:   r.FormValue("replace"),
+		Regex:     r.FormValue("regex") != "",
+		Namespace: strings.TrimSpace(r.FormValue("namespace")),
+	}
+	if data.Find == "" {
+		s.renderTemplate(w, r, "replace", data)
+		return
+	}
+	rp, err := newReplacer(data.Find, data.Replace, data.Regex)
+	if err != nil {
+		data.Error = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+		s.renderTemplate(w, r, "replace", data)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		etags := make(map[string]string)
+		for _, v := range r.Form["page"] {
+			title, etag, ok := strings.Cut(v, " ")
+			if ok && validTitle.MatchString(title) && inNamespace(title, data.Namespace) {
+				etags[title] = etag
+			}
+		}
+		actor := s.tokenName(r)
+		applied, conflicts, err := s.applyReplacements(r.Context(), rp, etags, actor, replaceSummary(data.Find, data.Replace))
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if len(applied) > 0 {
+			slog.Info("Text replaced", "by", actor, "find", data.Find, "replace", data.Replace, "pages", len(applied))
+		}
+		data.Applied, data.Conflicts = applied, conflicts
+	}
+
+	matches, err := s.findReplacements(r.Context(), rp, data.Namespace)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	data.Matches = matches
+	s.renderTemplate(w, r, "replace", data)
+}
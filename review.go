@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// EDIT REVIEW
+// =============================================================================
+
+// validEditID matches the IDs of pending edits
+var validEditID = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// PendingEdit is an edit held for review instead of being saved, stored as
+// JSON in the pending directory until a reviewer approves or rejects it
+type PendingEdit struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	Summary   string    `json:"summary,omitempty"`
+	Author    string    `json:"author"` // Name of the token used, or "anonymous"
+	Addr      string    `json:"addr,omitempty"`
+	Base      string    `json:"base,omitempty"` // ETag of the page the edit was made against, empty for new pages
+	Submitted time.Time `json:"submitted"`
+}
+
+// ReviewQueue contains data for rendering the list of pending edits
+type ReviewQueue struct {
+	Edits    []PendingEdit
+	Approved int // Number of edits just approved
+	Rejected int // Number of edits just rejected
+
+	csrfForm
+	themedPage
+}
+
+// ReviewPage contains data for rendering a pending edit against the current page
+type ReviewPage struct {
+	Edit  PendingEdit
+	New   bool // Whether the edit creates the page
+	Stale bool // Whether the page changed since the edit was made
+	Hunks []DiffHunk
+
+	csrfForm
+	themedPage
+}
+
+// reviewAlert is the JSON payload posted to the review webhook
+type reviewAlert struct {
+	Text string      `json:"text"` // Human-readable summary, the field chat webhooks display
+	Edit PendingEdit `json:"edit"`
+	URL  string      `json:"url"` // Path of the edit's review page
+}
+
+// anonymousAuthor is the author recorded for edits made without a token
+const anonymousAuthor = "anonymous"
+
+// needsReview reports whether a request's edits must be held for review:
+// review is enabled and the request carries no token allowed to write, or
+// moderation is enabled and it carries no token at all
+func (s *Server) needsReview(r *http.Request) bool {
+	cfg := s.cfg()
+	return cfg.ReviewEdits && !s.hasScope(r, scopeWrite) ||
+		cfg.ModerateAnonymous && s.tokenName(r) == ""
+}
+
+// canReview reports whether a request may approve or reject an edit.
+// Reviewers handle every edit; with moderation enabled, editors handle
+// those made anonymously.
+func (s *Server) canReview(r *http.Request, edit PendingEdit) bool {
+	if s.hasScope(r, scopeReview) {
+		return true
+	}
+	return s.cfg().ModerateAnonymous && edit.Author == anonymousAuthor && s.hasScope(r, scopeWrite)
+}
+
+// requireModerator wraps the review pages for reviewers, and for editors
+// when anonymous edits are moderated
+func (s *Server) requireModerator(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scope := scopeReview
+		if s.cfg().ModerateAnonymous && !s.hasScope(r, scopeReview) {
+			scope = scopeWrite
+		}
+		s.requireLogin(scope, fn)(w, r)
+	}
+}
+
+// holdEdit stores an edit for review and notifies the review webhook
+func (s *Server) holdEdit(r *http.Request, p *Page) (PendingEdit, error) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	edit := PendingEdit{
+		ID:        hex.EncodeToString(id),
+		Title:     p.Title,
+		Body:      string(p.Body),
+		Summary:   p.Summary,
+		Author:    p.Author,
+		Submitted: time.Now().UTC(),
+	}
+	if edit.Author == "" {
+		edit.Author = anonymousAuthor
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		edit.Addr = host
+	}
+	if current, err := s.store.Load(r.Context(), p.Title); err == nil {
+		edit.Base = bodyETag(current.Body)
+	}
+
+	data, err := json.MarshalIndent(edit, "", "\t")
+	if err != nil {
+		return edit, err
+	}
+	dir := filepath.Join(s.cfg().DataDir, pendingDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return edit, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, edit.ID+".json"), data, 0644); err != nil {
+		return edit, err
+	}
+	if s.cfg().ReviewWebhook != "" {
+		go s.sendReviewAlert(context.Background(), edit)
+	}
+	return edit, nil
+}
+
+// pendingEdits returns the edits awaiting review, oldest first
+func (s *Server) pendingEdits() ([]PendingEdit, error) {
+	entries, err := os.ReadDir(filepath.Join(s.cfg().DataDir, pendingDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var edits []PendingEdit
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !validEditID.MatchString(id) {
+			continue
+		}
+		edit, err := s.pendingEdit(id)
+		if err != nil {
+			slog.Error("Reading pending edit failed", "edit", id, "err", err)
+			continue
+		}
+		edits = append(edits, edit)
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].Submitted.Before(edits[j].Submitted) })
+	return edits, nil
+}
+
+// pendingEdit returns the edit awaiting review with an ID
+func (s *Server) pendingEdit(id string) (PendingEdit, error) {
+	var edit PendingEdit
+	data, err := os.ReadFile(filepath.Join(s.cfg().DataDir, pendingDir, id+".json"))
+	if err != nil {
+		return edit, err
+	}
+	err = json.Unmarshal(data, &edit)
+	return edit, err
+}
+
+// removePendingEdit deletes a reviewed edit from the queue
+func (s *Server) removePendingEdit(id string) error {
+	return os.Remove(filepath.Join(s.cfg().DataDir, pendingDir, id+".json"))
+}
+
+// approveEdit saves a pending edit as a new revision of its page
+func (s *Server) approveEdit(ctx context.Context, edit PendingEdit, reviewer string) error {
+	unlock := s.store.Lock(edit.Title)
+	defer unlock()
+	summary := edit.Summary
+	if summary == "" {
+		summary = "Edit by " + edit.Author
+	}
+	if err := s.savePage(ctx, &Page{Title: edit.Title, Body: []byte(edit.Body), Summary: summary, Author: edit.Author}); err != nil {
+		return err
+	}
+	s.audit.record(AuditEvent{Type: eventReview, Title: edit.Title, Actor: reviewer, Detail: "Approved edit by " + edit.Author})
+	return s.removePendingEdit(edit.ID)
+}
+
+// rejectEdit discards a pending edit
+func (s *Server) rejectEdit(edit PendingEdit, reviewer, reason string) error {
+	detail := "Rejected edit by " + edit.Author
+	if reason != "" {
+		detail += ": " + reason
+	}
+	s.audit.record(AuditEvent{Type: eventReview, Title: edit.Title, Actor: reviewer, Detail: detail})
+	return s.removePendingEdit(edit.ID)
+}
+
+// sendReviewAlert posts a newly held edit to the configured webhook
+func (s *Server) sendReviewAlert(ctx context.Context, edit PendingEdit) {
+	cfg := s.cfg()
+	text := fmt.Sprintf("Edit to %s by %s is awaiting review", edit.Title, edit.Author)
+	if edit.Summary != "" {
+		text += ": " + edit.Summary
+	}
+	payload, err := json.Marshal(reviewAlert{Text: text, Edit: edit, URL: "/review/" + edit.ID})
+	if err != nil {
+		slog.Error("Encoding review alert failed", "err", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.ReviewWebhook, bytes.NewReader(payload))
+	if err != nil {
+		slog.Error("Creating review alert request failed", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Error("Sending review alert failed", "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("Review webhook failed", "status", resp.Status)
+	}
+}
+
+// reviewQueueHandler lists the edits awaiting review that the reader may
+// handle, and approves or rejects the edits checked in the list when the
+// form is posted with action set
+func (s *Server) reviewQueueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		s.reviewEdits(w, r, r.PostFormValue("action"), r.PostForm["id"])
+		return
+	}
+
+	edits, err := s.pendingEdits()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	data := &ReviewQueue{}
+	for _, edit := range edits {
+		if s.canReview(r, edit) {
+			data.Edits = append(data.Edits, edit)
+		}
+	}
+	data.Approved, _ = strconv.Atoi(r.URL.Query().Get("approved"))
+	data.Rejected, _ = strconv.Atoi(r.URL.Query().Get("rejected"))
+	s.renderTemplate(w, r, "review", data)
+}
+
+// reviewEdits approves or rejects the pending edits with the given IDs and
+// returns to the queue. Edits already handled are skipped, as are those the
+// reader may not handle.
+func (s *Server) reviewEdits(w http.ResponseWriter, r *http.Request, action string, ids []string) {
+	if action != "approve" && action != "reject" {
+		http.Error(w, `action must be "approve" or "reject"`, http.StatusBadRequest)
+		return
+	}
+	reviewer := s.tokenName(r)
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	n := 0
+	for _, id := range ids {
+		if !validEditID.MatchString(id) {
+			continue
+		}
+		edit, err := s.pendingEdit(id)
+		if errors.Is(err, os.ErrNotExist) || err == nil && !s.canReview(r, edit) {
+			continue
+		} else if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if action == "approve" {
+			err = s.approveEdit(r.Context(), edit, reviewer)
+		} else {
+			err = s.rejectEdit(edit, reviewer, reason)
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		n++
+	}
+	http.Redirect(w, r, fmt.Sprintf("/review?%sd=%d", action, n), http.StatusSeeOther)
+}
+
+// reviewHandler shows a pending edit as a diff against the current page, and
+// approves or rejects it when the form is posted with action set
+func (s *Server) reviewHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !validEditID.MatchString(id) {
+		http.NotFound(w, r)
+		return
+	}
+	edit, err := s.pendingEdit(id)
+	if errors.Is(err, os.ErrNotExist) || err == nil && !s.canReview(r, edit) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		s.reviewEdits(w, r, r.FormValue("action"), []string{id})
+		return
+	}
+
+	data := &ReviewPage{Edit: edit}
+	var current []byte
+	p, err := s.store.Load(r.Context(), edit.Title)
+	switch {
+	case err == nil:
+		current = p.Body
+		data.Stale = bodyETag(p.Body) != edit.Base
+	case errors.Is(err, os.ErrNotExist):
+		data.New = true
+		data.Stale = edit.Base != ""
+	default:
+		serverError(w, r, err)
+		return
+	}
+	data.Hunks = unifiedDiff(string(current), edit.Body)
+	s.renderTemplate(w, r, "pending", data)
+}
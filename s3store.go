@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =============================================================================
+// OBJECT STORAGE
+// =============================================================================
+
+// s3Timeout bounds each request to the object store
+const s3Timeout = 30 * time.Second
+
+// errObjectChanged is returned when a conditional write finds the object
+// changed since it was read, because another server wrote it first
+var errObjectChanged = errors.New("the page was changed by another server at the same time; try again")
+
+// s3Store is a PageStore keeping pages and their history as objects in an
+// S3-compatible bucket, so servers need no persistent disk for them. Objects
+// are laid out under the prefix like files in the data directory, as
+// Projects/Alpha.txt and .history/Projects%2FAlpha/log.jsonl, so a data
+// directory can be copied into a bucket as it is. Writes are conditional on
+// the object being unchanged since it was read, so servers sharing a bucket
+// don't overwrite each other's edits. Attachments, accounts, tokens and the
+// other wiki data stay in the local data directory, which must be given
+// explicitly, as it needs persistent storage all the same.
+type s3Store struct {
+	client         *s3Client
+	prefix         string // Key prefix of every object, empty or ending in "/"
+	attachmentsDir string // Local directory of attachments, moved along with renamed pages
+	locks          sync.Map
+}
+
+// newS3Store returns a store keeping pages in the configured bucket
+func newS3Store(cfg Config) (*s3Store, error) {
+	endpoint := cfg.S3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + cfg.S3Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("-s3-endpoint %q is not an http or https URL", endpoint)
+	}
+	if cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+		return nil, errors.New("-s3-bucket is set but -s3-access-key or -s3-secret-key is empty")
+	}
+	if cfg.DataDir == savePath {
+		return nil, errors.New("-s3-bucket is set but -data isn't: the data directory still holds accounts, tokens, attachments and other data, and must be on persistent storage")
+	}
+	prefix := strings.Trim(cfg.S3Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Store{
+		client: &s3Client{
+			endpoint:  u,
+			bucket:    cfg.S3Bucket,
+			region:    cfg.S3Region,
+			accessKey: cfg.S3AccessKey,
+			secretKey: cfg.S3SecretKey,
+			// Temporary credentials come with a session token, which only the
+			// environment provides
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			http:         &http.Client{Timeout: s3Timeout},
+		},
+		prefix:         prefix,
+		attachmentsDir: filepath.Join(cfg.DataDir, attachmentsDir),
+	}, nil
+}
+
+// pageKey returns the key of the object holding a page's current body
+func (s *s3Store) pageKey(title string) string {
+	return s.prefix + pageFile(title)
+}
+
+// historyKey returns the key prefix of a page's revisions and revision log
+func (s *s3Store) historyKey(title string) string {
+	return s.prefix + historyDir + "/" + fileStem(title) + "/"
+}
+
+// revisionKey returns the key of the body of revision n of a page
+func (s *s3Store) revisionKey(title string, n int) string {
+	return s.historyKey(title) + strconv.Itoa(n) + ".txt"
+}
+
+// Lock acquires the lock for a page and returns the function releasing it.
+// It only serializes the writes of this server; conditional writes catch
+// those of others.
+func (s *s3Store) Lock(title string) (unlock func()) {
+	mu, _ := s.locks.LoadOrStore(title, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// Load fetches a page's object
+func (s *s3Store) Load(ctx context.Context, title string) (*Page, error) {
+	obj, err := s.client.get(ctx, s.pageKey(title))
+	if err != nil {
+		return nil, err
+	}
+	return &Page{Title: title, Body: obj.data, ModTime: obj.modTime, Meta: parsePageMeta(obj.data)}, nil
+}
+
+// ModTime returns when a page's object was last written
+func (s *s3Store) ModTime(ctx context.Context, title string) (time.Time, error) {
+	return s.client.head(ctx, s.pageKey(title))
+}
+
+// Exists reports whether a page's object exists, without fetching it
+func (s *s3Store) Exists(ctx context.Context, title string) bool {
+	_, err := s.ModTime(ctx, title)
+	return err == nil
+}
+
+// List returns the titles of the page objects under the prefix. Like files
+// in the data directory, keys with a segment starting with a dot hold other
+// wiki data and are skipped.
+func (s *s3Store) List(ctx context.Context) ([]string, error) {
+	keys, err := s.client.list(ctx, s.prefix)
+	if err != nil {
+		return nil, err
+	}
+	var pages []string
+	for _, key := range keys {
+		rel := strings.TrimPrefix(key, s.prefix)
+		if strings.HasPrefix(rel, ".") || strings.Contains(rel, "/.") || !strings.HasSuffix(rel, ".txt") {
+			continue
+		}
+		pages = append(pages, fileTitle(rel))
+	}
+	return pages, nil
+}
+
+// Save records a page as a new revision and then writes its object, unless
+// another server changed it since it was read. Recording the revision first
+// means a failed save leaves at most an extra revision, never a changed page
+// missing from its history.
+func (s *s3Store) Save(ctx context.Context, p *Page) (int, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, false, err
+	}
+	ctx = context.WithoutCancel(ctx) // Once started, the page and its history are written together
+	key := s.pageKey(p.Title)
+	previous, err := s.client.get(ctx, key)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, false, err
+	}
+	rev, err := s.recordRevision(ctx, p.Title, p.Body, p.Summary, previous.data)
+	if err != nil {
+		return 0, false, err
+	}
+	if _, err := s.client.put(ctx, key, p.Body, previous.etag); err != nil {
+		return 0, false, err
+	}
+	return rev, previous.etag == "", nil
+}
+
+// recordRevision adds a revision to a page's history unless its body is the
+// latest revision, as the file store does, returning its number or 0
+func (s *s3Store) recordRevision(ctx context.Context, title string, body []byte, summary string, previous []byte) (int, error) {
+	history, err := s.client.get(ctx, s.historyKey(title)+"log.jsonl")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	revs, err := parseRevisionLog(title, bytes.NewReader(history.data))
+	if err != nil {
+		return 0, err
+	}
+
+	if len(revs) == 0 && previous != nil && !bytes.Equal(previous, body) {
+		if err := s.appendRevision(ctx, title, 1, previous, "Content before revision history", &history); err != nil {
+			return 0, err
+		}
+		revs = append(revs, Revision{Number: 1})
+	}
+
+	if len(revs) > 0 {
+		latest, err := s.client.get(ctx, s.revisionKey(title, revs[len(revs)-1].Number))
+		if err == nil && bytes.Equal(latest.data, body) {
+			return 0, nil
+		}
+	}
+	n := len(revs) + 1
+	return n, s.appendRevision(ctx, title, n, body, summary, &history)
+}
+
+// appendRevision writes revision n of a page, failing if another server
+// wrote it first, and adds it to the revision log, updating history to the
+// log as written
+func (s *s3Store) appendRevision(ctx context.Context, title string, n int, body []byte, summary string, history *s3Object) error {
+	if _, err := s.client.put(ctx, s.revisionKey(title, n), body, ""); err != nil {
+		return err
+	}
+	entry, err := json.Marshal(Revision{Number: n, Time: time.Now().UTC(), Summary: summary, Size: len(body)})
+	if err != nil {
+		return err
+	}
+	data := append(append(bytes.Clone(history.data), entry...), '\n')
+	etag, err := s.client.put(ctx, s.historyKey(title)+"log.jsonl", data, history.etag)
+	if err != nil {
+		return err
+	}
+	history.data, history.etag = data, etag
+	return nil
+}
+
+// Rename copies a page's object and revision history to the new title and
+// removes the old ones, moving its local attachments along
+func (s *s3Store) Rename(ctx context.Context, from, to string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx = context.WithoutCancel(ctx)
+	page, err := s.client.get(ctx, s.pageKey(from))
+	if err != nil {
+		return err
+	}
+	if _, err := s.client.put(ctx, s.pageKey(to), page.data, ""); errors.Is(err, errObjectChanged) {
+		return errPageExists
+	} else if err != nil {
+		return err
+	}
+
+	keys, err := s.client.list(ctx, s.historyKey(from))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		obj, err := s.client.get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if _, err := s.client.put(ctx, s.historyKey(to)+strings.TrimPrefix(key, s.historyKey(from)), obj.data, "*"); err != nil {
+			return err
+		}
+		if err := s.client.delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	if err := s.client.delete(ctx, s.pageKey(from)); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(s.attachmentsDir, fileStem(from)), filepath.Join(s.attachmentsDir, fileStem(to))); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Delete removes a page's object, keeping its revision history
+func (s *s3Store) Delete(ctx context.Context, title string) error {
+	if !s.Exists(ctx, title) {
+		return os.ErrNotExist
+	}
+	return s.client.delete(ctx, s.pageKey(title))
+}
+
+// Revisions returns the revisions recorded in a page's revision log
+func (s *s3Store) Revisions(ctx context.Context, title string) ([]Revision, error) {
+	history, err := s.client.get(ctx, s.historyKey(title)+"log.jsonl")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseRevisionLog(title, bytes.NewReader(history.data))
+}
+
+// Revision fetches the body of revision n of a page
+func (s *s3Store) Revision(ctx context.Context, title string, n int) ([]byte, error) {
+	obj, err := s.client.get(ctx, s.revisionKey(title, n))
+	return obj.data, err
+}
+
+// =============================================================================
+// S3 CLIENT
+// =============================================================================
+
+// s3Client makes the few S3 API requests the store needs, addressing the
+// bucket by path so it works with S3-compatible servers as well as AWS, and
+// signing them with AWS Signature Version 4
+type s3Client struct {
+	endpoint     *url.URL
+	bucket       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	http         *http.Client
+}
+
+// s3Object is an object read from the bucket
+type s3Object struct {
+	data    []byte
+	etag    string // Empty when the object doesn't exist
+	modTime time.Time
+}
+
+// s3Error is an error response from the object store
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// Error describes the failure, as the store reported it
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("object store: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// get fetches an object. Missing objects give an error wrapping os.ErrNotExist.
+func (c *s3Client) get(ctx context.Context, key string) (s3Object, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return s3Object{}, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return s3Object{}, err
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return s3Object{data: data, etag: resp.Header.Get("ETag"), modTime: modTime}, nil
+}
+
+// head returns when an object was last written
+func (c *s3Client) head(ctx context.Context, key string) (time.Time, error) {
+	resp, err := c.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp.Body.Close()
+	return http.ParseTime(resp.Header.Get("Last-Modified"))
+}
+
+// put writes an object if it still has the ETag etag, or if it doesn't
+// exist yet when etag is empty, or in any case when etag is "*". It fails with
+// errObjectChanged otherwise, and returns the object's new ETag.
+func (c *s3Client) put(ctx context.Context, key string, data []byte, etag string) (string, error) {
+	header := make(http.Header)
+	switch etag {
+	case "":
+		header.Set("If-None-Match", "*")
+	case "*":
+	default:
+		header.Set("If-Match", etag)
+	}
+	resp, err := c.do(ctx, http.MethodPut, key, nil, data, header)
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) && (s3Err.Status == http.StatusPreconditionFailed || s3Err.Status == http.StatusConflict) {
+		return "", errObjectChanged
+	}
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// delete removes an object
+func (c *s3Client) delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3ListResult is a page of ListObjectsV2 results
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list returns the keys of the objects starting with prefix, following
+// ListObjectsV2's pages of results
+func (c *s3Client) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := c.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("object store: reading list of objects: %w", err)
+		}
+		for _, obj := range result.Contents {
+			keys = append(keys, obj.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// do sends a signed request for an object of the bucket, or for the bucket
+// itself when key is empty, and returns the response when it succeeded.
+// Failures are returned as *s3Error, wrapping os.ErrNotExist for 404s.
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	u := *c.endpoint
+	u.RawPath = strings.TrimSuffix(c.endpoint.EscapedPath(), "/") + "/" + s3Escape(c.bucket, false)
+	if key != "" {
+		u.RawPath += "/" + s3Escape(key, false)
+	}
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	c.sign(req, body, time.Now().UTC())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	s3Err := &s3Error{Status: resp.StatusCode}
+	if data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10)); len(data) > 0 {
+		xml.Unmarshal(data, s3Err)
+	}
+	if s3Err.Code == "" {
+		s3Err.Code = http.StatusText(resp.StatusCode)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+	}
+	return nil, s3Err
+}
+
+// sign adds the AWS Signature Version 4 authorization of a request, signing
+// its host, its x-amz- headers and its body
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.Join(values, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+	date := now.Format("20060102")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{date, c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes s as Signature Version 4 requires: every byte
+// but ASCII letters, digits and -._~ is encoded, and so is "/" when
+// escapeSlash is set
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery encodes query parameters sorted by name, as they are signed
+func s3CanonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
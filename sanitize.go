@@ -0,0 +1,181 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// =============================================================================
+// HTML SANITIZATION
+// =============================================================================
+
+// globalAttributes may be set on every allowed element
+var globalAttributes = []string{"class", "id", "title", "lang", "dir"}
+
+// userContentPrefix starts every id in a rendered page, so elements in the
+// page can't take the ids the wiki's own pages and scripts use, or shadow
+// the globals that named elements become. Links within the wiki point to
+// the prefixed ids.
+const userContentPrefix = "user-content-"
+
+// allowedElements are the elements rendered pages may contain, with the
+// attributes each may have besides the global ones. It covers what the
+// renderer writes and the formatting authors commonly write as HTML.
+var allowedElements = map[string][]string{
+	"a": {"href", "download"}, "img": {"src", "alt", "width", "height"},
+	"input": {"type", "checked", "disabled", "data-page", "data-task"}, "label": nil,
+	"p": nil, "div": nil, "span": nil, "br": nil, "hr": nil,
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"em": nil, "strong": nil, "b": nil, "i": nil, "u": nil, "s": nil, "del": nil, "ins": nil,
+	"sub": nil, "sup": nil, "small": nil, "mark": nil, "kbd": nil, "abbr": nil, "cite": nil, "q": nil,
+	"code": nil, "pre": nil, "blockquote": nil,
+	"ul": nil, "ol": {"start", "reversed"}, "li": {"value"}, "dl": nil, "dt": nil, "dd": nil,
+	"table": nil, "caption": nil, "thead": nil, "tbody": nil, "tfoot": nil, "tr": nil,
+	"th": {"colspan", "rowspan", "scope", "style"}, "td": {"colspan", "rowspan", "style"},
+	"section": nil, "nav": nil, "details": {"open"}, "summary": nil, "figure": nil, "figcaption": nil,
+}
+
+// droppedContent are the elements removed along with everything inside them,
+// rather than leaving their text behind
+var droppedContent = []string{"script", "style", "iframe", "object", "embed", "template", "noscript", "textarea", "title", "svg", "math"}
+
+// voidElements have no content or end tag
+var voidElements = []string{"br", "hr", "img", "input"}
+
+// allowedStyle is the only inline style kept, which the renderer sets on the
+// cells of aligned table columns
+var allowedStyle = regexp.MustCompile(`^\s*text-align:\s*(left|right|center)\s*;?\s*$`)
+
+// sanitizeHTML returns rendered page HTML keeping only the allowed elements
+// and attributes, so HTML written in pages can't run scripts or restyle the
+// wiki around them. Disallowed elements are dropped but their text is kept,
+// links only lead to http, https and mailto URLs or within the wiki, ids get
+// userContentPrefix, and end tags without a matching start tag are dropped,
+// so a page can't close the elements enclosing it.
+func sanitizeHTML(src string) string {
+	var b strings.Builder
+	var open []string // Allowed elements not closed yet, innermost last
+	skip := 0         // Depth inside an element whose content is dropped
+	z := html.NewTokenizer(strings.NewReader(src))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break // The end of the input
+		}
+		tok := z.Token()
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if slices.Contains(droppedContent, tok.Data) {
+				if tt == html.StartTagToken {
+					skip++
+				}
+				continue
+			}
+			if skip > 0 || !writeStartTag(&b, tok) {
+				continue
+			}
+			if tt == html.StartTagToken && !slices.Contains(voidElements, tok.Data) {
+				open = append(open, tok.Data)
+			}
+		case html.EndTagToken:
+			if slices.Contains(droppedContent, tok.Data) {
+				skip = max(skip-1, 0)
+				continue
+			}
+			i := len(open) - 1
+			for i >= 0 && open[i] != tok.Data {
+				i--
+			}
+			if skip > 0 || i < 0 {
+				continue
+			}
+			for len(open) > i {
+				b.WriteString("</" + open[len(open)-1] + ">")
+				open = open[:len(open)-1]
+			}
+		case html.TextToken:
+			if skip == 0 {
+				b.WriteString(html.EscapeString(tok.Data))
+			}
+		}
+		// Comments and doctypes are left out
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + open[i] + ">")
+	}
+	return b.String()
+}
+
+// writeStartTag writes the start tag of an allowed element with its allowed
+// attributes, reporting false when the element isn't allowed
+func writeStartTag(b *strings.Builder, tok html.Token) bool {
+	attrs, ok := allowedElements[tok.Data]
+	if !ok {
+		return false
+	}
+	if tok.Data == "input" && !slices.ContainsFunc(tok.Attr, func(a html.Attribute) bool {
+		return a.Key == "type" && strings.EqualFold(a.Val, "checkbox")
+	}) {
+		return false // Only task list checkboxes
+	}
+	b.WriteString("<" + tok.Data)
+	for _, a := range tok.Attr {
+		if a.Namespace != "" || !slices.Contains(attrs, a.Key) && !slices.Contains(globalAttributes, a.Key) {
+			continue
+		}
+		switch {
+		case a.Key == "href" && !safeURL(a.Val, "http", "https", "mailto"),
+			a.Key == "src" && !safeURL(a.Val, "http", "https"),
+			a.Key == "style" && !allowedStyle.MatchString(a.Val):
+			continue
+		case a.Key == "id":
+			a.Val = userContentID(a.Val)
+		case a.Key == "href":
+			a.Val = userContentFragment(a.Val)
+		}
+		b.WriteString(" " + a.Key + `="` + html.EscapeString(a.Val) + `"`)
+	}
+	b.WriteString(">")
+	return true
+}
+
+// userContentID returns an id starting with userContentPrefix
+func userContentID(id string) string {
+	if strings.HasPrefix(id, userContentPrefix) {
+		return id
+	}
+	return userContentPrefix + id
+}
+
+// userContentFragment points a link within the wiki, such as #usage or
+// /view/Guide#usage, to the prefixed id of its fragment
+func userContentFragment(href string) string {
+	if !strings.HasPrefix(href, "#") && (!strings.HasPrefix(href, "/") || strings.HasPrefix(href, "//")) {
+		return href
+	}
+	rest, fragment, ok := strings.Cut(href, "#")
+	if !ok || fragment == "" {
+		return href
+	}
+	return rest + "#" + userContentID(fragment)
+}
+
+// safeURL reports whether a URL is relative or uses one of the schemes.
+// Browsers ignore control characters and whitespace in schemes, so those
+// are removed before it is read.
+func safeURL(u string, schemes ...string) bool {
+	u = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, u)
+	i := strings.IndexAny(u, ":/?#")
+	if i < 0 || u[i] != ':' {
+		return true // No scheme
+	}
+	return slices.Contains(schemes, strings.ToLower(u[:i]))
+}
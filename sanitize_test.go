@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"javascript with a tab", "<a href=\"java\tscript:alert(1)\">x</a>", "<a>x</a>"},
+		{"javascript with a tab reference", "<a href=\"jav&#x09;ascript:alert(1)\">x</a>", "<a>x</a>"},
+		{"javascript after a control character", "<a href=\"&#14;javascript:alert(1)\">x</a>", "<a>x</a>"},
+		{"javascript with a NUL", "<a href=\"java\x00script:alert(1)\">x</a>", "<a>x</a>"},
+		{"javascript in mixed case", "<a href=\" JaVaScRiPt:alert(1)\">x</a>", "<a>x</a>"},
+		{"data image", "<img src=\"data:image/png;base64,AAAA\">", "<img>"},
+		{"safe links", "<a href=\"https://example.com/\">e</a><a href=\"mailto:a@example.com\">m</a><a href=\"/view/Home\">h</a>",
+			"<a href=\"https://example.com/\">e</a><a href=\"mailto:a@example.com\">m</a><a href=\"/view/Home\">h</a>"},
+		{"event handlers and styles", "<p onclick=\"alert(1)\" style=\"color:red\">s</p><td style=\"text-align: center\">c</td>",
+			"<p>s</p><td style=\"text-align: center\">c</td>"},
+		{"script", "a<script>alert(1)</script>b", "ab"},
+		{"svg", "before<svg><script>alert(1)</script><a href=\"#x\">in svg</a></svg>after", "beforeafter"},
+		{"math", "before<math><mi>x</mi><mtext><img src=x></mtext></math>after", "beforeafter"},
+		{"stray end tags", "<p>text</div></body></html><b>bold</p>", "<p>text<b>bold</b></p>"},
+		{"stray end tag in an element", "<div>a</span>b</div>", "<div>ab</div>"},
+		{"unclosed elements", "<div><em>a", "<div><em>a</em></div>"},
+		{"ids", "<h2 id=\"usage\">Usage</h2><h2 id=\"user-content-x\">X</h2>",
+			"<h2 id=\"user-content-usage\">Usage</h2><h2 id=\"user-content-x\">X</h2>"},
+		{"fragment links", "<a href=\"#usage\">u</a><a href=\"/view/Guide#usage\">g</a><a href=\"#user-content-x\">x</a><a href=\"/view/Guide#\">e</a>",
+			"<a href=\"#user-content-usage\">u</a><a href=\"/view/Guide#user-content-usage\">g</a><a href=\"#user-content-x\">x</a><a href=\"/view/Guide#\">e</a>"},
+		{"fragments of other sites", "<a href=\"https://example.com/#usage\">e</a><a href=\"//example.com/#usage\">p</a>",
+			"<a href=\"https://example.com/#usage\">e</a><a href=\"//example.com/#usage\">p</a>"},
+	} {
+		if got := sanitizeHTML(tc.in); got != tc.want {
+			t.Errorf("%s: sanitizeHTML(%q) = %q, want %q", tc.name, tc.in, got, tc.want)
+		}
+	}
+}
+
+// TestRenderedIDs checks that the ids the renderer writes, and the links of
+// the table of contents to them, get the user-content- prefix
+func TestRenderedIDs(t *testing.T) {
+	s := newTestServer(t, nil)
+	var body strings.Builder
+	for _, heading := range []string{"Usage", "Flags", "Examples", "Usage"} {
+		body.WriteString("## " + heading + "\n\nText.\n\n")
+	}
+	html, err := s.renderBody(context.Background(), "Guide", []byte(body.String()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`id="user-content-usage"`, `id="user-content-usage-1"`, `href="#user-content-flags"`} {
+		if !strings.Contains(string(html), want) {
+			t.Errorf("rendered page lacks %s:\n%s", want, html)
+		}
+	}
+	if strings.Contains(string(html), `id="usage"`) || strings.Contains(string(html), `href="#usage"`) {
+		t.Errorf("rendered page has unprefixed ids:\n%s", html)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// =============================================================================
+// SEARCH
+// =============================================================================
+
+// maxSuggestions caps the number of titles returned to browser search suggestions
+const maxSuggestions = 10
+
+// SearchResult is a single page matching a search query
+type SearchResult struct {
+	Title   string
+	Lang    string  // Language of the page content
+	Snippet string  // Excerpt of the body around the first match, empty for title-only matches
+	Summary string  // Generated summary of the page, empty when summaries are disabled
+	Score   float64 // Similarity to the query in semantic search
+}
+
+// Search modes
+const (
+	searchKeyword  = "keyword"  // Pages containing the query
+	searchSemantic = "semantic" // Pages related in meaning to the query
+)
+
+// SearchPage contains data for rendering the search results template
+type SearchPage struct {
+	Query    string
+	Lang     string // Language the results were restricted to, if any
+	Mode     string
+	Semantic bool   // Whether semantic search is available
+	Notice   string // Explains why a semantic search fell back to keywords
+	Results  []SearchResult
+
+	themedPage
+}
+
+// searchPages returns pages whose title or body contains query, ignoring case
+// by the rules of each page's language. Title matches are listed before
+// body-only matches. A non-empty lang restricts the results to pages in that
+// language or one of its regional variants; pages not declaring a language
+// are taken to be in defaultLang.
+func searchPages(ctx context.Context, store PageStore, query, lang, defaultLang string) ([]SearchResult, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, nil
+	}
+
+	titles, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(titles)
+
+	var titleHits, bodyHits []SearchResult
+	for _, title := range titles {
+		p, err := store.Load(ctx, title)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		pageLang := contentLang(p, defaultLang)
+		if lang != "" && !langMatches(pageLang, lang) {
+			continue
+		}
+
+		needle := foldCase(query, pageLang)
+		snippet := matchSnippet(string(pageContent(p.Body)), needle, pageLang)
+		switch {
+		case strings.Contains(foldCase(title, pageLang), needle):
+			titleHits = append(titleHits, SearchResult{Title: title, Lang: pageLang, Snippet: snippet})
+		case snippet != "":
+			bodyHits = append(bodyHits, SearchResult{Title: title, Lang: pageLang, Snippet: snippet})
+		}
+	}
+	return append(titleHits, bodyHits...), nil
+}
+
+// foldCase lowercases text for case-insensitive matching, following the
+// casing rules of lang where they differ from the default, as for the dotted
+// and dotless i of Turkish and Azerbaijani
+func foldCase(text, lang string) string {
+	switch primary, _, _ := strings.Cut(lang, "-"); primary {
+	case "tr", "az":
+		return strings.ToLowerSpecial(unicode.TurkishCase, text)
+	}
+	return strings.ToLower(text)
+}
+
+// langMatches reports whether a page in language tag is included by a filter
+// for lang: the same language, or a regional variant of it such as pt-BR for pt
+func langMatches(tag, lang string) bool {
+	return strings.EqualFold(tag, lang) || len(tag) > len(lang) && tag[len(lang)] == '-' && strings.EqualFold(tag[:len(lang)], lang)
+}
+
+// matchSnippet returns the text surrounding the first occurrence of needle in
+// body, folded by the casing rules of lang, or an empty string if body does
+// not contain it
+func matchSnippet(body, needle, lang string) string {
+	const context = 60
+
+	i := strings.Index(foldCase(body, lang), needle)
+	if i < 0 {
+		return ""
+	}
+	i = min(i, len(body)) // Folding can change the length of the text before the match
+	start, end := max(i-context, 0), min(i+len(needle)+context, len(body))
+	// Avoid cutting multi-byte characters in half
+	for start > 0 && !isRuneStart(body[start]) {
+		start--
+	}
+	for end < len(body) && !isRuneStart(body[end]) {
+		end++
+	}
+
+	snippet := strings.Join(strings.Fields(body[start:end]), " ")
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(body) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+// isRuneStart reports whether b is the first byte of a UTF-8 encoded rune
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// searchHandler displays pages matching the q query parameter, by keyword or,
+// with mode=semantic, by meaning when semantic search is enabled
+func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	lang := r.URL.Query().Get("lang")
+	if !validLang.MatchString(lang) {
+		lang = ""
+	}
+	embedder := s.embedder()
+	page := &SearchPage{Query: query, Lang: lang, Mode: searchKeyword, Semantic: embedder != nil}
+
+	var results []SearchResult
+	var err error
+	if r.URL.Query().Get("mode") == searchSemantic {
+		switch {
+		case embedder == nil:
+			page.Notice = "Semantic search is not enabled on this wiki, showing keyword matches instead."
+		case strings.TrimSpace(query) == "":
+			page.Mode = searchSemantic
+		default:
+			page.Mode = searchSemantic
+			results, err = s.semanticSearch(r.Context(), embedder, query, lang)
+			if err != nil && r.Context().Err() == nil {
+				slog.Error("Semantic search failed", "err", err)
+				page.Mode, page.Notice = searchKeyword, "Semantic search is unavailable right now, showing keyword matches instead."
+			}
+		}
+	}
+	if page.Mode == searchKeyword {
+		results, err = searchPages(r.Context(), s.store, query, lang, s.cfg().DefaultLang)
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	results = slices.DeleteFunc(results, func(res SearchResult) bool { return !s.canRead(r, res.Title) })
+	if s.summarizer() != nil {
+		for i := range results {
+			results[i].Summary = s.summaries.text(results[i].Title)
+		}
+	}
+
+	page.Results = results
+	s.renderTemplate(w, r, "search", page)
+}
+
+// suggestHandler returns page titles starting with or containing the q query
+// parameter in the OpenSearch suggestions format browsers use for autocomplete
+func (s *Server) suggestHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	needle := strings.ToLower(query)
+
+	titles, err := s.store.List(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	sort.Strings(titles)
+
+	var prefixed, contained []string
+	for _, title := range titles {
+		lower := strings.ToLower(title)
+		switch {
+		case strings.HasPrefix(lower, needle):
+			prefixed = append(prefixed, title)
+		case strings.Contains(lower, needle):
+			contained = append(contained, title)
+		}
+	}
+	suggestions := append(prefixed, contained...)
+	if len(suggestions) > maxSuggestions {
+		suggestions = suggestions[:maxSuggestions]
+	}
+	if suggestions == nil {
+		suggestions = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/x-suggestions+json")
+	if err := json.NewEncoder(w).Encode([]any{query, suggestions}); err != nil {
+		slog.Error("Encoding search suggestions failed", "err", err)
+	}
+}
+
+// =============================================================================
+// OPENSEARCH DESCRIPTION
+// =============================================================================
+
+// openSearchDescription is the OpenSearch 1.1 descriptor browsers use to add
+// the wiki as a search engine
+type openSearchDescription struct {
+	XMLName       xml.Name        `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName     string          `xml:"ShortName"`
+	Description   string          `xml:"Description"`
+	InputEncoding string          `xml:"InputEncoding"`
+	URLs          []openSearchURL `xml:"Url"`
+}
+
+// openSearchURL is a URL template within an OpenSearch descriptor
+type openSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Method   string `xml:"method,attr"`
+	Template string `xml:"template,attr"`
+}
+
+// baseURL reconstructs the scheme and host the client used to reach the server
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// openSearchHandler serves the OpenSearch description document
+func openSearchHandler(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r)
+	desc := openSearchDescription{
+		ShortName:     "Wiki",
+		Description:   "Search wiki pages",
+		InputEncoding: "UTF-8",
+		URLs: []openSearchURL{
+			{Type: "text/html", Method: "get", Template: base + "/search?q={searchTerms}"},
+			{Type: "application/x-suggestions+json", Method: "get", Template: base + "/search/suggest?q={searchTerms}"},
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/opensearchdescription+xml")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(desc); err != nil {
+		slog.Error("Encoding OpenSearch description failed", "err", err)
+	}
+}
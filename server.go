@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// =============================================================================
+// SERVER
+// =============================================================================
+
+// templateFiles lists the templates parsed at startup
+var templateFiles = []string{
+	"edit.html",
+	"view.html",
+	"index.html",
+	"search.html",
+	"diff.html",
+	"conflict.html",
+	"history.html",
+	"login.html",
+	"activity.html",
+	"changes.html",
+	"admin.html",
+	"rename.html",
+	"delete.html",
+	"trash.html",
+	"upload.html",
+	"backlinks.html",
+	"toc.html",
+	"moves.html",
+	"redirects.html",
+	"translations.html",
+	"duplicates.html",
+	"review.html",
+	"pending.html",
+	"user.html",
+	"tasks.html",
+	"permissions.html",
+	"replace.html",
+	"tags.html",
+	"tag.html",
+	"readonly.html",
+	"404.html",
+	"500.html",
+	"settings.html",
+	"theme.html",
+	"switcher.html",
+}
+
+// Server is a wiki instance: its configuration, page store, templates and the
+// HTTP routes serving them. It holds no package-level state, so several
+// servers can run in one process and tests can drive one through httptest.
+type Server struct {
+	config      atomic.Pointer[Config]            // Replaced as a whole by Reload
+	templates   atomic.Pointer[template.Template] // Replaced as a whole by Reload
+	templateGen atomic.Uint64                     // Counts template replacements, so cached pages go stale with them
+	store       PageStore
+	mux         *http.ServeMux
+	audit       *auditLog
+	tokens      *tokenRegistry
+	users       *userRegistry
+	permissions *permissionRegistry
+	renders     *renderCache
+	links       *linkGraph
+	metrics     *metrics
+
+	editLimiter *rateLimiter     // Per-client budget of requests to the edit form and save
+	editLocks   *editLockManager // Who is editing which page
+
+	summaries    *summaryStore
+	summaryQueue *pageQueue
+
+	comments *commentStore
+
+	vectors        *vectorIndex
+	embeddingQueue *pageQueue
+
+	duplicates *duplicateScanner
+
+	githubWake chan struct{} // Signals the GitHub sync that pages changed
+
+	emoji map[string]string // Shortcodes expanded into emoji
+
+	davLocks   webdav.LockSystem // Locks WebDAV clients hold on pages
+	davScratch *davScratch
+
+	listenersMu sync.RWMutex
+	listeners   []func(title string)
+
+	stop    context.CancelFunc // Cancels the context of the background jobs
+	closers []io.Closer
+
+	reloadMu     sync.Mutex
+	configSource func() (Config, error) // Rebuilds the configuration on reload, nil if reloading is unsupported
+	logLevel     *slog.LevelVar         // Level of the logger the server writes to, set on reload; nil if the server doesn't own it
+}
+
+// NewServer creates a wiki server using store for pages and registers its
+// routes. Background jobs only run once Start is called.
+func NewServer(cfg Config, store PageStore) (*Server, error) {
+	m := newMetrics()
+	s := &Server{
+		store:   &meteredStore{PageStore: store, metrics: m},
+		mux:     http.NewServeMux(),
+		audit:   newAuditLog(filepath.Join(cfg.DataDir, auditFile)),
+		tokens:  newTokenRegistry(),
+		users:   newUserRegistry(),
+		renders: newRenderCache(),
+		links:   newLinkGraph(),
+		metrics: m,
+		stop:    func() {},
+
+		permissions: newPermissionRegistry(),
+
+		editLimiter: newRateLimiter(),
+		editLocks:   newEditLockManager(),
+
+		summaries:    newSummaryStore(cfg.DataDir),
+		summaryQueue: newPageQueue(),
+
+		comments: newCommentStore(cfg.DataDir),
+
+		vectors:        newVectorIndex(cfg.DataDir),
+		embeddingQueue: newPageQueue(),
+
+		duplicates: newDuplicateScanner(cfg.DataDir),
+
+		githubWake: make(chan struct{}, 1),
+
+		davLocks:   webdav.NewMemLS(),
+		davScratch: newDavScratch(),
+	}
+
+	tmpl, err := parseTemplates(cfg.templateDir())
+	if err != nil {
+		return nil, err
+	}
+	s.setTemplates(tmpl)
+	if s.emoji, err = loadEmoji(cfg.EmojiFile); err != nil {
+		return nil, err
+	}
+	s.config.Store(&cfg)
+
+	s.onPageChange(s.renders.invalidate)
+	s.onPageChange(s.queueLinks)
+	s.onPageChange(s.queueSummary)
+	s.onPageChange(s.queueEmbedding)
+	s.onPageChange(s.duplicates.markStale)
+	s.onPageChange(s.queueGitHubSync)
+	s.routes()
+	return s, nil
+}
+
+// setTemplates replaces the templates pages are rendered with
+func (s *Server) setTemplates(tmpl *template.Template) {
+	s.templates.Store(tmpl)
+	s.templateGen.Add(1)
+}
+
+// parseTemplates compiles the HTML templates found in dir, or the built-in
+// ones when dir is empty, with the functions they use
+func parseTemplates(dir string) (*template.Template, error) {
+	return template.New("").Funcs(template.FuncMap{
+		"formatBytes": formatBytes,
+		"join":        func(list []string) string { return strings.Join(list, ", ") },
+		"pathEscape":  url.PathEscape,
+	}).ParseFS(templateFS(dir), templateFiles...)
+}
+
+// routes registers every handler on the server's mux
+func (s *Server) routes() {
+	// Serve static files (CSS)
+	s.mux.Handle("/static/", http.StripPrefix("/static/", http.HandlerFunc(s.staticHandler)))
+
+	s.mux.HandleFunc("/", s.rootHandler)
+	s.mux.HandleFunc("/index", s.indexHandler)
+	s.mux.HandleFunc("/view/", makeHandler(s.viewHandler))
+	s.mux.HandleFunc("/edit/", s.limitEdits(s.requireEditor(makeHandler(s.editHandler))))
+	s.mux.HandleFunc("/save/", s.limitEdits(s.requireEditor(makeHandler(s.saveHandler))))
+	s.mux.HandleFunc("/preview/", s.requireEditor(makeHandler(s.previewHandler)))
+	s.mux.HandleFunc("/draft/", s.requireEditor(makeHandler(s.draftHandler)))
+	s.mux.HandleFunc("/editlock/", s.requireEditor(makeHandler(s.editLockHandler)))
+	s.mux.HandleFunc("/comment/", s.limitEdits(s.requireEditor(makeHandler(s.commentHandler))))
+	s.mux.HandleFunc("/diff/", makeHandler(s.diffHandler))
+	s.mux.HandleFunc("/history/", makeHandler(s.historyHandler))
+	s.mux.HandleFunc("/backlinks/", makeHandler(s.backlinksHandler))
+	s.mux.HandleFunc("/feed/", s.pageFeedHandler)
+	s.mux.HandleFunc("/rename/", s.requireEditor(makeHandler(s.renameHandler)))
+	s.mux.HandleFunc("/delete/", s.requireEditor(makeHandler(s.deleteHandler)))
+	s.mux.HandleFunc("/book/", makeHandler(s.bookHandler))
+	s.mux.HandleFunc("/pdf/", makeHandler(s.pdfHandler))
+	s.mux.HandleFunc("/raw/", makeHandler(s.rawHandler))
+	s.mux.HandleFunc("/upload/", s.requireEditor(makeHandler(s.uploadHandler)))
+	s.mux.HandleFunc("GET /attachments/{path...}", s.attachmentHandler)
+	s.mux.HandleFunc("/activity", s.activityHandler)
+	s.mux.HandleFunc("GET /changes", s.changesHandler)
+	s.mux.HandleFunc("GET /toc", s.contentsHandler)
+	s.mux.HandleFunc("/login", s.loginHandler)
+	s.mux.HandleFunc("POST /logout", s.logoutHandler)
+	s.mux.HandleFunc("/settings", s.settingsHandler)
+	s.mux.HandleFunc("GET /users/{name}", s.userHandler)
+	s.mux.HandleFunc("/reports/moves", s.movesHandler)
+	s.mux.HandleFunc("/reports/redirects", s.doubleRedirectsHandler)
+	s.mux.HandleFunc("/reports/translations", s.translationsHandler)
+	s.mux.HandleFunc("/reports/duplicates", s.duplicatesHandler)
+	s.mux.HandleFunc("POST /reports/duplicates", s.requireAdmin(s.rescanDuplicatesHandler))
+	s.mux.HandleFunc("GET /tasks", s.tasksHandler)
+	s.mux.HandleFunc("GET /tags", s.tagsHandler)
+	s.mux.HandleFunc("GET /tag/{tag...}", s.tagHandler)
+	s.mux.HandleFunc("GET /export/epub", s.epubHandler)
+	s.mux.HandleFunc("/review", s.requireModerator(s.reviewQueueHandler))
+	s.mux.HandleFunc("/review/{id}", s.requireModerator(s.reviewHandler))
+	s.mux.HandleFunc("/admin", s.requireAdmin(s.adminHandler))
+	s.mux.HandleFunc("/trash", s.requireAdmin(s.trashHandler))
+	s.mux.HandleFunc("/admin/permissions", s.requireAdmin(s.permissionsHandler))
+	s.mux.HandleFunc("/admin/replace", s.requireAdmin(s.replaceHandler))
+	s.mux.HandleFunc("GET /api/admin/stats", s.requireAdmin(s.statsHandler))
+	s.mux.HandleFunc("GET /api/admin/disk", s.requireAdmin(s.diskUsageHandler))
+	s.mux.HandleFunc("POST /api/admin/reload", s.requireAdmin(s.reloadHandler))
+	s.mux.HandleFunc("GET /metrics", s.requireAdmin(s.metricsHandler))
+	// The page API is versioned under /api/v1, and also served unversioned
+	// for the clients written before it was
+	for _, api := range []string{"/api/v1", "/api"} {
+		s.mux.HandleFunc("GET "+api+"/pages", s.requireScope(scopeRead, s.listPagesHandler))
+		s.mux.HandleFunc("GET "+api+"/pages/{title}", s.requireScope(scopeRead, s.getPageHandler))
+		s.mux.HandleFunc("GET "+api+"/pages/{title}/exists", s.requireScope(scopeRead, s.existsHandler))
+		s.mux.HandleFunc("PUT "+api+"/pages/{title}", s.requireScope(scopeWrite, s.putPageHandler))
+		s.mux.HandleFunc("PATCH "+api+"/pages/{title}", s.requireScope(scopeWrite, s.patchPageHandler))
+		s.mux.HandleFunc("DELETE "+api+"/pages/{title}", s.requireScope(scopeWrite, s.deletePageHandler))
+		s.mux.HandleFunc("POST "+api+"/pages/{title}/tasks/{index}", s.requireScope(scopeWrite, s.taskHandler))
+		s.mux.HandleFunc("GET "+api+"/search", s.requireScope(scopeRead, s.searchAPIHandler))
+		s.mux.HandleFunc("GET "+api+"/titles", s.requireScope(scopeRead, s.titlesHandler))
+	}
+	s.mux.HandleFunc(davPrefix+"/", s.davHandler)
+	s.mux.HandleFunc("/search", s.searchHandler)
+	s.mux.HandleFunc("/search/suggest", s.suggestHandler)
+	s.mux.HandleFunc("GET /emoji/suggest", s.emojiSuggestHandler)
+	s.mux.HandleFunc("/opensearch.xml", openSearchHandler)
+	s.mux.HandleFunc("GET /version", versionHandler)
+}
+
+// exportPaths are the paths, or with a trailing slash the path prefixes, of
+// the exports compiling many pages into a book, given at least exportTimeout
+// to compile and send it in place of the request and write timeouts
+var exportPaths = []string{"/book/", "/pdf/", "/export/epub"}
+
+// exportTimeout is the least time an export is given
+const exportTimeout = 5 * time.Minute
+
+// ServeHTTP dispatches a request to the matching wiki handler once it passes
+// the read-only and CSRF checks and the permissions of the page it is about,
+// counting it in the metrics by route. Browsers are shown error pages in
+// place of the plain-text errors handlers write. The request context is cancelled when
+// the client goes away or the configured request timeout expires, abandoning
+// any storage and rendering work still running. Exports get longer.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	_, route := s.mux.Handler(r)
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	defer func() { s.metrics.observeRequest(route, r.Method, rec.status, time.Since(start)) }()
+
+	if !s.checkReadOnly(w, r) || !s.checkCSRF(w, r) || !s.checkPermissions(w, r) {
+		return
+	}
+	timeout := s.cfg().RequestTimeout
+	if isExport(r) {
+		timeout = s.extendForExport(w)
+	}
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	if !wantsErrorPage(r) {
+		s.mux.ServeHTTP(w, r)
+		return
+	}
+	ew := &errorPageWriter{ResponseWriter: w}
+	s.mux.ServeHTTP(ew, r)
+	if ew.status != 0 {
+		s.renderError(w, r, ew.status)
+	}
+}
+
+// isExport reports whether a request is for one of the exportPaths
+func isExport(r *http.Request) bool {
+	for _, path := range exportPaths {
+		if r.URL.Path == path || strings.HasSuffix(path, "/") && strings.HasPrefix(r.URL.Path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// extendForExport pushes the write deadline of an export's response to
+// exportTimeout from now, unless the configured write timeout allows longer,
+// and returns the request timeout it is given likewise, 0 for no limit
+func (s *Server) extendForExport(w http.ResponseWriter) time.Duration {
+	cfg := s.cfg()
+	if cfg.WriteTimeout > 0 && cfg.WriteTimeout < exportTimeout {
+		// Fails only for writers without deadlines, which can't time out either
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(exportTimeout))
+	}
+	if cfg.RequestTimeout > 0 && cfg.RequestTimeout < exportTimeout {
+		return exportTimeout
+	}
+	return cfg.RequestTimeout
+}
+
+// cfg returns the current configuration, which must not be modified
+func (s *Server) cfg() *Config {
+	return s.config.Load()
+}
+
+// Start launches the background jobs: picking up pages edited on disk, disk
+// usage alerts, trash purging, page summaries, the semantic search index,
+// near-duplicate scans, the GitHub sync and email digests, as enabled by the configuration
+func (s *Server) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stop = cancel
+
+	// Pick up pages edited directly on disk without restarting
+	if w, ok := s.store.(*meteredStore).PageStore.(changeWatcher); ok {
+		closer, err := w.Watch(s.externalEdit)
+		if err != nil {
+			slog.Warn("File watcher disabled", "err", err)
+		} else {
+			s.closers = append(s.closers, closer)
+		}
+	}
+
+	// These jobs always run so reloading the configuration can turn them on or off
+	go s.monitorDiskUsage(ctx)
+	go s.runTrashPurge(ctx)
+	go s.runLinkIndex(ctx)
+	go s.runSummaries(ctx)
+	go s.runEmbeddings(ctx)
+	go s.runDuplicateScan(ctx)
+	go s.runGitHubSync(ctx)
+	go s.runDigests(ctx)
+}
+
+// Close stops the background jobs started by Start
+func (s *Server) Close() error {
+	s.stop()
+	var firstErr error
+	for _, c := range s.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// httpServer returns an HTTP server serving handler on the configured address
+// with the configured timeouts and header size limit
+func (cfg Config) httpServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+}
+
+// renderTemplate executes an HTML template with the given data and handles any
+// rendering errors, giving pages with forms the reader's CSRF token and
+// every page the reader's theme. In
+// development mode the templates are parsed from disk first.
+func (s *Server) renderTemplate(w http.ResponseWriter, r *http.Request, tmpl string, data any) {
+	if form, ok := data.(interface{ setCSRF(string) }); ok {
+		form.setCSRF(s.csrfToken(w, r))
+	}
+	if page, ok := data.(interface{ setTheme(string) }); ok {
+		page.setTheme(readerTheme(r))
+	}
+	templates := s.templates.Load()
+	if cfg := s.cfg(); cfg.Dev {
+		var err error
+		if templates, err = parseTemplates(cfg.templateDir()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	err := templates.ExecuteTemplate(w, tmpl+".html", data)
+	if err != nil {
+		slog.Error("Rendering template failed", "template", tmpl, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serverError reports a failed operation, answering 503 when it was abandoned
+// because the request timed out. Nothing is written once the client has gone
+// away. Other failures are logged, as browsers only see a generic error page.
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "request timed out", http.StatusServiceUnavailable)
+	default:
+		slog.Error("Serving request failed", "method", r.Method, "path", r.URL.Path, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// =============================================================================
+// PAGE CHANGES
+// =============================================================================
+
+// onPageChange registers a callback that runs whenever a page changes,
+// whether it was saved through the wiki or modified directly on disk
+func (s *Server) onPageChange(fn func(title string)) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// notifyPageChange invokes every registered page change callback
+func (s *Server) notifyPageChange(title string) {
+	s.listenersMu.RLock()
+	defer s.listenersMu.RUnlock()
+	for _, fn := range s.listeners {
+		fn(title)
+	}
+}
+
+// pageQueue holds changed pages waiting for background processing, each at most once
+type pageQueue struct {
+	mu      sync.Mutex
+	pending map[string]bool
+	wake    chan struct{}
+}
+
+// newPageQueue returns an empty queue
+func newPageQueue() *pageQueue {
+	return &pageQueue{pending: make(map[string]bool), wake: make(chan struct{}, 1)}
+}
+
+// add queues a page and wakes the worker
+func (q *pageQueue) add(title string) {
+	q.mu.Lock()
+	q.pending[title] = true
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take removes and returns the queued pages
+func (q *pageQueue) take() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	titles := make([]string, 0, len(q.pending))
+	for title := range q.pending {
+		titles = append(titles, title)
+	}
+	clear(q.pending)
+	return titles
+}
+
+// savePage stores a page, notifies page change listeners and records the
+// change in the audit log. Callers hold the page's lock.
+func (s *Server) savePage(ctx context.Context, p *Page) error {
+	var old []byte
+	if prev, err := s.store.Load(ctx, p.Title); err == nil {
+		old = prev.Body
+	}
+	rev, created, err := s.store.Save(ctx, p)
+	s.metrics.observeSave(rev, created, err)
+	if err != nil {
+		return err
+	}
+	s.notifyPageChange(p.Title)
+
+	if rev > 0 {
+		eventType := eventEdit
+		if created {
+			eventType = eventCreate
+		}
+		ev := AuditEvent{Type: eventType, Title: p.Title, Actor: p.Author, Revision: rev, Detail: p.Summary}
+		s.audit.record(ev)
+		s.postChange(ev, parsePageMeta(p.Body))
+		s.notifyMentions(p, old, rev)
+	}
+	return nil
+}
+
+// externalEdit handles a page changed outside the wiki, recording the
+// revision the store created for it in the audit log
+func (s *Server) externalEdit(title string, rev int) {
+	s.notifyPageChange(title)
+	if rev > 0 {
+		eventType := eventEdit
+		if rev == 1 {
+			eventType = eventCreate
+		}
+		ev := AuditEvent{Type: eventType, Title: title, Revision: rev, Detail: "Edited outside the wiki"}
+		s.audit.record(ev)
+		if p, err := s.store.Load(context.Background(), title); err == nil {
+			s.postChange(ev, parsePageMeta(p.Body))
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestServer returns a server on a fresh data directory, with the
+// configuration changed by configure if it isn't nil
+func newTestServer(t testing.TB, configure func(cfg *Config)) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.DataDir = t.TempDir()
+	if configure != nil {
+		configure(&cfg)
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(cfg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// savePages saves pages with the given bodies, keyed by title
+func savePages(t testing.TB, s *Server, bodies map[string]string) {
+	t.Helper()
+	for title, body := range bodies {
+		if _, _, err := s.store.Save(context.Background(), &Page{Title: title, Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestServeHTTP serves a page and the index through a server built on a
+// fresh data directory, without listening on a socket
+func TestServeHTTP(t *testing.T) {
+	s := newTestServer(t, nil)
+	savePages(t, s, map[string]string{"Home": "Hello *world*\n"})
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/view/Home", http.StatusOK, "<em>world</em>"},
+		{"/index", http.StatusOK, "Home"},
+		{"/view/bad..title", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if w.Code != tc.status {
+			t.Errorf("GET %s: status %d, want %d", tc.path, w.Code, tc.status)
+		}
+		if !strings.Contains(w.Body.String(), tc.want) {
+			t.Errorf("GET %s: body lacks %q", tc.path, tc.want)
+		}
+	}
+}
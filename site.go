@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"html/template"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// =============================================================================
+// STATIC SITE EXPORT
+// =============================================================================
+
+// siteRedirect is written in place of redirect pages, sending readers on
+// without a server to answer with a redirect
+var siteRedirect = template.Must(template.New("redirect").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<title>{{.Title}}</title>
+	<meta http-equiv="refresh" content="0; url={{.URL}}">
+	<link rel="canonical" href="{{.URL}}">
+</head>
+<body>
+	<p>{{.Title}} redirects to <a href="{{.URL}}">{{.Target}}</a>.</p>
+</body>
+</html>
+`))
+
+// siteResult counts what exportSite wrote
+type siteResult struct {
+	Pages, Redirects, Files int
+}
+
+// exportSite renders every page through the view template into a static site
+// at dir, laid out like the wiki's URLs so links keep working: each page at
+// view/TITLE/index.html, the index at index.html, with the static files and
+// attachments beside them. Links to the server's other features are left out
+// of the pages. The site must be served from the root of its domain.
+func (s *Server) exportSite(ctx context.Context, dir string) (siteResult, error) {
+	var res siteResult
+	cfg := s.cfg()
+	titles, err := s.store.List(ctx)
+	if err != nil {
+		return res, err
+	}
+	if len(titles) == 0 {
+		return res, errors.New("the wiki has no pages")
+	}
+	for _, title := range titles {
+		if err := s.indexLinks(ctx, title); err != nil {
+			return res, err
+		}
+	}
+
+	tmpl := s.templates.Load()
+	for _, title := range titles {
+		p, err := s.store.Load(ctx, title)
+		if err != nil {
+			return res, err
+		}
+		name := path.Join("view", title, "index.html")
+		if target, ok := redirectTarget(p.Body); ok {
+			if err := writeSiteFile(dir, name, siteRedirect, "redirect", map[string]string{
+				"Title": title, "Target": target, "URL": "/view/" + titleURL(target),
+			}); err != nil {
+				return res, err
+			}
+			res.Redirects++
+			continue
+		}
+
+		if p.HTML, err = s.renderBody(ctx, p.Title, p.Body, nil); err != nil {
+			return res, err
+		}
+		p.Lang = contentLang(p, cfg.DefaultLang)
+		p.Backlinks = s.links.backlinks(p.Title)
+		if p.Translations, err = s.translations(ctx, p.Title); err != nil {
+			return res, err
+		}
+		p.Static = true
+		if err := writeSiteFile(dir, name, tmpl, "view.html", p); err != nil {
+			return res, err
+		}
+		res.Pages++
+
+		n, err := copyAttachments(cfg.DataDir, title, filepath.Join(dir, "attachments", filepath.FromSlash(title)))
+		res.Files += n
+		if err != nil {
+			return res, err
+		}
+	}
+
+	index := &IndexPage{Pages: titles, Tree: pageTree(titles), Sort: indexSortTree, Page: 1, PageCount: 1, Static: true}
+	var static func(nodes []*PageNode)
+	static = func(nodes []*PageNode) {
+		for _, n := range nodes {
+			n.Static = true
+			static(n.Children)
+		}
+	}
+	static(index.Tree)
+	if err := writeSiteFile(dir, "index.html", tmpl, "index.html", index); err != nil {
+		return res, err
+	}
+	return res, copySiteAssets(staticFS(cfg.staticDir()), filepath.Join(dir, "static"))
+}
+
+// writeSiteFile executes a template into the file at the slash-separated name under dir
+func writeSiteFile(dir, name string, tmpl *template.Template, tmplName string, data any) error {
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, tmplName, data); err != nil {
+		return err
+	}
+	file := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, buf.Bytes(), 0644)
+}
+
+// copySiteAssets copies the stylesheet and other static files into dst
+func copySiteAssets(assets fs.FS, dst string) error {
+	return fs.WalkDir(assets, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, filepath.FromSlash(name))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := fs.ReadFile(assets, name)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0644)
+	})
+}
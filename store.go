@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =============================================================================
+// PAGE STORE
+// =============================================================================
+
+var errPageExists = errors.New("a page with that title already exists")
+
+// PageStore persists pages and their revision history. Errors for missing
+// pages wrap os.ErrNotExist. Operations give up with the context's error once
+// it is done; writes that have started are completed so a page and its history
+// stay consistent.
+type PageStore interface {
+	// Load returns the current version of a page
+	Load(ctx context.Context, title string) (*Page, error)
+	// ModTime returns when a page was last modified, without reading its body
+	ModTime(ctx context.Context, title string) (time.Time, error)
+	// Exists reports whether a page has been saved
+	Exists(ctx context.Context, title string) bool
+	// List returns the titles of all pages
+	List(ctx context.Context) ([]string, error)
+	// Save writes a page and records it as a new revision. It returns the new
+	// revision number, or 0 if the body is unchanged, and whether the page was created.
+	Save(ctx context.Context, p *Page) (rev int, created bool, err error)
+	// Rename moves a page and its history to a new title, failing with
+	// errPageExists if the new title is taken
+	Rename(ctx context.Context, from, to string) error
+	// Delete removes a page, keeping its revision history
+	Delete(ctx context.Context, title string) error
+
+	// Revisions returns the revisions of a page, oldest first
+	Revisions(ctx context.Context, title string) ([]Revision, error)
+	// Revision returns the body of revision n of a page
+	Revision(ctx context.Context, title string, n int) ([]byte, error)
+
+	// Lock acquires the lock of a page, serializing read-modify-write cycles
+	// on it, and returns the function releasing it
+	Lock(title string) (unlock func())
+}
+
+// fileStore is a PageStore keeping each page as a text file in a directory
+type fileStore struct {
+	dir       string
+	locks     sync.Map   // Title to *sync.Mutex
+	historyMu sync.Mutex // Serializes appends to revision logs
+}
+
+// openStore returns the store keeping the configured wiki's pages: the S3
+// bucket when one is set, the data directory otherwise, under git with -git
+func openStore(cfg Config) (PageStore, error) {
+	if cfg.S3Bucket != "" {
+		return newS3Store(cfg)
+	}
+	if cfg.Git {
+		return newGitStore(cfg.DataDir, cfg.GitRemote)
+	}
+	return newFileStore(cfg.DataDir)
+}
+
+// newFileStore returns a store backed by dir, creating the directory if needed
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+// fileStem returns the name a page's history, attachments and other files are
+// stored under, keeping translations next to their page, as HomePage.es with
+// the dot before the language left as it is. Other bytes than
+// ASCII letters, digits, hyphens and underscores are percent-encoded, so
+// titles with spaces, namespaces or other scripts are safe on any filesystem
+// while ASCII titles keep their names: "Release Notes" becomes Release%20Notes
+// and Projects/Alpha becomes Projects%2FAlpha.
+func fileStem(title string) string {
+	base, lang := splitTitle(title)
+	if lang != "" {
+		return escapeStem(base) + "." + lang
+	}
+	return escapeStem(base)
+}
+
+// escapeStem percent-encodes the bytes of s other than ASCII letters, digits,
+// hyphens and underscores
+func escapeStem(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// pageFile returns the slash-separated path of the text file backing a page,
+// relative to the data directory. Pages in namespaces are stored in a
+// directory per namespace, as Projects/Alpha/Design.txt.
+func pageFile(title string) string {
+	base, lang := splitTitle(title)
+	segments := strings.Split(base, "/")
+	for i, segment := range segments {
+		segments[i] = escapeStem(segment)
+	}
+	file := strings.Join(segments, "/")
+	if lang != "" {
+		file += "." + lang
+	}
+	return file + ".txt"
+}
+
+// fileTitle returns the title of the page stored in a file, given by its
+// slash-separated path relative to the data directory
+func fileTitle(file string) string {
+	return stemTitle(strings.ReplaceAll(strings.TrimSuffix(file, ".txt"), "/", "%2F"))
+}
+
+// removeEmptyDirs removes dir and its parents below root for as long as they
+// are empty, cleaning up namespaces left without pages
+func removeEmptyDirs(root, dir string) {
+	for dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// stemTitle returns the title of the page stored under a file stem, or the
+// stem itself when it wasn't made by fileStem
+func stemTitle(stem string) string {
+	title, err := url.PathUnescape(stem)
+	if err != nil {
+		return stem
+	}
+	return title
+}
+
+// pagePath returns the location of the text file backing a wiki page
+func (fs *fileStore) pagePath(title string) string {
+	return filepath.Join(fs.dir, filepath.FromSlash(pageFile(title)))
+}
+
+// Lock acquires the lock for a page and returns the function releasing it
+func (fs *fileStore) Lock(title string) (unlock func()) {
+	mu, _ := fs.locks.LoadOrStore(title, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// Load retrieves a wiki page from the filesystem by reading its corresponding text file
+func (fs *fileStore) Load(ctx context.Context, title string) (*Page, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	body, err := os.ReadFile(fs.pagePath(title))
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fs.pagePath(title))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Page{Title: title, Body: body, ModTime: info.ModTime(), Meta: parsePageMeta(body)}, nil
+}
+
+// ModTime returns the modification time of a page's text file
+func (fs *fileStore) ModTime(ctx context.Context, title string) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+	info, err := os.Stat(fs.pagePath(title))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if info.IsDir() {
+		return time.Time{}, os.ErrNotExist
+	}
+	return info.ModTime(), nil
+}
+
+// Exists reports whether a page has been saved, without reading its body
+func (fs *fileStore) Exists(ctx context.Context, title string) bool {
+	_, err := fs.ModTime(ctx, title)
+	return err == nil
+}
+
+// List scans the data directory, including namespace directories, and returns
+// a list of all available wiki page names. Directories and files starting
+// with a dot hold other wiki data and are skipped.
+func (fs *fileStore) List(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var pages []string
+	err := filepath.WalkDir(fs.dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == fs.dir {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), ".txt") {
+			rel, _ := filepath.Rel(fs.dir, path)
+			pages = append(pages, fileTitle(filepath.ToSlash(rel)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+// Save writes the page content to a text file in the data directory and records it as a new revision
+func (fs *fileStore) Save(ctx context.Context, p *Page) (int, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, false, err
+	}
+	previous, _ := os.ReadFile(fs.pagePath(p.Title)) // nil for new pages
+	if err := os.MkdirAll(filepath.Dir(fs.pagePath(p.Title)), 0755); err != nil {
+		return 0, false, err
+	}
+	if err := writeFileAtomic(fs.pagePath(p.Title), p.Body, 0600); err != nil {
+		return 0, false, err
+	}
+	rev, err := fs.recordRevision(p.Title, p.Body, p.Summary, previous)
+	return rev, previous == nil, err
+}
+
+// writeFileAtomic replaces a file with data by writing a temporary file next
+// to it and renaming it into place, so a crash or kill mid-write leaves the
+// old content rather than a truncated file. The temporary file's leading dot
+// keeps it out of page and attachment listings.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Rename moves a page's text file, revision history and attachments to a new title
+func (fs *fileStore) Rename(ctx context.Context, from, to string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !fs.Exists(ctx, from) {
+		return os.ErrNotExist
+	}
+	if fs.Exists(ctx, to) {
+		return errPageExists
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fs.pagePath(to)), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(fs.pagePath(from), fs.pagePath(to)); err != nil {
+		return err
+	}
+	removeEmptyDirs(fs.dir, filepath.Dir(fs.pagePath(from)))
+	if err := os.Rename(fs.historyPath(from), fs.historyPath(to)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Rename(filepath.Join(fs.dir, attachmentsDir, fileStem(from)), filepath.Join(fs.dir, attachmentsDir, fileStem(to))); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Delete removes a page's text file, and the namespace directories left empty
+func (fs *fileStore) Delete(ctx context.Context, title string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := os.Remove(fs.pagePath(title)); err != nil {
+		return err
+	}
+	removeEmptyDirs(fs.dir, filepath.Dir(fs.pagePath(title)))
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// PAGE SUMMARIES
+// =============================================================================
+
+// Limits on generated summaries
+const (
+	maxSummaryInput  = 16 << 10 // Bytes of page content sent to the provider
+	maxSummaryLength = 300      // Bytes of summary kept
+	summaryTimeout   = time.Minute
+)
+
+// summariesSubdir is the directory below indexDir holding generated summaries
+const summariesSubdir = "summaries"
+
+// summaryPrompt instructs the provider, given the language of the page
+const summaryPrompt = "Summarize the wiki page below in one or two sentences of at most 40 words, " +
+	"written in the language with the tag %s. Reply with the summary only."
+
+// Summarizer generates a short summary of a page's content. It is the
+// integration point for language model providers.
+type Summarizer interface {
+	Summarize(ctx context.Context, title, lang string, content []byte) (string, error)
+}
+
+// summarizer returns the provider configured to summarize pages, or nil when
+// summaries are disabled
+func (s *Server) summarizer() Summarizer {
+	cfg := s.cfg()
+	if cfg.SummaryURL == "" {
+		return nil
+	}
+	return &chatSummarizer{url: cfg.SummaryURL, key: cfg.SummaryKey, model: cfg.SummaryModel}
+}
+
+// chatSummarizer asks an OpenAI-compatible chat completions endpoint for
+// summaries, as offered by hosted providers and local model servers alike
+type chatSummarizer struct {
+	url   string
+	key   string // Sent as a bearer token when set
+	model string
+}
+
+// chatMessage is one message of a chat completions request or response
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// chatRequest is the body of a chat completions request
+type chatRequest struct {
+	Model     string        `json:"model"`
+	Messages  []chatMessage `json:"messages"`
+	MaxTokens int           `json:"max_tokens"`
+}
+
+// chatResponse is the part of a chat completions response the wiki reads
+type chatResponse struct {
+	Choices []struct {
+		Message chatMessage `json:"message"`
+	} `json:"choices"`
+}
+
+// Summarize sends the page to the chat completions endpoint and returns the reply
+func (c *chatSummarizer) Summarize(ctx context.Context, title, lang string, content []byte) (string, error) {
+	if len(content) > maxSummaryInput {
+		content = content[:maxSummaryInput]
+		for len(content) > 0 && !isRuneStart(content[len(content)-1]) {
+			content = content[:len(content)-1]
+		}
+	}
+	payload, err := json.Marshal(chatRequest{
+		Model: c.model,
+		Messages: []chatMessage{
+			{Role: "system", Content: fmt.Sprintf(summaryPrompt, lang)},
+			{Role: "user", Content: "# " + title + "\n\n" + string(content)},
+		},
+		MaxTokens: 120,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("summary provider responded with %s", resp.Status)
+	}
+
+	var reply chatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return "", fmt.Errorf("decoding summary response: %w", err)
+	}
+	if len(reply.Choices) == 0 {
+		return "", errors.New("summary provider returned no choices")
+	}
+	return reply.Choices[0].Message.Content, nil
+}
+
+// cleanSummary collapses the whitespace of a generated summary and caps its length
+func cleanSummary(summary string) string {
+	summary = strings.Join(strings.Fields(summary), " ")
+	if len(summary) <= maxSummaryLength {
+		return summary
+	}
+	cut := maxSummaryLength
+	for cut > 0 && !isRuneStart(summary[cut]) {
+		cut--
+	}
+	return summary[:cut] + "…"
+}
+
+// =============================================================================
+// SUMMARY STORAGE
+// =============================================================================
+
+// pageSummary is a generated summary kept next to the search indexes, since
+// it can be regenerated from the page
+type pageSummary struct {
+	Summary string    `json:"summary"`
+	Source  string    `json:"source"` // ETag of the content that was summarized
+	Time    time.Time `json:"time"`
+}
+
+// summaryStore keeps the generated summary of each page as a JSON file
+type summaryStore struct {
+	dir string
+}
+
+// newSummaryStore returns the summaries stored below the data directory
+func newSummaryStore(dataDir string) *summaryStore {
+	return &summaryStore{dir: filepath.Join(dataDir, indexDir, summariesSubdir)}
+}
+
+// path returns the file holding a page's summary
+func (ss *summaryStore) path(title string) string {
+	return filepath.Join(ss.dir, fileStem(title)+".json")
+}
+
+// get returns the summary of a page, reporting false when it has none
+func (ss *summaryStore) get(title string) (pageSummary, bool) {
+	data, err := os.ReadFile(ss.path(title))
+	if err != nil {
+		return pageSummary{}, false
+	}
+	var sum pageSummary
+	if err := json.Unmarshal(data, &sum); err != nil {
+		return pageSummary{}, false
+	}
+	return sum, true
+}
+
+// text returns the summary text of a page, empty when it has none
+func (ss *summaryStore) text(title string) string {
+	sum, _ := ss.get(title)
+	return sum.Summary
+}
+
+// put stores the summary of a page
+func (ss *summaryStore) put(title string, sum pageSummary) error {
+	data, err := json.Marshal(sum)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(ss.dir, 0755); err != nil {
+		return err
+	}
+	tmp := ss.path(title) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ss.path(title))
+}
+
+// remove deletes the summary of a page
+func (ss *summaryStore) remove(title string) error {
+	err := os.Remove(ss.path(title))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// rename moves a page's summary along with the page
+func (ss *summaryStore) rename(from, to string) error {
+	err := os.Rename(ss.path(from), ss.path(to))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// =============================================================================
+// SUMMARY GENERATION
+// =============================================================================
+
+// queueSummary schedules a changed page to be summarized, when summaries are enabled
+func (s *Server) queueSummary(title string) {
+	if s.summarizer() != nil {
+		s.summaryQueue.add(title)
+	}
+}
+
+// runSummaries summarizes queued pages in the background until ctx is done,
+// so saving never waits for the provider
+func (s *Server) runSummaries(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.summaryQueue.wake:
+		}
+		for _, title := range s.summaryQueue.take() {
+			if err := s.summarizePage(ctx, title); err != nil && ctx.Err() == nil {
+				slog.Error("Summarizing page failed", "title", title, "err", err)
+			}
+		}
+	}
+}
+
+// summarizePage generates the summary of a page unless its current content
+// has already been summarized. Pages that were removed, emptied or turned
+// into redirects lose their summary.
+func (s *Server) summarizePage(ctx context.Context, title string) error {
+	summarizer := s.summarizer()
+	if summarizer == nil {
+		return nil
+	}
+
+	p, err := s.store.Load(ctx, title)
+	if errors.Is(err, os.ErrNotExist) {
+		return s.summaries.remove(title)
+	}
+	if err != nil {
+		return err
+	}
+	content := bytes.TrimSpace(pageContent(p.Body))
+	if _, ok := redirectTarget(p.Body); ok || len(content) == 0 {
+		return s.summaries.remove(title)
+	}
+	source := bodyETag(content)
+	if sum, ok := s.summaries.get(title); ok && sum.Source == source {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, summaryTimeout)
+	defer cancel()
+	text, err := summarizer.Summarize(ctx, title, contentLang(p, s.cfg().DefaultLang), content)
+	if err != nil {
+		return err
+	}
+	if text = cleanSummary(text); text == "" {
+		return errors.New("summary provider returned an empty summary")
+	}
+	return s.summaries.put(title, pageSummary{Summary: text, Source: source, Time: time.Now().UTC()})
+}
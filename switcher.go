@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// =============================================================================
+// QUICK SWITCHER
+// =============================================================================
+
+// Number of titles the quick switcher is sent by default and at most
+const (
+	defaultTitleMatches = 10
+	maxTitleMatches     = 50
+)
+
+// apiTitleList is the JSON answer of the title lookup, best match first
+type apiTitleList struct {
+	Titles []string `json:"titles"`
+}
+
+// fuzzyScore reports whether the runes of query appear in title in order,
+// ignoring case, and scores how well they do: matches at the start of the
+// title or of a word within it, and runs of consecutive matches, count for
+// more, while skipped runes count against it
+func fuzzyScore(title, query string) (int, bool) {
+	score := 0
+	prev := rune(-1) // Rune before the current one in title, -1 at the start
+	run := 0         // Length of the current run of consecutive matches
+	rest := query
+	for _, c := range title {
+		if rest == "" {
+			break
+		}
+		q, size := utf8.DecodeRuneInString(rest)
+		if unicode.ToLower(c) != unicode.ToLower(q) {
+			score--
+			run = 0
+			prev = c
+			continue
+		}
+		rest = rest[size:]
+		run++
+		score += 1 + 2*run
+		switch {
+		case prev == -1:
+			score += 15
+		case !unicode.IsLetter(prev) && !unicode.IsDigit(prev), unicode.IsUpper(c) && unicode.IsLower(prev):
+			score += 8 // Start of a word, as in Deploy/Guide, deploy_guide or DeployGuide
+		}
+		prev = c
+	}
+	if rest != "" {
+		return 0, false
+	}
+	return score - utf8.RuneCountInString(title)/4, true
+}
+
+// titlesHandler returns the titles fuzzily matching the q query parameter,
+// best first, for the quick switcher to jump between pages. Titles are
+// listed to everyone, as in the index. limit caps the number returned.
+func (s *Server) titlesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := strings.Join(strings.Fields(q.Get("q")), "")
+	limit := defaultTitleMatches
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTitleMatches {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and " + strconv.Itoa(maxTitleMatches)})
+			return
+		}
+		limit = n
+	}
+
+	titles, err := s.store.List(r.Context())
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	type match struct {
+		title string
+		score int
+	}
+	var matches []match
+	for _, title := range titles {
+		if score, ok := fuzzyScore(title, query); ok {
+			matches = append(matches, match{title, score})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].title < matches[j].title
+	})
+
+	list := apiTitleList{Titles: []string{}}
+	for _, m := range matches[:min(len(matches), limit)] {
+		list.Titles = append(list.Titles, m.title)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
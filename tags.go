@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// =============================================================================
+// TAGS
+// =============================================================================
+
+// TagCount is a tag used in the wiki with the number of pages carrying it
+type TagCount struct {
+	Name  string
+	Count int
+}
+
+// TagsPage contains data for rendering the list of every tag
+type TagsPage struct {
+	Tags []TagCount
+
+	themedPage
+}
+
+// TagPage contains data for rendering the pages carrying a tag
+type TagPage struct {
+	Tag   string
+	Pages []string
+
+	themedPage
+}
+
+// taggedPages returns the titles of the pages the reader may see, sorted,
+// keyed by each tag they carry in their metadata
+func (s *Server) taggedPages(r *http.Request) (map[string][]string, error) {
+	titles, err := s.store.List(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(titles)
+	tagged := make(map[string][]string)
+	for _, title := range titles {
+		if !s.canRead(r, title) {
+			continue
+		}
+		p, err := s.store.Load(r.Context(), title)
+		if err != nil {
+			if r.Context().Err() != nil {
+				return nil, err
+			}
+			continue // Removed since it was listed
+		}
+		for _, tag := range parsePageMeta(p.Body).Tags {
+			tagged[tag] = append(tagged[tag], title)
+		}
+	}
+	return tagged, nil
+}
+
+// tagsHandler lists every tag of the wiki with the number of pages carrying it
+func (s *Server) tagsHandler(w http.ResponseWriter, r *http.Request) {
+	tagged, err := s.taggedPages(r)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	data := &TagsPage{}
+	for tag, titles := range tagged {
+		data.Tags = append(data.Tags, TagCount{Name: tag, Count: len(titles)})
+	}
+	sort.Slice(data.Tags, func(i, j int) bool {
+		a, b := strings.ToLower(data.Tags[i].Name), strings.ToLower(data.Tags[j].Name)
+		return a < b || a == b && data.Tags[i].Name < data.Tags[j].Name
+	})
+	s.renderTemplate(w, r, "tags", data)
+}
+
+// tagHandler lists the pages carrying the tag named in the path
+func (s *Server) tagHandler(w http.ResponseWriter, r *http.Request) {
+	tag := strings.TrimSpace(r.PathValue("tag"))
+	if tag == "" {
+		http.Redirect(w, r, "/tags", http.StatusFound)
+		return
+	}
+	tagged, err := s.taggedPages(r)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	s.renderTemplate(w, r, "tag", &TagPage{Tag: tag, Pages: tagged[tag]})
+}
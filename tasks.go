@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// =============================================================================
+// TASK LISTS
+// =============================================================================
+
+// taskLine matches a task list item: "- [ ] text" for an open task and
+// "- [x] text" for a done one, optionally indented and with * for -
+var taskLine = regexp.MustCompile(`^[ \t]*[-*] \[([ xX])\] (.*)$`)
+
+// Task is a task list item of a page
+type Task struct {
+	Index  int    `json:"index"` // Position among the page's tasks, counting from 0
+	Done   bool   `json:"done"`  // Whether the box is checked
+	Text   string `json:"text"`  // Text following the box
+	offset int    // Offset of the box's mark in the page body
+}
+
+// parseTask recognizes a task list item, returning its text and whether it
+// is done, or ok false for any other line
+func parseTask(line []byte) (text []byte, done, ok bool) {
+	m := taskLine.FindSubmatchIndex(line)
+	if m == nil {
+		return nil, false, false
+	}
+	return line[m[4]:m[5]], line[m[2]] != ' ', true
+}
+
+// pageTasks returns the task list items of a page body in order, leaving out
+// any in its metadata block or in code blocks
+func pageTasks(body []byte) []Task {
+	content := pageContent(body)
+	offset := len(body) - len(content)
+	var tasks []Task
+	fence := "" // Fence of the code block the line is in
+	for len(content) > 0 {
+		line := content
+		next := len(content)
+		if i := bytes.IndexByte(content, '\n'); i >= 0 {
+			line, next = content[:i], i+1
+		}
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		switch {
+		case fence != "":
+			if closesFence(line, fence) {
+				fence = ""
+			}
+		case fenceMarker(line) != "":
+			fence = fenceMarker(line)
+		default:
+			if m := taskLine.FindSubmatchIndex(line); m != nil {
+				tasks = append(tasks, Task{Index: len(tasks), Done: line[m[2]] != ' ', Text: string(line[m[4]:m[5]]), offset: offset + m[2]})
+			}
+		}
+		content, offset = content[next:], offset+next
+	}
+	return tasks
+}
+
+// taskUpdate is the JSON body of a request checking or unchecking a task
+type taskUpdate struct {
+	Done    bool   `json:"done"`
+	Summary string `json:"summary,omitempty"`
+}
+
+// taskHandler checks or unchecks the task with the index given in the path,
+// the request behind the checkboxes of task lists. Edits needing review are
+// held like any other.
+func (s *Server) taskHandler(w http.ResponseWriter, r *http.Request) {
+	title := r.PathValue("title")
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if !validTitle.MatchString(title) || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var update taskUpdate
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodyBytes)).Decode(&update); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+
+	unlock := s.store.Lock(title)
+	defer unlock()
+	p, err := s.store.Load(r.Context(), title)
+	if errors.Is(err, os.ErrNotExist) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "page not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != bodyETag(p.Body) {
+		writeJSON(w, http.StatusPreconditionFailed, map[string]string{"error": "page has changed since it was read"})
+		return
+	}
+	tasks := pageTasks(p.Body)
+	if index < 0 || index >= len(tasks) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "task not found"})
+		return
+	}
+	task := tasks[index]
+	if task.Done == update.Done {
+		w.Header().Set("ETag", bodyETag(p.Body))
+		writeJSON(w, http.StatusOK, task)
+		return
+	}
+
+	body := slices.Clone(p.Body)
+	body[task.offset], task.Done = ' ', update.Done
+	summary := "Reopened task: " + task.Text
+	if update.Done {
+		body[task.offset] = 'x'
+		summary = "Completed task: " + task.Text
+	}
+	if update.Summary != "" {
+		summary = update.Summary
+	}
+	p = &Page{Title: title, Body: body, Summary: summary, Author: s.tokenName(r)}
+	if s.needsReview(r) {
+		s.holdAPIEdit(w, r, p)
+		return
+	}
+	if err := s.savePage(r.Context(), p); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("ETag", bodyETag(body))
+	writeJSON(w, http.StatusOK, task)
+}
+
+// PageTasks lists the open tasks of one page for the task overview
+type PageTasks struct {
+	Title string
+	Tasks []Task
+}
+
+// TasksPage contains data for rendering the open tasks across the wiki
+type TasksPage struct {
+	Pages    []PageTasks
+	Tag      string // Only pages with this tag are shown, when set
+	Assignee string // Only tasks mentioning this user are shown, when set
+	Count    int    // Number of tasks shown
+
+	themedPage
+}
+
+// tasksHandler lists the open tasks of every page, optionally only those of
+// pages with a tag or mentioning a user, who is taken to be their assignee
+func (s *Server) tasksHandler(w http.ResponseWriter, r *http.Request) {
+	data := &TasksPage{Tag: r.URL.Query().Get("tag"), Assignee: r.URL.Query().Get("assignee")}
+	if data.Assignee != "" && !validUser.MatchString(data.Assignee) {
+		http.Error(w, "invalid assignee", http.StatusBadRequest)
+		return
+	}
+	titles, err := s.store.List(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	sort.Strings(titles)
+	for _, title := range titles {
+		if !s.canRead(r, title) {
+			continue
+		}
+		p, err := s.store.Load(r.Context(), title)
+		if err != nil {
+			if r.Context().Err() != nil {
+				serverError(w, r, err)
+				return
+			}
+			continue
+		}
+		if data.Tag != "" && !slices.Contains(parsePageMeta(p.Body).Tags, data.Tag) {
+			continue
+		}
+		var open []Task
+		for _, t := range pageTasks(p.Body) {
+			if !t.Done && (data.Assignee == "" || slices.Contains(mentionedUsers([]byte(t.Text)), data.Assignee)) {
+				open = append(open, t)
+			}
+		}
+		if len(open) > 0 {
+			data.Pages = append(data.Pages, PageTasks{Title: title, Tasks: open})
+			data.Count += len(open)
+		}
+	}
+	s.renderTemplate(w, r, "tasks", data)
+}
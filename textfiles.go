@@ -0,0 +1,115 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// =============================================================================
+// IMPORTING TEXT FILES
+// =============================================================================
+
+// textFileExts are the extensions of the files read as pages, which the
+// wiki's markup reads as they are
+var textFileExts = map[string]bool{".txt": true, ".md": true, ".markdown": true}
+
+// titleJunk matches runs of characters that can't appear in a title segment
+var titleJunk = regexp.MustCompile(`[^\p{L}\p{M}\p{N}_-]+`)
+
+// readTextFiles reads the .txt and .md files of a directory or zip file as
+// pages. Each file's path without its extension becomes the title, with
+// subdirectories as namespaces, so notes/Meeting.md becomes notes/Meeting.
+// Characters titles can't hold become spaces; files whose names have nothing
+// usable left are skipped, and files that end up with the same title are
+// numbered apart. Modification times are kept.
+func readTextFiles(src string) (*wikiExport, error) {
+	var fsys fs.FS
+	if info, err := os.Stat(src); err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		fsys = os.DirFS(src)
+	} else {
+		zr, err := zip.OpenReader(src)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a directory or zip file: %w", src, err)
+		}
+		defer zr.Close()
+		fsys = zr
+	}
+
+	// Zip files are often made of a single directory holding everything
+	root := "."
+	if entries, err := fs.ReadDir(fsys, "."); err == nil && len(entries) == 1 && entries[0].IsDir() {
+		root = entries[0].Name()
+	}
+
+	var names []string
+	err := fs.WalkDir(fsys, root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && name != root {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && textFileExts[strings.ToLower(path.Ext(name))] {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	export := &wikiExport{}
+	used := make(map[string]bool)
+	for _, name := range names {
+		rel := strings.TrimPrefix(name, root+"/")
+		title := fileImportTitle(strings.TrimSuffix(rel, path.Ext(rel)))
+		if title == "" {
+			export.Skipped = append(export.Skipped, rel+": no usable title in the file name")
+			continue
+		}
+		body, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		export.Pages = append(export.Pages, importedPage{
+			Title:    uniqueTitle(title, used),
+			Body:     body,
+			Modified: info.ModTime(),
+		})
+	}
+	return export, nil
+}
+
+// fileImportTitle turns a slash-separated file path into a page title,
+// replacing what titles can't hold with spaces, or returns "" when nothing
+// valid is left
+func fileImportTitle(name string) string {
+	var segments []string
+	for _, seg := range strings.Split(name, "/") {
+		seg = strings.TrimSpace(titleJunk.ReplaceAllString(seg, " "))
+		if seg != "" {
+			segments = append(segments, seg)
+		}
+	}
+	title := strings.Join(segments, "/")
+	if !validTitle.MatchString(title) {
+		return ""
+	}
+	return title
+}
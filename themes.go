@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// =============================================================================
+// THEMES
+// =============================================================================
+
+// themeCookie is the cookie holding the theme a reader chose
+const themeCookie = "wiki_theme"
+
+// themeCookieMaxAge is how long, in seconds, a browser remembers its theme
+const themeCookieMaxAge = 365 * 24 * 60 * 60
+
+// themes are the stylesheets under static/themes a reader can choose, each
+// applied over style.css. Readers who choose none get the light look, or the
+// dark theme when their system prefers a dark color scheme.
+var themes = []string{"light", "dark", "sepia"}
+
+// themedPage is embedded in the data of every template, and filled in by
+// renderTemplate, so the page links the stylesheet of the reader's theme
+type themedPage struct {
+	Theme string // Theme the reader chose, empty for the automatic one
+}
+
+// setTheme gives the template the reader's theme
+func (t *themedPage) setTheme(theme string) {
+	t.Theme = theme
+}
+
+// readerTheme returns the theme the reader chose, or "" when they haven't
+// chosen one the wiki still has
+func readerTheme(r *http.Request) string {
+	c, err := r.Cookie(themeCookie)
+	if err != nil || !slices.Contains(themes, c.Value) {
+		return ""
+	}
+	return c.Value
+}
+
+// SettingsPage contains data for rendering the reader's settings
+type SettingsPage struct {
+	Themes []string
+	Saved  bool // Whether the settings were just changed
+
+	csrfForm
+	themedPage
+}
+
+// settingsHandler shows the reader's settings and stores them in cookies
+// when posted. Choosing the automatic theme forgets the chosen one.
+func (s *Server) settingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		c := &http.Cookie{
+			Name:     themeCookie,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil || strings.HasPrefix(s.cfg().PublicURL, "https:"),
+			SameSite: http.SameSiteLaxMode,
+		}
+		if theme := r.FormValue("theme"); slices.Contains(themes, theme) {
+			c.Value, c.MaxAge = theme, themeCookieMaxAge
+		} else {
+			c.MaxAge = -1
+		}
+		http.SetCookie(w, c)
+		http.Redirect(w, r, "/settings?saved", http.StatusSeeOther)
+		return
+	}
+	s.renderTemplate(w, r, "settings", &SettingsPage{Themes: themes, Saved: r.URL.Query().Has("saved")})
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// TIDDLYWIKI IMPORT
+// =============================================================================
+
+// tiddler is a TiddlyWiki entry, with its fields as stored in the export
+type tiddler map[string]string
+
+// Regular expressions picking tiddlers out of a TiddlyWiki HTML file: the JSON
+// store of TiddlyWiki 5.2 and later, and the store area of older versions with
+// one div per tiddler
+var (
+	tiddlyJSONStore = regexp.MustCompile(`(?s)<script class="tiddlywiki-tiddler-store" type="application/json">(.*?)</script>`)
+	tiddlyStoreDiv  = regexp.MustCompile(`(?s)<div\s+([^>]*?\btitle="[^"]*"[^>]*)>\s*<pre>(.*?)</pre>\s*</div>`)
+	tiddlyAttr      = regexp.MustCompile(`([\w.-]+)="([^"]*)"`)
+)
+
+// readTiddlyWiki reads the tiddlers of a TiddlyWiki HTML file, or of a JSON
+// export of tiddlers, converting each to a page. Tags and the creation time
+// are kept in the page's metadata block, and the title when it had to change
+// to be a valid page title. System tiddlers, drafts and tiddlers that aren't
+// text, such as images, are left out.
+func readTiddlyWiki(src string) (*wikiExport, error) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return nil, err
+	}
+	tiddlers, err := parseTiddlers(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", src, err)
+	}
+
+	var kept []tiddler
+	for _, t := range tiddlers {
+		typ := t["type"]
+		if t["title"] == "" || strings.HasPrefix(t["title"], "$:/") || t["draft.of"] != "" ||
+			typ != "" && typ != "text/vnd.tiddlywiki" && typ != "text/x-tiddlywiki" && !strings.HasPrefix(typ, "text/") {
+			continue
+		}
+		kept = append(kept, t)
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i]["title"] < kept[j]["title"] })
+
+	conv := &tiddlyConverter{titles: make(map[string]string)}
+	used := make(map[string]bool)
+	for _, t := range kept {
+		title := titleWords(t["title"])
+		if title == "" {
+			title = "Tiddler"
+		}
+		conv.titles[t["title"]] = uniqueTitle(title, used)
+	}
+
+	export := &wikiExport{}
+	for _, t := range kept {
+		var body bytes.Buffer
+		var meta []string
+		if conv.titles[t["title"]] != t["title"] {
+			meta = append(meta, "title: "+t["title"])
+		}
+		if tags := tiddlyList(t["tags"]); len(tags) > 0 {
+			meta = append(meta, "tags: "+strings.Join(tags, ", "))
+		}
+		if created, ok := tiddlyTime(t["created"]); ok {
+			meta = append(meta, "created: "+created.Format(time.RFC3339))
+		}
+		if len(meta) > 0 {
+			body.WriteString(frontMatterDelim + "\n" + strings.Join(meta, "\n") + "\n" + frontMatterDelim + "\n")
+		}
+
+		switch t["type"] {
+		case "", "text/vnd.tiddlywiki", "text/x-tiddlywiki":
+			body.Write(conv.convert(t["text"]))
+		default: // Other text, such as Markdown or plain text, is kept as it was written
+			body.WriteString("<pre>" + preText(t["text"]) + "</pre>")
+		}
+		modified, _ := tiddlyTime(t["modified"])
+		export.Pages = append(export.Pages, importedPage{Title: conv.titles[t["title"]], Body: body.Bytes(), Modified: modified})
+	}
+	return export, nil
+}
+
+// parseTiddlers extracts the tiddlers of a TiddlyWiki HTML file or JSON export
+func parseTiddlers(data []byte) ([]tiddler, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		return decodeTiddlers(trimmed)
+	}
+
+	var tiddlers []tiddler
+	for _, m := range tiddlyJSONStore.FindAllSubmatch(data, -1) {
+		ts, err := decodeTiddlers(m[1])
+		if err != nil {
+			return nil, err
+		}
+		tiddlers = append(tiddlers, ts...)
+	}
+	for _, m := range tiddlyStoreDiv.FindAllSubmatch(data, -1) {
+		t := tiddler{"text": html.UnescapeString(string(m[2]))}
+		for _, attr := range tiddlyAttr.FindAllSubmatch(m[1], -1) {
+			t[string(attr[1])] = html.UnescapeString(string(attr[2]))
+		}
+		tiddlers = append(tiddlers, t)
+	}
+	if len(tiddlers) == 0 {
+		return nil, errors.New("no tiddlers found, expected a TiddlyWiki HTML file or JSON export")
+	}
+	return tiddlers, nil
+}
+
+// decodeTiddlers decodes a JSON array of tiddlers. Fields are usually
+// strings; other values are kept in their JSON form.
+func decodeTiddlers(data []byte) ([]tiddler, error) {
+	var raw []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	tiddlers := make([]tiddler, 0, len(raw))
+	for _, fields := range raw {
+		t := make(tiddler, len(fields))
+		for name, value := range fields {
+			var s string
+			if json.Unmarshal(value, &s) != nil {
+				s = string(value)
+			}
+			t[name] = s
+		}
+		tiddlers = append(tiddlers, t)
+	}
+	return tiddlers, nil
+}
+
+// tiddlyList splits a TiddlyWiki title list, such as the tags field: titles
+// are separated by spaces, and those containing spaces are wrapped in [[ ]]
+func tiddlyList(s string) []string {
+	var list []string
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		var item string
+		if rest, ok := strings.CutPrefix(s, "[["); ok {
+			item, s, _ = strings.Cut(rest, "]]")
+		} else {
+			item, s, _ = strings.Cut(s, " ")
+		}
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// tiddlyTime parses a TiddlyWiki timestamp, UTC digits from the year to the
+// millisecond (or to the minute in older versions)
+func tiddlyTime(s string) (time.Time, bool) {
+	for _, layout := range []string{"20060102150405", "200601021504"} {
+		if len(s) >= len(layout) {
+			if t, err := time.Parse(layout, s[:len(layout)]); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// =============================================================================
+// TIDDLYWIKI MARKUP CONVERSION
+// =============================================================================
+
+// Regular expressions matching TiddlyWiki block markup
+var (
+	tiddlyHeading  = regexp.MustCompile(`^(!{1,6})\s*(.*)$`)
+	tiddlyRule     = regexp.MustCompile(`^-{3,}\s*$`)
+	tiddlyListItem = regexp.MustCompile(`^([*#]+)\s*(.*)$`)
+	tiddlyTableRow = regexp.MustCompile(`^\|(.*)\|([hkcf]?)\s*$`)
+	tiddlyQuote    = regexp.MustCompile(`^>\s?(.*)$`)
+)
+
+// tiddlyInline matches TiddlyWiki inline markup: links, external links,
+// images, transclusions, macros, bare URLs and formatting toggles
+var tiddlyInline = regexp.MustCompile("\\[\\[(.*?)\\]\\]|\\[ext\\[(.*?)\\]\\]|\\[img[^\\[]*\\[(.*?)\\]\\]|\\{\\{(.*?)\\}\\}|<<.*?>>|(?:https?|ftp)://[^\\s<>\\[\\]{}]+|''|//|__|~~|\\^\\^|,,|`")
+
+// tiddlyToggles maps formatting markers to the HTML elements they open and close
+var tiddlyToggles = map[string]string{"''": "strong", "//": "em", "__": "u", "~~": "del", "^^": "sup", ",,": "sub", "`": "code"}
+
+// tiddlyConverter turns TiddlyWiki markup into the wiki's own, like the
+// DokuWiki converter: headings become # lines, links [Title] links,
+// transclusions includes, and the rest HTML
+type tiddlyConverter struct {
+	titles map[string]string // Tiddler title to page title
+
+	out   bytes.Buffer
+	block string   // Open block: "p", "table", "quote" or "" for none
+	lists []string // Open lists, outermost first
+}
+
+// title returns the page title of a tiddler, "" when it can't have one
+func (c *tiddlyConverter) title(name string) string {
+	if t, ok := c.titles[name]; ok {
+		return t
+	}
+	return titleWords(name)
+}
+
+// convert returns a tiddler's text in the wiki's markup
+func (c *tiddlyConverter) convert(text string) []byte {
+	c.out.Reset()
+	code, quote := false, false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "```") {
+			c.closeBlocks()
+			if code {
+				c.out.WriteString("</pre>\n")
+			} else {
+				c.out.WriteString("<pre>")
+			}
+			code = !code
+			continue
+		}
+		if code {
+			c.out.WriteString(preText(line) + "\n")
+			continue
+		}
+		if strings.HasPrefix(line, "<<<") { // Block quotes span the lines between two <<<
+			c.closeBlocks()
+			if quote {
+				c.out.WriteString("</blockquote>\n")
+			} else {
+				c.out.WriteString("<blockquote>\n")
+			}
+			quote = !quote
+			continue
+		}
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			c.closeBlocks()
+			c.out.WriteString("\n")
+		case tiddlyHeading.MatchString(line):
+			m := tiddlyHeading.FindStringSubmatch(line)
+			c.closeBlocks()
+			c.out.WriteString(strings.Repeat("#", len(m[1])) + " " + c.inline(m[2]) + "\n")
+		case tiddlyRule.MatchString(line):
+			c.closeBlocks()
+			c.out.WriteString("<hr>\n")
+		case tiddlyListItem.MatchString(line):
+			m := tiddlyListItem.FindStringSubmatch(line)
+			c.listItem(m[1], m[2])
+		case tiddlyTableRow.MatchString(line):
+			m := tiddlyTableRow.FindStringSubmatch(line)
+			c.tableRow(m[1], m[2])
+		case tiddlyQuote.MatchString(line):
+			c.openBlock("quote", "<blockquote>")
+			c.out.WriteString(c.inline(tiddlyQuote.FindStringSubmatch(line)[1]))
+		default:
+			c.openBlock("p", "<p>")
+			c.out.WriteString(c.inline(line))
+		}
+	}
+	c.closeBlocks()
+	if code {
+		c.out.WriteString("</pre>\n")
+	}
+	if quote {
+		c.out.WriteString("</blockquote>\n")
+	}
+	return bytes.Clone(bytes.TrimSpace(c.out.Bytes()))
+}
+
+// openBlock starts a block of the given kind with its opening tag, or
+// continues the open one on a new line
+func (c *tiddlyConverter) openBlock(kind, open string) {
+	if c.block == kind {
+		c.out.WriteString("\n")
+		return
+	}
+	c.closeBlocks()
+	c.block = kind
+	c.out.WriteString(open)
+}
+
+// closeBlocks ends the open block and lists
+func (c *tiddlyConverter) closeBlocks() {
+	switch c.block {
+	case "p":
+		c.out.WriteString("</p>\n")
+	case "table":
+		c.out.WriteString("</table>\n")
+	case "quote":
+		c.out.WriteString("</blockquote>\n")
+	}
+	c.block = ""
+	for len(c.lists) > 0 {
+		c.closeList()
+	}
+}
+
+// closeList ends the innermost open list
+func (c *tiddlyConverter) closeList() {
+	c.out.WriteString("</li></" + c.lists[len(c.lists)-1] + ">\n")
+	c.lists = c.lists[:len(c.lists)-1]
+}
+
+// listItem writes a list item. Each marker character is a level of nesting,
+// "*" for bullets and "#" for numbers, so "*#" is a numbered item in a bullet list.
+func (c *tiddlyConverter) listItem(markers, text string) {
+	if c.block != "" {
+		lists := c.lists
+		c.lists = nil
+		c.closeBlocks()
+		c.lists = lists
+	}
+	kinds := make([]string, len(markers))
+	for i, m := range markers {
+		kinds[i] = "ul"
+		if m == '#' {
+			kinds[i] = "ol"
+		}
+	}
+
+	// Keep the open lists that match the item's markers
+	same := 0
+	for same < len(c.lists) && same < len(kinds) && c.lists[same] == kinds[same] {
+		same++
+	}
+	for len(c.lists) > same {
+		c.closeList()
+	}
+	if same == len(kinds) {
+		c.out.WriteString("</li>\n<li>")
+	}
+	for len(c.lists) < len(kinds) {
+		c.lists = append(c.lists, kinds[len(c.lists)])
+		c.out.WriteString("<" + c.lists[len(c.lists)-1] + ">\n<li>")
+	}
+	c.out.WriteString(c.inline(text))
+}
+
+// tableRow writes a table row from the cells between its bars. The row is a
+// header when marked with h, as are cells starting with !.
+func (c *tiddlyConverter) tableRow(cells, kind string) {
+	if kind == "k" || kind == "c" { // Class and caption rows have no equivalent
+		return
+	}
+	c.openBlock("table", "<table>\n")
+	c.out.WriteString("<tr>")
+	for _, cell := range strings.Split(cells, "|") {
+		tag := "td"
+		if kind == "h" {
+			tag = "th"
+		}
+		if rest, ok := strings.CutPrefix(cell, "!"); ok {
+			tag, cell = "th", rest
+		}
+		c.out.WriteString("<" + tag + ">" + c.inline(strings.TrimSpace(cell)) + "</" + tag + ">")
+	}
+	c.out.WriteString("</tr>")
+}
+
+// inline converts the inline markup of a line. Formatting left open at the
+// end of the line is closed there.
+func (c *tiddlyConverter) inline(text string) string {
+	var b strings.Builder
+	var open []string // Markers of open formatting, innermost last
+	last := 0
+	for _, m := range tiddlyInline.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(importText.Replace(text[last:m[0]]))
+		last = m[1]
+		token := text[m[0]:m[1]]
+		group := func(n int) string { return text[m[2*n]:m[2*n+1]] }
+
+		switch {
+		case m[2] >= 0:
+			b.WriteString(c.link(group(1)))
+		case m[4] >= 0:
+			label, url, ok := strings.Cut(group(2), "|")
+			if !ok {
+				url = label
+			}
+			b.WriteString(`<a href="` + importText.Replace(url) + `">` + importText.Replace(label) + `</a>`)
+		case m[6] >= 0:
+			label, src, ok := strings.Cut(group(3), "|")
+			if !ok {
+				label, src = "", label
+			}
+			b.WriteString(`<img src="` + importText.Replace(src) + `" alt="` + strings.ReplaceAll(importText.Replace(label), `"`, "&quot;") + `">`)
+		case m[8] >= 0:
+			name, _, _ := strings.Cut(group(4), "||") // Templates have no equivalent
+			if title := c.title(strings.TrimSpace(name)); title != "" {
+				b.WriteString(includePrefix + title + includeSuffix)
+			}
+		case strings.HasPrefix(token, "<<"): // Macros have no equivalent
+		case strings.Contains(token, "://"):
+			url := strings.TrimRight(token, ".,;:!?)") // Punctuation ending a sentence
+			b.WriteString(`<a href="` + url + `">` + url + `</a>` + token[len(url):])
+		default:
+			tag := tiddlyToggles[token]
+			if i := indexOf(open, token); i >= 0 {
+				b.WriteString("</" + tag + ">")
+				open = append(open[:i], open[i+1:]...)
+			} else {
+				b.WriteString("<" + tag + ">")
+				open = append(open, token)
+			}
+		}
+	}
+	b.WriteString(importText.Replace(text[last:]))
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + tiddlyToggles[open[i]] + ">")
+	}
+	return b.String()
+}
+
+// link converts a [[Target]] or [[label|Target]] link
+func (c *tiddlyConverter) link(inner string) string {
+	label, target, hasLabel := strings.Cut(inner, "|")
+	if !hasLabel {
+		target = label
+	}
+	target = strings.TrimSpace(target)
+	if strings.Contains(target, "://") || strings.HasPrefix(target, "mailto:") {
+		return `<a href="` + importText.Replace(target) + `">` + importText.Replace(label) + `</a>`
+	}
+
+	title := c.title(target)
+	switch {
+	case title == "":
+		return importText.Replace(label)
+	case !hasLabel || label == title:
+		return "[" + title + "]"
+	default:
+		return `<a href="/view/` + title + `">` + importText.Replace(label) + `</a>`
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// =============================================================================
+// TLS
+// =============================================================================
+
+// autocertDir is the default directory below the data directory caching the
+// account key and certificates obtained from Let's Encrypt
+const autocertDir = ".autocert"
+
+// certLoader serves a certificate and key read from files, reading them again
+// once either changes on disk so renewed certificates are picked up without a
+// restart
+type certLoader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // Latest modification time of the two files when they were read
+}
+
+// newCertLoader returns a loader for the certificate and key files, failing
+// when they can't be read as a key pair
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	cl := &certLoader{certFile: certFile, keyFile: keyFile}
+	if _, err := cl.getCertificate(nil); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+// getCertificate returns the current certificate, for tls.Config. When the
+// files changed but can't be read, the certificate read before keeps being
+// served.
+func (cl *certLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	var modTime time.Time
+	for _, file := range []string{cl.certFile, cl.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			if cl.cert != nil {
+				return cl.cert, nil
+			}
+			return nil, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if cl.cert != nil && modTime.Equal(cl.modTime) {
+		return cl.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cl.certFile, cl.keyFile)
+	if err != nil {
+		if cl.cert != nil {
+			return cl.cert, nil
+		}
+		return nil, fmt.Errorf("loading -tls-cert and -tls-key: %w", err)
+	}
+	cl.cert, cl.modTime = &cert, modTime
+	return cl.cert, nil
+}
+
+// autocertHosts returns the host names certificates are obtained for
+func (cfg Config) autocertHosts() []string {
+	var hosts []string
+	for _, host := range strings.Split(cfg.Autocert, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// autocertCache returns the directory caching certificates from Let's Encrypt
+func (cfg Config) autocertCache() string {
+	if cfg.AutocertCache != "" {
+		return cfg.AutocertCache
+	}
+	return filepath.Join(cfg.DataDir, autocertDir)
+}
+
+// tlsSetup returns the TLS configuration the wiki is served with, nil to
+// serve plain HTTP, and the handler of the listener on RedirectAddr, which
+// sends browsers to HTTPS and answers Let's Encrypt's challenges
+func (cfg Config) tlsSetup() (*tls.Config, http.Handler, error) {
+	redirect := http.HandlerFunc(cfg.redirectToHTTPS)
+	switch {
+	case cfg.Autocert != "" && cfg.TLSCert != "":
+		return nil, nil, fmt.Errorf("-autocert and -tls-cert are both set; choose one")
+	case cfg.Autocert != "":
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.autocertHosts()...),
+			Cache:      autocert.DirCache(cfg.autocertCache()),
+			Email:      cfg.AutocertEmail,
+		}
+		return m.TLSConfig(), m.HTTPHandler(redirect), nil
+	case cfg.TLSCert != "" || cfg.TLSKey != "":
+		if cfg.TLSCert == "" || cfg.TLSKey == "" {
+			return nil, nil, fmt.Errorf("-tls-cert and -tls-key must be set together")
+		}
+		cl, err := newCertLoader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{GetCertificate: cl.getCertificate, MinVersion: tls.VersionTLS12}, redirect, nil
+	case cfg.RedirectAddr != "":
+		return nil, nil, fmt.Errorf("-redirect-addr needs -tls-cert or -autocert")
+	}
+	return nil, nil, nil
+}
+
+// redirectToHTTPS sends a request to the same URL over HTTPS, on the port
+// the wiki listens on
+func (cfg Config) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		host = strings.Trim(host, "[]") // IPv6 address without a port
+	}
+	if host == "" {
+		http.Error(w, "Use HTTPS", http.StatusBadRequest)
+		return
+	}
+	if _, port, err := net.SplitHostPort(cfg.Addr); err == nil && port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
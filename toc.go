@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// =============================================================================
+// TABLES OF CONTENTS
+// =============================================================================
+
+// minContentsHeadings is how many headings a page needs before a table of
+// contents is put at its top
+const minContentsHeadings = 3
+
+// tocEntry is a heading written by the renderer, listed in the page's table of contents
+type tocEntry struct {
+	level int
+	id    string
+	text  string // Heading as HTML text, without tags
+}
+
+// contents returns a table of contents linking to the headings rendered so
+// far, nested by level, or "" when there are too few for the page to need one
+func (rd *renderer) contents() string {
+	if len(rd.headings) < minContentsHeadings {
+		return ""
+	}
+	top := rd.headings[0].level
+	for _, h := range rd.headings {
+		top = min(top, h.level)
+	}
+
+	var b strings.Builder
+	b.WriteString(`<nav class="toc"><div class="toc-title">Contents</div>`)
+	depth := 0
+	for _, h := range rd.headings {
+		// Skipped levels nest only one deeper, so the lists stay well formed
+		level := min(h.level-top+1, depth+1)
+		if level > depth {
+			b.WriteString("<ul>")
+			depth = level
+		} else {
+			b.WriteString("</li>")
+			for ; depth > level; depth-- {
+				b.WriteString("</ul></li>")
+			}
+		}
+		b.WriteString(`<li><a href="#` + h.id + `">` + h.text + `</a>`)
+	}
+	b.WriteString("</li>")
+	for ; depth > 1; depth-- {
+		b.WriteString("</ul></li>")
+	}
+	b.WriteString("</ul></nav>\n")
+	return b.String()
+}
+
+// PageOutline is a page listed on the site-wide table of contents
+type PageOutline struct {
+	Title    string
+	Heading  string        // First heading of the page, which it is listed by; the title when it has none
+	Sections []pageSection // Level 1 and 2 headings after the first
+}
+
+// ContentsPage contains data for the site-wide table of contents
+type ContentsPage struct {
+	Pages []PageOutline
+
+	themedPage
+}
+
+// contentsHandler lists every page by its first heading, with the sections
+// below it, sorted by heading. Redirects are left out.
+func (s *Server) contentsHandler(w http.ResponseWriter, r *http.Request) {
+	titles, err := s.store.List(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	data := &ContentsPage{}
+	for _, title := range titles {
+		if !s.canRead(r, title) {
+			continue
+		}
+		p, err := s.store.Load(r.Context(), title)
+		if err != nil {
+			if r.Context().Err() != nil {
+				serverError(w, r, r.Context().Err())
+				return
+			}
+			continue
+		}
+		if _, ok := redirectTarget(p.Body); ok {
+			continue
+		}
+		outline := PageOutline{Title: title, Heading: title}
+		if sections := pageSections(p.Body); len(sections) > 0 {
+			outline.Heading, outline.Sections = sections[0].Text, sections[1:]
+		}
+		data.Pages = append(data.Pages, outline)
+	}
+	sort.SliceStable(data.Pages, func(i, j int) bool {
+		return strings.ToLower(data.Pages[i].Heading) < strings.ToLower(data.Pages[j].Heading)
+	})
+	s.renderTemplate(w, r, "toc", data)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =============================================================================
+// API TOKENS
+// =============================================================================
+
+// tokensFile lists the API tokens issued with the token command. Only hashes
+// of the tokens are kept. The leading dot keeps it out of page listings.
+const tokensFile = ".tokens.json"
+
+// Scopes granting API tokens access to groups of endpoints
+const (
+	scopeRead   = "read"   // Reading pages and searching
+	scopeWrite  = "write"  // Changing pages
+	scopeAdmin  = "admin"  // The admin endpoints
+	scopeReview = "review" // Approving and rejecting edits held for review
+)
+
+// apiScopes lists the valid scopes
+var apiScopes = []string{scopeRead, scopeWrite, scopeAdmin, scopeReview}
+
+// rateWindow is the period rate limits count requests over
+const rateWindow = time.Minute
+
+// APIToken is an issued API token
+type APIToken struct {
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"` // Hex SHA-256 of the token
+	Scopes    []string  `json:"scopes"`
+	RateLimit int       `json:"rate_limit,omitempty"` // Requests allowed per minute, 0 for no limit
+	Email     string    `json:"email,omitempty"`      // Address mentions of the token's name are mailed to
+	Created   time.Time `json:"created"`
+}
+
+// hasScope reports whether the token grants a scope
+func (t *APIToken) hasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// hashToken returns the hash a token is stored as
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseScopes reads a comma-separated list of scopes
+func parseScopes(list string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(list, ",") {
+		scope = strings.TrimSpace(scope)
+		if !slices.Contains(apiScopes, scope) {
+			return nil, fmt.Errorf("unknown scope %q, expected %s", scope, strings.Join(apiScopes, ", "))
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// readTokens returns the tokens issued for a data directory
+func readTokens(dataDir string) ([]APIToken, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, tokensFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tokens []APIToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", tokensFile, err)
+	}
+	return tokens, nil
+}
+
+// writeTokens replaces the tokens issued for a data directory
+func writeTokens(dataDir string, tokens []APIToken) error {
+	data, err := json.MarshalIndent(tokens, "", "\t")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, tokensFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// issueToken adds a token to a data directory and returns its secret value,
+// which isn't stored and can't be shown again. The name doubles as the name
+// of the user holding the token, as shown in the audit log and mentions.
+func issueToken(dataDir, name string, scopes []string, rateLimit int, email string) (string, error) {
+	if !validUser.MatchString(name) {
+		return "", fmt.Errorf("invalid name %q: use letters, digits, - and _", name)
+	}
+	if err := reservedName(name); err != nil {
+		return "", err
+	}
+	if email != "" && !validEmail(email) {
+		return "", fmt.Errorf("invalid email address %q", email)
+	}
+	tokens, err := readTokens(dataDir)
+	if err != nil {
+		return "", err
+	}
+	for _, t := range tokens {
+		if t.Name == name {
+			return "", fmt.Errorf("a token named %q already exists", name)
+		}
+	}
+	secret := make([]byte, 24)
+	rand.Read(secret)
+	token := "wiki_" + hex.EncodeToString(secret)
+	tokens = append(tokens, APIToken{Name: name, Hash: hashToken(token), Scopes: scopes, RateLimit: rateLimit, Email: email, Created: time.Now().UTC()})
+	return token, writeTokens(dataDir, tokens)
+}
+
+// revokeToken removes a token from a data directory
+func revokeToken(dataDir, name string) error {
+	tokens, err := readTokens(dataDir)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(tokens, func(t APIToken) bool { return t.Name == name })
+	if i < 0 {
+		return fmt.Errorf("no token named %q", name)
+	}
+	return writeTokens(dataDir, slices.Delete(tokens, i, i+1))
+}
+
+// tokenRegistry checks requests against the issued tokens, rereading the
+// tokens file when the token command changes it, and counts each token's
+// requests for its rate limit
+type tokenRegistry struct {
+	mu      sync.Mutex
+	modTime time.Time
+	tokens  []APIToken
+	windows map[string]*requestWindow // By token name
+}
+
+// requestWindow counts a token's requests in the current rate limit window
+type requestWindow struct {
+	start time.Time
+	count int
+}
+
+// newTokenRegistry returns a registry that loads tokens on first use
+func newTokenRegistry() *tokenRegistry {
+	return &tokenRegistry{windows: make(map[string]*requestWindow)}
+}
+
+// lookup returns the issued token matching a secret, reporting false when none does
+func (tr *tokenRegistry) lookup(dataDir, token string) (APIToken, bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.refresh(dataDir)
+	hash := hashToken(token)
+	for _, t := range tr.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			return t, true
+		}
+	}
+	return APIToken{}, false
+}
+
+// named returns the issued token with a name, reporting false when there is none
+func (tr *tokenRegistry) named(dataDir, name string) (APIToken, bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.refresh(dataDir)
+	for _, t := range tr.tokens {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return APIToken{}, false
+}
+
+// any reports whether tokens have been issued
+func (tr *tokenRegistry) any(dataDir string) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.refresh(dataDir)
+	return len(tr.tokens) > 0
+}
+
+// count returns the number of tokens issued
+func (tr *tokenRegistry) count(dataDir string) int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.refresh(dataDir)
+	return len(tr.tokens)
+}
+
+// refresh rereads the tokens file if it changed. Callers hold mu.
+func (tr *tokenRegistry) refresh(dataDir string) {
+	info, err := os.Stat(filepath.Join(dataDir, tokensFile))
+	if err != nil {
+		tr.tokens, tr.modTime = nil, time.Time{}
+		return
+	}
+	if info.ModTime().Equal(tr.modTime) {
+		return
+	}
+	tokens, err := readTokens(dataDir)
+	if err != nil {
+		return // Keep the tokens read before rather than locking everyone out
+	}
+	tr.tokens, tr.modTime = tokens, info.ModTime()
+}
+
+// allow counts a request by a token against its rate limit, returning how
+// many requests remain in the window, when the window resets and whether the
+// request is allowed
+func (tr *tokenRegistry) allow(t APIToken, now time.Time) (remaining int, reset time.Time, ok bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	w := tr.windows[t.Name]
+	if w == nil || now.Sub(w.start) >= rateWindow {
+		w = &requestWindow{start: now}
+		tr.windows[t.Name] = w
+	}
+	reset = w.start.Add(rateWindow)
+	if w.count >= t.RateLimit {
+		return 0, reset, false
+	}
+	w.count++
+	return t.RateLimit - w.count, reset, true
+}
+
+// authorize checks that a request carries a token granting scope, answering
+// 401, 403 or 429 and reporting false when it doesn't. Requests with the
+// admin token or the -api-token pass the checks for the scopes those grant,
+// and requests without a token may be logged in to an account granting it.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, scope string) bool {
+	cfg := s.cfg()
+	token := requestToken(r)
+	if u, ok := s.sessionUser(r); ok && token == "" {
+		if !u.hasScope(scope) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "account lacks the " + scope + " scope", "required_scope": scope})
+			return false
+		}
+		return true
+	}
+	switch configuredToken(cfg, token) {
+	case adminName:
+		return true
+	case apiName:
+		if scope == scopeRead || scope == scopeWrite {
+			return true
+		}
+	}
+
+	t, ok := s.tokens.lookup(cfg.DataDir, token)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="wiki api"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or invalid API token"})
+		return false
+	}
+	if !t.hasScope(scope) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "token lacks the " + scope + " scope", "required_scope": scope})
+		return false
+	}
+	if t.RateLimit > 0 {
+		remaining, reset, ok := s.tokens.allow(t, time.Now())
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(t.RateLimit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "rate limit exceeded", "reset": reset.UTC().Format(time.RFC3339)})
+			return false
+		}
+	}
+	return true
+}
+
+// Names the configured admin and API tokens go by, which issued tokens and
+// accounts can't take
+const (
+	adminName = "admin"
+	apiName   = "api"
+)
+
+// configuredToken returns adminName or apiName when token is the configured
+// admin or API token, and "" otherwise
+func configuredToken(cfg *Config, token string) string {
+	switch {
+	case token == "":
+		return ""
+	case cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1:
+		return adminName
+	case cfg.APIToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.APIToken)) == 1:
+		return apiName
+	}
+	return ""
+}
+
+// reservedName reports an error for the names of the configured tokens,
+// which would otherwise pass for them in permissions and the audit log
+func reservedName(name string) error {
+	if name == adminName || name == apiName {
+		return fmt.Errorf("the name %q is reserved for the configured tokens", name)
+	}
+	return nil
+}
+
+// tokenName returns the name of the token a request carries, "admin" or
+// "api" for the configured tokens, the name of the account it is logged in
+// to when it carries no token, or "" when it has neither
+func (s *Server) tokenName(r *http.Request) string {
+	cfg := s.cfg()
+	token := requestToken(r)
+	if token == "" {
+		u, _ := s.sessionUser(r)
+		return u.Name
+	}
+	if name := configuredToken(cfg, token); name != "" {
+		return name
+	}
+	t, _ := s.tokens.lookup(cfg.DataDir, token)
+	return t.Name
+}
+
+// hasScope reports whether a request carries a token granting scope, or is
+// logged in to an account granting it, without counting it against the
+// token's rate limit. The configured tokens are told apart by their value,
+// as issued tokens may have any name.
+func (s *Server) hasScope(r *http.Request, scope string) bool {
+	cfg := s.cfg()
+	token := requestToken(r)
+	if token == "" {
+		u, ok := s.sessionUser(r)
+		return ok && u.hasScope(scope)
+	}
+	switch configuredToken(cfg, token) {
+	case adminName:
+		return true
+	case apiName:
+		return scope == scopeRead || scope == scopeWrite
+	}
+	t, ok := s.tokens.lookup(cfg.DataDir, token)
+	return ok && t.hasScope(scope)
+}
+
+// requireLogin wraps a page for users and holders of tokens granting scope,
+// sending browsers to log in when they are neither
+func (s *Server) requireLogin(scope string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.tokenName(r) == "" {
+			s.loginChallenge(w, r)
+			return
+		}
+		if s.authorize(w, r, scope) {
+			fn(w, r)
+		}
+	}
+}
+
+// requireScope wraps an API handler so it only runs for requests with a
+// token granting scope, or logged in to an account granting it. Reading is
+// open to anonymous clients, and so is writing until an -api-token, tokens
+// or user accounts are configured; tokens that are sent are always checked,
+// so their rate limits apply.
+func (s *Server) requireScope(scope string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestToken(r) == "" {
+			cfg := s.cfg()
+			if scope == scopeRead || scope == scopeWrite && cfg.APIToken == "" && !s.tokens.any(cfg.DataDir) && !s.users.any(cfg.DataDir) {
+				fn(w, r)
+				return
+			}
+		}
+		if s.authorize(w, r, scope) {
+			fn(w, r)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Values of the configured tokens in tests
+const (
+	testAdminToken = "admin-secret"
+	testAPIToken   = "api-secret"
+)
+
+// newCredentialServer returns a test server with the configured tokens set,
+// and returns the requests made with each kind of credential, by name:
+// none, the configured tokens, issued tokens with various scopes, issued
+// tokens named like the configured ones, an unknown token and a logged-in
+// account
+func newCredentialServer(t *testing.T, configure func(cfg *Config)) (*Server, map[string]*http.Request) {
+	t.Helper()
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.AdminToken, cfg.APIToken = testAdminToken, testAPIToken
+		if configure != nil {
+			configure(cfg)
+		}
+	})
+	dir := s.cfg().DataDir
+
+	issued := map[string][]string{
+		"reader":   {scopeRead},
+		"writer":   {scopeRead, scopeWrite},
+		"reviewer": {scopeRead, scopeReview},
+		"ops":      {scopeAdmin},
+	}
+	secrets := make(map[string]string)
+	for name, scopes := range issued {
+		secret, err := issueToken(dir, name, scopes, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		secrets[name] = secret
+	}
+	// Tokens issued before the configured tokens' names were reserved
+	tokens, err := readTokens(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens = append(tokens,
+		APIToken{Name: adminName, Hash: hashToken("legacy-admin"), Scopes: []string{scopeRead}},
+		APIToken{Name: apiName, Hash: hashToken("legacy-api"), Scopes: []string{scopeRead}})
+	if err := writeTokens(dir, tokens); err != nil {
+		t.Fatal(err)
+	}
+	if err := addUser(dir, "alice", "correct horse", []string{scopeRead, scopeWrite}, ""); err != nil {
+		t.Fatal(err)
+	}
+	session := s.users.login("alice", time.Now())
+
+	request := func(token string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return r
+	}
+	reqs := map[string]*http.Request{
+		"anonymous":    request(""),
+		"admin token":  request(testAdminToken),
+		"api token":    request(testAPIToken),
+		"reader":       request(secrets["reader"]),
+		"writer":       request(secrets["writer"]),
+		"reviewer":     request(secrets["reviewer"]),
+		"ops":          request(secrets["ops"]),
+		"named admin":  request("legacy-admin"),
+		"named api":    request("legacy-api"),
+		"unknown":      request("wiki_unknown"),
+		"user session": request(""),
+	}
+	reqs["user session"].AddCookie(&http.Cookie{Name: sessionCookie, Value: session})
+	return s, reqs
+}
+
+func TestHasScope(t *testing.T) {
+	s, reqs := newCredentialServer(t, nil)
+	for name, want := range map[string][]string{
+		"anonymous":    nil,
+		"admin token":  apiScopes,
+		"api token":    {scopeRead, scopeWrite},
+		"reader":       {scopeRead},
+		"writer":       {scopeRead, scopeWrite},
+		"reviewer":     {scopeRead, scopeReview},
+		"ops":          {scopeAdmin},
+		"named admin":  {scopeRead},
+		"named api":    {scopeRead},
+		"unknown":      nil,
+		"user session": {scopeRead, scopeWrite},
+	} {
+		for _, scope := range apiScopes {
+			if got := s.hasScope(reqs[name], scope); got != slices.Contains(want, scope) {
+				t.Errorf("%s: hasScope(%s) = %v, want %v", name, scope, got, !got)
+			}
+		}
+	}
+}
+
+func TestNeedsReview(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		configure func(cfg *Config)
+		held      []string // Credentials whose edits are held
+	}{
+		{"open", nil, nil},
+		{"review edits", func(cfg *Config) { cfg.ReviewEdits = true },
+			[]string{"anonymous", "reader", "reviewer", "ops", "named admin", "named api", "unknown"}},
+		{"moderate anonymous", func(cfg *Config) { cfg.ModerateAnonymous = true },
+			[]string{"anonymous", "unknown"}},
+	} {
+		s, reqs := newCredentialServer(t, tc.configure)
+		for name, r := range reqs {
+			if got := s.needsReview(r); got != slices.Contains(tc.held, name) {
+				t.Errorf("%s: %s: needsReview = %v, want %v", tc.name, name, got, !got)
+			}
+		}
+	}
+}
+
+func TestCanReview(t *testing.T) {
+	anonymous := PendingEdit{Author: anonymousAuthor}
+	named := PendingEdit{Author: "bob"}
+	for _, tc := range []struct {
+		name      string
+		moderate  bool
+		edit      PendingEdit
+		reviewers []string
+	}{
+		{"anonymous edit", false, anonymous, []string{"admin token", "reviewer"}},
+		{"named edit", false, named, []string{"admin token", "reviewer"}},
+		{"moderated anonymous edit", true, anonymous, []string{"admin token", "api token", "reviewer", "writer", "user session"}},
+		{"moderated named edit", true, named, []string{"admin token", "reviewer"}},
+	} {
+		s, reqs := newCredentialServer(t, func(cfg *Config) { cfg.ModerateAnonymous = tc.moderate })
+		for name, r := range reqs {
+			if got := s.canReview(r, tc.edit); got != slices.Contains(tc.reviewers, name) {
+				t.Errorf("%s: %s: canReview = %v, want %v", tc.name, name, got, !got)
+			}
+		}
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{adminName, apiName} {
+		if _, err := issueToken(dir, name, []string{scopeRead}, 0, ""); err == nil {
+			t.Errorf("issueToken(%q) succeeded", name)
+		}
+		if err := addUser(dir, name, "password", []string{scopeRead}, ""); err == nil {
+			t.Errorf("addUser(%q) succeeded", name)
+		}
+	}
+}
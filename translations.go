@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// =============================================================================
+// TRANSLATIONS
+// =============================================================================
+
+// Translation is one language version of a page, listed in the language
+// switcher of the view template
+type Translation struct {
+	Title   string
+	Lang    string // Empty for the original page
+	Current bool   // Whether this is the version being viewed
+}
+
+// LanguageLabel returns the text of the translation's switcher link
+func (t Translation) LanguageLabel() string {
+	if t.Lang == "" {
+		return "original"
+	}
+	return t.Lang
+}
+
+// splitTitle separates a title into the page it belongs to and the language
+// of the translation, which is empty for original pages. Translations follow
+// the title of their page with a dot, which page names can't hold, and the
+// language: Projects/Alpha.es is the Spanish translation of Projects/Alpha,
+// while Projects/es is just a page in Projects.
+func splitTitle(title string) (base, lang string) {
+	i := strings.LastIndexByte(title, '.')
+	if i < 0 || !validLang.MatchString(title[i+1:]) {
+		return title, ""
+	}
+	return title[:i], title[i+1:]
+}
+
+// fallbackTitles returns the pages shown in place of a missing translation,
+// in order of preference: the same language without its region or script
+// subtags, then the original page. pt-BR falls back to pt, then the original.
+func fallbackTitles(title string) []string {
+	base, lang := splitTitle(title)
+	if lang == "" {
+		return nil
+	}
+	var titles []string
+	for i := strings.LastIndexByte(lang, '-'); i > 0; i = strings.LastIndexByte(lang, '-') {
+		lang = lang[:i]
+		titles = append(titles, base+"."+lang)
+	}
+	return append(titles, base)
+}
+
+// loadFallback loads the first existing page to show in place of a missing
+// translation, or returns nil when there is none
+func (s *Server) loadFallback(ctx context.Context, title string) (*Page, error) {
+	for _, t := range fallbackTitles(title) {
+		p, err := s.store.Load(ctx, t)
+		if err == nil {
+			return p, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, nil
+}
+
+// translations returns the original of a page followed by its translations
+// ordered by language, or nothing when the page hasn't been translated
+func (s *Server) translations(ctx context.Context, title string) ([]Translation, error) {
+	titles, err := s.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	base, _ := splitTitle(title)
+
+	var found []Translation
+	for _, t := range titles {
+		if b, lang := splitTitle(t); b == base && lang != "" {
+			found = append(found, Translation{Title: t, Lang: lang, Current: t == title})
+		}
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Lang < found[j].Lang })
+	return append([]Translation{{Title: base, Current: base == title}}, found...), nil
+}
+
+// LanguageReport lists the pages not yet translated to one language
+type LanguageReport struct {
+	Lang       string
+	Translated int
+	Missing    []string // Original pages without a translation, sorted
+}
+
+// TranslationsReport contains data for rendering the untranslated pages report
+type TranslationsReport struct {
+	Originals int
+	Languages []LanguageReport
+
+	themedPage
+}
+
+// untranslatedPages reports, for every language any page is translated to,
+// the original pages that have no translation in that language
+func (s *Server) untranslatedPages(ctx context.Context) (*TranslationsReport, error) {
+	titles, err := s.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(titles)
+
+	var originals []string
+	translated := make(map[string]map[string]bool) // Language to originals translated to it
+	for _, t := range titles {
+		base, lang := splitTitle(t)
+		if lang == "" {
+			originals = append(originals, t)
+			continue
+		}
+		if translated[lang] == nil {
+			translated[lang] = make(map[string]bool)
+		}
+		translated[lang][base] = true
+	}
+
+	report := &TranslationsReport{Originals: len(originals)}
+	for lang, bases := range translated {
+		lr := LanguageReport{Lang: lang}
+		for _, t := range originals {
+			if bases[t] {
+				lr.Translated++
+			} else {
+				lr.Missing = append(lr.Missing, t)
+			}
+		}
+		report.Languages = append(report.Languages, lr)
+	}
+	sort.Slice(report.Languages, func(i, j int) bool { return report.Languages[i].Lang < report.Languages[j].Lang })
+	return report, nil
+}
+
+// translationsHandler displays the untranslated pages of each language
+func (s *Server) translationsHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := s.untranslatedPages(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	s.renderTemplate(w, r, "translations", report)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// TRASH
+// =============================================================================
+
+// trashPurgeInterval is how often the background job looks for expired trash entries
+const trashPurgeInterval = time.Hour
+
+// TrashEntry is a deleted page kept in the trash until it is restored or purged.
+// Entries are stored as "<unix deletion time>-<title>.txt" inside the trash
+// directory, the time in seconds with nine digits of nanoseconds after a dot,
+// so deleting a page twice within a second keeps both. Entries from before
+// have whole seconds.
+type TrashEntry struct {
+	Name    string // File name within the trash directory
+	Title   string
+	Deleted time.Time
+}
+
+// parseTrashEntry decodes a trash file name, reporting false for names not created by the wiki
+func parseTrashEntry(name string) (TrashEntry, bool) {
+	stamp, title, ok := strings.Cut(strings.TrimSuffix(name, ".txt"), "-")
+	if !ok || title == "" || !strings.HasSuffix(name, ".txt") {
+		return TrashEntry{}, false
+	}
+	stamp, fraction, precise := strings.Cut(stamp, ".")
+	secs, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return TrashEntry{}, false
+	}
+	var nsecs int64
+	if precise {
+		if nsecs, err = strconv.ParseInt(fraction, 10, 64); err != nil || len(fraction) != 9 {
+			return TrashEntry{}, false
+		}
+	}
+	return TrashEntry{Name: name, Title: stemTitle(title), Deleted: time.Unix(secs, nsecs).UTC()}, true
+}
+
+// listTrash returns the entries in the trash, most recently deleted first
+func (s *Server) listTrash() ([]TrashEntry, error) {
+	files, err := os.ReadDir(filepath.Join(s.cfg().DataDir, trashDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []TrashEntry
+	for _, file := range files {
+		if entry, ok := parseTrashEntry(file.Name()); ok && !file.IsDir() {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Deleted.After(entries[j].Deleted) })
+	return entries, nil
+}
+
+// trashPage moves a page into the trash and records its deletion by actor in
+// the audit log. Callers hold the page's lock. It fails with os.ErrExist
+// rather than overwrite an entry deleted at the same time.
+func (s *Server) trashPage(ctx context.Context, title, actor, reason string) error {
+	dir := filepath.Join(s.cfg().DataDir, trashDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%d.%09d-%s.txt", now.Unix(), now.Nanosecond(), fileStem(title))
+	if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+		return fmt.Errorf("trash entry %s: %w", name, os.ErrExist)
+	}
+	p, err := s.store.Load(ctx, title)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, name), p.Body, 0600); err != nil {
+		return err
+	}
+	if err := s.store.Delete(ctx, title); err != nil {
+		os.Remove(filepath.Join(dir, name))
+		return err
+	}
+	s.notifyPageChange(title)
+	s.audit.record(AuditEvent{Type: eventDelete, Title: title, Actor: actor, Detail: reason})
+	return nil
+}
+
+// purgeTrashEntry permanently removes an entry from the trash and records its
+// purge by actor in the audit log
+func (s *Server) purgeTrashEntry(entry TrashEntry, actor, reason string) error {
+	if err := os.Remove(filepath.Join(s.cfg().DataDir, trashDir, entry.Name)); err != nil {
+		return err
+	}
+	s.audit.record(AuditEvent{Type: eventPurge, Title: entry.Title, Actor: actor, Detail: reason})
+	return nil
+}
+
+// purgeExpiredTrash removes trash entries deleted longer than the retention
+// period ago and returns how many were purged
+func (s *Server) purgeExpiredTrash(retention time.Duration) (int, error) {
+	entries, err := s.listTrash()
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-retention)
+	purged := 0
+	for _, entry := range entries {
+		if entry.Deleted.After(cutoff) {
+			continue
+		}
+		if err := s.purgeTrashEntry(entry, "", "Retention period of "+retention.String()+" expired"); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// runTrashPurge periodically purges trash entries older than the configured
+// retention, except while the wiki is read-only
+func (s *Server) runTrashPurge(ctx context.Context) {
+	for {
+		if retention := s.cfg().TrashRetention; retention > 0 && !s.cfg().ReadOnly {
+			purged, err := s.purgeExpiredTrash(retention)
+			if err != nil {
+				slog.Error("Purging trash failed", "err", err)
+			}
+			if purged > 0 {
+				slog.Info("Purged expired trash entries", "count", purged)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(trashPurgeInterval):
+		}
+	}
+}
+
+// restoreTrashEntry saves a deleted page again and removes it from the
+// trash. Its content is usually its latest revision, so the restore is
+// recorded as the page's creation at that revision rather than as a new one.
+// It fails with os.ErrExist when a page with the title was created since.
+func (s *Server) restoreTrashEntry(ctx context.Context, entry TrashEntry, actor string) error {
+	unlock := s.store.Lock(entry.Title)
+	defer unlock()
+	if s.store.Exists(ctx, entry.Title) {
+		return os.ErrExist
+	}
+	path := filepath.Join(s.cfg().DataDir, trashDir, entry.Name)
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rev, _, err := s.store.Save(ctx, &Page{Title: entry.Title, Body: body, Summary: "Restored from the trash", Author: actor})
+	if err != nil {
+		return err
+	}
+	s.notifyPageChange(entry.Title)
+	if rev == 0 {
+		revs, err := s.store.Revisions(ctx, entry.Title)
+		if err != nil {
+			return err
+		}
+		rev = len(revs)
+	}
+	ev := AuditEvent{Type: eventCreate, Title: entry.Title, Actor: actor, Revision: rev, Detail: "Restored from the trash"}
+	s.audit.record(ev)
+	s.postChange(ev, parsePageMeta(body))
+	return os.Remove(path)
+}
+
+// =============================================================================
+// DELETION HANDLERS
+// =============================================================================
+
+// DeletePage contains data for rendering the confirmation of a deletion
+type DeletePage struct {
+	Title string
+
+	csrfForm
+	themedPage
+}
+
+// TrashPage contains data for rendering the trash
+type TrashPage struct {
+	Entries   []TrashEntry
+	Retention time.Duration // How long entries are kept, 0 for ever
+	Error     string
+
+	csrfForm
+	themedPage
+}
+
+// deleteHandler asks for confirmation before deleting a page, and moves it
+// to the trash when the confirmation is posted. Deletions can't be held for
+// review, so readers whose edits would be can't delete pages.
+func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request, title string) {
+	if !s.store.Exists(r.Context(), title) {
+		http.NotFound(w, r)
+		return
+	}
+	if s.needsReview(r) {
+		http.Error(w, "Deleting pages needs the write scope", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		s.renderTemplate(w, r, "delete", &DeletePage{Title: title})
+		return
+	}
+
+	unlock := s.store.Lock(title)
+	err := s.trashPage(r.Context(), title, s.tokenName(r), strings.TrimSpace(r.PostFormValue("reason")))
+	unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/?deleted="+url.QueryEscape(title), http.StatusSeeOther)
+}
+
+// trashHandler lists the deleted pages, and restores or purges the entry
+// named in the form when it is posted with action set
+func (s *Server) trashHandler(w http.ResponseWriter, r *http.Request) {
+	data := &TrashPage{Retention: s.cfg().TrashRetention}
+	if r.Method == http.MethodPost {
+		entry, ok := parseTrashEntry(r.PostFormValue("name"))
+		if !ok || strings.ContainsAny(entry.Name, `/\`) {
+			http.Error(w, "invalid trash entry", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch r.PostFormValue("action") {
+		case "restore":
+			err = s.restoreTrashEntry(r.Context(), entry, s.tokenName(r))
+		case "purge":
+			err = s.purgeTrashEntry(entry, s.tokenName(r), "Purged by hand")
+		default:
+			http.Error(w, `action must be "restore" or "purge"`, http.StatusBadRequest)
+			return
+		}
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			data.Error = entry.Title + " is no longer in the trash."
+		case errors.Is(err, os.ErrExist):
+			data.Error = entry.Title + " can't be restored: a page with that title was created since. Rename it first."
+		case err != nil:
+			serverError(w, r, err)
+			return
+		default:
+			if r.PostFormValue("action") == "restore" {
+				http.Redirect(w, r, "/view/"+titleURL(entry.Title), http.StatusSeeOther)
+			} else {
+				http.Redirect(w, r, "/trash", http.StatusSeeOther)
+			}
+			return
+		}
+	}
+
+	entries, err := s.listTrash()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	data.Entries = entries
+	s.renderTemplate(w, r, "trash", data)
+}
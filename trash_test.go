@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseTrashEntry(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		title   string
+		deleted time.Time
+		ok      bool
+	}{
+		{"1700000000-Home.txt", "Home", time.Unix(1700000000, 0), true},
+		{"1700000000.000000042-Home.txt", "Home", time.Unix(1700000000, 42), true},
+		{"1700000000.000000042-Team-Plan.txt", "Team-Plan", time.Unix(1700000000, 42), true},
+		{"1700000000.42-Home.txt", "", time.Time{}, false},
+		{"1700000000-Home.md", "", time.Time{}, false},
+		{"Home.txt", "", time.Time{}, false},
+		{"1700000000-.txt", "", time.Time{}, false},
+	} {
+		entry, ok := parseTrashEntry(tc.name)
+		if ok != tc.ok || ok && (entry.Title != tc.title || !entry.Deleted.Equal(tc.deleted)) {
+			t.Errorf("parseTrashEntry(%q) = %+v, %v", tc.name, entry, ok)
+		}
+	}
+}
+
+// TestTrashPageTwice deletes a page, creates it again and deletes it again
+// at once, which keeps both deleted versions in the trash
+func TestTrashPageTwice(t *testing.T) {
+	s := newTestServer(t, nil)
+	ctx := context.Background()
+	for _, body := range []string{"First.\n", "Second.\n"} {
+		savePages(t, s, map[string]string{"Home": body})
+		if err := s.trashPage(ctx, "Home", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := s.listTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name == entries[1].Name {
+		t.Fatalf("trash entries %+v, want two", entries)
+	}
+	if err := s.restoreTrashEntry(ctx, entries[0], ""); err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.store.Load(ctx, "Home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Body) != "Second.\n" {
+		t.Errorf("restored the latest deletion as %q, want %q", p.Body, "Second.\n")
+	}
+}
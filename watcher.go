@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// =============================================================================
+// DATA DIRECTORY WATCHER
+// =============================================================================
+
+// watchDebounce is how long the watcher waits for a burst of events on the same
+// file (editors often write, rename and chmod in quick succession) to settle
+const watchDebounce = 200 * time.Millisecond
+
+// changeWatcher is implemented by stores that can notice pages changed
+// without going through the wiki
+type changeWatcher interface {
+	// Watch calls onChange with the title of every page changed externally and
+	// the revision recorded for it (0 if the content is unchanged) until the
+	// returned closer is closed
+	Watch(onChange func(title string, rev int)) (io.Closer, error)
+}
+
+// Watch watches the data directory and its namespace directories for page
+// files that are created, modified, renamed or removed outside the server
+// (rsync, git pull, a text editor), snapshots them into the revision history
+// and reports them so indexes and caches stay fresh
+func (fs *fileStore) Watch(onChange func(title string, rev int)) (io.Closer, error) {
+	return fs.watch(fs.snapshot, onChange)
+}
+
+// watch runs the data directory watcher, recording changed pages with
+// snapshot, which returns the revision recorded or 0
+func (fs *fileStore) watch(snapshot func(title, summary string) (int, error), onChange func(title string, rev int)) (io.Closer, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.watchDirs(watcher, fs.dir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go func() {
+		var mu sync.Mutex
+		pending := make(map[string]*time.Timer)
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Base(event.Name)
+				if strings.HasPrefix(name, ".") {
+					continue
+				}
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() && event.Has(fsnotify.Create) {
+					// A new namespace directory
+					if err := fs.watchDirs(watcher, event.Name); err != nil {
+						slog.Error("Watching file failed", "file", event.Name, "err", err)
+					}
+					continue
+				}
+				if !strings.HasSuffix(name, ".txt") {
+					continue
+				}
+				rel, err := filepath.Rel(fs.dir, event.Name)
+				if err != nil {
+					continue
+				}
+				title := fileTitle(filepath.ToSlash(rel))
+
+				mu.Lock()
+				if t, ok := pending[title]; ok {
+					t.Reset(watchDebounce)
+				} else {
+					pending[title] = time.AfterFunc(watchDebounce, func() {
+						mu.Lock()
+						delete(pending, title)
+						mu.Unlock()
+
+						rev, err := snapshot(title, "Edited outside the wiki")
+						if err != nil {
+							slog.Error("Recording revision failed", "title", title, "err", err)
+						}
+						if rev > 0 {
+							slog.Info("Page changed on disk", "title", title)
+						}
+						onChange(title, rev)
+					})
+				}
+				mu.Unlock()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("File watcher failed", "err", err)
+			}
+		}
+	}()
+
+	return watcher, nil
+}
+
+// watchDirs adds dir and the namespace directories below it to watcher,
+// leaving out the directories of other wiki data, whose names start with a dot
+func (fs *fileStore) watchDirs(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		if path != fs.dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
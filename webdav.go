@@ -0,0 +1,727 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// =============================================================================
+// WEBDAV
+// =============================================================================
+
+// davPrefix is the path the page store is served under over WebDAV
+const davPrefix = "/dav"
+
+// davExt is the extension of the files pages appear as over WebDAV
+const davExt = ".txt"
+
+// davSummary is the edit summary of saves made over WebDAV
+const davSummary = "Edited over WebDAV"
+
+// davMaxScratch bounds the number of scratch files and folders kept at once
+const davMaxScratch = 200
+
+// davScratch holds files and folders written over WebDAV that aren't pages,
+// in memory: the temporary and backup files editors write next to the files
+// they save, such as .Home.txt.swp or Home.txt~, and folders made before
+// the pages in them. Each client has its own, so nobody sees or moves the
+// scratch files of another. They are lost when the wiki restarts.
+type davScratch struct {
+	mu      sync.Mutex
+	entries map[davScratchKey]*davScratchEntry
+}
+
+// davScratchKey names a scratch entry: the client it belongs to, as its
+// account or token name, or its address after an @ for anonymous clients,
+// and its
+// slash-separated path without a leading slash
+type davScratchKey struct {
+	client string
+	name   string
+}
+
+// davScratchEntry is a scratch file or folder
+type davScratchEntry struct {
+	dir     bool
+	data    []byte
+	modTime time.Time
+}
+
+// newDavScratch returns an empty scratch area
+func newDavScratch() *davScratch {
+	return &davScratch{entries: make(map[davScratchKey]*davScratchEntry)}
+}
+
+// get returns the client's entry at name
+func (sc *davScratch) get(client, name string) (*davScratchEntry, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	e, ok := sc.entries[davScratchKey{client, name}]
+	return e, ok
+}
+
+// put stores an entry of the client at name, failing when the scratch area
+// is full
+func (sc *davScratch) put(client, name string, e *davScratchEntry) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	key := davScratchKey{client, name}
+	if _, ok := sc.entries[key]; !ok && len(sc.entries) >= davMaxScratch {
+		return fs.ErrPermission
+	}
+	sc.entries[key] = e
+	return nil
+}
+
+// remove deletes the client's entry at name and everything below it
+func (sc *davScratch) remove(client, name string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for key := range sc.entries {
+		if key.client == client && (key.name == name || strings.HasPrefix(key.name, name+"/")) {
+			delete(sc.entries, key)
+		}
+	}
+}
+
+// move renames the client's entry at from and everything below it to to
+func (sc *davScratch) move(client, from, to string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for key, e := range sc.entries {
+		if key.client != client {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(key.name, from); ok && (rest == "" || rest[0] == '/') {
+			delete(sc.entries, key)
+			sc.entries[davScratchKey{client, to + rest}] = e
+		}
+	}
+}
+
+// children returns the client's entries directly inside the folder dir, ""
+// for the root
+func (sc *davScratch) children(client, dir string) map[string]*davScratchEntry {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	children := make(map[string]*davScratchEntry)
+	for key, e := range sc.entries {
+		if key.client == client && path.Dir("/"+key.name) == "/"+dir {
+			children[path.Base(key.name)] = e
+		}
+	}
+	return children
+}
+
+// davScratchTitle returns the title of the page a scratch file is kept for,
+// as Home for .Home.txt.swp, Home.txt~ or #Home.txt#, reporting false for
+// scratch files and folders not named after a page
+func davScratchTitle(name string) (string, bool) {
+	dir, base := path.Split(name)
+	base = strings.TrimLeft(base, ".#~")
+	stem, _, ok := strings.Cut(base, davExt)
+	if !ok || stem == "" || !validTitle.MatchString(dir+stem) {
+		return "", false
+	}
+	return dir + stem, true
+}
+
+// davFS is the page store seen as a WebDAV file system by the client of one
+// request: each page is a text file named after its title, in folders named
+// after its namespaces, as Projects/Alpha.txt. Only the pages the client may
+// read are listed. Writes are saved as revisions by the client's account or
+// token, or held for review when its edits need it; deletions move pages to
+// the trash and renames move their history with them.
+type davFS struct {
+	s *Server
+	r *http.Request
+}
+
+// davName cleans a WebDAV path into a slash-separated name without leading
+// or trailing slashes, "" for the root
+func davName(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// davTitle returns the title of the page a file name stands for, reporting
+// false for names that aren't page files
+func davTitle(name string) (string, bool) {
+	title, ok := strings.CutSuffix(name, davExt)
+	if !ok || !validTitle.MatchString(title) {
+		return "", false
+	}
+	return title, true
+}
+
+// titles returns the titles of the pages the client may read
+func (dfs *davFS) titles(ctx context.Context) ([]string, error) {
+	titles, err := dfs.s.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(titles, func(title string) bool { return !dfs.s.canRead(dfs.r, title) }), nil
+}
+
+// pagesIn returns the readable titles of the pages inside the folder dir, at
+// any depth
+func (dfs *davFS) pagesIn(ctx context.Context, dir string) ([]string, error) {
+	titles, err := dfs.titles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var inside []string
+	for _, title := range titles {
+		if dir == "" || strings.HasPrefix(title, dir+"/") {
+			inside = append(inside, title)
+		}
+	}
+	return inside, nil
+}
+
+// isDir reports whether name is a folder: the root, a namespace holding
+// readable pages, or a scratch folder
+func (dfs *davFS) isDir(ctx context.Context, name string) (bool, error) {
+	if name == "" {
+		return true, nil
+	}
+	if e, ok := dfs.s.davScratch.get(dfs.client(), name); ok && dfs.scratchReadable(name) {
+		return e.dir, nil
+	}
+	inside, err := dfs.pagesIn(ctx, name)
+	return len(inside) > 0, err
+}
+
+// parentExists reports fs.ErrNotExist unless the folder holding name exists
+func (dfs *davFS) parentExists(ctx context.Context, name string) error {
+	dir, err := dfs.isDir(ctx, strings.TrimPrefix(path.Dir("/"+name), "/"))
+	if err != nil {
+		return err
+	}
+	if !dir {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+// writable reports an error unless the client may edit the page
+func (dfs *davFS) writable(title string, level accessLevel) error {
+	if !dfs.s.permitted(dfs.r, title, level) {
+		return fs.ErrPermission
+	}
+	return nil
+}
+
+// client returns the name the client's scratch entries are kept under
+func (dfs *davFS) client() string {
+	if name := dfs.s.tokenName(dfs.r); name != "" {
+		return name
+	}
+	return "@" + clientAddr(dfs.r) // Names can't hold an @
+}
+
+// scratchReadable reports whether the client may read a scratch entry: those
+// kept for a page are as readable as the page
+func (dfs *davFS) scratchReadable(name string) bool {
+	title, ok := davScratchTitle(name)
+	return !ok || dfs.s.canRead(dfs.r, title)
+}
+
+// scratchWritable reports an error unless the client may write a scratch
+// entry: those kept for a page need it to be readable and editable
+func (dfs *davFS) scratchWritable(name string) error {
+	title, ok := davScratchTitle(name)
+	if !ok {
+		return nil
+	}
+	if !dfs.s.canRead(dfs.r, title) {
+		return fs.ErrPermission
+	}
+	return dfs.writable(title, accessEdit)
+}
+
+// Mkdir makes a folder. Namespaces exist as long as pages are in them, so
+// the folder is kept as a scratch folder until then.
+func (dfs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = davName(name)
+	if _, err := dfs.Stat(ctx, name); err == nil {
+		return fs.ErrExist
+	}
+	if err := dfs.parentExists(ctx, name); err != nil {
+		return err
+	}
+	if err := dfs.scratchWritable(name); err != nil {
+		return err
+	}
+	return dfs.s.davScratch.put(dfs.client(), name, &davScratchEntry{dir: true, modTime: time.Now()})
+}
+
+// OpenFile opens a folder, a page or a scratch file. Pages opened for writing
+// are saved when closed.
+func (dfs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = davName(name)
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if dir, err := dfs.isDir(ctx, name); err != nil {
+		return nil, err
+	} else if dir {
+		if write {
+			return nil, fs.ErrPermission
+		}
+		return dfs.openDir(ctx, name)
+	}
+
+	title, isPage := davTitle(name)
+	if !isPage {
+		return dfs.openScratch(ctx, name, flag)
+	}
+	if !dfs.s.canRead(dfs.r, title) {
+		return nil, fs.ErrPermission
+	}
+	p, err := dfs.s.store.Load(ctx, title)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	exists := err == nil
+	if !write {
+		if !exists {
+			return nil, fs.ErrNotExist
+		}
+		return newDavFile(davInfo{name: path.Base(name), size: int64(len(p.Body)), modTime: p.ModTime}, p.Body), nil
+	}
+
+	if err := dfs.writable(title, accessEdit); err != nil {
+		return nil, err
+	}
+	if !exists && flag&os.O_CREATE == 0 {
+		return nil, fs.ErrNotExist
+	}
+	var body []byte
+	if exists && flag&os.O_TRUNC == 0 {
+		body = p.Body
+	}
+	f := newDavFile(davInfo{name: path.Base(name), modTime: time.Now()}, nil)
+	f.buf = bytes.NewBuffer(bytes.Clone(body))
+	f.save = func(body []byte) error { return dfs.savePage(title, body) }
+	return f, nil
+}
+
+// openDir opens a folder, listing its pages, namespaces and scratch entries
+func (dfs *davFS) openDir(ctx context.Context, dir string) (webdav.File, error) {
+	inside, err := dfs.pagesIn(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]os.FileInfo)
+	for _, title := range inside {
+		rest := strings.TrimPrefix(title, dir+"/")
+		if dir == "" {
+			rest = title
+		}
+		if sub, _, nested := strings.Cut(rest, "/"); nested {
+			entries[sub] = davInfo{name: sub, dir: true}
+			continue
+		}
+		info, err := dfs.Stat(ctx, path.Join(dir, rest+davExt))
+		if err != nil {
+			continue // Removed since it was listed
+		}
+		entries[info.Name()] = info
+	}
+	for name, e := range dfs.s.davScratch.children(dfs.client(), dir) {
+		if _, ok := entries[name]; !ok && dfs.scratchReadable(path.Join(dir, name)) {
+			entries[name] = davInfo{name: name, dir: e.dir, size: int64(len(e.data)), modTime: e.modTime}
+		}
+	}
+
+	f := newDavFile(davInfo{name: path.Base("/" + dir), dir: true}, nil)
+	for _, info := range entries {
+		f.entries = append(f.entries, info)
+	}
+	sort.Slice(f.entries, func(i, j int) bool { return f.entries[i].Name() < f.entries[j].Name() })
+	return f, nil
+}
+
+// openScratch opens a scratch file of the client, which is kept when closed
+// after writing
+func (dfs *davFS) openScratch(ctx context.Context, name string, flag int) (webdav.File, error) {
+	client := dfs.client()
+	e, exists := dfs.s.davScratch.get(client, name)
+	exists = exists && dfs.scratchReadable(name)
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if !exists {
+			return nil, fs.ErrNotExist
+		}
+		return newDavFile(davInfo{name: path.Base(name), size: int64(len(e.data)), modTime: e.modTime}, e.data), nil
+	}
+	if !exists && flag&os.O_CREATE == 0 {
+		return nil, fs.ErrNotExist
+	}
+	if err := dfs.scratchWritable(name); err != nil {
+		return nil, err
+	}
+	if err := dfs.parentExists(ctx, name); err != nil {
+		return nil, err
+	}
+	var data []byte
+	if exists && flag&os.O_TRUNC == 0 {
+		data = e.data
+	}
+	f := newDavFile(davInfo{name: path.Base(name), modTime: time.Now()}, nil)
+	f.buf = bytes.NewBuffer(bytes.Clone(data))
+	f.save = func(data []byte) error {
+		return dfs.s.davScratch.put(client, name, &davScratchEntry{data: data, modTime: time.Now()})
+	}
+	return f, nil
+}
+
+// savePage saves a page body written over WebDAV, or holds it for review
+func (dfs *davFS) savePage(title string, body []byte) error {
+	p := &Page{Title: title, Body: body, Summary: davSummary, Author: dfs.s.tokenName(dfs.r), Meta: parsePageMeta(body)}
+	if dfs.s.needsReview(dfs.r) {
+		_, err := dfs.s.holdEdit(dfs.r, p)
+		return err
+	}
+	unlock := dfs.s.store.Lock(title)
+	defer unlock()
+	return dfs.s.savePage(dfs.r.Context(), p)
+}
+
+// RemoveAll moves a page, or the pages in a folder, to the trash, or drops a
+// scratch entry
+func (dfs *davFS) RemoveAll(ctx context.Context, name string) error {
+	name = davName(name)
+	if name == "" {
+		return fs.ErrPermission
+	}
+	if _, ok := dfs.s.davScratch.get(dfs.client(), name); ok {
+		dfs.s.davScratch.remove(dfs.client(), name)
+		return nil
+	}
+	titles := []string{}
+	if title, ok := davTitle(name); ok {
+		titles = append(titles, title)
+	} else {
+		var err error
+		if titles, err = dfs.pagesIn(ctx, name); err != nil {
+			return err
+		}
+	}
+	if dfs.s.needsReview(dfs.r) {
+		return fs.ErrPermission // Deletions can't be held for review
+	}
+	for _, title := range titles {
+		if err := dfs.writable(title, accessAdmin); err != nil {
+			return err
+		}
+	}
+	for _, title := range titles {
+		if err := dfs.trashPage(ctx, title); err != nil {
+			return err
+		}
+	}
+	dfs.s.davScratch.remove(dfs.client(), name)
+	return nil
+}
+
+// trashPage moves one page to the trash
+func (dfs *davFS) trashPage(ctx context.Context, title string) error {
+	unlock := dfs.s.store.Lock(title)
+	defer unlock()
+	err := dfs.s.trashPage(ctx, title, dfs.s.tokenName(dfs.r), "Deleted over WebDAV")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Rename moves a page, the pages in a folder, or a scratch entry of the
+// client. A scratch
+// file moved onto a page is saved as its new body, as editors write a
+// temporary file and move it over the one they save. A page moved onto a
+// scratch name is copied there and kept, as editors move the file they are
+// about to save out of the way as a backup.
+func (dfs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = davName(oldName), davName(newName)
+	if oldName == "" || newName == "" {
+		return fs.ErrPermission
+	}
+	from, fromPage := davTitle(oldName)
+	to, toPage := davTitle(newName)
+	client := dfs.client()
+	e, fromScratch := dfs.s.davScratch.get(client, oldName)
+	if fromScratch && !dfs.scratchReadable(oldName) {
+		return fs.ErrPermission
+	}
+
+	switch {
+	case fromScratch && toPage:
+		if e.dir {
+			return fs.ErrPermission
+		}
+		if err := dfs.writable(to, accessEdit); err != nil {
+			return err
+		}
+		if err := dfs.savePage(to, e.data); err != nil {
+			return err
+		}
+		dfs.s.davScratch.remove(client, oldName)
+		return nil
+	case fromScratch:
+		if err := dfs.scratchWritable(newName); err != nil {
+			return err
+		}
+		dfs.s.davScratch.move(client, oldName, newName)
+		return nil
+	case fromPage && !toPage:
+		if !dfs.s.canRead(dfs.r, from) {
+			return fs.ErrPermission
+		}
+		if err := dfs.scratchWritable(newName); err != nil {
+			return err
+		}
+		p, err := dfs.s.store.Load(ctx, from)
+		if err != nil {
+			return err
+		}
+		return dfs.s.davScratch.put(client, newName, &davScratchEntry{data: p.Body, modTime: p.ModTime})
+	case fromPage:
+		return dfs.renamePages(ctx, map[string]string{from: to})
+	}
+
+	// A folder moves the pages inside it, which must land on valid titles
+	inside, err := dfs.pagesIn(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if len(inside) == 0 {
+		return fs.ErrNotExist
+	}
+	moves := make(map[string]string)
+	for _, title := range inside {
+		moved := newName + strings.TrimPrefix(title, oldName)
+		if !validTitle.MatchString(moved) {
+			return fs.ErrPermission
+		}
+		moves[title] = moved
+	}
+	if err := dfs.renamePages(ctx, moves); err != nil {
+		return err
+	}
+	dfs.s.davScratch.move(client, oldName, newName)
+	return nil
+}
+
+// renamePages renames pages with their history, once the client is known to
+// be allowed to rename them all
+func (dfs *davFS) renamePages(ctx context.Context, moves map[string]string) error {
+	if dfs.s.needsReview(dfs.r) {
+		return fs.ErrPermission // Renames can't be held for review
+	}
+	for from, to := range moves {
+		if err := errors.Join(dfs.writable(from, accessAdmin), dfs.writable(to, accessAdmin)); err != nil {
+			return fs.ErrPermission
+		}
+	}
+	for from, to := range moves {
+		if err := dfs.s.renamePage(ctx, from, to, dfs.s.tokenName(dfs.r), "Moved over WebDAV"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stat describes a folder, a page or a scratch file
+func (dfs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = davName(name)
+	if dir, err := dfs.isDir(ctx, name); err != nil {
+		return nil, err
+	} else if dir {
+		return davInfo{name: path.Base("/" + name), dir: true}, nil
+	}
+	if e, ok := dfs.s.davScratch.get(dfs.client(), name); ok && dfs.scratchReadable(name) {
+		return davInfo{name: path.Base(name), size: int64(len(e.data)), modTime: e.modTime}, nil
+	}
+	title, ok := davTitle(name)
+	if !ok || !dfs.s.canRead(dfs.r, title) {
+		return nil, fs.ErrNotExist
+	}
+	p, err := dfs.s.store.Load(ctx, title)
+	if err != nil {
+		return nil, err
+	}
+	return davInfo{name: path.Base(name), size: int64(len(p.Body)), modTime: p.ModTime}, nil
+}
+
+// davInfo describes a file or folder over WebDAV
+type davInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi davInfo) Name() string       { return fi.name }
+func (fi davInfo) Size() int64        { return fi.size }
+func (fi davInfo) ModTime() time.Time { return fi.modTime }
+func (fi davInfo) IsDir() bool        { return fi.dir }
+func (fi davInfo) Sys() any           { return nil }
+
+// Mode returns permissive modes, leaving permissions to the wiki
+func (fi davInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// davFile is an open file or folder. Files opened for writing collect what is
+// written in buf and hand it to save when closed.
+type davFile struct {
+	*bytes.Reader
+	info    davInfo
+	entries []os.FileInfo // Contents of a folder
+	read    int           // Entries of a folder already returned by Readdir
+
+	buf  *bytes.Buffer
+	save func([]byte) error
+}
+
+// newDavFile returns a file reading data
+func newDavFile(info davInfo, data []byte) *davFile {
+	return &davFile{Reader: bytes.NewReader(data), info: info}
+}
+
+// Write implements webdav.File for files opened for writing
+func (f *davFile) Write(p []byte) (int, error) {
+	if f.buf == nil {
+		return 0, fs.ErrPermission
+	}
+	return f.buf.Write(p)
+}
+
+// Readdir implements webdav.File, returning all entries when count <= 0
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.info.dir {
+		return nil, fs.ErrInvalid
+	}
+	rest := f.entries[f.read:]
+	if count <= 0 {
+		f.read = len(f.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(rest))
+	f.read += n
+	return rest[:n], nil
+}
+
+// Stat implements webdav.File
+func (f *davFile) Stat() (os.FileInfo, error) {
+	info := f.info
+	if f.buf != nil {
+		info.size = int64(f.buf.Len())
+	}
+	return info, nil
+}
+
+// Close saves what was written to a file opened for writing
+func (f *davFile) Close() error {
+	if f.buf == nil {
+		return nil
+	}
+	buf := f.buf
+	f.buf = nil
+	return f.save(buf.Bytes())
+}
+
+// davHandler serves the page store over WebDAV, so the wiki can be mounted as
+// a network drive and its pages edited with local editors. Reading needs the
+// read scope and changing anything the write scope, as with the page API;
+// clients log in with HTTP basic auth, giving an API token as the password.
+func (s *Server) davHandler(w http.ResponseWriter, r *http.Request) {
+	scope := scopeWrite
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		scope = scopeRead
+	}
+	if r.ContentLength != 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodyBytes)
+	}
+	dfs := &davFS{s: s, r: r}
+	h := &webdav.Handler{Prefix: davPrefix, FileSystem: dfs, LockSystem: s.davLocks}
+	s.requireScope(scope, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "MOVE" && s.davSaveMove(w, r, dfs) {
+			return
+		}
+		h.ServeHTTP(w, r)
+	})(davChallenge{w}, r)
+}
+
+// davSaveMove moves a scratch file over a page as a save, reporting false for
+// other moves. The WebDAV handler would delete the page before moving the
+// file there, starting its history over.
+func (s *Server) davSaveMove(w http.ResponseWriter, r *http.Request, dfs *davFS) bool {
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || u.Host != "" && u.Host != r.Host {
+		return false
+	}
+	src, ok1 := strings.CutPrefix(r.URL.Path, davPrefix)
+	dst, ok2 := strings.CutPrefix(u.Path, davPrefix)
+	if !ok1 || !ok2 {
+		return false
+	}
+	src, dst = davName(src), davName(dst)
+	title, toPage := davTitle(dst)
+	if e, ok := s.davScratch.get(dfs.client(), src); !ok || e.dir || !toPage {
+		return false
+	}
+
+	existed := s.store.Exists(r.Context(), title)
+	if existed && r.Header.Get("Overwrite") == "F" {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return true
+	}
+	if err := dfs.Rename(r.Context(), src, dst); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, fs.ErrPermission) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return true
+	}
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return true
+}
+
+// davChallenge asks WebDAV clients refused for lack of credentials to log in
+// with HTTP basic auth, which they support, rather than a bearer token
+type davChallenge struct {
+	http.ResponseWriter
+}
+
+// WriteHeader replaces the challenge of 401 responses
+func (c davChallenge) WriteHeader(code int) {
+	if code == http.StatusUnauthorized {
+		c.Header().Set("WWW-Authenticate", `Basic realm="wiki"`)
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
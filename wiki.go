@@ -1,168 +1,696 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"html/template"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Page represents a wiki page with a title and content body
 type Page struct {
-	Title string
-	Body  []byte
+	Title   string
+	Body    []byte
+	ModTime time.Time     // Last modification time of the backing file, zero for unsaved pages
+	Summary string        // Edit summary recorded with the revision created by save
+	Author  string        // Who made the edit saved, empty when unknown
+	Meta    PageMeta      // Metadata declared at the top of the body
+	HTML    template.HTML // Rendered body, filled in by the view handler
+	Lang    string        // Language of the content, filled in by the view handler
+
+	RedirectedFrom    string // Stale title the reader followed to reach this page
+	RedirectWasRename bool   // Whether RedirectedFrom is the old title of a renamed page rather than a redirect page
+	RedirectStopped   string // Target of a redirect not followed, as it was reached through another or leads back to the page
+
+	Translations []Translation // Original and translations of the page, for the language switcher
+	Untranslated string        // Missing translation this page is shown in place of
+
+	Held bool   // Whether the reader's edit to the page was held for review
+	Base string // ETag of the body the edit form was loaded with, empty for new pages
+
+	Draft time.Time // When the reader's unsaved draft of the page was autosaved, offered for restoring by the edit form
+
+	Locked      bool      // Whether someone else is editing the page, warned about by the edit form
+	LockedBy    string    // Who is editing it, empty for an anonymous editor
+	LockedSince time.Time // When they opened the edit form
+
+	Revision  int // Old revision shown by the time-travel view, 0 for the current page
+	Revisions int // Number of revisions of the page, when showing an old one
+
+	Backlinks []string // Pages linking to or transcluding this one, filled in by the view handler
+
+	Comments   []CommentEntry // Discussion below the page, filled in by the view handler
+	Moderator  bool           // Whether the reader may delete comments
+	NoComments bool           // Whether the reader's comments would need review, which comments can't be held for
+
+	User     string // Account the reader is logged in to
+	Login    bool   // Whether user accounts exist, so readers log in to edit
+	ReadOnly bool   // Whether the wiki is read-only, so the page can't be edited
+
+	Static bool // Whether the page is exported to a static site, without the server's features
+
+	csrfForm
+	themedPage
+}
+
+// articleLD is the schema.org Article structured data embedded in rendered pages
+type articleLD struct {
+	Context       string    `json:"@context"`
+	Type          string    `json:"@type"`
+	Headline      string    `json:"headline"`
+	DatePublished string    `json:"datePublished,omitempty"`
+	DateModified  string    `json:"dateModified,omitempty"`
+	InLanguage    string    `json:"inLanguage,omitempty"`
+	Author        *personLD `json:"author,omitempty"`
+}
+
+// personLD is the schema.org Person used as an article author
+type personLD struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+// apiPage is the JSON representation of a wiki page
+type apiPage struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
 }
 
 // IndexPage contains data for rendering the index page with all available pages
 type IndexPage struct {
-	Pages []string
+	Pages     []string
+	Tree      []*PageNode   // Pages arranged by namespace, when sorted as a tree
+	Groups    []IndexGroup  // The current page of the list, when sorted by title or modification
+	Letters   []IndexLetter // The headings of the whole list when sorted by title, to jump between pages
+	Sort      string        // How the pages are listed: indexSortTitle, indexSortModified or indexSortTree
+	Page      int           // Number of the page of the list shown, from 1
+	PageCount int           // Number of pages the list is split into
+	Deleted   string        // Page the reader just moved to the trash
+	ReadOnly  bool          // Whether the wiki is read-only, without links to create or edit pages
+	Static    bool          // Whether the index is exported to a static site, without the server's features
+
+	themedPage
 }
 
-const (
-	savePath     = "data"      // Directory where wiki pages are stored
-	templatePath = "templates" // Directory containing HTML templates
-)
+// IndexGroup is a run of index entries under a heading: the first letter of
+// their titles, or the day they were modified
+type IndexGroup struct {
+	Heading string
+	Anchor  string // Fragment the letters link to, when sorted by title
+	Entries []IndexEntry
+}
 
-// Pre-compiled templates with custom function for processing wiki links
-var templates = template.Must(template.New("").Funcs(template.FuncMap{
-	"processLinks": processLinks,
-}).ParseFiles(
-	filepath.Join(templatePath, "edit.html"),
-	filepath.Join(templatePath, "view.html"),
-	filepath.Join(templatePath, "index.html"),
-))
+// IndexLetter is a heading of the index sorted by title, with the page of the
+// list its first entry is on
+type IndexLetter struct {
+	Letter string
+	Page   int
+}
 
-// Regular expression to validate and extract page names from URLs
-var validPath = regexp.MustCompile("^/(edit|save|view)/([a-zA-Z0-9]+)$")
+// IndexEntry is a page listed on the index
+type IndexEntry struct {
+	Title   string
+	ModTime time.Time // Zero unless the index is sorted by modification
+	Summary string    // Generated summary of the page, if it has one
+}
 
-// =============================================================================
-// DATA PERSISTENCE FUNCTIONS
-// =============================================================================
+// The orders the index can list pages in
+const (
+	indexSortTitle    = "title"
+	indexSortModified = "modified"
+	indexSortTree     = "tree"
+)
 
-// save writes the page content to a text file in the data directory
-func (p *Page) save() error {
-	filename := p.Title + ".txt"
-	filePath := filepath.Join(savePath, filename)
+// indexPageSize is the number of entries on each page of the index
+const indexPageSize = 100
+
+// PageNode is an entry of the page tree on the index: a page, a namespace
+// holding other pages, or both
+type PageNode struct {
+	Name     string // Last segment of the title, with the language of a translation
+	Title    string // Title of the page, empty for a namespace without a page of its own
+	Summary  string // Generated summary of the page, if it has one
+	Static   bool   // Whether the entry is in a static site, which has no edit links
+	ReadOnly bool   // Whether the wiki is read-only, so the entry has no edit link
+	Children []*PageNode
+}
 
-	return os.WriteFile(filePath, p.Body, 0600)
+// pageTree arranges titles into a tree of namespaces, sorted by name at each
+// level. Translations sit next to their page, as Alpha.es beside Alpha.
+func pageTree(titles []string) []*PageNode {
+	root := &PageNode{}
+	for _, title := range titles {
+		base, lang := splitTitle(title)
+		segments := strings.Split(base, "/")
+		if lang != "" {
+			segments[len(segments)-1] += "." + lang
+		}
+		node := root
+		for _, name := range segments {
+			i := slices.IndexFunc(node.Children, func(n *PageNode) bool { return n.Name == name })
+			if i < 0 {
+				node.Children = append(node.Children, &PageNode{Name: name})
+				i = len(node.Children) - 1
+			}
+			node = node.Children[i]
+		}
+		node.Title = title
+	}
+	var sortNodes func(nodes []*PageNode)
+	sortNodes = func(nodes []*PageNode) {
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+		for _, n := range nodes {
+			sortNodes(n.Children)
+		}
+	}
+	sortNodes(root.Children)
+	return root.Children
 }
 
-// loadPage retrieves a wiki page from the filesystem by reading its corresponding text file
-func loadPage(title string) (*Page, error) {
-	filename := title + ".txt"
-	filePath := filepath.Join(savePath, filename)
+// langPattern matches language tags, such as es or pt-BR
+const langPattern = `[a-z]{2,3}(?:-[a-zA-Z0-9]{2,8})*`
 
-	body, err := os.ReadFile(filePath)
-	if err != nil {
-		return nil, err
-	}
+// segmentPattern matches a part of a page title: words of letters in any
+// script, digits, hyphens and underscores separated by single spaces
+const segmentPattern = `[\p{L}\p{M}\p{N}_-]+(?: [\p{L}\p{M}\p{N}_-]+)*`
 
-	return &Page{Title: title, Body: body}, nil
-}
+// titlePattern matches page titles: segments separated by slashes, each
+// segment but the last naming a namespace, as in Projects/Alpha/Design. A dot
+// and a language tag after them make the page a translation, as in
+// HomePage.es or Release Notes.pt-BR, as split by splitTitle.
+const titlePattern = segmentPattern + `(?:/` + segmentPattern + `)*(?:\.` + langPattern + `)?`
 
-// getAllPages scans the data directory and returns a list of all available wiki page names
-func getAllPages() ([]string, error) {
-	files, err := os.ReadDir(savePath)
-	if err != nil {
-		return nil, err
-	}
+// Regular expression to validate and extract page names from URLs
+var validPath = regexp.MustCompile("^/(edit|save|view|diff|history|rename|delete|book|pdf|raw|upload|backlinks|preview|draft|editlock|comment)/(" + titlePattern + ")$")
 
-	var pages []string
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".txt") {
-			pageName := strings.TrimSuffix(file.Name(), ".txt")
-			pages = append(pages, pageName)
-		}
+// Regular expression to validate page names taken from other sources (API path values)
+var validTitle = regexp.MustCompile("^" + titlePattern + "$")
+
+// Regular expression to validate language tags from page metadata and configuration
+var validLang = regexp.MustCompile("^" + langPattern + "$")
+
+// titleURL returns a title escaped for use in URL paths, as in
+// "/view/"+titleURL(title), keeping the slashes between its segments
+func titleURL(title string) string {
+	segments := strings.Split(title, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
 	}
-	return pages, nil
+	return strings.Join(segments, "/")
 }
 
 // =============================================================================
 // TEMPLATE RENDERING FUNCTIONS
 // =============================================================================
 
-// processLinks converts wiki-style links [PageName] into HTML anchor tags
-func processLinks(body []byte) template.HTML {
-	s := string(body)
-	re := regexp.MustCompile(`\[([a-zA-Z0-9]+)\]`)
-	processed := re.ReplaceAllStringFunc(s, func(match string) string {
-		pageName := match[1 : len(match)-1]
-		return `<a href="/view/` + pageName + `">` + pageName + `</a>`
-	})
-	return template.HTML(processed)
+// PrevPage returns the number of the page of the index list before the current one
+func (p *IndexPage) PrevPage() int {
+	return p.Page - 1
 }
 
-// renderTemplate executes an HTML template with page data and handles any rendering errors
-func renderTemplate(w http.ResponseWriter, tmpl string, p *Page) {
-	err := templates.ExecuteTemplate(w, tmpl+".html", p)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// NextPage returns the number of the page of the index list after the current one
+func (p *IndexPage) NextPage() int {
+	return p.Page + 1
+}
+
+// StructuredData returns the schema.org Article metadata for the page, rendered
+// as JSON-LD in the view template so search engines can show rich results
+func (p *Page) StructuredData() articleLD {
+	ld := articleLD{
+		Context:    "https://schema.org",
+		Type:       "Article",
+		Headline:   p.DisplayTitle(),
+		InLanguage: p.Lang,
+	}
+	if !p.Meta.Created.IsZero() {
+		ld.DatePublished = p.Meta.Created.UTC().Format(time.RFC3339)
+	}
+	if !p.ModTime.IsZero() {
+		ld.DateModified = p.ModTime.UTC().Format(time.RFC3339)
+	}
+	if p.Meta.Author != "" {
+		ld.Author = &personLD{Type: "Person", Name: p.Meta.Author}
 	}
+	return ld
 }
 
-// renderIndexTemplate executes the index template with a list of all available pages
-func renderIndexTemplate(w http.ResponseWriter, tmpl string, indexData *IndexPage) {
-	err := templates.ExecuteTemplate(w, tmpl+".html", indexData)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// DisplayTitle returns the title the page's metadata gives it, else its name
+func (p *Page) DisplayTitle() string {
+	if p.Meta.Title != "" {
+		return p.Meta.Title
 	}
+	return p.Title
 }
 
 // =============================================================================
 // HTTP HANDLER FUNCTIONS
 // =============================================================================
 
-// indexHandler displays the main index page showing all available wiki pages
-func indexHandler(w http.ResponseWriter, r *http.Request) {
-	pages, err := getAllPages()
+// indexHandler displays the main index page showing all available wiki pages,
+// with the summaries of those the reader may read
+func (s *Server) indexHandler(w http.ResponseWriter, r *http.Request) {
+	pages, err := s.store.List(r.Context())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
+		return
+	}
+	q := r.URL.Query()
+	data := &IndexPage{Pages: pages, Sort: q.Get("sort"), Page: 1, PageCount: 1, ReadOnly: s.cfg().ReadOnly}
+	if deleted := q.Get("deleted"); validTitle.MatchString(deleted) {
+		data.Deleted = deleted
+	}
+	summarize := s.summarizer() != nil
+
+	switch data.Sort {
+	case indexSortTree:
+		data.Tree = pageTree(pages)
+		var fill func(nodes []*PageNode)
+		fill = func(nodes []*PageNode) {
+			for _, n := range nodes {
+				if n.Title != "" && summarize && s.canRead(r, n.Title) {
+					n.Summary = s.summaries.text(n.Title)
+				}
+				n.ReadOnly = data.ReadOnly
+				fill(n.Children)
+			}
+		}
+		fill(data.Tree)
+		s.renderTemplate(w, r, "index", data)
 		return
+	case indexSortModified:
+	default:
+		data.Sort = indexSortTitle
+	}
+
+	entries := make([]IndexEntry, 0, len(pages))
+	for _, title := range pages {
+		entry := IndexEntry{Title: title}
+		if data.Sort == indexSortModified {
+			if entry.ModTime, err = s.store.ModTime(r.Context(), title); err != nil {
+				continue // Removed since it was listed
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if data.Sort == indexSortModified {
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].ModTime.After(entries[j].ModTime) })
+	} else {
+		sort.SliceStable(entries, func(i, j int) bool {
+			a, b := strings.ToLower(entries[i].Title), strings.ToLower(entries[j].Title)
+			return a < b || a == b && entries[i].Title < entries[j].Title
+		})
+	}
+
+	if data.Sort == indexSortTitle {
+		for i, entry := range entries {
+			if letter := indexLetter(entry.Title); len(data.Letters) == 0 || data.Letters[len(data.Letters)-1].Letter != letter {
+				data.Letters = append(data.Letters, IndexLetter{Letter: letter, Page: i/indexPageSize + 1})
+			}
+		}
 	}
-	indexData := &IndexPage{Pages: pages}
-	renderIndexTemplate(w, "index", indexData)
+	data.PageCount = max((len(entries)+indexPageSize-1)/indexPageSize, 1)
+	if n, err := strconv.Atoi(q.Get("page")); err == nil {
+		data.Page = min(max(n, 1), data.PageCount)
+	}
+	entries = entries[min((data.Page-1)*indexPageSize, len(entries)):min(data.Page*indexPageSize, len(entries))]
+	for _, entry := range entries {
+		if summarize && s.canRead(r, entry.Title) {
+			entry.Summary = s.summaries.text(entry.Title)
+		}
+		heading := indexLetter(entry.Title)
+		if data.Sort == indexSortModified {
+			heading = entry.ModTime.Format("2006-01-02")
+		}
+		if n := len(data.Groups); n == 0 || data.Groups[n-1].Heading != heading {
+			group := IndexGroup{Heading: heading}
+			if i := slices.IndexFunc(data.Letters, func(l IndexLetter) bool { return l.Letter == heading }); i >= 0 {
+				group.Anchor = "letter-" + strconv.Itoa(i)
+			}
+			data.Groups = append(data.Groups, group)
+		}
+		group := &data.Groups[len(data.Groups)-1]
+		group.Entries = append(group.Entries, entry)
+	}
+	s.renderTemplate(w, r, "index", data)
+}
+
+// indexLetter returns the heading a title is listed under on the index
+// sorted by title: its first letter in upper case, or # for titles starting
+// with a digit or symbol
+func indexLetter(title string) string {
+	r, _ := utf8.DecodeRuneInString(title)
+	if !unicode.IsLetter(r) {
+		return "#"
+	}
+	return string(unicode.ToUpper(r))
 }
 
-// viewHandler displays a wiki page in read-only mode, redirecting to edit if page doesn't exist
-func viewHandler(w http.ResponseWriter, r *http.Request, title string) {
-	p, err := loadPage(title)
+// viewHandler displays a wiki page in read-only mode, redirecting to edit if page doesn't exist.
+// Clients can ask for the raw markup or JSON instead of HTML through the Accept header.
+func (s *Server) viewHandler(w http.ResponseWriter, r *http.Request, title string) {
+	w.Header().Add("Vary", "Accept")
+	mediaType := negotiate(r.Header.Get("Accept"), pageMediaTypes)
+	if mediaType == "" {
+		http.Error(w, "Not Acceptable", http.StatusNotAcceptable)
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		s.headPageHandler(w, r, title, mediaType)
+		return
+	}
+	if q := r.URL.Query(); q.Has("rev") || q.Has("asof") {
+		s.viewRevisionHandler(w, r, title, mediaType)
+		return
+	}
+
+	p, err := s.store.Load(r.Context(), title)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		serverError(w, r, err)
+		return
+	}
 	if err != nil {
-		http.Redirect(w, r, "/edit/"+title, http.StatusFound)
+		if mediaType != mediaHTML {
+			http.NotFound(w, r)
+			return
+		}
+		// Follow links to pages that have since been renamed
+		if to, ok := s.resolveMove(r.Context(), title); ok {
+			http.Redirect(w, r, "/view/"+titleURL(to)+"?redirectedfrom="+url.QueryEscape(title), http.StatusFound)
+			return
+		}
+		// Show missing translations in the closest language available
+		if p, err = s.loadFallback(r.Context(), title); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if p == nil {
+			http.Redirect(w, r, "/edit/"+titleURL(title), http.StatusFound)
+			return
+		}
+		p.Untranslated = title
+	}
+	p.Held = r.URL.Query().Has("held")
+	if from := r.URL.Query().Get("redirectedfrom"); validTitle.MatchString(from) {
+		p.RedirectedFrom = from
+		p.RedirectWasRename = !s.store.Exists(r.Context(), from)
+	}
+	// Redirect pages send readers on to their target unless asked not to.
+	// Only one redirect is followed, so pages redirecting to themselves or to
+	// each other don't send readers round in circles.
+	if target, ok := redirectTarget(p.Body); ok && mediaType == mediaHTML && r.URL.Query().Get("redirect") != "no" {
+		if p.RedirectedFrom != "" || target == title {
+			p.RedirectStopped = target
+		} else {
+			http.Redirect(w, r, "/view/"+titleURL(target)+"?redirectedfrom="+url.QueryEscape(title), http.StatusFound)
+			return
+		}
+	}
+
+	switch mediaType {
+	case mediaPlain, mediaMarkdown:
+		if notModified(w, r, bodyETag(p.Body), p.ModTime) {
+			return
+		}
+		w.Header().Set("Content-Type", mediaType+"; charset=utf-8")
+		w.Write(p.Body)
+	case mediaJSON:
+		if notModified(w, r, bodyETag(p.Body), p.ModTime) {
+			return
+		}
+		writeJSON(w, http.StatusOK, apiPage{Title: p.Title, Body: string(p.Body)})
+	default:
+		if p.HTML, err = s.renderBody(r.Context(), p.Title, p.Body, s.readChecker(r)); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		p.Lang = contentLang(p, s.cfg().DefaultLang)
+		s.setReader(r, p)
+		p.Base = bodyETag(p.Body)
+		p.Backlinks = s.links.backlinks(p.Title)
+		if p.Comments, err = s.comments.discussion(p.Title); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		p.Moderator = s.hasScope(r, scopeAdmin)
+		p.NoComments = s.needsReview(r)
+		if p.Translations, err = s.translations(r.Context(), p.Title); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		// The token and theme are part of the page, so new ones change its tag
+		p.setCSRF(s.csrfToken(w, r))
+		p.setTheme(readerTheme(r))
+		// Templates read from disk on every request have no version to tag
+		if !s.cfg().Dev {
+			// The page depends on who is reading it, so only their browser may reuse it
+			w.Header().Set("Cache-Control", "private, no-cache")
+			if notModified(w, r, s.viewETag(p), p.ModTime) {
+				return
+			}
+		}
+		s.renderTemplate(w, r, "view", p)
+	}
+}
+
+// viewETag returns the entity tag of a rendered page. Everything the template
+// is given is hashed along with the template version, so the tag changes when
+// an included page, the backlinks or the reader do, not only the body.
+func (s *Server) viewETag(p *Page) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n", s.templateGen.Load())
+	json.NewEncoder(h).Encode(p)
+	return `"v` + hex.EncodeToString(h.Sum(nil)[:8]) + `"`
+}
+
+// notModified sets the validators of a response and answers 304 Not Modified
+// when the request's conditions show the client already has it. If-None-Match
+// takes precedence over If-Modified-Since, as RFC 9110 requires.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modTime.IsZero() || modTime.Truncate(time.Second).After(since) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// headPageHandler answers HEAD requests for a page from file metadata alone,
+// so existence checks don't pay for reading and rendering the body
+func (s *Server) headPageHandler(w http.ResponseWriter, r *http.Request, title, mediaType string) {
+	modTime, err := s.store.ModTime(r.Context(), title)
+	if err != nil {
+		if mediaType != mediaHTML {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, "/edit/"+titleURL(title), http.StatusFound)
 		return
 	}
-	renderTemplate(w, "view", p)
+	if mediaType == mediaJSON {
+		w.Header().Set("Content-Type", mediaType)
+	} else {
+		w.Header().Set("Content-Type", mediaType+"; charset=utf-8")
+	}
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
 }
 
 // editHandler displays the edit form for a wiki page, creating a new page if it doesn't exist
-func editHandler(w http.ResponseWriter, r *http.Request, title string) {
-	p, err := loadPage(title)
+func (s *Server) editHandler(w http.ResponseWriter, r *http.Request, title string) {
+	p, err := s.store.Load(r.Context(), title)
 
-	// If the page does not exist, create a new one with an empty body.
+	// If the page does not exist, create a new one with an empty body. New
+	// translations start out as a copy of the text they translate.
 	if err != nil {
 		p = &Page{Title: title}
+		if fallback, _ := s.loadFallback(r.Context(), title); fallback != nil {
+			p.Body = fallback.Body
+		}
+	} else {
+		p.Base = bodyETag(p.Body)
+	}
+
+	// A draft left by an edit that was never saved is offered for restoring,
+	// and loaded in place of the page once the reader asks for it
+	draft, err := s.loadDraft(r, title)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if draft != nil && draft.Body != string(p.Body) {
+		if r.URL.Query().Has("draft") {
+			p.Body, p.Summary, p.Base = []byte(draft.Body), draft.Summary, draft.Base
+		} else {
+			p.Draft = draft.Saved
+		}
 	}
-	renderTemplate(w, "edit", p)
+	p.Held = r.URL.Query().Has("held")
+	s.lockForEditing(w, r, p)
+	s.renderTemplate(w, r, "edit", p)
 }
 
-// saveHandler processes form submissions to save wiki page content and redirects to view mode
-func saveHandler(w http.ResponseWriter, r *http.Request, title string) {
+// previewHandler renders the body posted by the edit form without saving it,
+// showing it above the form so the author can keep editing or save
+func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request, title string) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/edit/"+titleURL(title), http.StatusFound)
+		return
+	}
+	body := []byte(r.FormValue("body"))
+	p := &Page{Title: title, Body: body, Summary: r.FormValue("summary"), Meta: parsePageMeta(body), Base: r.FormValue("base")}
+
+	// Previews bypass the render cache, which holds saved pages only
+	var out bytes.Buffer
+	rd := &renderer{ctx: r.Context(), store: s.readableBy(r), out: &out, anchors: make(anchorSet), deps: make(map[string]bool), emoji: s.emoji}
+	rd.render(title, body)
+	if rd.err != nil {
+		serverError(w, r, rd.err)
+		return
+	}
+	p.HTML = template.HTML(sanitizeHTML(rd.contents() + out.String()))
+	p.Lang = contentLang(p, s.cfg().DefaultLang)
+	s.renderTemplate(w, r, "edit", p)
+}
+
+// saveHandler processes form submissions to save wiki page content and redirects to view mode.
+// Edits that need review are held instead, and the reader is told so. Forms
+// carry the ETag of the body they were loaded with; when the page changed
+// since, the edit isn't saved and the merge page is shown instead.
+func (s *Server) saveHandler(w http.ResponseWriter, r *http.Request, title string) {
 	body := r.FormValue("body")
-	p := &Page{Title: title, Body: []byte(body)}
-	err := p.save()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	p := &Page{Title: title, Body: []byte(body), Summary: strings.TrimSpace(r.FormValue("summary")), Author: s.tokenName(r)}
+	if s.needsReview(r) {
+		if s.editConflict(w, r, p) {
+			return
+		}
+		if _, err := s.holdEdit(r, p); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if err := s.discardDraft(r, title); err != nil {
+			slog.Error("Discarding draft failed", "title", title, "err", err)
+		}
+		s.editLocks.release(title, s.draftOwner(r))
+		// New pages have nothing to view yet, so the notice is shown on the edit form
+		if s.store.Exists(r.Context(), title) {
+			http.Redirect(w, r, "/view/"+titleURL(title)+"?held", http.StatusFound)
+		} else {
+			http.Redirect(w, r, "/edit/"+titleURL(title)+"?held", http.StatusFound)
+		}
+		return
+	}
+	unlock := s.store.Lock(title)
+	defer unlock()
+	if s.editConflict(w, r, p) {
+		return
+	}
+	if err := s.savePage(r.Context(), p); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if err := s.discardDraft(r, title); err != nil {
+		slog.Error("Discarding draft failed", "title", title, "err", err)
+	}
+	s.editLocks.release(title, s.draftOwner(r))
+	http.Redirect(w, r, "/view/"+titleURL(title), http.StatusFound)
+}
+
+// ConflictPage is the data for the merge page, shown when a page changed
+// while someone was editing it
+type ConflictPage struct {
+	Title   string
+	Body    string     // The text that wasn't saved
+	Summary string     // Its edit summary
+	Current string     // The page as it is now
+	Base    string     // ETag of the current body, so saving the merge overwrites it
+	Hunks   []DiffHunk // Changes from the current page to the text that wasn't saved
+
+	csrfForm
+	themedPage
+}
+
+// editConflict reports whether the page being saved changed since the form
+// was loaded, answering with the merge page if so. Forms without a base
+// revision, like those of older clients, are saved as they are.
+func (s *Server) editConflict(w http.ResponseWriter, r *http.Request, p *Page) bool {
+	base, ok := r.PostForm["base"]
+	if !ok {
+		return false
+	}
+	current, err := s.store.Load(r.Context(), p.Title)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		serverError(w, r, err)
+		return true
+	}
+	data := ConflictPage{Title: p.Title, Body: string(p.Body), Summary: p.Summary}
+	if current != nil {
+		data.Current, data.Base = string(current.Body), bodyETag(current.Body)
+	}
+	if data.Base == base[0] {
+		return false
+	}
+	data.Hunks = unifiedDiff(data.Current, data.Body)
+	w.WriteHeader(http.StatusConflict)
+	s.renderTemplate(w, r, "conflict", &data)
+	return true
+}
+
+// existsHandler reports as JSON whether a page exists, answering 200 or 404 so
+// clients can also rely on the status code alone
+func (s *Server) existsHandler(w http.ResponseWriter, r *http.Request) {
+	title := r.PathValue("title")
+	if !validTitle.MatchString(title) {
+		http.NotFound(w, r)
 		return
 	}
-	http.Redirect(w, r, "/view/"+title, http.StatusFound)
+
+	exists := s.store.Exists(r.Context(), title)
+	status := http.StatusOK
+	if !exists {
+		status = http.StatusNotFound
+	}
+	writeJSON(w, status, map[string]any{"title": title, "exists": exists})
 }
 
 // rootHandler handles requests to the root path, redirecting to the index page
-func rootHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) rootHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "/" {
-		indexHandler(w, r)
+		s.indexHandler(w, r)
 		return
 	}
 	http.NotFound(w, r)
@@ -184,35 +712,126 @@ func makeHandler(fn func(http.ResponseWriter, *http.Request, string)) http.Handl
 	}
 }
 
+// writeJSON encodes v as the JSON response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Encoding JSON response failed", "err", err)
+	}
+}
+
 // =============================================================================
 // APPLICATION ENTRY POINT
 // =============================================================================
 
-// main initializes the wiki application, sets up HTTP routes, and starts the web server
+// main initializes the wiki application, sets up HTTP routes, and starts the web server.
+// A subcommand name as first argument runs that command-line tool instead.
 func main() {
-	err := os.MkdirAll(savePath, 0755) // Ensure the savePath directory exists.
+	if len(os.Args) > 1 {
+		if _, ok := cliCommands[os.Args[1]]; ok {
+			os.Exit(runCommand(os.Args[1], os.Args[2:]))
+		}
+	}
+
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	cfg, source, err := loadConfig()
+	if *showVersion {
+		fmt.Println(buildInfo())
+		return
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Serve static files (CSS)
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	logLevel, closeLog, err := setupLogging(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeLog()
 
-	http.HandleFunc("/", rootHandler)
-	http.HandleFunc("/index", indexHandler)
-	http.HandleFunc("/view/", makeHandler(viewHandler))
-	http.HandleFunc("/edit/", makeHandler(editHandler))
-	http.HandleFunc("/save/", makeHandler(saveHandler))
+	store, err := openStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig, redirect, err := cfg.tlsSetup()
+	if err != nil {
+		log.Fatal(err)
+	}
+	server, err := NewServer(cfg, store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.SetConfigSource(source.load)
+	server.SetLogLevel(logLevel)
+	server.Start()
+	defer server.Close()
+
+	// Reload the configuration on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			pending, err := server.ReloadConfig()
+			if err != nil {
+				slog.Error("Reloading configuration failed", "err", err)
+				continue
+			}
+			logReload(pending)
+		}
+	}()
+
+	// Listen on the socket passed by systemd, or on the configured address
+	ln, err := listen(cfg.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	httpServer := cfg.httpServer(logRequests(server))
+	httpServer.TLSConfig = tlsConfig
+
+	// Send browsers arriving over plain HTTP to HTTPS
+	var redirectServer *http.Server
+	if cfg.RedirectAddr != "" {
+		redirectServer = cfg.httpServer(logRequests(redirect))
+		redirectServer.Addr = cfg.RedirectAddr
+		go func() {
+			if err := redirectServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
 
-	// Wrap the default ServeMux with a logging middleware
-	loggedMux := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !strings.HasPrefix(r.URL.Path, "/static/") && r.URL.Path != "/favicon.ico" {
-			log.Printf("Request: %s %s", r.Method, r.URL.Path)
+	// Finish in-flight requests before exiting on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		sdNotify("STOPPING=1")
+		slog.Info("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Shutting down failed", "err", err)
 		}
-		http.DefaultServeMux.ServeHTTP(w, r)
-	})
+		if redirectServer != nil {
+			redirectServer.Close()
+		}
+	}()
+
+	sdNotify("READY=1")
+	go runWatchdog(ctx)
 
-	// Log server start and listen on port 8080
-	log.Println("Server started on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", loggedMux))
+	if tlsConfig != nil {
+		slog.Info("Server started with HTTPS", "addr", ln.Addr().String())
+		err = httpServer.ServeTLS(ln, "", "")
+	} else {
+		slog.Info("Server started", "addr", ln.Addr().String())
+		err = httpServer.Serve(ln)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-shutdownDone
 }